@@ -0,0 +1,199 @@
+package event
+
+// IssueAction is the action of an Issue event.
+type IssueAction string
+
+// Issue actions.
+const (
+	IssueOpened   IssueAction = "opened"
+	IssueClosed   IssueAction = "closed"
+	IssueReopened IssueAction = "reopened"
+	IssuePinned   IssueAction = "pinned"
+	IssueUnpinned IssueAction = "unpinned"
+)
+
+// Valid reports whether a is a known issue action.
+func (a IssueAction) Valid() bool {
+	switch a {
+	case IssueOpened, IssueClosed, IssueReopened, IssuePinned, IssueUnpinned:
+		return true
+	default:
+		return false
+	}
+}
+
+// ChangeAction is the action of a Change event.
+type ChangeAction string
+
+// Change actions.
+const (
+	ChangeOpened   ChangeAction = "opened"
+	ChangeClosed   ChangeAction = "closed"
+	ChangeMerged   ChangeAction = "merged"
+	ChangeReopened ChangeAction = "reopened"
+)
+
+// Valid reports whether a is a known change action.
+func (a ChangeAction) Valid() bool {
+	switch a {
+	case ChangeOpened, ChangeClosed, ChangeMerged, ChangeReopened:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreateType is the type of what was created in a Create event.
+type CreateType string
+
+// Create types.
+const (
+	CreateRepository CreateType = "repository"
+	CreatePackage    CreateType = "package"
+	CreateBranch     CreateType = "branch"
+	CreateTag        CreateType = "tag"
+)
+
+// Valid reports whether t is a known create type.
+func (t CreateType) Valid() bool {
+	switch t {
+	case CreateRepository, CreatePackage, CreateBranch, CreateTag:
+		return true
+	default:
+		return false
+	}
+}
+
+// DeleteType is the type of what was deleted in a Delete event.
+type DeleteType string
+
+// Delete types.
+const (
+	DeleteBranch DeleteType = "branch"
+	DeleteTag    DeleteType = "tag"
+)
+
+// Valid reports whether t is a known delete type.
+func (t DeleteType) Valid() bool {
+	switch t {
+	case DeleteBranch, DeleteTag:
+		return true
+	default:
+		return false
+	}
+}
+
+// MemberAction is the action of a Member event.
+type MemberAction string
+
+// Member actions.
+const (
+	MemberAdded   MemberAction = "added"
+	MemberRemoved MemberAction = "removed"
+)
+
+// Valid reports whether a is a known member action.
+func (a MemberAction) Valid() bool {
+	switch a {
+	case MemberAdded, MemberRemoved:
+		return true
+	default:
+		return false
+	}
+}
+
+// PageAction is the action of a Page in a Wiki event.
+type PageAction string
+
+// Page actions.
+const (
+	PageCreated PageAction = "created"
+	PageEdited  PageAction = "edited"
+)
+
+// Valid reports whether a is a known page action.
+func (a PageAction) Valid() bool {
+	switch a {
+	case PageCreated, PageEdited:
+		return true
+	default:
+		return false
+	}
+}
+
+// AssignAction is the action of an Assign event.
+type AssignAction string
+
+// Assign actions.
+const (
+	AssignAssigned   AssignAction = "assigned"
+	AssignUnassigned AssignAction = "unassigned"
+)
+
+// Valid reports whether a is a known assign action.
+func (a AssignAction) Valid() bool {
+	switch a {
+	case AssignAssigned, AssignUnassigned:
+		return true
+	default:
+		return false
+	}
+}
+
+// LabelAction is the action of a Label event.
+type LabelAction string
+
+// Label actions.
+const (
+	LabelLabeled   LabelAction = "labeled"
+	LabelUnlabeled LabelAction = "unlabeled"
+)
+
+// Valid reports whether a is a known label action.
+func (a LabelAction) Valid() bool {
+	switch a {
+	case LabelLabeled, LabelUnlabeled:
+		return true
+	default:
+		return false
+	}
+}
+
+// MilestoneAction is the action of a Milestone event.
+type MilestoneAction string
+
+// Milestone actions.
+const (
+	MilestoneMilestoned   MilestoneAction = "milestoned"
+	MilestoneDemilestoned MilestoneAction = "demilestoned"
+)
+
+// Valid reports whether a is a known milestone action.
+func (a MilestoneAction) Valid() bool {
+	switch a {
+	case MilestoneMilestoned, MilestoneDemilestoned:
+		return true
+	default:
+		return false
+	}
+}
+
+// CommentAction is the action of an IssueComment or ChangeComment event.
+type CommentAction string
+
+// Comment actions.
+const (
+	CommentCreated CommentAction = "created"
+	CommentEdited  CommentAction = "edited"
+	CommentDeleted CommentAction = "deleted"
+)
+
+// Valid reports whether a is a known comment action.
+func (a CommentAction) Valid() bool {
+	switch a {
+	case CommentCreated, CommentEdited, CommentDeleted:
+		return true
+	default:
+		return false
+	}
+}
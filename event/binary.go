@@ -0,0 +1,78 @@
+package event
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/shurcooL/users"
+)
+
+// eventBinary is the binary representation of Event.
+// It's encoded with encoding/gob.
+type eventBinary struct {
+	ID        string
+	Time      time.Time
+	Actor     users.User
+	Container string
+	Type      string
+	Payload   []byte // Payload encoded with encoding/gob. Empty for payloads without fields, like Star.
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+// It uses the encoding/gob format.
+func (e Event) MarshalBinary() ([]byte, error) {
+	if e.Payload == nil {
+		return nil, fmt.Errorf("Event.MarshalBinary: invalid payload type %T; Event was %+v", e.Payload, e)
+	}
+	v := eventBinary{
+		ID:        e.ID,
+		Time:      e.Time,
+		Actor:     e.Actor,
+		Container: e.Container,
+		Type:      e.Payload.EventType(),
+	}
+	if reflect.TypeOf(e.Payload).NumField() > 0 { // Gob can't encode types without fields, like Star.
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(e.Payload)
+		if err != nil {
+			return nil, err
+		}
+		v.Payload = buf.Bytes()
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (e *Event) UnmarshalBinary(b []byte) error {
+	var v eventBinary
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	if err != nil {
+		return err
+	}
+	p := newPayload(v.Type)
+	if p == nil {
+		return fmt.Errorf("Event.UnmarshalBinary: invalid payload type %q", v.Type)
+	}
+	if len(v.Payload) > 0 {
+		err := gob.NewDecoder(bytes.NewReader(v.Payload)).Decode(p)
+		if err != nil {
+			return err
+		}
+	}
+	*e = Event{
+		ID:        v.ID,
+		Time:      v.Time,
+		Actor:     v.Actor,
+		Container: v.Container,
+		Payload:   reflect.ValueOf(p).Elem().Interface().(Payload),
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ package event
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"time"
 
 	"dmitri.shuralyov.com/state"
@@ -12,65 +13,140 @@ import (
 
 // Event represents an event.
 type Event struct {
+	// ID uniquely identifies the event within the service that produced it.
+	// Optional, the empty string means the event has no ID.
+	ID string
+
 	Time  time.Time
 	Actor users.User // UserSpec and Login fields populated.
 
 	// Container is the URL (without schema) of event target.
 	//
 	// For event types Issue, Change, IssueComment, ChangeComment, CommitComment,
-	// and Create with "package" type, it's the import path of the target package.
+	// and Create with CreatePackage type, it's the import path of the target package.
 	// E.g., "golang.org/x/image/font/sfnt" or "github.com/user/repo/sub/dir".
 	//
 	// For all other event types, it is the module path of the target repository.
 	// E.g., "golang.org/x/image" or "github.com/user/repo".
 	Container string
 
-	// Payload specifies the event type. It's one of:
-	// Issue, Change, IssueComment, ChangeComment, CommitComment,
-	// Push, Star, Create, Fork, Delete, Wiki.
-	Payload interface{}
+	// Payload specifies the event type.
+	Payload Payload
+}
+
+// Payload is the payload of an event. It's one of:
+// Issue, Change, IssueComment, ChangeComment, CommitComment,
+// Push, Star, Create, Fork, Delete, Wiki, Release, Publish, Member, Sponsor,
+// Assign, Label, Milestone, Transfer, Rename.
+//
+// The set of payload types is closed; Payload can't be
+// implemented by types outside of this package.
+// PayloadTypes returns all of them.
+type Payload interface {
+	// EventType returns the name of the event type, e.g., "IssueComment".
+	// It's the same as the name of the payload type.
+	EventType() string
+
+	payload()
+}
+
+// EventType implements Payload.
+func (Issue) EventType() string         { return "Issue" }
+func (Change) EventType() string        { return "Change" }
+func (IssueComment) EventType() string  { return "IssueComment" }
+func (ChangeComment) EventType() string { return "ChangeComment" }
+func (CommitComment) EventType() string { return "CommitComment" }
+func (Push) EventType() string          { return "Push" }
+func (Star) EventType() string          { return "Star" }
+func (Create) EventType() string        { return "Create" }
+func (Fork) EventType() string          { return "Fork" }
+func (Delete) EventType() string        { return "Delete" }
+func (Wiki) EventType() string          { return "Wiki" }
+func (Release) EventType() string       { return "Release" }
+func (Publish) EventType() string       { return "Publish" }
+func (Member) EventType() string        { return "Member" }
+func (Sponsor) EventType() string       { return "Sponsor" }
+func (Assign) EventType() string        { return "Assign" }
+func (Label) EventType() string         { return "Label" }
+func (Milestone) EventType() string     { return "Milestone" }
+func (Transfer) EventType() string      { return "Transfer" }
+func (Rename) EventType() string        { return "Rename" }
+
+func (Issue) payload()         {}
+func (Change) payload()        {}
+func (IssueComment) payload()  {}
+func (ChangeComment) payload() {}
+func (CommitComment) payload() {}
+func (Push) payload()          {}
+func (Star) payload()          {}
+func (Create) payload()        {}
+func (Fork) payload()          {}
+func (Delete) payload()        {}
+func (Wiki) payload()          {}
+func (Release) payload()       {}
+func (Publish) payload()       {}
+func (Member) payload()        {}
+func (Sponsor) payload()       {}
+func (Assign) payload()        {}
+func (Label) payload()         {}
+func (Milestone) payload()     {}
+func (Transfer) payload()      {}
+func (Rename) payload()        {}
+
+// payloadTypes holds the zero value of each payload type,
+// in the same order as the Payload documentation lists them.
+// Encodings of payloads are driven by it, so each supports every type.
+var payloadTypes = []Payload{
+	Issue{}, Change{}, IssueComment{}, ChangeComment{}, CommitComment{},
+	Push{}, Star{}, Create{}, Fork{}, Delete{}, Wiki{}, Release{}, Publish{}, Member{}, Sponsor{},
+	Assign{}, Label{}, Milestone{}, Transfer{}, Rename{},
+}
+
+// PayloadTypes returns the zero value of each payload type, in the same
+// order as the Payload documentation lists them. It's meant for encodings
+// of events outside of this package, to support and test every type.
+func PayloadTypes() []Payload {
+	return append([]Payload(nil), payloadTypes...)
+}
+
+// PayloadOf returns v as a Payload, for code that holds payloads
+// as an interface{}, as Event.Payload used to. v must be nil or
+// implement Payload; any other value is an error.
+func PayloadOf(v interface{}) (Payload, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case Payload:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("event.PayloadOf: invalid payload type %T", v)
+	}
 }
 
 // MarshalJSON implements the json.Marshaler interface.
+//
+// It's the canonical JSON encoding of an event. The payload is encoded
+// as a tagged union: the Type field holds the name of the event type
+// as returned by Payload.EventType, and the Payload field holds the payload.
 func (e Event) MarshalJSON() ([]byte, error) {
+	if e.Payload == nil {
+		return nil, fmt.Errorf("Event.MarshalJSON: invalid payload type %T; Event was %+v", e.Payload, e)
+	}
 	v := struct {
+		ID        string `json:",omitempty"`
 		Time      time.Time
 		Actor     users.User
 		Container string
 		Type      string
-		Payload   interface{}
+		Payload   Payload
 	}{
+		ID:        e.ID,
 		Time:      e.Time,
 		Actor:     e.Actor,
 		Container: e.Container,
+		Type:      e.Payload.EventType(),
 		Payload:   e.Payload,
 	}
-	switch e.Payload.(type) {
-	case Issue:
-		v.Type = "Issue"
-	case Change:
-		v.Type = "Change"
-	case IssueComment:
-		v.Type = "IssueComment"
-	case ChangeComment:
-		v.Type = "ChangeComment"
-	case CommitComment:
-		v.Type = "CommitComment"
-	case Push:
-		v.Type = "Push"
-	case Star:
-		v.Type = "Star"
-	case Create:
-		v.Type = "Create"
-	case Fork:
-		v.Type = "Fork"
-	case Delete:
-		v.Type = "Delete"
-	case Wiki:
-		v.Type = "Wiki"
-	default:
-		return nil, fmt.Errorf("Event.MarshalJSON: invalid payload type %T; Event was %+v", e.Payload, e)
-	}
 	return json.Marshal(v)
 }
 
@@ -81,6 +157,7 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 		return nil
 	}
 	var v struct {
+		ID        string
 		Time      time.Time
 		Actor     users.User
 		Container string
@@ -92,132 +169,108 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	*e = Event{
+		ID:        v.ID,
 		Time:      v.Time,
 		Actor:     v.Actor,
 		Container: v.Container,
 	}
-	switch v.Type {
-	case "Issue":
-		var p Issue
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Change":
-		var p Change
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "IssueComment":
-		var p IssueComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "ChangeComment":
-		var p ChangeComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "CommitComment":
-		var p CommitComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Push":
-		var p Push
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Star":
-		var p Star
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Create":
-		var p Create
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Fork":
-		var p Fork
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Delete":
-		var p Delete
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	case "Wiki":
-		var p Wiki
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p
-	default:
+	p := newPayload(v.Type)
+	if p == nil {
 		return fmt.Errorf("Event.UnmarshalJSON: invalid payload type %q", v.Type)
 	}
+	err = json.Unmarshal(v.Payload, p)
+	if err != nil {
+		return err
+	}
+	e.Payload = reflect.ValueOf(p).Elem().Interface().(Payload)
+	return nil
+}
+
+// newPayload returns a pointer to a new zero value of the payload type
+// for event type typ, or nil if typ is not a known event type.
+func newPayload(typ string) interface{} {
+	for _, p := range payloadTypes {
+		if p.EventType() == typ {
+			return reflect.New(reflect.TypeOf(p)).Interface()
+		}
+	}
 	return nil
 }
 
 // Issue is an issue event.
 type Issue struct {
-	Action       string // "opened", "closed", "reopened".
+	Action       IssueAction
+	IssueNumber  uint64 // Optional.
 	IssueTitle   string
-	IssueBody    string // Only set when action is "opened".
+	IssueBody    string // Only set when action is IssueOpened.
 	IssueHTMLURL string
+
+	Milestone string      // Title of the milestone. Optional.
+	Labels    []LabelInfo // Optional.
 }
 
 // Change is a change event.
 type Change struct {
-	Action        string // "opened", "closed", "merged", "reopened".
+	Action        ChangeAction
+	ChangeNumber  uint64 // Optional.
 	ChangeTitle   string
-	ChangeBody    string // Only set when action is "opened".
+	ChangeBody    string // Only set when action is ChangeOpened.
 	ChangeHTMLURL string
+
+	BaseBranch string // Name of branch the change is to be merged into. E.g., "master". Optional.
+	HeadBranch string // Name of branch with the proposed changes. Optional.
+
+	Draft       bool         // Whether the change is a draft, i.e., not yet ready for review.
+	ReviewState state.Review // Overall review state of the change at the time of the event. Optional.
+
+	Milestone string      // Title of the milestone. Optional.
+	Labels    []LabelInfo // Optional.
+
+	References []Reference // Issues and changes mentioned in ChangeBody. Optional.
 }
 
 // IssueComment is an issue comment event.
 type IssueComment struct {
-	IssueTitle     string
-	IssueState     state.Issue
-	CommentBody    string
-	CommentHTMLURL string
+	Action           CommentAction // Optional. The zero value means CommentCreated.
+	IssueNumber      uint64        // Optional.
+	IssueTitle       string
+	IssueState       state.Issue
+	CommentID        uint64    // Optional.
+	CommentBody      string    // Empty if the comment was deleted.
+	CommentCreatedAt time.Time // Optional.
+	CommentHTMLURL   string
+
+	References []Reference // Issues and changes mentioned in CommentBody. Optional.
 }
 
 // ChangeComment is a change comment event.
 // A change comment is a review iff CommentReview is non-zero.
 type ChangeComment struct {
-	ChangeTitle    string
-	ChangeState    state.Change
-	CommentBody    string
-	CommentReview  state.Review
-	CommentHTMLURL string
+	Action           CommentAction // Optional. The zero value means CommentCreated.
+	ChangeTitle      string
+	ChangeState      state.Change
+	CommentID        uint64 // Optional.
+	CommentBody      string // Empty if the comment was deleted.
+	CommentReview    state.Review
+	CommentCreatedAt time.Time // Optional.
+	CommentHTMLURL   string
+
+	References []Reference // Issues and changes mentioned in CommentBody. Optional.
 }
 
 // CommitComment is a commit comment event.
 type CommitComment struct {
-	Commit      Commit
-	CommentBody string
+	Commit           Commit
+	CommentID        uint64 // Optional.
+	CommentBody      string
+	CommentCreatedAt time.Time // Optional.
+
+	// Path and Line are the file and line in it that the comment is on,
+	// if it's an inline comment. E.g., "foo.go" and 42. Optional.
+	Path string
+	Line int
+
+	References []Reference // Issues and changes mentioned in CommentBody. Optional.
 }
 
 // Push is a push event.
@@ -227,32 +280,128 @@ type Push struct {
 	Before  string   // SHA of the most recent commit before the push.
 	Commits []Commit // Ordered from earliest to most recent (head).
 
+	// TotalCommits is the total number of commits in the push.
+	// It may be greater than len(Commits), since Commits can be truncated.
+	// Optional, the zero value means unknown.
+	TotalCommits int
+
+	// Forced reports whether the push was a force-push,
+	// i.e., Before is not an ancestor of Head.
+	Forced bool
+
 	HeadHTMLURL   string // Optional.
 	BeforeHTMLURL string // Optional.
 }
 
+// Truncated reports whether the push contained more commits than
+// are included in Commits.
+func (p Push) Truncated() bool {
+	return p.TotalCommits > len(p.Commits)
+}
+
 // Star is a star event.
 type Star struct{}
 
 // Create is a create event.
 type Create struct {
-	Type        string // "repository", "package", "branch", "tag".
-	Name        string // Only for "branch", "tag" types.
-	Description string // Only for "repository", "package" types. Optional.
+	Type        CreateType
+	Name        string // Only for CreateBranch, CreateTag types.
+	NameHTMLURL string // Only for CreateBranch, CreateTag types. Optional.
+	Description string // Only for CreateRepository, CreatePackage types. Optional.
 }
 
 // Fork is a fork event.
 type Fork struct {
-	Container string // URL (without schema) of the created repository. E.g., "github.com/anotheruser/repo".
+	Container     string // URL (without schema) of the created repository. E.g., "github.com/anotheruser/repo".
+	HTMLURL       string // URL of the created repository. Optional.
+	Description   string // Description of the created repository, as of the fork. Optional.
+	DefaultBranch string // Default branch of the created repository, as of the fork. Optional.
 }
 
 // Delete is a delete event.
 type Delete struct {
-	Type string // "branch", "tag".
+	Type DeleteType
 	Name string
+
+	LastSHA        string // SHA of the commit the ref pointed to before it was deleted. Optional.
+	TreeHTMLURL    string // Tree of the repository at LastSHA, where what the ref pointed to can still be explored. Optional.
+	CompareHTMLURL string // Compares LastSHA to the default branch. Optional.
 }
 
 // Wiki is a wiki event. It happens when an actor updates a wiki.
 type Wiki struct {
 	Pages []Page // Wiki pages that are affected.
 }
+
+// Release is a release event. It happens when an actor publishes a release.
+type Release struct {
+	TagName    string // Name of the tag the release is of. E.g., "v1.0.0".
+	Name       string // Name of the release. Optional.
+	Body       string // Release notes. It may be an excerpt of them. Optional.
+	Prerelease bool   // Whether the release is a pre-release, i.e., not ready for production.
+	HTMLURL    string
+}
+
+// Publish is a publish event. It happens when an actor makes
+// a private repository public, e.g., to open source it.
+type Publish struct{}
+
+// Member is a member event. It happens when an actor adds
+// a collaborator to a repository, or removes one.
+type Member struct {
+	Action MemberAction
+	Member users.User // The collaborator. UserSpec, Login and AvatarURL fields populated.
+}
+
+// Sponsor is a sponsor event. It happens when an actor starts sponsoring
+// a user or an organization.
+type Sponsor struct {
+	Sponsorable users.User // The user or organization sponsored. UserSpec, Login and AvatarURL fields populated.
+	TierName    string     // Name of the sponsorship tier. E.g., "$5 a month". Optional.
+	HTMLURL     string     // URL of the sponsorable's sponsors profile.
+}
+
+// Assign is an assign event. It happens when an actor assigns
+// a user to an issue, or unassigns one.
+type Assign struct {
+	Action       AssignAction
+	Assignee     users.User // UserSpec, Login and AvatarURL fields populated.
+	IssueNumber  uint64     // Optional.
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+// Label is a label event. It happens when an actor adds
+// a label to an issue, or removes one.
+type Label struct {
+	Action       LabelAction
+	Label        LabelInfo
+	IssueNumber  uint64 // Optional.
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+// Milestone is a milestone event. It happens when an actor adds
+// an issue to a milestone, or removes it from one.
+type Milestone struct {
+	Action       MilestoneAction
+	Milestone    string // Title of the milestone. Optional.
+	IssueNumber  uint64 // Optional.
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+// Transfer is a transfer event. It happens when an actor transfers
+// an issue to another repository.
+type Transfer struct {
+	IssueNumber  uint64 // Optional.
+	IssueTitle   string
+	IssueHTMLURL string // URL of the issue before it was transferred, which redirects to it.
+}
+
+// Rename is a rename event. It happens when an actor renames
+// a repository, or transfers it to another owner.
+type Rename struct {
+	From string // URL (without schema) of the repository before. E.g., "github.com/user/old-repo".
+	To   string // URL (without schema) of the repository after. E.g., "github.com/anotheruser/repo".
+}
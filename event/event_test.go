@@ -0,0 +1,637 @@
+package event_test
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/state"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+func TestEventJSON(t *testing.T) {
+	for _, want := range mockEvents {
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got event.Event
+		err = json.Unmarshal(b, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got:\n%+v\nwant:\n%+v", want.Payload.EventType(), got, want)
+		}
+	}
+}
+
+func TestEventJSONInvalidPayload(t *testing.T) {
+	_, err := json.Marshal(event.Event{})
+	if err == nil {
+		t.Error("Marshal: got nil error for event with nil payload")
+	}
+	var e event.Event
+	err = json.Unmarshal([]byte(`{"Type":"NoSuchType","Payload":{}}`), &e)
+	if err == nil {
+		t.Error("Unmarshal: got nil error for unknown payload type")
+	}
+}
+
+func TestPayloadOf(t *testing.T) {
+	for _, want := range event.PayloadTypes() {
+		got, err := event.PayloadOf(interface{}(want))
+		if err != nil {
+			t.Errorf("PayloadOf(%T): %v", want, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("PayloadOf(%T): got %v, want %v", want, got, want)
+		}
+	}
+	if got, err := event.PayloadOf(nil); got != nil || err != nil {
+		t.Errorf("PayloadOf(nil): got %v, %v, want nil, nil", got, err)
+	}
+	for _, v := range []interface{}{"Issue", struct{}{}} {
+		if _, err := event.PayloadOf(v); err == nil {
+			t.Errorf("PayloadOf(%T): got nil error", v)
+		}
+	}
+}
+
+// TestPayloadTypes tests that PayloadTypes returns every type that
+// implements Payload, in the order the Payload documentation lists them,
+// and that each one's EventType is its name.
+func TestPayloadTypes(t *testing.T) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string // Names of payload types, which implement the unexported payload method.
+	var doc string    // Documentation of the Payload type.
+	for _, f := range pkgs["event"].Files {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil || decl.Name.Name != "payload" {
+					continue
+				}
+				if ident, ok := decl.Recv.List[0].Type.(*ast.Ident); ok {
+					want = append(want, ident.Name)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok && ts.Name.Name == "Payload" {
+						doc = decl.Doc.Text()
+					}
+				}
+			}
+		}
+	}
+	var got []string
+	for _, p := range event.PayloadTypes() {
+		if name := reflect.TypeOf(p).Name(); p.EventType() != name {
+			t.Errorf("%s: EventType = %q, want %q", name, p.EventType(), name)
+		}
+		got = append(got, p.EventType())
+	}
+	if listed := strings.Join(got, ", ") + "."; !strings.Contains(strings.Join(strings.Fields(doc), " "), listed) {
+		t.Errorf("Payload documentation doesn't list payload types in the order PayloadTypes does: %s", listed)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PayloadTypes:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+// TestProto tests that the messages in event.proto mirror the payload types,
+// and the types of their fields, with a field for each Go field, named after it
+// in snake case. The Event message must have a payload oneof with an entry
+// for each payload type.
+func TestProto(t *testing.T) {
+	b, err := os.ReadFile("event.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := parseProto(string(b))
+
+	var eventFields []string
+	for _, f := range messages["Event"] {
+		eventFields = append(eventFields, f.Name)
+	}
+	if got, want := eventFields, []string{"id", "time", "actor", "container"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Event message: got fields %v, want %v", got, want)
+	}
+	oneof := make(map[string]string) // Message type -> oneof entry name.
+	for _, f := range messages["Event.payload"] {
+		oneof[f.Type] = f.Name
+	}
+	if got, want := len(oneof), len(event.PayloadTypes()); got != want {
+		t.Errorf("Event.payload oneof has %d entries, want %d", got, want)
+	}
+	checked := make(map[reflect.Type]bool)
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		if checked[typ] {
+			return
+		}
+		checked[typ] = true
+		fields, ok := messages[typ.Name()]
+		if !ok {
+			t.Errorf("event.proto has no %s message", typ.Name())
+			return
+		}
+		var want []string // Fields, e.g., "issue_title" or "repeated labels".
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			ft, repeated := f.Type, false
+			if ft.Kind() == reflect.Slice {
+				ft, repeated = ft.Elem(), true
+			}
+			want = append(want, protoField{Name: snakeCase(f.Name), Repeated: repeated}.String())
+			if ft.Kind() == reflect.Struct && ft.PkgPath() == typ.PkgPath() {
+				check(ft)
+			}
+		}
+		var got []string
+		for _, f := range fields {
+			got = append(got, protoField{Name: f.Name, Repeated: f.Repeated}.String())
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s message:\ngot  fields %q\nwant fields %q", typ.Name(), got, want)
+		}
+	}
+	for _, p := range event.PayloadTypes() {
+		typ := reflect.TypeOf(p)
+		if name, ok := oneof[typ.Name()]; !ok {
+			t.Errorf("Event.payload oneof has no %s entry", typ.Name())
+		} else if want := snakeCase(typ.Name()); name != want {
+			t.Errorf("Event.payload oneof entry of %s is named %q, want %q", typ.Name(), name, want)
+		}
+		check(typ)
+	}
+
+	// The User message has only the fields of users.User that events
+	// populate, with those of its UserSpec inlined.
+	userFields := map[string]bool{"id": true, "domain": true}
+	for i, typ := 0, reflect.TypeOf(users.User{}); i < typ.NumField(); i++ {
+		userFields[snakeCase(typ.Field(i).Name)] = true
+	}
+	for _, f := range messages["User"] {
+		if !userFields[f.Name] {
+			t.Errorf("User message has field %q, which users.User doesn't have", f.Name)
+		}
+	}
+}
+
+// protoField is a field of a message in a .proto file.
+type protoField struct {
+	Type     string
+	Name     string
+	Repeated bool
+}
+
+// String returns f without its type, e.g., "repeated labels".
+func (f protoField) String() string {
+	if f.Repeated {
+		return "repeated " + f.Name
+	}
+	return f.Name
+}
+
+var (
+	protoMessage = regexp.MustCompile(`^(message|oneof|enum) (\w+) \{(\})?$`)
+	protoFieldRE = regexp.MustCompile(`^(repeated )?([\w.]+) (\w+) = \d+;`)
+)
+
+// parseProto returns the fields of each message in the .proto file src,
+// keyed by message name. Fields of oneofs are keyed by the message name
+// and the oneof name, e.g., "Event.payload". Nested enums are skipped.
+// It supports only the subset of the syntax that event.proto uses.
+func parseProto(src string) map[string][]protoField {
+	messages := make(map[string][]protoField)
+	var scope []string // Names of enclosing messages, oneofs and enums.
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if m := protoMessage.FindStringSubmatch(line); m != nil {
+			if m[1] == "message" {
+				messages[m[2]] = nil
+			}
+			if m[3] == "" {
+				scope = append(scope, m[2])
+			}
+			continue
+		}
+		if line == "}" {
+			scope = scope[:len(scope)-1]
+			continue
+		}
+		m := protoFieldRE.FindStringSubmatch(line)
+		if m == nil || len(scope) == 0 {
+			// Not a field, or a value of an enum.
+			continue
+		}
+		key := strings.Join(scope, ".")
+		messages[key] = append(messages[key], protoField{Type: m[2], Name: m[3], Repeated: m[1] != ""})
+	}
+	return messages
+}
+
+// snakeCase returns the snake case form of the Go identifier name,
+// e.g., "issue_html_url" for "IssueHTMLURL".
+func snakeCase(name string) string {
+	for _, initialism := range []string{"HTML", "URL", "SHA", "ID"} {
+		name = strings.ReplaceAll(name, initialism, initialism[:1]+strings.ToLower(initialism[1:]))
+	}
+	var b strings.Builder
+	for i, r := range name {
+		if 'A' <= r && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func TestEventBinary(t *testing.T) {
+	for _, want := range mockEvents {
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got event.Event
+		err = got.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got:\n%+v\nwant:\n%+v", want.Payload.EventType(), got, want)
+		}
+	}
+}
+
+// FuzzEventBinary checks that any event that can be decoded
+// survives an encoding round-trip without changes.
+func FuzzEventBinary(f *testing.F) {
+	for _, e := range mockEvents {
+		b, err := e.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var e1 event.Event
+		if err := e1.UnmarshalBinary(b); err != nil {
+			return
+		}
+		b2, err := e1.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary of decoded event failed: %v", err)
+		}
+		var e2 event.Event
+		err = e2.UnmarshalBinary(b2)
+		if err != nil {
+			t.Fatalf("UnmarshalBinary of re-encoded event failed: %v", err)
+		}
+		if !reflect.DeepEqual(e1, e2) {
+			t.Errorf("round-trip mismatch:\n%+v\n%+v", e1, e2)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	for _, e := range mockEvents {
+		if err := e.Validate(); err != nil {
+			t.Errorf("%s: Validate: %v", e.Payload.EventType(), err)
+		}
+	}
+
+	invalid := []event.Event{
+		{Actor: mockUser, Payload: event.Star{}},
+		{Time: mockEvents[0].Time, Payload: event.Star{}},
+		{Time: mockEvents[0].Time, Actor: mockUser},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Issue{Action: "locked", IssueHTMLURL: "https://example.org/issues/1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Issue{Action: "opened", IssueHTMLURL: "/issues/1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.IssueComment{Action: "resolved", IssueState: state.IssueOpen, CommentHTMLURL: "https://example.org/issues/1#comment-1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.ChangeComment{Action: "resolved", ChangeState: state.ChangeOpen, CommentHTMLURL: "https://example.org/pull/1#comment-1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Push{Branch: "master"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Create{Type: "gist"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Create{Type: "tag"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Delete{Type: "branch"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Delete{Type: "tag", Name: "v1.0.0", TreeHTMLURL: "/tree/4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Fork{Container: "example.org/gopher/some-app", HTMLURL: "/gopher/some-app"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Wiki{}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Member{Action: "invited", Member: mockUser}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Sponsor{Sponsorable: mockUser}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Assign{Action: "assigned", IssueHTMLURL: "https://example.org/issues/1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Label{Action: "added", Label: event.LabelInfo{Name: "bug"}, IssueHTMLURL: "https://example.org/issues/1"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Milestone{Action: "milestoned"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Transfer{IssueTitle: "Title."}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Rename{From: "example.org/some-app"}},
+		{Time: mockEvents[0].Time, Actor: mockUser, Payload: event.Release{HTMLURL: "https://example.org/some-app/releases/tag/v1.2.0"}},
+	}
+	for i, e := range invalid {
+		if err := e.Validate(); err == nil {
+			t.Errorf("invalid event %d: Validate: got nil error", i)
+		}
+	}
+}
+
+// mockEvents contains an event of every payload type.
+var mockEvents = []event.Event{
+	{
+		ID:        "1",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Issue{
+			Action:       "opened",
+			IssueNumber:  40,
+			IssueTitle:   "\"Create Issue\" button doesn't show up if user isn't logged in.",
+			IssueBody:    "Steps to reproduce...",
+			IssueHTMLURL: "https://example.org/some-app/issues/40",
+			Milestone:    "v2.0",
+			Labels:       []event.LabelInfo{{Name: "bug", Color: "fc2929"}},
+		},
+	},
+	{
+		ID:        "2",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Change{
+			Action:        "opened",
+			ChangeNumber:  41,
+			ChangeTitle:   "Show \"Create Issue\" button to logged out users.",
+			ChangeBody:    "Fixes #40.",
+			ChangeHTMLURL: "https://example.org/some-app/pull/41",
+			BaseBranch:    "master",
+			HeadBranch:    "fix-40",
+			Draft:         true,
+			ReviewState:   state.ReviewPlus1,
+			Milestone:     "v2.0",
+			Labels:        []event.LabelInfo{{Name: "bug", Color: "fc2929"}, {Name: "needs review", Color: "ededed"}},
+			References:    []event.Reference{{Container: "example.org/some-app", Number: 40, HTMLURL: "https://example.org/some-app/issues/40"}},
+		},
+	},
+	{
+		ID:        "3",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.IssueComment{
+			IssueNumber:      3,
+			IssueTitle:       "feature request: \"recently read\" notifications tab",
+			IssueState:       state.IssueOpen,
+			CommentID:        2,
+			CommentBody:      "I am going to work on this and implement it soon.",
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			CommentHTMLURL:   "https://example.org/another-app/issues/3#comment-2",
+		},
+	},
+	{
+		ID:        "4",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.ChangeComment{
+			ChangeTitle:      "Add \"recently read\" notifications tab.",
+			ChangeState:      state.ChangeMerged,
+			CommentID:        5,
+			CommentBody:      "LGTM.",
+			CommentReview:    state.ReviewPlus2,
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			CommentHTMLURL:   "https://example.org/another-app/pull/4#comment-5",
+		},
+	},
+	{
+		ID:        "5",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.CommitComment{
+			Commit:           mockCommit,
+			CommentID:        6,
+			CommentBody:      "Nice.",
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	},
+	{
+		ID:        "6",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.Push{
+			Branch:        "master",
+			Head:          mockCommit.SHA,
+			Before:        "3ac1e4e1c6a8e3b7be7d1e2a9e0c0f1f4c1f2a3b",
+			Commits:       []event.Commit{mockCommit},
+			TotalCommits:  1,
+			Forced:        true,
+			HeadHTMLURL:   mockCommit.HTMLURL,
+			BeforeHTMLURL: "https://example.org/another-app/commit/3ac1e4e1c6a8e3b7be7d1e2a9e0c0f1f4c1f2a3b",
+		},
+	},
+	{
+		ID:        "7",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/starworthy",
+		Payload:   event.Star{},
+	},
+	{
+		ID:        "8",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Create{
+			Type:        "repository",
+			Description: "Some app.",
+		},
+	},
+	{
+		ID:        "9",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Fork{
+			Container: "example.org/gopher/some-app",
+		},
+	},
+	{
+		ID:        "10",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Delete{
+			Type:           "branch",
+			Name:           "fix-40",
+			LastSHA:        "4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+			CompareHTMLURL: "https://example.org/some-app/compare/4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+		},
+	},
+	{
+		ID:        "11",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Wiki{
+			Pages: []event.Page{{
+				Action:         "edited",
+				SHA:            "b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				Title:          "Home",
+				HTMLURL:        "https://example.org/some-app/wiki/Home/b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				CompareHTMLURL: "https://example.org/some-app/wiki/Home/_compare/b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c^...b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				Additions:      5,
+				Deletions:      1,
+			}},
+		},
+	},
+	{
+		ID:        "12",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Release{
+			TagName:    "v1.2.0",
+			Name:       "Version 1.2",
+			Body:       "This release fixes #40.",
+			Prerelease: true,
+			HTMLURL:    "https://example.org/some-app/releases/tag/v1.2.0",
+		},
+	},
+	{
+		ID:        "13",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload:   event.Publish{},
+	},
+	{
+		ID:        "14",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Member{
+			Action: "added",
+			Member: users.User{
+				UserSpec:  users.UserSpec{ID: 2, Domain: "example.org"},
+				Login:     "collaborator",
+				AvatarURL: "https://example.org/avatars/collaborator",
+			},
+		},
+	},
+	{
+		ID:        "15",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/maintainer",
+		Payload: event.Sponsor{
+			Sponsorable: users.User{
+				UserSpec:  users.UserSpec{ID: 3, Domain: "example.org"},
+				Login:     "maintainer",
+				AvatarURL: "https://example.org/avatars/maintainer",
+			},
+			TierName: "$5 a month",
+			HTMLURL:  "https://example.org/sponsors/maintainer",
+		},
+	},
+	{
+		ID:        "16",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Assign{
+			Action: "assigned",
+			Assignee: users.User{
+				UserSpec:  users.UserSpec{ID: 2, Domain: "example.org"},
+				Login:     "collaborator",
+				AvatarURL: "https://example.org/avatars/collaborator",
+			},
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		ID:        "17",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Label{
+			Action:       "labeled",
+			Label:        event.LabelInfo{Name: "bug", Color: "fc2929"},
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		ID:        "18",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Milestone{
+			Action:       "milestoned",
+			Milestone:    "v1.2.0",
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		ID:        "19",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Transfer{
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		ID:        "20",
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Rename{
+			From: "example.org/gopher/old-app",
+			To:   "example.org/some-app",
+		},
+	},
+}
+
+var mockCommit = event.Commit{
+	SHA:             "d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3",
+	Message:         "Fix a bug.\n\nThis change fixes a bug.",
+	AuthorAvatarURL: "https://avatars0.githubusercontent.com/u/8566911?v=4&s=32",
+	HTMLURL:         "https://example.org/another-app/commit/d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3",
+	Additions:       10,
+	Deletions:       2,
+	ChangedFiles:    3,
+}
+
+var mockUser = users.User{
+	UserSpec:  users.UserSpec{ID: 1, Domain: "example.org"},
+	Login:     "gopher",
+	Name:      "Sample Gopher",
+	Email:     "gopher@example.org",
+	AvatarURL: "https://avatars0.githubusercontent.com/u/8566911?v=4&s=32",
+}
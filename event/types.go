@@ -6,13 +6,35 @@ type Commit struct {
 	Message         string
 	AuthorAvatarURL string
 	HTMLURL         string // Optional.
+
+	Additions    int // Number of added lines. Optional.
+	Deletions    int // Number of deleted lines. Optional.
+	ChangedFiles int // Number of changed files. Optional.
+}
+
+// Reference describes an issue or change that is referenced by an event,
+// e.g., by mentioning "#123" or "owner/repo#123" in a body.
+type Reference struct {
+	Container string // URL (without schema) of the repository. E.g., "github.com/user/repo".
+	Number    uint64
+	HTMLURL   string
+}
+
+// LabelInfo describes a label in an Issue or Change event.
+type LabelInfo struct {
+	Name  string
+	Color string // Color in hex notation, without the leading '#'. E.g., "fc2929".
 }
 
 // Page describes a page action in a Wiki event.
 type Page struct {
-	Action         string // "created", "edited".
+	Action         PageAction
 	SHA            string
 	Title          string
+	Summary        string // Summary of the edit, if one was given. Optional.
 	HTMLURL        string
-	CompareHTMLURL string
+	CompareHTMLURL string // Optional, since a created page has nothing to compare with.
+
+	Additions int // Number of added lines. Optional.
+	Deletions int // Number of deleted lines. Optional.
 }
@@ -0,0 +1,200 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"dmitri.shuralyov.com/state"
+	"github.com/shurcooL/users"
+)
+
+// Validate reports an error if e is malformed. It checks invariants
+// common to all events, as well as ones specific to the payload type.
+func (e Event) Validate() error {
+	if e.Time.IsZero() {
+		return errors.New("Event.Time is zero")
+	}
+	if e.Actor.UserSpec == (users.UserSpec{}) {
+		return errors.New("Event.Actor.UserSpec is zero")
+	}
+	switch p := e.Payload.(type) {
+	case Issue:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Issue.Action %q is not valid", p.Action)
+		}
+		return validateURL("Issue.IssueHTMLURL", p.IssueHTMLURL)
+	case Change:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Change.Action %q is not valid", p.Action)
+		}
+		return validateURL("Change.ChangeHTMLURL", p.ChangeHTMLURL)
+	case IssueComment:
+		if p.Action != "" && !p.Action.Valid() {
+			return fmt.Errorf("IssueComment.Action %q is not valid", p.Action)
+		}
+		if !oneOf(string(p.IssueState), string(state.IssueOpen), string(state.IssueClosed)) {
+			return fmt.Errorf("IssueComment.IssueState %q is not valid", p.IssueState)
+		}
+		return validateURL("IssueComment.CommentHTMLURL", p.CommentHTMLURL)
+	case ChangeComment:
+		if p.Action != "" && !p.Action.Valid() {
+			return fmt.Errorf("ChangeComment.Action %q is not valid", p.Action)
+		}
+		if !oneOf(string(p.ChangeState), string(state.ChangeOpen), string(state.ChangeClosed), string(state.ChangeMerged)) {
+			return fmt.Errorf("ChangeComment.ChangeState %q is not valid", p.ChangeState)
+		}
+		if p.CommentReview < state.ReviewMinus2 || p.CommentReview > state.ReviewPlus2 {
+			return fmt.Errorf("ChangeComment.CommentReview %d is not valid", p.CommentReview)
+		}
+		return validateURL("ChangeComment.CommentHTMLURL", p.CommentHTMLURL)
+	case CommitComment:
+		return validateCommit("CommitComment.Commit", p.Commit)
+	case Push:
+		if p.Head == "" {
+			return errors.New("Push.Head is empty")
+		}
+		for i, c := range p.Commits {
+			if err := validateCommit(fmt.Sprintf("Push.Commits[%d]", i), c); err != nil {
+				return err
+			}
+		}
+		if err := validateOptionalURL("Push.HeadHTMLURL", p.HeadHTMLURL); err != nil {
+			return err
+		}
+		return validateOptionalURL("Push.BeforeHTMLURL", p.BeforeHTMLURL)
+	case Star:
+		return nil
+	case Create:
+		switch p.Type {
+		case CreateRepository, CreatePackage:
+			return nil
+		case CreateBranch, CreateTag:
+			if p.Name == "" {
+				return fmt.Errorf("Create.Name is empty for %q type", p.Type)
+			}
+			return validateOptionalURL("Create.NameHTMLURL", p.NameHTMLURL)
+		default:
+			return fmt.Errorf("Create.Type %q is not valid", p.Type)
+		}
+	case Fork:
+		if p.Container == "" {
+			return errors.New("Fork.Container is empty")
+		}
+		return validateOptionalURL("Fork.HTMLURL", p.HTMLURL)
+	case Delete:
+		if !p.Type.Valid() {
+			return fmt.Errorf("Delete.Type %q is not valid", p.Type)
+		}
+		if p.Name == "" {
+			return errors.New("Delete.Name is empty")
+		}
+		if err := validateOptionalURL("Delete.TreeHTMLURL", p.TreeHTMLURL); err != nil {
+			return err
+		}
+		return validateOptionalURL("Delete.CompareHTMLURL", p.CompareHTMLURL)
+	case Wiki:
+		if len(p.Pages) == 0 {
+			return errors.New("Wiki.Pages is empty")
+		}
+		for i, page := range p.Pages {
+			if !page.Action.Valid() {
+				return fmt.Errorf("Wiki.Pages[%d].Action %q is not valid", i, page.Action)
+			}
+			if err := validateURL(fmt.Sprintf("Wiki.Pages[%d].HTMLURL", i), page.HTMLURL); err != nil {
+				return err
+			}
+			if err := validateOptionalURL(fmt.Sprintf("Wiki.Pages[%d].CompareHTMLURL", i), page.CompareHTMLURL); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Publish:
+		return nil
+	case Member:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Member.Action %q is not valid", p.Action)
+		}
+		if p.Member.Login == "" {
+			return errors.New("Member.Member.Login is empty")
+		}
+		return nil
+	case Sponsor:
+		if p.Sponsorable.Login == "" {
+			return errors.New("Sponsor.Sponsorable.Login is empty")
+		}
+		return validateURL("Sponsor.HTMLURL", p.HTMLURL)
+	case Assign:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Assign.Action %q is not valid", p.Action)
+		}
+		if p.Assignee.Login == "" {
+			return errors.New("Assign.Assignee.Login is empty")
+		}
+		return validateURL("Assign.IssueHTMLURL", p.IssueHTMLURL)
+	case Label:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Label.Action %q is not valid", p.Action)
+		}
+		if p.Label.Name == "" {
+			return errors.New("Label.Label.Name is empty")
+		}
+		return validateURL("Label.IssueHTMLURL", p.IssueHTMLURL)
+	case Milestone:
+		if !p.Action.Valid() {
+			return fmt.Errorf("Milestone.Action %q is not valid", p.Action)
+		}
+		return validateURL("Milestone.IssueHTMLURL", p.IssueHTMLURL)
+	case Transfer:
+		return validateURL("Transfer.IssueHTMLURL", p.IssueHTMLURL)
+	case Rename:
+		if p.From == "" || p.To == "" {
+			return errors.New("Rename.From or Rename.To is empty")
+		}
+		return nil
+	case Release:
+		if p.TagName == "" {
+			return errors.New("Release.TagName is empty")
+		}
+		return validateURL("Release.HTMLURL", p.HTMLURL)
+	default:
+		return fmt.Errorf("Event.Payload has invalid type %T", e.Payload)
+	}
+}
+
+func validateCommit(name string, c Commit) error {
+	if c.SHA == "" {
+		return fmt.Errorf("%s.SHA is empty", name)
+	}
+	return validateOptionalURL(name+".HTMLURL", c.HTMLURL)
+}
+
+// validateURL reports an error if s is not an absolute URL.
+// name is the name of the field being validated.
+func validateURL(name, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid URL: %v", name, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%s %q is not an absolute URL", name, s)
+	}
+	return nil
+}
+
+// validateOptionalURL is like validateURL, but the empty string is valid.
+func validateOptionalURL(name, s string) error {
+	if s == "" {
+		return nil
+	}
+	return validateURL(name, s)
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
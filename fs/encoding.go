@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Encoding is an encoding used for storing events.
+type Encoding int
+
+const (
+	// JSON stores events as JSON. It's the default.
+	JSON Encoding = iota
+
+	// CBOR stores events as CBOR (RFC 8949), which is more compact
+	// and faster to decode than JSON.
+	CBOR
+)
+
+func (enc Encoding) String() string {
+	switch enc {
+	case JSON:
+		return "JSON"
+	case CBOR:
+		return "CBOR"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(enc))
+	}
+}
+
+// cborMagic is the self-described CBOR tag (RFC 8949, section 3.4.6).
+// It starts files with CBOR-encoded events, so they can be told apart from JSON.
+var cborMagic = []byte{0xd9, 0xd9, 0xf7}
+
+// cborEncMode encodes times with nanosecond precision, same as JSON.
+var cborEncMode = func() cbor.EncMode {
+	em, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}()
+
+// fileFormat is the format of a file with events.
+type fileFormat struct {
+	enc  Encoding
+	gzip bool        // Whether the file is compressed with gzip.
+	aead cipher.AEAD // Encrypts the file, or nil if it's not encrypted.
+}
+
+// gzipMagic is the start of every gzip member (RFC 1952, section 2.3.1).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// writeEvents writes events to w in the specified format.
+// If start is true, w is at the start of a file.
+//
+// Compressed events are written as a new gzip member, and encrypted ones
+// as a new chunk, so that they can be appended to an existing file.
+// Events are compressed before they're encrypted.
+func writeEvents(w io.Writer, format fileFormat, start bool, events ...eventDisk) error {
+	if format.aead != nil {
+		var buf bytes.Buffer
+		plain := format
+		plain.aead = nil
+		err := writeEvents(&buf, plain, start, events...)
+		if err != nil {
+			return err
+		}
+		return writeEncrypted(w, format.aead, buf.Bytes())
+	}
+	if !format.gzip {
+		return writeEncoded(w, format.enc, start, events)
+	}
+	zw := gzip.NewWriter(w)
+	err := writeEncoded(zw, format.enc, start, events)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeEncoded writes events to w in encoding enc.
+// If start is true, w is at the start of the encoded stream.
+func writeEncoded(w io.Writer, enc Encoding, start bool, events []eventDisk) error {
+	switch enc {
+	case JSON:
+		e := json.NewEncoder(w)
+		for _, event := range events {
+			err := e.Encode(event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case CBOR:
+		if start {
+			_, err := w.Write(cborMagic)
+			if err != nil {
+				return err
+			}
+		}
+		e := cborEncMode.NewEncoder(w)
+		for _, event := range events {
+			err := e.Encode(event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported encoding %v", enc)
+	}
+}
+
+// readEvents reads all events from r, which is at the start of a file,
+// and reports the format of the file. If the file is encrypted,
+// it's decrypted with aead, which must not be nil.
+//
+// If the file is corrupt, readEvents returns the events it could read,
+// and reports the first problem as corrupt. Events that don't match their
+// checksum, or have an unknown payload type, are skipped. Events after
+// malformed data can't be told apart from it, so reading stops there.
+// Errors reading r are returned as err.
+func readEvents(r io.Reader, aead cipher.AEAD) (_ []eventDisk, _ fileFormat, corrupt, err error) {
+	var format fileFormat
+	er := &errReader{r: r}
+	br := bufio.NewReader(er)
+	if b, _ := br.Peek(len(encryptionMagic)); bytes.Equal(b, encryptionMagic) {
+		if aead == nil {
+			return nil, fileFormat{}, nil, errors.New("file is encrypted, but no encryption key is set")
+		}
+		// Decode the chunks that decrypt, and report the rest as corrupt.
+		var plaintext []byte
+		plaintext, corrupt, err = readEncrypted(br, aead)
+		if err != nil {
+			return nil, fileFormat{}, nil, err
+		}
+		br = bufio.NewReader(bytes.NewReader(plaintext))
+		format.aead = aead
+	}
+	if b, _ := br.Peek(len(gzipMagic)); bytes.Equal(b, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if er.err != nil {
+			return nil, fileFormat{}, nil, er.err
+		} else if err != nil {
+			if corrupt == nil {
+				corrupt = err
+			}
+			return nil, format, corrupt, nil
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+		format.gzip = true
+	}
+	var decode func(v interface{}) error
+	if b, _ := br.Peek(len(cborMagic)); bytes.Equal(b, cborMagic) {
+		br.Discard(len(cborMagic))
+		format.enc, decode = CBOR, cbor.NewDecoder(br).Decode
+	} else {
+		format.enc, decode = JSON, json.NewDecoder(br).Decode
+	}
+	var events []eventDisk
+	for {
+		var event eventDisk
+		err := decode(&event)
+		if er.err != nil {
+			return nil, fileFormat{}, nil, er.err
+		} else if err == io.EOF {
+			break
+		} else if errors.Is(err, errChecksum) || errors.Is(err, errPayloadType) {
+			if corrupt == nil {
+				corrupt = err
+			}
+			continue
+		} else if err != nil {
+			if corrupt == nil {
+				corrupt = err
+			}
+			break
+		}
+		events = append(events, event)
+	}
+	return events, format, corrupt, nil
+}
+
+// errReader is an io.Reader that records the first error reading from r
+// other than io.EOF, so that read errors can be told apart from decode errors.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
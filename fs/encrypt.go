@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// Encrypted file layout:
+//
+// 	chunk
+// 	chunk
+// 	...
+//
+// Each chunk is:
+//
+// 	encryptionMagic  4 bytes
+// 	nonce            12 bytes
+// 	length           4 bytes, big-endian length of ciphertext
+// 	ciphertext       AES-GCM encryption of plaintext with nonce
+//
+// Every write to a file adds a chunk, so that events can be appended to
+// an encrypted file like to any other. Decrypted plaintexts of the chunks,
+// one after another, are the content the file would have unencrypted.
+
+// encryptionMagic starts every chunk of an encrypted file.
+// JSON, CBOR and gzip never start with a zero byte,
+// so encrypted files can be told apart from them.
+var encryptionMagic = []byte("\x00enc")
+
+// maxChunkSize is the maximum length of the ciphertext of a chunk.
+// It's far more than any write needs, and rejects a corrupt length
+// before allocating memory for it.
+const maxChunkSize = 1 << 30
+
+// newAEAD returns AES-GCM with key, which must be 16, 24 or 32 bytes long.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeEncrypted encrypts plaintext with aead, and writes it to w as a chunk.
+func writeEncrypted(w io.Writer, aead cipher.AEAD, plaintext []byte) error {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
+	var chunk bytes.Buffer
+	chunk.Write(encryptionMagic)
+	chunk.Write(nonce)
+	binary.Write(&chunk, binary.BigEndian, uint32(len(ciphertext)))
+	chunk.Write(ciphertext)
+	_, err = w.Write(chunk.Bytes())
+	return err
+}
+
+// readEncrypted reads all chunks from r, and returns their plaintexts,
+// one after another. If a chunk is malformed or fails to decrypt,
+// it returns the plaintexts of chunks before it, and reports the problem
+// as corrupt. Errors reading r are returned as err.
+func readEncrypted(r *bufio.Reader, aead cipher.AEAD) (plaintext []byte, corrupt, err error) {
+	header := make([]byte, len(encryptionMagic)+aead.NonceSize()+4)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return plaintext, nil, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return plaintext, errors.New("encrypted chunk header is truncated"), nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+			return plaintext, errors.New("encrypted chunk doesn't start with magic"), nil
+		}
+		nonce := header[len(encryptionMagic) : len(encryptionMagic)+aead.NonceSize()]
+		n := binary.BigEndian.Uint32(header[len(header)-4:])
+		if n > maxChunkSize {
+			return plaintext, fmt.Errorf("encrypted chunk has invalid length %d", n), nil
+		}
+		ciphertext := make([]byte, n)
+		_, err = io.ReadFull(r, ciphertext)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return plaintext, errors.New("encrypted chunk is truncated"), nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		plaintext, err = aead.Open(plaintext, nonce, ciphertext, nil)
+		if err != nil {
+			return plaintext, errors.New("encrypted chunk fails to decrypt"), nil
+		}
+	}
+}
+
+// keyCheck is the plaintext of the key file.
+var keyCheck = []byte("shurcooL/events key check")
+
+// checkKey checks that aead decrypts the key file at path, which tells
+// whether the key is the one storage was encrypted with. Otherwise
+// every encrypted file would just seem corrupt. If there's no key file
+// yet and create is true, it's created.
+func checkKey(ctx context.Context, fs webdav.FileSystem, path string, aead cipher.AEAD, create bool) error {
+	f, err := vfsutil.Open(ctx, fs, path)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil
+		}
+		return writeFile(ctx, fs, path, true, func(w io.Writer) error {
+			return writeEncrypted(w, aead, keyCheck)
+		})
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	plaintext, corrupt, err := readEncrypted(bufio.NewReader(f), aead)
+	if err != nil {
+		return err
+	} else if corrupt != nil || !bytes.Equal(plaintext, keyCheck) {
+		return errors.New("encryption key isn't the one events were encrypted with")
+	}
+	return nil
+}
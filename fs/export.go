@@ -0,0 +1,337 @@
+package fs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// Archive layout:
+//
+// 	manifest.json
+// 	tree/version
+// 	tree/index
+// 	tree/event-{{time}}-{{key}}
+// 	tree/...
+// 	tree/log-{{n}}.jsonl
+// 	tree/segments/{{year}}/{{month}}/segment-{{n}}
+//
+// The manifest comes first. The tree directory holds the files of the tree
+// of the user, as described in schema.go, except for the generation file.
+
+// archiveVersion is the current version of the archive layout.
+const archiveVersion = 1
+
+// manifestName is the name of the manifest in an archive.
+const manifestName = "manifest.json"
+
+// treePrefix is the prefix of names of tree files in an archive.
+const treePrefix = "tree/"
+
+// manifest describes an archive.
+type manifest struct {
+	Version       int            // Version of the archive layout.
+	SchemaVersion int            // Schema version of the tree.
+	User          users.UserSpec // User whose events are in the archive.
+	Time          time.Time      // When the archive was created.
+	Events        int            // Number of events.
+	Files         int            // Number of tree files, or 0 if unknown. A truncated archive is detected by it.
+}
+
+// Export writes a tar archive with all events of the user to w.
+// The archive holds a manifest and the files of the user's tree as stored,
+// so it can be restored by Import. To produce a compressed archive,
+// pass a gzip.Writer as w.
+func (s *Service) Export(ctx context.Context, w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.flush(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.ensureLoaded(ctx)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		// Hold the lock, so that other processes don't write in the middle of it.
+		unlock, err := s.lockStorage(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	var files []string
+	err = walkFiles(ctx, s.fs, eventsDir(s.user.UserSpec), func(name string) {
+		if name == generationPath(s.user.UserSpec) || strings.HasPrefix(path.Base(name), ".") {
+			// Skip the generation file, which is only relevant to processes
+			// sharing this storage, and temporary files.
+			return
+		}
+		files = append(files, name)
+	})
+	if os.IsNotExist(err) {
+		// No tree yet, nothing but the manifest to export.
+	} else if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	m := manifest{
+		Version:       archiveVersion,
+		SchemaVersion: schemaVersion,
+		User:          s.user.UserSpec,
+		Time:          time.Now().UTC(),
+		Events:        len(s.events),
+		Files:         len(files),
+	}
+	mb, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, manifestName, m.Time, bytes.NewReader(mb), int64(len(mb)))
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		err := exportFile(ctx, tw, s.fs, name, treePrefix+strings.TrimPrefix(name, eventsDir(s.user.UserSpec)+"/"))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// exportFile writes file at path in fs to tw, with the specified name.
+func exportFile(ctx context.Context, tw *tar.Writer, fs webdav.FileSystem, path, name string) error {
+	f, err := vfsutil.Open(ctx, fs, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, name, fi.ModTime(), f, fi.Size())
+}
+
+// writeTarFile writes a regular file with content from r of the specified size to tw.
+func writeTarFile(tw *tar.Writer, name string, modTime time.Time, r io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// Import replaces all events of the user with events from an archive
+// written by Export, read from r. r may be compressed with gzip.
+// The archive must be of the same user. If it was written with an older
+// schema version, it's upgraded. Afterwards, List returns the imported events.
+//
+// The archive is first extracted next to the user's tree, which is then
+// replaced with it, so that a malformed archive leaves the events as they were.
+//
+// A read-only service doesn't import events, it returns os.ErrPermission.
+func (s *Service) Import(ctx context.Context, r io.Reader) error {
+	if s.readOnly {
+		return os.ErrPermission
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Buffered events are replaced too, but write them first, so that storage
+	// is left with all events logged before Import if it fails.
+	err := s.flush(ctx)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		unlock, err := lock(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		// Count the import as a write before doing it, so that other processes
+		// reload even if it partially fails.
+		s.generation, err = readGeneration(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+		err = s.bumpGeneration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := eventsDir(s.user.UserSpec)
+	staging := dir + ".import"
+	err = s.fs.RemoveAll(ctx, staging)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = extractArchive(ctx, s.fs, tar.NewReader(r), s.user.UserSpec, staging)
+	if err == nil && s.format.aead != nil {
+		err = checkKey(ctx, s.fs, path.Join(staging, path.Base(keyPath(s.user.UserSpec))), s.format.aead, false)
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, staging)
+		return fmt.Errorf("importing archive: %v", err)
+	}
+
+	err = replaceTree(ctx, s.fs, dir, staging)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		// The imported tree has no generation file. Carry it over.
+		err := jsonEncodeFile(ctx, s.fs, generationPath(s.user.UserSpec), s.generation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.loadLocked(ctx)
+}
+
+// replaceTree replaces the tree in directory dir with the one in directory
+// staging, which is moved in its place. If that fails, dir is left as it was.
+func replaceTree(ctx context.Context, fs webdav.FileSystem, dir, staging string) error {
+	old := dir + ".old"
+	err := fs.RemoveAll(ctx, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = fs.Rename(ctx, dir, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = fs.Rename(ctx, staging, dir)
+	if err != nil {
+		fs.Rename(ctx, old, dir)
+		return err
+	}
+	err = fs.RemoveAll(ctx, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// extractArchive extracts the tree of user from archive tr into directory dir.
+func extractArchive(ctx context.Context, fs webdav.FileSystem, tr *tar.Reader, user users.UserSpec, dir string) error {
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return errors.New("archive is empty")
+	} else if err != nil {
+		return err
+	}
+	if hdr.Name != manifestName {
+		return fmt.Errorf("archive starts with %q, want %q", hdr.Name, manifestName)
+	}
+	var m manifest
+	err = json.NewDecoder(tr).Decode(&m)
+	if err != nil {
+		return fmt.Errorf("decoding manifest: %v", err)
+	}
+	if m.Version != archiveVersion {
+		return fmt.Errorf("archive has version %d, but only version %d is supported", m.Version, archiveVersion)
+	}
+	if m.SchemaVersion > schemaVersion {
+		return fmt.Errorf("archive has schema version %d, but only versions up to %d are supported", m.SchemaVersion, schemaVersion)
+	}
+	if m.User != user {
+		return fmt.Errorf("archive has events of user %v, not %v", m.User, user)
+	}
+
+	err = vfsutil.MkdirAll(ctx, fs, dir, defaultDirMode)
+	if err != nil {
+		return err
+	}
+	var files int // Number of tree files extracted.
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF && m.Files != 0 && files != m.Files {
+			return fmt.Errorf("archive has %d tree files, manifest says %d", files, m.Files)
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(name, treePrefix) {
+			return fmt.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+		err = writeFile(ctx, fs, path.Join(dir, strings.TrimPrefix(name, treePrefix)), true, func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		files++
+	}
+}
+
+// walkFiles calls fn with the path of every file in dir and its subdirectories.
+// If dir doesn't exist, the returned error satisfies os.IsNotExist.
+func walkFiles(ctx context.Context, fs webdav.FileSystem, dir string, fn func(path string)) error {
+	f, err := vfsutil.Open(ctx, fs, dir)
+	if err != nil {
+		return err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			err := walkFiles(ctx, fs, name, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fn(name)
+	}
+	return nil
+}
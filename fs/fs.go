@@ -4,82 +4,972 @@ package fs
 import (
 	"context"
 	"errors"
+	"fmt"
+	iofs "io/fs"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/shurcooL/events"
 	"github.com/shurcooL/events/event"
 	"github.com/shurcooL/users"
 	"golang.org/x/net/webdav"
 )
 
-// NewService creates a virtual filesystem-backed events.Service,
+// NewService creates a virtual filesystem-backed events service,
 // using root for storage. It logs and fetches events only for the specified user.
-func NewService(root webdav.FileSystem, user users.User, users users.Service) (events.Service, error) {
-	s := &service{
-		fs:    root,
-		user:  user,
-		users: users,
+//
+// If root was written with an older schema version, it's upgraded
+// to the current one. If root was previously written with a different ring size,
+// existing events are migrated to the configured ring size,
+// keeping as many of the latest events as fit.
+func NewService(root webdav.FileSystem, user users.User, users users.Service, opts ...Option) (*Service, error) {
+	return newService(root, user, users, false, opts)
+}
+
+// NewOSService creates an events service backed by the native filesystem,
+// using directory dir for storage. dir is created if it doesn't exist.
+// It behaves like NewService otherwise.
+//
+// Changes are synced to disk before they're reported to succeed:
+// an event is durable once Log returns without error.
+func NewOSService(dir string, user users.User, users users.Service, opts ...Option) (*Service, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, o.dirMode)
+	if err != nil {
+		return nil, err
 	}
-	err := s.load()
+	return newService(osFS{dir}, user, users, false, opts)
+}
+
+// NewReadOnlyService creates a read-only events service, using fsys for storage.
+// fsys must hold a tree written by a service created by NewService,
+// with the current schema version. It fetches events only for the specified user.
+//
+// The service lists events, but doesn't log them: Log returns os.ErrPermission.
+// Options apply as with NewService, except nothing is ever written to fsys.
+// In particular, a tree with a different ring size is read as is,
+// and events discarded by a retention policy are only left out of listings.
+func NewReadOnlyService(fsys iofs.FS, user users.User, opts ...Option) (*Service, error) {
+	return newService(readOnlyFS{fsys}, user, nil, true, opts)
+}
+
+func newService(root webdav.FileSystem, user users.User, users users.Service, readOnly bool, opts []Option) (*Service, error) {
+	o, err := newOptions(opts)
 	if err != nil {
 		return nil, err
 	}
+	s := &Service{
+		root:        root,
+		readOnly:    readOnly,
+		locking:     o.locking && !readOnly,
+		format:      o.format,
+		retention:   o.retention,
+		otherActors: o.otherActors,
+		maxBody:     o.maxBodyLength,
+		opts:        opts,
+		user:        user,
+		users:       users,
+	}
+	if !readOnly {
+		root = withPermissions(root, o.fileMode, o.dirMode)
+	}
+	if o.replica != nil && !readOnly {
+		replica := withPermissions(o.replica, o.fileMode, o.dirMode)
+		err := reconcileLocked(o.loadContext, root, replica, user.UserSpec, s.locking)
+		if err != nil {
+			return nil, err
+		}
+		root = withReplica(root, replica)
+	}
+	s.fs = root
+	s.store, err = newStore(root, user, o, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if !o.appendOnly && !o.jsonLines {
+		s.capacity, s.evict = o.ringSize, o.evict
+	}
+	if !o.lazy {
+		err = s.load(o.loadContext)
+		if err != nil && o.loadContext.Err() != nil {
+			// Report cancellation as is, rather than as the error it caused.
+			return nil, o.loadContext.Err()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if !readOnly && (o.bufferSize > 0 || o.flushInterval > 0) {
+		s.buffered, s.bufferSize, s.flushInterval = true, o.bufferSize, o.flushInterval
+	}
+	if o.refreshInterval > 0 {
+		s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+		go s.refreshEvery(o.refreshInterval)
+	}
 	return s, nil
 }
 
-type service struct {
-	mu     sync.Mutex
-	fs     webdav.FileSystem
-	ring   ring
-	events [ringSize]event.Event // Latest events are added to the end.
+// newStore returns the store for the storage mode configured by o.
+func newStore(root webdav.FileSystem, user users.User, o options, readOnly bool) (store, error) {
+	switch {
+	case o.appendOnly:
+		return &segmentStore{fs: root, user: user, format: o.format, readOnly: readOnly}, nil
+	case o.jsonLines:
+		format := o.format
+		format.enc = JSON
+		return &logStore{fs: root, user: user, format: format, readOnly: readOnly}, nil
+	default:
+		if o.ringSize < 1 {
+			return nil, fmt.Errorf("ring size must be positive, got %d", o.ringSize)
+		}
+		return &ringStore{fs: root, user: user, size: o.ringSize, format: o.format, readOnly: readOnly}, nil
+	}
+}
+
+// newOptions returns options configured by opts, with the format
+// of stored events set up.
+func newOptions(opts []Option) (options, error) {
+	o := options{ringSize: defaultRingSize, loadContext: context.Background(), fileMode: defaultFileMode, dirMode: defaultDirMode}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.format.enc != JSON && o.format.enc != CBOR {
+		return options{}, fmt.Errorf("unsupported encoding %v", o.format.enc)
+	}
+	if o.key != nil {
+		aead, err := newAEAD(o.key)
+		if err != nil {
+			return options{}, err
+		}
+		o.format.aead = aead
+	}
+	if o.retention.MaxAge < 0 || o.retention.MaxEvents < 0 {
+		return options{}, fmt.Errorf("retention limits must not be negative, got %+v", o.retention)
+	}
+	if o.otherActors < SkipOtherActors || o.otherActors > StoreOtherActors {
+		return options{}, fmt.Errorf("unsupported handling of other actors %d", int(o.otherActors))
+	}
+	if o.maxBodyLength < 0 {
+		return options{}, fmt.Errorf("maximum body length must not be negative, got %d", o.maxBodyLength)
+	}
+	if o.bufferSize < 0 || o.flushInterval < 0 {
+		return options{}, fmt.Errorf("buffered writes limits must not be negative, got %d events and %v", o.bufferSize, o.flushInterval)
+	}
+	if o.fileMode&^os.ModePerm != 0 || o.dirMode&^os.ModePerm != 0 {
+		return options{}, fmt.Errorf("permissions must only have permission bits, got %v and %v", o.fileMode, o.dirMode)
+	}
+	return o, nil
+}
+
+// Option configures a service created by NewService or NewReadOnlyService.
+// If multiple options select a storage mode, the last one applies.
+type Option func(*options)
+
+type options struct {
+	ringSize   int
+	evict      func(event.Event)
+	appendOnly bool
+	jsonLines  bool
+	retention  Retention
+	format     fileFormat
+	key        []byte
+	locking    bool
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	replica    webdav.FileSystem
+
+	refreshInterval time.Duration
+	loadContext     context.Context
+	lazy            bool
+
+	bufferSize    int
+	flushInterval time.Duration
+
+	otherActors   OtherActors
+	maxBodyLength int
+}
+
+// WithRingSize selects ring storage, which is the default,
+// and sets the maximum number of events that are kept.
+// Once it's reached, logging an event discards the oldest one.
+// The default is 100. Memory is only used for the events that are stored,
+// so a large ring that's mostly empty takes little of it.
+func WithRingSize(n int) Option {
+	return func(o *options) { o.ringSize, o.appendOnly, o.jsonLines = n, false, false }
+}
+
+// WithEvictHandler makes Log call h with each event that ring storage
+// is about to overwrite, oldest first, so that it can be archived elsewhere,
+// such as in a cold store. It's called before the event is removed
+// from storage, so if writing fails, it may be called with the same
+// event again by a later Log.
+//
+// h is called while the service is writing, so it mustn't call methods
+// of the service. With buffered writes, it's called when buffered events
+// are written. Events discarded by a retention policy, or because the ring
+// size was reduced since storage was last used, aren't passed to h.
+func WithEvictHandler(h func(event.Event)) Option {
+	return func(o *options) { o.evict = h }
+}
+
+// WithAppendOnly selects append-only storage, which keeps all events.
+// Events are appended to segment files, and are never overwritten.
+// Segment files are in directories by year and month of their events,
+// so that each directory stays small.
+//
+// If root has no events in append-only storage but has events in ring storage,
+// those events are copied into append-only storage.
+func WithAppendOnly() Option {
+	return func(o *options) { o.appendOnly, o.jsonLines = true, false }
+}
+
+// WithJSONLines selects JSON Lines storage, which keeps all events,
+// like append-only storage, in far fewer files. Events are appended
+// to a log file, which holds them as JSON, one per line, and is rotated
+// once it holds 10000 events. Logging an event or loading events takes
+// only a few filesystem operations, which matters for network-backed
+// filesystems, such as WebDAV, where each one is a round-trip.
+// In exchange, removing an event rewrites the log file with it.
+//
+// Events are always encoded as JSON, regardless of WithEncoding.
+// WithGzip and WithEncryption apply to log files, which then need to be
+// decompressed or decrypted to be read as JSON Lines.
+//
+// If root has no events in JSON Lines storage, events in append-only
+// storage, or if there are none, in ring storage, are copied into it.
+func WithJSONLines() Option {
+	return func(o *options) { o.jsonLines, o.appendOnly = true, false }
+}
+
+// WithEncoding sets the encoding used for storing events. The default is JSON.
+// Index, ring and version files are always stored as JSON.
+//
+// Events already stored in another encoding are still read.
+// They're left as is, and newly logged events are stored in enc.
+func WithEncoding(enc Encoding) Option {
+	return func(o *options) { o.format.enc = enc }
+}
+
+// WithGzip sets whether stored event files are compressed with gzip.
+// The default is not to compress them.
+//
+// Compressed and uncompressed files are both read, regardless of this option.
+// Existing files are left as is, and newly logged events are stored
+// compressed or not, as configured.
+func WithGzip(compress bool) Option {
+	return func(o *options) { o.format.gzip = compress }
+}
+
+// WithEncryption makes the service encrypt event files with key,
+// using AES-GCM. key must be 16, 24 or 32 bytes long, for AES-128,
+// AES-192 or AES-256. The default is not to encrypt them.
+//
+// Only the content of event, segment and log files is encrypted, so file names,
+// and the index, ring and other files, which hold no event content beyond
+// event times and IDs, stay readable. Encrypted and unencrypted files are
+// both read. Existing files are left as is, and newly logged events are
+// stored encrypted. A key file, encrypted with key, is stored too, so that
+// using a different key later is reported as an error, rather than making
+// encrypted events seem corrupt.
+func WithEncryption(key []byte) Option {
+	return func(o *options) { o.key = key }
+}
+
+// WithLocking makes the service safe to use when its storage is shared
+// with services in other processes. Writes are done while holding a lock
+// on storage, and events written by other processes since the service
+// last wrote are loaded before it writes again.
+//
+// Advisory file locks are used for the lock when storage supports them,
+// as it does on Unix with NewOSService. Otherwise, a lock file is created
+// for the duration of each write, and is rewritten every 15 seconds
+// while it's held. A lock file that's not been modified for a minute
+// is considered left behind by a process that exited while holding it,
+// and is removed. All processes sharing storage must access it the same way,
+// either via NewOSService or not.
+//
+// Read-only services don't write, so they don't lock.
+func WithLocking() Option {
+	return func(o *options) { o.locking = true }
+}
+
+// WithPermissions sets the permissions of files and directories
+// the service creates, which are 0600 and 0700 by default, so that only
+// the owner can access them. For example, WithPermissions(0640, 0750)
+// lets the group read the tree, such as a read-only web process that
+// serves it with NewReadOnlyService.
+//
+// The umask of the process still applies, as with os.OpenFile, so
+// WithPermissions(0666, 0777) leaves permissions up to the umask.
+// Existing files keep their permissions until they're rewritten.
+func WithPermissions(file, dir os.FileMode) Option {
+	return func(o *options) { o.fileMode, o.dirMode = file, dir }
+}
+
+// WithReplica makes the service mirror every write to storage to replica,
+// which ends up with a copy of the tree, such as on a different disk or
+// a network-backed filesystem, so that events survive losing root.
+// Reads are only done from root, and locks are only held in root.
+//
+// Failing to write to replica doesn't fail writes to root. Instead,
+// the service brings replica up to date when it's created: files that
+// are missing from replica or differ are copied over, and ones that
+// aren't in root are removed from it. If root has no tree of the user
+// but replica does, the tree is copied from replica into root instead.
+// This takes reading the tree from both, apart from event files,
+// which are never overwritten.
+//
+// Read-only services don't write, so they don't use replica.
+func WithReplica(replica webdav.FileSystem) Option {
+	return func(o *options) { o.replica = replica }
+}
+
+// WithRefreshInterval makes the service call Refresh every d, so that it
+// picks up changes to storage. It's for storage that's changed by
+// something other than the service, such as another process or a file
+// synchronization tool. Services created with this option must be closed
+// with Close when they're no longer needed.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(o *options) { o.refreshInterval = d }
+}
+
+// WithBufferedWrites makes Log buffer events in memory, and write them
+// to storage together, once n events are buffered, or d after the first
+// of them was logged, whichever comes first. Writing many events together
+// is much cheaper than writing them one by one: the index file is updated
+// once, and append-only and JSON Lines storage append to a file once.
+// Zero n or d means there's no such limit. Flush writes buffered events
+// right away. Close and the other methods that write do so too.
+//
+// Buffered events are listed, like written ones. However, they're lost
+// if the process exits before they're written, and errors writing them
+// are only reported by the call that writes them. A failed write is retried
+// by the next one. Services created with this option must be closed with
+// Close when they're no longer needed.
+func WithBufferedWrites(n int, d time.Duration) Option {
+	return func(o *options) { o.bufferSize, o.flushInterval = n, d }
+}
+
+// WithLoadContext sets the context used for loading events when the service
+// is created, which may take a while for large storage. If ctx is done
+// before loading finishes, creating the service fails with ctx.Err().
+// The default is context.Background().
+func WithLoadContext(ctx context.Context) Option {
+	return func(o *options) { o.loadContext = ctx }
+}
+
+// WithLazyLoad makes the service load events the first time they're needed,
+// rather than when it's created, and keep them loaded from then on,
+// unless they're unloaded with Unload.
+// Creating the service doesn't access storage, so services for many users,
+// most of which are idle, start quickly and don't hold idle users' events
+// in memory. Errors loading events, and upgrading storage, are returned
+// by the first method that needs them. WithLoadContext doesn't apply.
+//
+// Refresh, and so WithRefreshInterval, does nothing until events are loaded.
+func WithLazyLoad() Option {
+	return func(o *options) { o.lazy = true }
+}
+
+// Retention is a policy for discarding old events.
+// Zero value keeps all events.
+type Retention struct {
+	MaxAge    time.Duration // Events with Time older than MaxAge are discarded. Zero means no limit.
+	MaxEvents int           // Only the latest MaxEvents events are kept. Zero means no limit.
+}
+
+// WithRetention sets a retention policy. It's applied when the service
+// is created and after every logged event, and works with all storage modes.
+// Ring storage additionally never keeps more events than the ring size.
+//
+// Events are discarded oldest first. An old event isn't discarded by MaxAge
+// while an earlier logged event is still within MaxAge.
+//
+// Append-only and JSON Lines storage remove a segment or log file once all of
+// its events are discarded, but may leave some discarded events at the start
+// of a segment or log file in place for a while. If a later retention policy is less strict, those events come back.
+func WithRetention(r Retention) Option {
+	return func(o *options) { o.retention = r }
+}
+
+// OtherActors is how Log handles events whose actor isn't the user
+// the service is for.
+type OtherActors int
+
+const (
+	// SkipOtherActors skips such events: Log returns nil without
+	// storing them. It's the default.
+	SkipOtherActors OtherActors = iota
+
+	// RejectOtherActors makes Log return an error for such events.
+	RejectOtherActors
+
+	// StoreOtherActors stores such events in the tree of their actor
+	// in the same root, the same as a service for that user with the same
+	// options would. Only the user of the service needs to be authenticated.
+	StoreOtherActors
+)
+
+// WithOtherActors sets how Log and ImportJSONLines handle events
+// whose actor isn't the user of the service.
+func WithOtherActors(oa OtherActors) Option {
+	return func(o *options) { o.otherActors = oa }
+}
+
+// WithMaxBodyLength makes Log and ImportJSONLines truncate the bodies
+// of issue and change events, Issue.IssueBody and Change.ChangeBody,
+// to at most n bytes, so that long descriptions don't take up storage.
+// Bodies are cut at a UTF-8 character boundary. References in a change body
+// are kept. Zero n, the default, means bodies aren't truncated.
+// Events already stored are left as is.
+func WithMaxBodyLength(n int) Option {
+	return func(o *options) { o.maxBodyLength = n }
+}
+
+// Service is a virtual filesystem-backed events service.
+// It implements events.Service.
+type Service struct {
+	mu        sync.Mutex   // Serializes access to storage. Held during file I/O.
+	memMu     sync.RWMutex // Guards events, base, index, pending and corrupt. They're changed only while holding mu too.
+	fs        webdav.FileSystem
+	readOnly  bool // Whether nothing is to be written to fs.
+	locking   bool // Whether writes are done holding the storage lock.
+	store     store
+	format    fileFormat // Format events are stored in.
+	capacity  int        // Maximum number of events kept, or 0 if unlimited.
+	retention Retention
+	events    []event.Event // Latest events are added to the end.
+	base      int           // Sequence number of events[0]. Sequence numbers start at 0 for each load.
+
+	index      timeIndex
+	indexDirty bool // Whether the index file needs to be rewritten.
+
+	// ids maps IDs of events to their sequence numbers. It may have stale
+	// entries for events that were discarded, see stored. Only used while holding mu.
+	ids map[string]int
+
+	corrupt []*CorruptionError // Corrupt files found by the last load.
+
+	evict func(event.Event) // Called with events about to be overwritten, when capacity isn't 0. May be nil.
+
+	generation int // Generation of storage last loaded or written. Only used when locking.
+
+	loaded atomic.Bool // Whether events are loaded. Only set while holding mu.
+
+	bufferSize    int           // Number of buffered events that are written together, or 0 if unlimited.
+	flushInterval time.Duration // How long events are buffered at most, or 0 if unlimited.
+	buffered      bool          // Whether s buffers writes.
+	pending       []event.Event // Buffered events not yet written, oldest first.
+	flushTimer    *time.Timer   // Flushes pending events. Nil if not running.
+
+	stop      chan struct{} // Closed to stop refreshing. Nil if s isn't refreshed periodically.
+	stopped   chan struct{} // Closed once refreshing has stopped.
+	closeOnce sync.Once
+
+	maxBody int // Maximum length of issue and change bodies, in bytes, or 0 if unlimited.
+
+	otherActors OtherActors
+	root        webdav.FileSystem           // Filesystem s was created with, for creating services for other actors.
+	opts        []Option                    // Options s was created with, for the same.
+	othersMu    sync.Mutex                  // Guards others.
+	others      map[users.UserSpec]*Service // Services for other actors, with StoreOtherActors.
 
 	user  users.User
 	users users.Service
 }
 
-func (s *service) load() error {
-	err := jsonDecodeFile(context.Background(), s.fs, ringPath(s.user.UserSpec), &s.ring)
-	if os.IsNotExist(err) {
-		s.ring = ring{}
-	} else if err != nil {
+func (s *Service) load(ctx context.Context) error {
+	if s.locking {
+		unlock, err := lock(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	err := s.loadLocked(ctx)
+	if err != nil {
 		return err
 	}
-	for i := 0; i < s.ring.Length; i++ {
-		idx := s.ring.At(i)
-		var event eventDisk
-		err := jsonDecodeFile(context.Background(), s.fs, eventPath(s.user.UserSpec, idx), &event)
+	if s.locking {
+		// Loading may have written to storage, by upgrading it.
+		// Count that as a write, so that other processes reload.
+		return s.bumpGeneration(ctx)
+	}
+	return nil
+}
+
+// loadLocked loads events from storage into s, replacing any loaded before.
+// The storage lock must be held, if s uses it.
+// s.mu must be held, unless s is still being created.
+func (s *Service) loadLocked(ctx context.Context) error {
+	var err error
+	if s.readOnly {
+		err = checkVersion(ctx, s.fs, s.user.UserSpec)
+	} else {
+		err = upgrade(ctx, s.fs, s.user.UserSpec, s.format.aead)
+	}
+	if err != nil {
+		return err
+	}
+	if s.format.aead != nil {
+		err := checkKey(ctx, s.fs, keyPath(s.user.UserSpec), s.format.aead, !s.readOnly)
 		if err != nil {
 			return err
 		}
-		s.events[idx] = event.Event(s.user)
 	}
+	events, err := s.store.load(ctx)
+	if err != nil {
+		return err
+	}
+	index, ok := loadIndex(ctx, s.fs, s.user.UserSpec, events, 0)
+	s.memMu.Lock()
+	s.events, s.base, s.index = events, 0, index
+	s.corrupt = s.store.corruption()
+	s.memMu.Unlock()
+	s.buildIDs()
+	s.indexDirty = !ok
+	if s.locking {
+		s.generation, err = readGeneration(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.compact(ctx)
+	if err != nil {
+		return err
+	}
+	s.saveIndex(ctx, false)
+	s.loaded.Store(true)
 	return nil
 }
 
-// List lists events.
-func (s *service) List(_ context.Context) ([]event.Event, error) {
-	var events []event.Event
+// ensureLoaded loads events, unless they were already loaded.
+// s.mu must be held.
+func (s *Service) ensureLoaded(ctx context.Context) error {
+	if s.loaded.Load() {
+		return nil
+	}
+	return s.load(ctx)
+}
+
+// ensureListable loads events, unless they were already loaded,
+// for listing them.
+func (s *Service) ensureListable(ctx context.Context) error {
+	if s.loaded.Load() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ensureLoaded(ctx)
+}
+
+// lockStorage acquires the storage lock, and reloads events
+// if another process wrote to storage since s last did.
+// The returned function releases the lock.
+// s.mu must be held.
+func (s *Service) lockStorage(ctx context.Context) (unlock func(), err error) {
+	unlock, err = lock(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return nil, err
+	}
+	g, err := readGeneration(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if g != s.generation {
+		err := s.loadLocked(ctx)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// bumpGeneration records that s wrote to storage.
+// The storage lock must be held.
+func (s *Service) bumpGeneration(ctx context.Context) error {
+	err := jsonEncodeFile(ctx, s.fs, generationPath(s.user.UserSpec), s.generation+1)
+	if err != nil {
+		return err
+	}
+	s.generation++
+	return nil
+}
+
+// compact discards events that aren't kept by the retention policy,
+// from storage and from memory.
+// s.mu must be held, unless s is still being created.
+func (s *Service) compact(ctx context.Context) error {
+	var n int // Number of oldest events to discard.
+	if s.retention.MaxEvents != 0 && len(s.events) > s.retention.MaxEvents {
+		n = len(s.events) - s.retention.MaxEvents
+	}
+	if s.retention.MaxAge != 0 {
+		cutoff := time.Now().Add(-s.retention.MaxAge)
+		for n < len(s.events) && s.events[n].Time.Before(cutoff) {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if s.locking {
+		err := s.bumpGeneration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if !s.readOnly {
+		err := s.store.prune(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	s.discard(n)
+	return nil
+}
+
+// discard discards the oldest n events from memory.
+// s.mu must be held, unless s is still being created.
+func (s *Service) discard(n int) {
+	s.memMu.Lock()
+	defer s.memMu.Unlock()
+	for i := range s.events[:n] {
+		s.events[i] = event.Event{} // Let go of discarded events.
+	}
+	// Slice off discarded events, rather than move the rest, which would
+	// take time proportional to the ring size for each logged event.
+	// The unused start of the array is let go of once append allocates
+	// a new one, so it takes no more space than the events in use.
+	s.events = s.events[n:]
+	s.base += n
+	s.index.discard(s.base)
+	s.indexDirty = true
+}
+
+// buildIDs rebuilds s.ids from events.
+// s.mu must be held, unless s is still being created.
+func (s *Service) buildIDs() {
+	s.ids = make(map[string]int, len(s.events))
+	for i, e := range s.events {
+		s.ids[e.ID] = s.base + i
+	}
+}
+
+// stored reports whether an event with the specified ID is stored.
+// s.mu must be held.
+func (s *Service) stored(id string) bool {
+	// Entries of discarded events are left in s.ids, rather than removed
+	// for each discarded event, so check the entry is still current.
+	seq, ok := s.ids[id]
+	return ok && seq >= s.base && seq-s.base < len(s.events) && s.events[seq-s.base].ID == id
+}
+
+// dedup returns events without the ones whose ID is already stored,
+// and without repeats of an ID within events. It doesn't modify events.
+// s.mu must be held.
+func (s *Service) dedup(events []event.Event) []event.Event {
+	kept := events[:0:0]
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if s.stored(e.ID) || seen[e.ID] {
+			continue
+		}
+		seen[e.ID] = true
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// saveIndex updates the index file. If appended is true and the index file
+// is otherwise up to date, it's updated by appending the last index entry.
+//
+// The index file can always be rebuilt from events, so failing to update it
+// isn't treated as an error. It's rewritten by a later call instead.
+// s.mu must be held, unless s is still being created.
+func (s *Service) saveIndex(ctx context.Context, appended bool) {
+	if s.readOnly {
+		return
+	}
+	if !s.indexDirty && appended {
+		err := jsonAppendFile(ctx, s.fs, indexPath(s.user.UserSpec), s.index[len(s.index)-1])
+		s.indexDirty = err != nil
+		return
+	} else if !s.indexDirty {
+		return
+	}
+	err := writeIndex(ctx, s.fs, s.user.UserSpec, s.index)
+	s.indexDirty = err != nil
+}
+
+// CorruptionError records corrupt data found in a file in storage.
+type CorruptionError struct {
+	Path string // Path of the file in storage.
+	Err  error  // What's wrong with the data.
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupt: %v", e.Path, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+// Corruption reports corrupt files found when events were last loaded.
+//
+// Every event is stored with a checksum, which is verified when it's loaded.
+// A corrupt event doesn't fail loading. Instead, it's skipped, along with
+// any events after it in the same file that can't be read because of it,
+// and reported here. Other events are loaded as usual. Corrupt data is
+// left in storage, unless rewriting a file for another reason drops it.
+func (s *Service) Corruption() []*CorruptionError {
+	s.memMu.RLock()
+	defer s.memMu.RUnlock()
+	return s.corrupt
+}
+
+// Refresh reloads events from storage if it was changed by something other
+// than s since s last loaded or wrote them, such as another process or a file
+// synchronization tool. Afterwards, List returns the reloaded events.
+//
+// For ring storage, a change is detected when event files are added or removed.
+// For append-only and JSON Lines storage, it's detected when segment
+// or log files are added or removed, or the last one changes.
+func (s *Service) Refresh(ctx context.Context) error {
 	s.mu.Lock()
-	for i := s.ring.Length - 1; i >= 0; i-- { // Reverse order to get latest events first.
-		events = append(events, s.events[s.ring.At(i)])
+	defer s.mu.Unlock()
+	if !s.loaded.Load() {
+		// The events will be freshly loaded when first needed.
+		return nil
 	}
+	if s.locking {
+		// This reloads events if another process that uses locking wrote them.
+		unlock, err := s.lockStorage(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	changed, err := s.store.changed(ctx)
+	if err != nil || !changed {
+		return err
+	}
+	return s.loadLocked(ctx)
+}
+
+// refreshEvery calls Refresh every d, until s is closed.
+// Errors are ignored, a later call tries again.
+func (s *Service) refreshEvery(d time.Duration) {
+	defer close(s.stopped)
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			_ = s.Refresh(context.Background())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing events periodically, if s does that,
+// and writes buffered events, if any. Services for other actors,
+// with StoreOtherActors, are closed too.
+// It's safe to call more than once. Afterwards, s can still be used.
+func (s *Service) Close() error {
+	if s.stop != nil {
+		s.closeOnce.Do(func() { close(s.stop) })
+		<-s.stopped
+	}
+	err := s.Flush(context.Background())
+	for _, other := range s.otherServices() {
+		if closeErr := other.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Unload writes buffered events, if any, and lets go of events held
+// in memory, so that the service of an idle user takes little memory.
+// Events are loaded again the first time they're needed, as with
+// WithLazyLoad, which picks up any changes to storage made meanwhile.
+// Refresh does nothing until then. Services for other actors,
+// with StoreOtherActors, are unloaded too.
+//
+// A server with services for many users can keep memory use bounded,
+// however large their ring sizes, by unloading the ones that were used
+// least recently.
+func (s *Service) Unload(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.unload(ctx)
 	s.mu.Unlock()
+	for _, other := range s.otherServices() {
+		if unloadErr := other.Unload(ctx); err == nil {
+			err = unloadErr
+		}
+	}
+	return err
+}
+
+// unload lets go of events held in memory, after writing pending ones.
+// s.mu must be held.
+func (s *Service) unload(ctx context.Context) error {
+	if !s.loaded.Load() {
+		return nil
+	}
+	err := s.flush(ctx)
+	if err != nil {
+		return err
+	}
+	s.saveIndex(ctx, false)
+	s.memMu.Lock()
+	s.events, s.index, s.corrupt = nil, nil, nil
+	s.indexDirty = false
+	s.memMu.Unlock()
+	s.ids = nil
+	s.loaded.Store(false)
+	return nil
+}
+
+// other returns the service for storing events of actor, with StoreOtherActors.
+// It's created the first time it's needed.
+func (s *Service) other(actor users.User) (*Service, error) {
+	s.othersMu.Lock()
+	defer s.othersMu.Unlock()
+	if other, ok := s.others[actor.UserSpec]; ok {
+		return other, nil
+	}
+	other, err := newService(s.root, actor, s.users, false, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	if s.others == nil {
+		s.others = make(map[users.UserSpec]*Service)
+	}
+	s.others[actor.UserSpec] = other
+	return other, nil
+}
+
+// otherServices returns the services for other actors created so far.
+func (s *Service) otherServices() []*Service {
+	s.othersMu.Lock()
+	defer s.othersMu.Unlock()
+	var others []*Service
+	for _, other := range s.others {
+		others = append(others, other)
+	}
+	return others
+}
+
+// otherActorError is the error for an event of actor,
+// with RejectOtherActors.
+func (s *Service) otherActorError(actor users.UserSpec) error {
+	return fmt.Errorf("event actor %s isn't the user of the service, %s", marshalUserSpec(actor), marshalUserSpec(s.user.UserSpec))
+}
+
+// List lists events.
+// It doesn't wait for writes to storage in progress, such as those
+// done by Log or Refresh, but lists events as they were before them.
+func (s *Service) List(ctx context.Context) ([]event.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.ensureListable(ctx); err != nil {
+		return nil, err
+	}
+	var events []event.Event
+	s.memMu.RLock()
+	for i := len(s.pending) - 1; i >= 0; i-- { // Buffered events were logged last.
+		events = append(events, s.pending[i])
+	}
+	for i := len(s.events) - 1; i >= 0; i-- { // Reverse order to get latest events first.
+		events = append(events, s.events[i])
+	}
+	s.memMu.RUnlock()
+	if s.capacity != 0 && len(events) > s.capacity {
+		// Writing buffered events will discard the oldest ones.
+		events = events[:s.capacity]
+	}
+	return events, nil
+}
+
+// ListRange lists events with Time in the [since, until) range, latest first.
+// Zero until means there's no upper bound.
+// Like List, it doesn't wait for writes to storage in progress.
+func (s *Service) ListRange(ctx context.Context, since, until time.Time) ([]event.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.ensureListable(ctx); err != nil {
+		return nil, err
+	}
+	var events []event.Event
+	s.memMu.RLock()
+	for i := len(s.pending) - 1; i >= 0; i-- { // Buffered events were logged last.
+		if e := s.pending[i]; !e.Time.Before(since) && (until.IsZero() || e.Time.Before(until)) {
+			events = append(events, e)
+		}
+	}
+	buffered := len(events)
+	lo, hi := s.index.search(since, until)
+	for i := hi - 1; i >= lo; i-- { // Reverse order to get latest events first.
+		events = append(events, s.events[s.index[i].seq-s.base])
+	}
+	if buffered > 0 {
+		// Buffered events aren't indexed, so sort them in.
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+	}
+	s.memMu.RUnlock()
 	return events, nil
 }
 
 // Log logs the event.
 // event.Time time zone must be UTC.
-func (s *service) Log(ctx context.Context, event event.Event) error {
+// Malformed events, as reported by event.Validate, are rejected.
+// Issue and change bodies are truncated if WithMaxBodyLength is set.
+//
+// If event.ID is empty, a new ULID is generated for it. Otherwise,
+// if an event with the same ID is already stored, or buffered to be,
+// the event isn't logged again. That makes it safe to retry logging
+// an event, such as one delivered by a webhook more than once.
+// Afterwards, events that aren't kept by the retention policy are discarded.
+// With buffered writes, that's done once the event is written,
+// as described by WithBufferedWrites.
+//
+// Events whose actor isn't the user of s are skipped, unless
+// WithOtherActors sets otherwise.
+//
+// A read-only service doesn't log events, it returns os.ErrPermission.
+func (s *Service) Log(ctx context.Context, event event.Event) error {
+	if s.readOnly {
+		return os.ErrPermission
+	}
 	if event.Time.Location() != time.UTC {
 		return errors.New("event.Time time zone must be UTC")
 	}
 
-	if event.Actor.UserSpec != s.user.UserSpec {
-		// Skip other users.
-		return nil
+	other := event.Actor.UserSpec != s.user.UserSpec
+	if other {
+		switch s.otherActors {
+		case SkipOtherActors:
+			return nil
+		case RejectOtherActors:
+			return s.otherActorError(event.Actor.UserSpec)
+		}
 	}
+	if err := event.Validate(); err != nil {
+		return err
+	}
+	event = truncateBody(event, s.maxBody)
 
 	authenticatedSpec, err := s.users.GetAuthenticatedSpec(ctx)
 	if err != nil {
@@ -89,24 +979,268 @@ func (s *service) Log(ctx context.Context, event event.Event) error {
 		return os.ErrPermission
 	}
 
+	if event.ID == "" {
+		event.ID, err = newID(event.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	if other {
+		o, err := s.other(event.Actor)
+		if err != nil {
+			return err
+		}
+		return o.log(ctx, event)
+	}
+	return s.log(ctx, event)
+}
+
+// truncateBody returns e with its issue or change body truncated
+// to at most n bytes, as described by WithMaxBodyLength.
+func truncateBody(e event.Event, n int) event.Event {
+	switch p := e.Payload.(type) {
+	case event.Issue:
+		p.IssueBody = truncate(p.IssueBody, n)
+		e.Payload = p
+	case event.Change:
+		p.ChangeBody = truncate(p.ChangeBody, n)
+		e.Payload = p
+	}
+	return e
+}
+
+// truncate returns s cut to at most n bytes at a character boundary,
+// or s as is if n is zero.
+func truncate(s string, n int) string {
+	if n == 0 || len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// log logs the valid event, which has an ID, without checking
+// whether logging it is permitted.
+func (s *Service) log(ctx context.Context, event event.Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ring, idx := s.ring.Next()
+	if s.buffered {
+		if s.stored(event.ID) {
+			return nil
+		}
+		for _, e := range s.pending {
+			if e.ID == event.ID {
+				return nil
+			}
+		}
+		s.memMu.Lock()
+		s.pending = append(s.pending, event)
+		s.memMu.Unlock()
+		if s.bufferSize > 0 && len(s.pending) >= s.bufferSize {
+			return s.flush(ctx)
+		}
+		if s.flushTimer == nil && s.flushInterval > 0 {
+			s.flushTimer = time.AfterFunc(s.flushInterval, func() { _ = s.Flush(context.Background()) })
+		}
+		return nil
+	}
+	_, err := s.write(ctx, event)
+	return err
+}
+
+// Flush writes events logged in buffered write mode that aren't written yet,
+// including those of services for other actors, with StoreOtherActors.
+// Without buffered write mode, it does nothing.
+func (s *Service) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.flush(ctx)
+	s.mu.Unlock()
+	for _, other := range s.otherServices() {
+		if flushErr := other.Flush(ctx); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// flush writes pending events. If that fails, they're kept pending,
+// and writing them is retried by the next flush.
+// s.mu must be held.
+func (s *Service) flush(ctx context.Context) error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+	_, err := s.write(ctx, s.pending...)
+	if err != nil {
+		if s.flushInterval > 0 {
+			s.flushTimer = time.AfterFunc(s.flushInterval, func() { _ = s.Flush(context.Background()) })
+		}
+		return err
+	}
+	s.memMu.Lock()
+	s.pending = nil
+	s.memMu.Unlock()
+	return nil
+}
+
+// write writes events, oldest first, after all existing events,
+// to storage and to memory, and returns how many were written.
+// Events whose ID is already stored are skipped, as are repeats
+// of an ID within events. Afterwards, events that aren't kept
+// by the retention policy are discarded.
+// s.mu must be held.
+func (s *Service) write(ctx context.Context, events ...event.Event) (int, error) {
+	err := s.ensureLoaded(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if s.locking {
+		unlock, err := s.lockStorage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
+	// Check for events already stored after reloading,
+	// since another process may have stored them.
+	events = s.dedup(events)
+	if len(events) == 0 {
+		return 0, nil
+	}
+	if s.locking {
+		// Count the write before doing it, so that other processes
+		// reload even if it partially fails.
+		err = s.bumpGeneration(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if s.evict != nil {
+		s.evictOldest(events)
+	}
 
 	// Commit to storage first, returning error on failure.
-	// Write the event file, then write the ring file, so that partial failure is less bad.
-	err = jsonEncodeFileWithMkdirAll(ctx, s.fs, eventPath(s.user.UserSpec, idx), fromEvent(event))
+	dropped, err := s.store.append(ctx, events...)
+	if err != nil {
+		return 0, err
+	}
+
+	// Commit to memory second.
+	s.memMu.Lock()
+	for _, e := range events {
+		s.events = append(s.events, e)
+		atEnd := s.index.insert(indexEntry{Time: e.Time, ID: e.ID, seq: s.base + len(s.events) - 1})
+		if !atEnd || len(events) > 1 {
+			// Many index entries may be added, so rewrite the index file,
+			// rather than append to it.
+			s.indexDirty = true
+		}
+	}
+	s.memMu.Unlock()
+	for i, e := range events {
+		s.ids[e.ID] = s.base + len(s.events) - len(events) + i
+	}
+	if dropped > 0 {
+		// The store overwrote the oldest events.
+		s.discard(dropped)
+	}
+	if len(s.ids) > 2*len(s.events)+100 {
+		// Let go of entries of discarded events.
+		s.buildIDs()
+	}
+
+	err = s.compact(ctx)
+	s.saveIndex(ctx, true)
+	return len(events), err
+}
+
+// evictOldest calls s.evict with the events that storing events is
+// about to overwrite: the oldest ones, which may include some of events
+// if there are more of them than fit.
+func (s *Service) evictOldest(events []event.Event) {
+	n := len(s.events) + len(events) - s.capacity
+	for i := 0; i < n && i < len(s.events); i++ {
+		s.evict(s.events[i])
+	}
+	for i := 0; i < n-len(s.events); i++ {
+		s.evict(events[i])
+	}
+}
+
+// Delete deletes the event with the specified ID from storage.
+// If there's no such event, the returned error satisfies os.IsNotExist.
+//
+// A read-only service doesn't delete events, it returns os.ErrPermission.
+func (s *Service) Delete(ctx context.Context, id string) error {
+	if s.readOnly {
+		return os.ErrPermission
+	}
+	authenticatedSpec, err := s.users.GetAuthenticatedSpec(ctx)
+	if err != nil {
+		return err
+	}
+	if authenticatedSpec != s.user.UserSpec {
+		return os.ErrPermission
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.flush(ctx)
 	if err != nil {
 		return err
 	}
-	err = jsonEncodeFile(ctx, s.fs, ringPath(s.user.UserSpec), ring)
+	err = s.ensureLoaded(ctx)
+	if err != nil {
+		return err
+	}
+
+	if s.locking {
+		unlock, err := s.lockStorage(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		err = s.bumpGeneration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	i := -1
+	for j := range s.events {
+		if s.events[j].ID == id {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		return &os.PathError{Op: "delete", Path: id, Err: os.ErrNotExist}
+	}
+
+	// Commit to storage first, returning error on failure.
+	err = s.store.remove(ctx, i)
 	if err != nil {
 		return err
 	}
 
 	// Commit to memory second.
-	s.events[idx] = event
-	s.ring = ring
+	s.memMu.Lock()
+	copy(s.events[i:], s.events[i+1:])
+	s.events[len(s.events)-1] = event.Event{} // Let go of deleted event.
+	s.events = s.events[:len(s.events)-1]
+	s.index = buildIndex(s.events, s.base)
+	s.memMu.Unlock()
+	s.buildIDs() // Sequence numbers of later events changed.
+	s.indexDirty = true
+	s.saveIndex(ctx, false)
 	return nil
 }
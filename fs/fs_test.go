@@ -1,13 +1,28 @@
 package fs_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"dmitri.shuralyov.com/state"
+	"github.com/shurcooL/events"
 	"github.com/shurcooL/events/event"
 	"github.com/shurcooL/events/fs"
 	"github.com/shurcooL/users"
@@ -39,12 +54,3398 @@ func Test(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Log should've assigned IDs to events that didn't have one.
+	for i := range got {
+		if got[i].ID == "" {
+			t.Errorf("List: event %d has empty ID", i)
+		}
+		got[i].ID = ""
+	}
 	want := []event.Event{mockEvents[2], mockEvents[1], mockEvents[0]}
 	if !reflect.DeepEqual(got, want) {
 		t.Error("List: got != want")
 	}
 }
 
+// TestReload tests that events of every payload type
+// survive being written to and read back from storage.
+func TestReload(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range allPayloadsEvents {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a new service using the same storage, so events get loaded from it.
+	s, err = fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(allPayloadsEvents) {
+		t.Fatalf("List: got %d events, want %d", len(got), len(allPayloadsEvents))
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("List: event %d (%s):\ngot:  %+v\nwant: %+v", i, want[i].Payload.EventType(), got[i], want[i])
+		}
+	}
+}
+
+// TestSchemaCoverage tests that allPayloadsEvents has an event of every
+// payload type in the event package, with every field populated by one
+// of them, so that TestReload fails when the schema doesn't cover one.
+func TestSchemaCoverage(t *testing.T) {
+	var types []string // Names of payload types.
+	for _, p := range event.PayloadTypes() {
+		types = append(types, p.EventType())
+	}
+	unpopulated := make(map[string][]string) // Fields of each payload type that no event populates.
+	for _, e := range allPayloadsEvents {
+		typ := e.Payload.EventType()
+		zero := zeroFields(reflect.ValueOf(e.Payload), typ)
+		if prev, ok := unpopulated[typ]; ok {
+			zero = intersect(prev, zero)
+		}
+		unpopulated[typ] = zero
+	}
+	for _, typ := range types {
+		zero, ok := unpopulated[typ]
+		if !ok {
+			t.Errorf("allPayloadsEvents has no %s payload", typ)
+		} else if len(zero) > 0 {
+			t.Errorf("allPayloadsEvents has no %s payload with fields %v populated", typ, zero)
+		}
+	}
+}
+
+// intersect returns the elements of a that are also in b.
+func intersect(a, b []string) []string {
+	var r []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				r = append(r, x)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// zeroFields returns the paths of fields in v, which is named name,
+// that have zero values, including fields of nested structs and of
+// the first element of slices. Only the UserSpec, Login and AvatarURL
+// fields of users are considered, since payloads populate only those.
+func zeroFields(v reflect.Value, name string) []string {
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			break
+		}
+		if u, ok := v.Interface().(users.User); ok {
+			return zeroFields(reflect.ValueOf(struct {
+				UserSpec  users.UserSpec
+				Login     string
+				AvatarURL string
+			}{u.UserSpec, u.Login, u.AvatarURL}), name)
+		}
+		var zero []string
+		for i := 0; i < v.NumField(); i++ {
+			zero = append(zero, zeroFields(v.Field(i), name+"."+v.Type().Field(i).Name)...)
+		}
+		return zero
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return []string{name}
+		}
+		return zeroFields(v.Index(0), name+"[0]")
+	}
+	if v.IsZero() {
+		return []string{name}
+	}
+	return nil
+}
+
+// TestRingSize tests that only the latest events that fit in the ring are kept,
+// and that existing events are migrated when the ring size changes.
+func TestRingSize(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	var all []event.Event
+	for i := 0; i < 5; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	// latest returns the latest n events, with latest events first.
+	latest := func(events []event.Event, n int) []event.Event {
+		var l []event.Event
+		for i := len(events) - 1; i >= 0 && len(l) < n; i-- {
+			l = append(l, events[i])
+		}
+		return l
+	}
+
+	s, err := fs.NewService(mem, mockUser, usersService, fs.WithRingSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all[:4] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := latest(all[:4], 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("List with ring size 3:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	// Grow the ring. All existing events should be kept.
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Log(context.Background(), all[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := latest(all, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after growing ring size to 4:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	// Shrink the ring. Only the latest events should be kept,
+	// and event files that are no longer used should be removed.
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := latest(all, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after shrinking ring size to 2:\ngot:  %v\nwant: %v", got, want)
+	}
+	if got := eventFiles(t, mem); len(got) != 2 {
+		t.Errorf("got event files %q after shrinking ring size to 2, want 2", got)
+	}
+
+	// Reopen with the same ring size. Nothing should change.
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := latest(all, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after reopening:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	_, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(0))
+	if err == nil {
+		t.Error("NewService with ring size 0: got nil error, want non-nil")
+	}
+}
+
+// TestEvictHandler tests that the evict handler is called with the events
+// the ring overwrites, oldest first, and only with those.
+func TestEvictHandler(t *testing.T) {
+	var all []event.Event
+	for i := 0; i < 8; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+		want []event.Event // Evicted events.
+	}{
+		{"ring", []fs.Option{fs.WithRingSize(3)}, all[:5]},
+		{"buffered", []fs.Option{fs.WithRingSize(3), fs.WithBufferedWrites(5, 0)}, all[:5]},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var evicted []event.Event
+			opts := append(tc.opts, fs.WithEvictHandler(func(e event.Event) { evicted = append(evicted, e) }))
+			s, err := fs.NewService(webdav.NewMemFS(), mockUser, &mockUsers{Current: mockUser.UserSpec}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, e := range all {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = s.Flush(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(evicted, tc.want) {
+				t.Errorf("evicted events: got %d, want %d", len(evicted), len(tc.want))
+			}
+		})
+	}
+}
+
+// TestAppendOnly tests that append-only storage keeps all events,
+// including events copied from existing ring storage.
+func TestAppendOnly(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	var all []event.Event
+	for i := 0; i < 1500; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	// reversed returns events with latest events first.
+	reversed := func(events []event.Event) []event.Event {
+		var r []event.Event
+		for i := len(events) - 1; i >= 0; i-- {
+			r = append(r, events[i])
+		}
+		return r
+	}
+
+	// Start out with some events in ring storage.
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all[:10] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithAppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all[10:] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reversed(all); !reflect.DeepEqual(got, want) {
+		t.Errorf("List: got %d events, want %d", len(got), len(want))
+	}
+
+	// Create a new service using the same storage, so events get loaded from it.
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithAppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reversed(all); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after reload: got %d events, want %d", len(got), len(want))
+	}
+}
+
+// TestJSONLines tests that JSON Lines storage copies events from append-only
+// storage, stores events as JSON Lines, and rotates log files.
+func TestJSONLines(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	var all []event.Event
+	for i := 0; i < 10010; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	// reversed returns events with latest events first.
+	reversed := func(events []event.Event) []event.Event {
+		var r []event.Event
+		for i := len(events) - 1; i >= 0; i-- {
+			r = append(r, events[i])
+		}
+		return r
+	}
+	dir := fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain)
+
+	// Start out with some events in append-only storage.
+	s, err := fs.NewService(mem, mockUser, usersService, fs.WithAppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all[:10] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithJSONLines(), fs.WithEncoding(fs.CBOR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all[10:20] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Events are stored as JSON Lines, even with another encoding set.
+	f, err := mem.OpenFile(context.Background(), dir+"/log-0.jsonl", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+	if len(lines) != 20 {
+		t.Errorf("log-0.jsonl has %d lines, want 20", len(lines))
+	}
+	for i, line := range lines {
+		if !json.Valid(line) {
+			t.Errorf("line %d of log-0.jsonl isn't valid JSON: %s", i+1, line)
+		}
+	}
+
+	// Importing the rest of the events fills up the log file, and rotates it.
+	var jsonl bytes.Buffer
+	for _, e := range all[20:] {
+		err := json.NewEncoder(&jsonl).Encode(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = s.ImportJSONLines(context.Background(), &jsonl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"log-0.jsonl", "log-1.jsonl"} {
+		_, err := mem.Stat(context.Background(), dir+"/"+name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Create a new service using the same storage, so events get loaded from it.
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithJSONLines())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reversed(all); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after reload: got %d events, want %d", len(got), len(want))
+	}
+	problems, err := fs.Verify(context.Background(), mem, mockUser.UserSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Verify: got %v, want no problems", problems)
+	}
+}
+
+// TestRetention tests that events not kept by the retention policy
+// are discarded, in all storage modes.
+func TestRetention(t *testing.T) {
+	now := time.Now().UTC()
+	var all []event.Event
+	for i := 0; i < 10; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      now.Add(time.Duration(i-9) * time.Hour), // Last event is logged now, first one 9 hours ago.
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	// latest returns the latest n events, with latest events first.
+	latest := func(n int) []event.Event {
+		var l []event.Event
+		for i := len(all) - 1; i >= 0 && len(l) < n; i-- {
+			l = append(l, all[i])
+		}
+		return l
+	}
+
+	for _, tc := range []struct {
+		name      string
+		opts      []fs.Option
+		retention fs.Retention
+		want      []event.Event
+	}{
+		{"ring/MaxEvents", nil, fs.Retention{MaxEvents: 3}, latest(3)},
+		{"ring/MaxAge", nil, fs.Retention{MaxAge: 150 * time.Minute}, latest(3)},
+		{"append-only/MaxEvents", []fs.Option{fs.WithAppendOnly()}, fs.Retention{MaxEvents: 3}, latest(3)},
+		{"append-only/MaxAge", []fs.Option{fs.WithAppendOnly()}, fs.Retention{MaxAge: 150 * time.Minute}, latest(3)},
+		{"append-only/both", []fs.Option{fs.WithAppendOnly()}, fs.Retention{MaxAge: 150 * time.Minute, MaxEvents: 2}, latest(2)},
+		{"JSON Lines/MaxEvents", []fs.Option{fs.WithJSONLines()}, fs.Retention{MaxEvents: 3}, latest(3)},
+		{"JSON Lines/MaxAge", []fs.Option{fs.WithJSONLines()}, fs.Retention{MaxAge: 150 * time.Minute}, latest(3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			opts := append(tc.opts, fs.WithRetention(tc.retention))
+			s, err := fs.NewService(mem, mockUser, usersService, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range all {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List:\ngot:  %v\nwant: %v", got, tc.want)
+			}
+
+			// Create a new service using the same storage, so events get loaded from it.
+			s, err = fs.NewService(mem, mockUser, usersService, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List after reload:\ngot:  %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+
+	// Retention policy applies to events that were stored before it was set.
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithRetention(fs.Retention{MaxEvents: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := latest(4); !reflect.DeepEqual(got, want) {
+		t.Errorf("List after setting retention policy:\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+// TestUpgrade tests that a tree written before the schema was versioned
+// is upgraded when it's loaded.
+func TestUpgrade(t *testing.T) {
+	mem := webdav.NewMemFS()
+	dir := fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain)
+	for name, content := range map[string]string{
+		"ring":    `{"Start":0,"Length":2}`,
+		"event-0": `{"Time":"2021-01-02T03:04:05Z","Container":"example.org/some-app","Type":"push","Payload":{"Branch":"main","Head":"bbb","Before":"aaa","Commits":[{"SHA":"bbb","CommitMessage":"Add a thing.","AuthorAvatarURL":"https://example.org/avatar.png"}]}}`,
+		"event-1": `{"Time":"2021-01-02T03:04:06Z","Container":"example.org/some-app","Type":"commitComment","Payload":{"Commit":{"SHA":"bbb","CommitMessage":"Add a thing.","AuthorAvatarURL":"https://example.org/avatar.png"},"CommentID":18446744073709551615,"CommentBody":"Nice."}}`,
+	} {
+		err := mem.Mkdir(context.Background(), dir, 0700)
+		if err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+		f, err := mem.OpenFile(context.Background(), dir+"/"+name, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte(content + "\n"))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := fs.NewService(mem, mockUser, &mockUsers{Current: mockUser.UserSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("List: got %d events, want 2", len(got))
+	}
+	commit := event.Commit{SHA: "bbb", Message: "Add a thing.", AuthorAvatarURL: "https://example.org/avatar.png"}
+	if got, want := got[0].Payload, (event.CommitComment{Commit: commit, CommentID: 18446744073709551615, CommentBody: "Nice."}); !reflect.DeepEqual(got, want) {
+		t.Errorf("List: event 0:\ngot:  %+v\nwant: %+v", got, want)
+	}
+	if got, want := got[1].Payload, (event.Push{Branch: "main", Head: "bbb", Before: "aaa", Commits: []event.Commit{commit}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("List: event 1:\ngot:  %+v\nwant: %+v", got, want)
+	}
+	if names := eventFiles(t, mem); len(names) != 2 || names[0] == "event-0" || names[1] == "event-1" {
+		t.Errorf("event files after upgrade: got %q, want 2 named after their events", names)
+	}
+	if _, err := mem.Stat(context.Background(), dir+"/ring"); !os.IsNotExist(err) {
+		t.Errorf("ring file after upgrade: got error %v, want not exist", err)
+	}
+
+	// A tree with a newer schema version than supported can't be loaded.
+	f, err := mem.OpenFile(context.Background(), dir+"/version", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(`{"Version":1000}`))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.NewService(mem, mockUser, &mockUsers{Current: mockUser.UserSpec})
+	if err == nil {
+		t.Error("NewService with newer schema version: got nil error, want non-nil")
+	}
+}
+
+// TestEncoding tests that events are stored in the configured encoding,
+// and that events stored in either encoding can be read back.
+func TestEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []fs.Option
+		lastFile string // Path of file with the last logged event, relative to user directory, or empty for the last event file.
+	}{
+		{"ring", nil, ""},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, "segments/2021/01/segment-1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			half := len(allPayloadsEvents) / 2
+
+			// Log the first half of events as JSON, and the rest as CBOR.
+			s, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithEncoding(fs.JSON))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[:half] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithEncoding(fs.CBOR))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[half:] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lastFile := tc.lastFile
+			if lastFile == "" {
+				names := eventFiles(t, mem)
+				lastFile = names[len(names)-1]
+			}
+			name := fmt.Sprintf("/%d@%s/%s", mockUser.ID, mockUser.Domain, lastFile)
+			f, err := mem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			magic := make([]byte, 3)
+			_, err = f.Read(magic)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []byte{0xd9, 0xd9, 0xf7}; !reflect.DeepEqual(magic, want) {
+				t.Errorf("%s starts with %x, want %x", lastFile, magic, want)
+			}
+
+			for _, enc := range []fs.Encoding{fs.JSON, fs.CBOR} {
+				s, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithEncoding(enc))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List after reload with %v encoding: got != want", enc)
+				}
+			}
+		})
+	}
+}
+
+// TestGzip tests that event files are compressed when configured,
+// and that compressed and uncompressed files can both be read back.
+func TestGzip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []fs.Option
+		lastFile string // Path of file with the last logged event, relative to user directory, or empty for the last event file.
+	}{
+		{"ring/JSON", nil, ""},
+		{"ring/CBOR", []fs.Option{fs.WithEncoding(fs.CBOR)}, ""},
+		{"append-only/JSON", []fs.Option{fs.WithAppendOnly()}, "segments/2021/01/segment-1"},
+		{"append-only/CBOR", []fs.Option{fs.WithAppendOnly(), fs.WithEncoding(fs.CBOR)}, "segments/2021/01/segment-1"},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, "log-1.jsonl"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			half := len(allPayloadsEvents) / 2
+
+			// Log the first half of events uncompressed, and the rest compressed.
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[:half] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithGzip(true))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[half:] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lastFile := tc.lastFile
+			if lastFile == "" {
+				names := eventFiles(t, mem)
+				lastFile = names[len(names)-1]
+			}
+			name := fmt.Sprintf("/%d@%s/%s", mockUser.ID, mockUser.Domain, lastFile)
+			f, err := mem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			magic := make([]byte, 2)
+			_, err = f.Read(magic)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []byte{0x1f, 0x8b}; !reflect.DeepEqual(magic, want) {
+				t.Errorf("%s starts with %x, want %x", lastFile, magic, want)
+			}
+
+			for _, compress := range []bool{false, true} {
+				s, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithGzip(compress))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List after reload with WithGzip(%v): got != want", compress)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	for _, tc := range []struct {
+		name     string
+		opts     []fs.Option
+		lastFile string // Path of file with the last logged event, relative to user directory, or empty for the last event file.
+	}{
+		{"ring/JSON", nil, ""},
+		{"ring/CBOR+gzip", []fs.Option{fs.WithEncoding(fs.CBOR), fs.WithGzip(true)}, ""},
+		{"append-only/JSON", []fs.Option{fs.WithAppendOnly()}, "segments/2021/01/segment-1"},
+		{"append-only/CBOR+gzip", []fs.Option{fs.WithAppendOnly(), fs.WithEncoding(fs.CBOR), fs.WithGzip(true)}, "segments/2021/01/segment-1"},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, "log-1.jsonl"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			half := len(allPayloadsEvents) / 2
+			encrypted := append(tc.opts, fs.WithEncryption(key))
+
+			// Log the first half of events unencrypted, and the rest encrypted,
+			// one at a time, so that segment files are appended to.
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[:half] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, encrypted...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents[half:] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lastFile := tc.lastFile
+			if lastFile == "" {
+				names := eventFiles(t, mem)
+				lastFile = names[len(names)-1]
+			}
+			name := fmt.Sprintf("/%d@%s/%s", mockUser.ID, mockUser.Domain, lastFile)
+			f, err := mem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, []byte("\x00enc")) {
+				t.Errorf("%s starts with %x, want encryption magic", lastFile, b[:4])
+			}
+			if last := allPayloadsEvents[len(allPayloadsEvents)-1]; bytes.Contains(b, []byte(last.Container)) {
+				t.Errorf("%s contains event container %q in plaintext", lastFile, last.Container)
+			}
+
+			s, err = fs.NewService(mem, mockUser, usersService, encrypted...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("List after reload: got != want")
+			}
+			if c := s.Corruption(); len(c) != 0 {
+				t.Errorf("got corruption %v, want none", c)
+			}
+
+			// Encrypted events can't be loaded without the key, or with another one.
+			_, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err == nil {
+				t.Error("NewService without encryption key: got nil error, want non-nil")
+			}
+			_, err = fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithEncryption(bytes.Repeat([]byte{0x43}, 32)))...)
+			if err == nil {
+				t.Error("NewService with wrong encryption key: got nil error, want non-nil")
+			}
+		})
+	}
+
+	_, err := fs.NewService(webdav.NewMemFS(), mockUser, &mockUsers{Current: mockUser.UserSpec}, fs.WithEncryption([]byte("short")))
+	if err == nil {
+		t.Error("NewService with invalid encryption key: got nil error, want non-nil")
+	}
+}
+
+// TestShardSegments tests that segment files written before they were
+// sharded by month are moved into month directories when they're loaded.
+func TestShardSegments(t *testing.T) {
+	mem := webdav.NewMemFS()
+	dir := fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain)
+	star := func(id, time string) string {
+		return `{"ID":"` + id + `","Time":"` + time + `","Container":"example.org/starworthy","Type":"star","Payload":{}}` + "\n"
+	}
+	for name, content := range map[string]string{
+		"version":            `{"Version":1}`,
+		"segments/segment-0": star("0", "2021-01-30T00:00:00Z") + star("1", "2021-01-31T00:00:00Z") + star("2", "2021-02-01T00:00:00Z"),
+		"segments/segment-1": star("3", "2021-02-02T00:00:00Z"),
+	} {
+		err := mem.Mkdir(context.Background(), dir, 0700)
+		if err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+		err = mem.Mkdir(context.Background(), dir+"/segments", 0700)
+		if err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+		f, err := mem.OpenFile(context.Background(), dir+"/"+name, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte(content))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := fs.NewService(mem, mockUser, &mockUsers{Current: mockUser.UserSpec}, fs.WithAppendOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range got {
+		ids = append(ids, e.ID)
+	}
+	if want := []string{"3", "2", "1", "0"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List: got %q, want %q", ids, want)
+	}
+	for name, wantExist := range map[string]bool{
+		"segments/2021/01/segment-0": true,
+		"segments/2021/02/segment-1": true,
+		"segments/2021/02/segment-2": false,
+		"segments/segment-0":         false,
+		"segments/segment-1":         false,
+		"segments-v1":                false,
+	} {
+		_, err := mem.Stat(context.Background(), dir+"/"+name)
+		if exist := !os.IsNotExist(err); exist != wantExist {
+			t.Errorf("Stat(%q): got exist %v, want %v (error: %v)", name, exist, wantExist, err)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "regenerate golden trees of the current schema version in testdata/golden")
+
+// goldenModes are the storage modes of golden trees, by the suffix
+// of their directory names.
+var goldenModes = map[string][]fs.Option{
+	"ring":        nil,
+	"append-only": {fs.WithAppendOnly()},
+	"jsonl":       {fs.WithJSONLines()},
+}
+
+// TestGolden tests that golden trees in testdata/golden, which were written
+// with earlier schema versions, are still read, and upgraded, correctly.
+// Each directory there is named v{{version}}-{{mode}}, and holds a tree
+// in the storage mode, and the events it holds, latest first, in want.jsonl.
+//
+// With the -update flag, trees of the current schema version are
+// regenerated first. Trees of earlier schema versions are kept as they are,
+// since they can't be written anymore.
+func TestGolden(t *testing.T) {
+	if *update {
+		generateGolden(t)
+	}
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "v*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("found no golden trees")
+	}
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		t.Run(name, func(t *testing.T) {
+			opts, ok := goldenModes[name[strings.IndexByte(name, '-')+1:]]
+			if !ok {
+				t.Fatalf("unknown storage mode of %s", name)
+			}
+			var want []event.Event
+			b, err := os.ReadFile(filepath.Join(dir, "want.jsonl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := json.NewDecoder(bytes.NewReader(b))
+			for dec.More() {
+				var e event.Event
+				err := dec.Decode(&e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, e)
+			}
+
+			version, err := strconv.Atoi(name[1:strings.IndexByte(name, '-')])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Trees are upgraded the same on filesystems that can't rename files,
+			// with event files copied rather than renamed. Upgrading trees
+			// of version 1 moves the segments directory, which needs renaming.
+			for _, tr := range []struct {
+				name       string
+				wrap       func(webdav.FileSystem) webdav.FileSystem
+				minVersion int
+			}{
+				{"rename", func(root webdav.FileSystem) webdav.FileSystem { return root }, 0},
+				{"no rename", func(root webdav.FileSystem) webdav.FileSystem { return noRenameFS{root} }, 2},
+			} {
+				if version < tr.minVersion {
+					continue
+				}
+				t.Run(tr.name, func(t *testing.T) {
+					// Upgrading changes the tree, so work on a copy of it.
+					mem := webdav.NewMemFS()
+					err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+						if err != nil || path == dir || fi.Name() == "want.jsonl" {
+							return err
+						}
+						rel, err := filepath.Rel(dir, path)
+						if err != nil {
+							return err
+						}
+						name := "/" + filepath.ToSlash(rel)
+						if fi.IsDir() {
+							return mem.Mkdir(context.Background(), name, 0700)
+						}
+						b, err := os.ReadFile(path)
+						if err != nil {
+							return err
+						}
+						f, err := mem.OpenFile(context.Background(), name, os.O_WRONLY|os.O_CREATE, 0600)
+						if err != nil {
+							return err
+						}
+						_, err = f.Write(b)
+						if closeErr := f.Close(); err == nil {
+							err = closeErr
+						}
+						return err
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					root := tr.wrap(mem)
+					for i := 0; i < 2; i++ { // The second time, the tree is already upgraded.
+						s, err := fs.NewService(root, mockUser, &mockUsers{Current: mockUser.UserSpec}, opts...)
+						if err != nil {
+							t.Fatal(err)
+						}
+						got, err := s.List(context.Background())
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !reflect.DeepEqual(got, want) {
+							t.Errorf("List, load %d:\ngot:  %v\nwant: %v", i+1, got, want)
+						}
+						if c := s.Corruption(); len(c) != 0 {
+							t.Errorf("load %d: got corruption %v, want none", i+1, c)
+						}
+					}
+					problems, err := fs.Verify(context.Background(), root, mockUser.UserSpec)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(problems) != 0 {
+						t.Errorf("Verify: got %v, want no problems", problems)
+					}
+				})
+			}
+		})
+	}
+}
+
+// generateGolden writes golden trees of the current schema version
+// in every storage mode, with allPayloadsEvents, replacing existing ones.
+func generateGolden(t *testing.T) {
+	t.Helper()
+	for mode, opts := range goldenModes {
+		err := os.MkdirAll(filepath.Join("testdata", "golden"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp, err := os.MkdirTemp(filepath.Join("testdata", "golden"), ".tmp-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		s, err := fs.NewOSService(tmp, mockUser, &mockUsers{Current: mockUser.UserSpec}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range allPayloadsEvents {
+			err := s.Log(context.Background(), e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		events, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jsonl bytes.Buffer
+		for _, e := range events {
+			err := json.NewEncoder(&jsonl).Encode(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = os.WriteFile(filepath.Join(tmp, "want.jsonl"), jsonl.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct{ Version int }
+		b, err := os.ReadFile(filepath.Join(tmp, fmt.Sprintf("%d@%s", mockUser.ID, mockUser.Domain), "version"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(b, &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join("testdata", "golden", fmt.Sprintf("v%d-%s", v.Version, mode))
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Rename(tmp, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReadOnly tests that a read-only service lists events
+// from an io/fs.FS, and doesn't log them.
+func TestReadOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  []fs.Option
+		small fs.Option // Option that would modify storage, if it weren't read-only.
+	}{
+		{"ring", nil, fs.WithRingSize(2)},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, fs.WithRetention(fs.Retention{MaxEvents: 1})},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, fs.WithRetention(fs.Retention{MaxEvents: 1})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(webdav.Dir(dir), mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ro, err := fs.NewReadOnlyService(os.DirFS(dir), mockUser, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ro.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("List: got != want")
+			}
+			if err := ro.Log(context.Background(), allPayloadsEvents[0]); err != os.ErrPermission {
+				t.Errorf("Log: got error %v, want %v", err, os.ErrPermission)
+			}
+
+			// Options that would otherwise modify storage only affect what's listed.
+			ro, err = fs.NewReadOnlyService(os.DirFS(dir), mockUser, append(tc.opts, tc.small, fs.WithRetention(fs.Retention{MaxEvents: 1}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = ro.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], want[0]) {
+				t.Errorf("List with retention policy: got %d events, want only the latest one", len(got))
+			}
+			s, err = fs.NewService(webdav.Dir(dir), mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("List after read-only service: got != want")
+			}
+		})
+	}
+
+	// An empty tree has no events.
+	ro, err := fs.NewReadOnlyService(os.DirFS(t.TempDir()), mockUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ro.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("List on empty tree: got %d events, want 0", len(got))
+	}
+}
+
+// TestOSService tests that a service backed by the native filesystem
+// stores events in the same layout as NewService does.
+func TestOSService(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", nil},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "events") // Doesn't exist yet.
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewOSService(dir, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = fs.NewOSService(dir, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("List after reload: got != want")
+			}
+
+			s, err = fs.NewService(webdav.Dir(dir), mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Error("List via webdav.Dir: got != want")
+			}
+		})
+	}
+}
+
+// TestPermissions tests that files and directories are created
+// with the configured permissions.
+func TestPermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		opts      []fs.Option
+		file, dir os.FileMode
+	}{
+		{"default", nil, 0600, 0700},
+		{"group read", []fs.Option{fs.WithPermissions(0640, 0750)}, 0640, 0750},
+		{"append-only", []fs.Option{fs.WithAppendOnly(), fs.WithPermissions(0640, 0750)}, 0640, 0750},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithLocking())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range mockEvents {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var walk func(dir string)
+			walk = func(dir string) {
+				t.Helper()
+				f, err := mem.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fis, err := f.Readdir(0)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, fi := range fis {
+					name := path.Join(dir, fi.Name())
+					want := tc.file
+					if fi.IsDir() {
+						want = tc.dir
+						walk(name)
+					}
+					if got := fi.Mode().Perm(); got != want {
+						t.Errorf("%s has permissions %v, want %v", name, got, want)
+					}
+				}
+			}
+			walk("/")
+		})
+	}
+
+	_, err := fs.NewService(webdav.NewMemFS(), mockUser, &mockUsers{Current: mockUser.UserSpec}, fs.WithPermissions(os.ModeSetuid|0600, 0700))
+	if err == nil {
+		t.Error("NewService with invalid permissions: got nil error, want non-nil")
+	}
+}
+
+// TestReplica tests that writes are mirrored to a replica, and that it's
+// brought up to date after writes to it failed, or restored from after
+// losing storage.
+func TestReplica(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", []fs.Option{fs.WithRingSize(5)}},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines(), fs.WithLocking()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			replica := &failFS{FileSystem: webdav.NewMemFS()}
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			opts := append(tc.opts, fs.WithReplica(replica))
+			s, err := fs.NewService(mem, mockUser, usersService, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			half := len(allPayloadsEvents) / 2
+			for _, e := range allPayloadsEvents[:half] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, want := treeFiles(t, replica), treeFiles(t, mem); !reflect.DeepEqual(got, want) {
+				t.Errorf("replica after Log: got %d files, want %d the same as storage", len(got), len(want))
+			}
+
+			// Writes still succeed while the replica fails,
+			// and it's brought up to date by the next service.
+			replica.fail = true
+			for _, e := range allPayloadsEvents[half:] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			replica.fail = false
+			if got, want := treeFiles(t, replica), treeFiles(t, mem); reflect.DeepEqual(got, want) {
+				t.Error("replica after failed writes: got the same files as storage, want them out of date")
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := treeFiles(t, replica), treeFiles(t, mem); !reflect.DeepEqual(got, want) {
+				t.Errorf("replica after reconciling: got %d files, want %d the same as storage", len(got), len(want))
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Storage that's lost is restored from the replica.
+			s, err = fs.NewService(webdav.NewMemFS(), mockUser, usersService, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after restoring from replica: got %d events, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// TestLocking tests that services sharing storage with locking enabled
+// don't lose each other's events, and that a stale lock file is recovered from.
+func TestLocking(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func(t *testing.T) func(opts ...fs.Option) (*fs.Service, error)
+	}{
+		{"lock file", func(t *testing.T) func(opts ...fs.Option) (*fs.Service, error) {
+			mem := webdav.NewMemFS()
+			return func(opts ...fs.Option) (*fs.Service, error) {
+				return fs.NewService(mem, mockUser, &mockUsers{Current: mockUser.UserSpec}, opts...)
+			}
+		}},
+		{"os", func(t *testing.T) func(opts ...fs.Option) (*fs.Service, error) {
+			dir := t.TempDir()
+			return func(opts ...fs.Option) (*fs.Service, error) {
+				return fs.NewOSService(dir, mockUser, &mockUsers{Current: mockUser.UserSpec}, opts...)
+			}
+		}},
+	} {
+		for _, mode := range []struct {
+			name string
+			opts []fs.Option
+		}{
+			{"ring", []fs.Option{fs.WithLocking()}},
+			{"append-only", []fs.Option{fs.WithLocking(), fs.WithAppendOnly()}},
+			{"JSON Lines", []fs.Option{fs.WithLocking(), fs.WithJSONLines()}},
+		} {
+			t.Run(tc.name+"/"+mode.name, func(t *testing.T) {
+				newService := tc.new(t)
+				var ss [2]*fs.Service
+				for i := range ss {
+					var err error
+					ss[i], err = newService(mode.opts...)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				// Take turns logging events.
+				var want []event.Event
+				for i, e := range allPayloadsEvents {
+					e.ID = fmt.Sprint(i)
+					err := ss[i%2].Log(context.Background(), e)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want = append([]event.Event{e}, want...)
+				}
+				got, err := ss[(len(allPayloadsEvents)-1)%2].List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List from last service to log: got %d events, want %d", len(got), len(want))
+				}
+				s, err := newService(mode.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List after reload: got %d events, want %d", len(got), len(want))
+				}
+			})
+		}
+	}
+
+	lockName := fmt.Sprintf("/%d@%s.lock", mockUser.ID, mockUser.Domain)
+
+	// A lock file held by another process makes Log wait.
+	mem := webdav.NewMemFS()
+	s, err := fs.NewService(mem, mockUser, &mockUsers{Current: mockUser.UserSpec}, fs.WithLocking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.OpenFile(context.Background(), lockName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("{}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Log(ctx, allPayloadsEvents[0]); err != context.DeadlineExceeded {
+		t.Errorf("Log with held lock: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A stale lock file is removed.
+	dir := t.TempDir()
+	s, err = fs.NewService(webdav.Dir(dir), mockUser, &mockUsers{Current: mockUser.UserSpec}, fs.WithLocking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, filepath.FromSlash(lockName)), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filepath.Join(dir, filepath.FromSlash(lockName)), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Log(context.Background(), allPayloadsEvents[0])
+	if err != nil {
+		t.Errorf("Log with stale lock: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(lockName))); !os.IsNotExist(err) {
+		t.Errorf("lock file wasn't removed after Log: %v", err)
+	}
+}
+
+// TestRefresh tests that a service picks up events written to its storage
+// by another service, both when refreshed explicitly and periodically.
+func TestRefresh(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", nil},
+		{"ring full", []fs.Option{fs.WithRingSize(3)}},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			writer, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			poller, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithRefreshInterval(time.Millisecond))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Close()
+
+			for i, e := range allPayloadsEvents {
+				e.ID = fmt.Sprint(i)
+				err := writer.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := writer.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := reader.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("List before Refresh: got %d events, want 0", len(got))
+			}
+			err = reader.Refresh(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = reader.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after Refresh: got %d events, want %d", len(got), len(want))
+			}
+
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				got, err = poller.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reflect.DeepEqual(got, want) {
+					break
+				} else if time.Now().After(deadline) {
+					t.Fatalf("List with refresh interval: got %d events, want %d", len(got), len(want))
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+// TestCrashConsistency tests that interrupting Log at any point,
+// as if the process crashed, leaves storage with either the events
+// from before the Log, or the events from after it, or for a full ring,
+// the events from before it without the oldest one.
+func TestCrashConsistency(t *testing.T) {
+	var all []event.Event
+	for i := 0; i < 3; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	before := []event.Event{all[1], all[0]}
+	dropped := []event.Event{all[1]} // The ring is full, so all[0] is dropped before all[2] overwrites it.
+	after := []event.Event{all[2], all[1]}
+
+	for writes := 0; ; writes++ {
+		mem := webdav.NewMemFS()
+		usersService := &mockUsers{Current: mockUser.UserSpec}
+		s, err := fs.NewService(mem, mockUser, usersService, fs.WithRingSize(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range all[:2] {
+			err := s.Log(context.Background(), e)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Crash after the specified number of writes.
+		crash := &crashFS{FileSystem: mem, writesLeft: writes}
+		s, err = fs.NewService(crash, mockUser, usersService, fs.WithRingSize(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Log(context.Background(), all[2])
+
+		s, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(2))
+		if err != nil {
+			t.Fatalf("NewService after crashing after %d writes: %v", writes, err)
+		}
+		got, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, before) && !reflect.DeepEqual(got, dropped) && !reflect.DeepEqual(got, after) {
+			t.Errorf("List after crashing after %d writes:\ngot:  %v\nwant: %v, %v or %v", writes, got, before, dropped, after)
+		}
+
+		if !crash.crashed {
+			// Log finished before it got to crash.
+			break
+		}
+	}
+
+	// Files are still written, in place, if they can't be renamed.
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(noRenameFS{mem}, mockUser, usersService, fs.WithRingSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = fs.NewService(mem, mockUser, usersService, fs.WithRingSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, after) {
+		t.Errorf("List after writing without renaming:\ngot:  %v\nwant: %v", got, after)
+	}
+}
+
+// TestExportImport tests that events exported to an archive
+// are restored by importing it.
+func TestExportImport(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+		gzip bool
+	}{
+		{"ring", nil, false},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, false},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, false},
+		{"gzip", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(webdav.NewMemFS(), mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range allPayloadsEvents {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if tc.gzip {
+				zw := gzip.NewWriter(&buf)
+				err = s.Export(context.Background(), zw)
+				if err == nil {
+					err = zw.Close()
+				}
+			} else {
+				err = s.Export(context.Background(), &buf)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Import into storage that already has other events.
+			mem := webdav.NewMemFS()
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Log(context.Background(), mockEvents[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Import(context.Background(), bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after Import: got %d events, want %d", len(got), len(want))
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after reload: got %d events, want %d", len(got), len(want))
+			}
+
+			// An archive of another user, or a malformed one, is rejected
+			// and leaves events as they were.
+			other := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "example.org"}}
+			s2, err := fs.NewService(mem, other, &mockUsers{Current: other.UserSpec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s2.Import(context.Background(), bytes.NewReader(buf.Bytes())); err == nil {
+				t.Error("Import of another user's archive: got nil error, want non-nil")
+			}
+			if err := s.Import(context.Background(), bytes.NewReader(buf.Bytes()[:buf.Len()/2])); err == nil {
+				t.Error("Import of truncated archive: got nil error, want non-nil")
+			}
+			// Including one cut right before the header of a file,
+			// which otherwise reads as a complete archive.
+			if err := s.Import(context.Background(), bytes.NewReader(cutBeforeLastFile(t, buf.Bytes(), tc.gzip))); err == nil {
+				t.Error("Import of archive truncated at a file boundary: got nil error, want non-nil")
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after failed Import: got %d events, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// TestSnapshotRestore tests that snapshots taken while events are logged
+// concurrently are consistent, and that restoring one brings back its events.
+func TestSnapshotRestore(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", nil},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"locking", []fs.Option{fs.WithLocking()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			half := len(allPayloadsEvents) / 2
+			for _, e := range allPayloadsEvents[:half] {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := s.Snapshot(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Take more snapshots while the rest of events are logged.
+			done := make(chan error)
+			go func() {
+				for _, e := range allPayloadsEvents[half:] {
+					err := s.Log(context.Background(), e)
+					if err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+			for i := 0; i < 3; i++ {
+				_, err := s.Snapshot(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			names, err := s.Snapshots(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 4 || names[0] != first {
+				t.Fatalf("Snapshots: got %q, want 4 starting with %q", names, first)
+			}
+
+			// Each snapshot has a prefix of the logged events.
+			for _, name := range names[1:] {
+				err := s.Restore(context.Background(), name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) < half || len(got) > len(allPayloadsEvents) {
+					t.Errorf("List after Restore of %s: got %d events, want %d to %d", name, len(got), half, len(allPayloadsEvents))
+				}
+			}
+
+			err = s.Restore(context.Background(), first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after Restore: got %d events, want %d", len(got), len(want))
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after reload: got %d events, want %d", len(got), len(want))
+			}
+
+			// A missing or invalid snapshot isn't restored, and leaves events as they were.
+			for _, name := range []string{"20000101T000000.000000000Z", "../1@example.org"} {
+				if err := s.Restore(context.Background(), name); err == nil {
+					t.Errorf("Restore of %q: got nil error, want non-nil", name)
+				}
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after failed Restore: got %d events, want %d", len(got), len(want))
+			}
+
+			for _, name := range names {
+				err := s.RemoveSnapshot(context.Background(), name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			names, err = s.Snapshots(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 0 {
+				t.Errorf("Snapshots after RemoveSnapshot: got %q, want none", names)
+			}
+		})
+	}
+}
+
+// TestImportJSONLines tests that events imported from JSON Lines
+// are stored in chronological order.
+func TestImportJSONLines(t *testing.T) {
+	var all []event.Event
+	for i := 0; i < 5; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	var jsonl bytes.Buffer
+	for _, i := range []int{3, 0, 4, 2, 1} { // Out of order.
+		e := all[i]
+		if i == 2 {
+			e.Time = e.Time.In(time.FixedZone("UTC+1", 60*60))
+		}
+		err := json.NewEncoder(&jsonl).Encode(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := all[0]
+	other.Actor = users.User{UserSpec: users.UserSpec{ID: 2, Domain: "example.org"}}
+	err := json.NewEncoder(&jsonl).Encode(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// latest returns the latest n events, with latest events first.
+	latest := func(events []event.Event, n int) []event.Event {
+		var l []event.Event
+		for i := len(events) - 1; i >= 0 && len(l) < n; i-- {
+			l = append(l, events[i])
+		}
+		return l
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+		want []event.Event
+	}{
+		{"ring", nil, latest(all, 5)},
+		{"small ring", []fs.Option{fs.WithRingSize(3)}, latest(all, 3)},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, latest(all, 5)},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, latest(all, 5)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := s.ImportJSONLines(context.Background(), bytes.NewReader(jsonl.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tc.want) {
+				t.Errorf("ImportJSONLines: got %d events stored, want %d", n, len(tc.want))
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List:\ngot:  %v\nwant: %v", got, tc.want)
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List after reload:\ngot:  %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+
+	// Nothing is stored if there's a malformed event.
+	s, err := fs.NewService(webdav.NewMemFS(), mockUser, &mockUsers{Current: mockUser.UserSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformed := jsonl.String() + `{"Time":"2021-01-02T03:04:05Z","Type":"Nope","Payload":{}}` + "\n"
+	if _, err := s.ImportJSONLines(context.Background(), strings.NewReader(malformed)); err == nil {
+		t.Error("ImportJSONLines with malformed event: got nil error, want non-nil")
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("List after failed ImportJSONLines: got %d events, want 0", len(got))
+	}
+}
+
+// TestDelete tests that deleting an event at any position removes only it,
+// in all storage modes.
+func TestDelete(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []fs.Option
+		months bool // Whether events are in different months, so each is in its own segment file.
+		n      int  // Number of events to log.
+	}{
+		{"ring", []fs.Option{fs.WithRingSize(5)}, false, 5},
+		{"wrapped ring", []fs.Option{fs.WithRingSize(5)}, false, 8},
+		{"partial ring", []fs.Option{fs.WithRingSize(10)}, false, 5},
+		{"segment", []fs.Option{fs.WithAppendOnly()}, false, 5},
+		{"segments", []fs.Option{fs.WithAppendOnly()}, true, 5},
+		{"log", []fs.Option{fs.WithJSONLines()}, false, 5},
+	} {
+		for del := 0; del < 5; del++ {
+			t.Run(fmt.Sprintf("%s/%d", tc.name, del), func(t *testing.T) {
+				mem := webdav.NewMemFS()
+				usersService := &mockUsers{Current: mockUser.UserSpec}
+				s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var all []event.Event
+				for i := 0; i < tc.n; i++ {
+					e := event.Event{
+						ID:        fmt.Sprint(i),
+						Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+						Actor:     mockUser,
+						Container: "example.org/starworthy",
+						Payload:   event.Star{},
+					}
+					if tc.months {
+						e.Time = e.Time.AddDate(0, i, 0)
+					}
+					err := s.Log(context.Background(), e)
+					if err != nil {
+						t.Fatal(err)
+					}
+					all = append(all, e)
+				}
+				// want is the latest 5 events, latest first, without the deleted one.
+				var want []event.Event
+				for i := len(all) - 1; i >= len(all)-5; i-- {
+					if i != len(all)-5+del {
+						want = append(want, all[i])
+					}
+				}
+
+				err = s.Delete(context.Background(), all[len(all)-5+del].ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List after Delete:\ngot:  %v\nwant: %v", got, want)
+				}
+				s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List after reload:\ngot:  %v\nwant: %v", got, want)
+				}
+
+				// Logging still works after deleting.
+				next := event.Event{
+					ID:        "next",
+					Time:      all[len(all)-1].Time.Add(time.Second),
+					Actor:     mockUser,
+					Container: "example.org/starworthy",
+					Payload:   event.Star{},
+				}
+				err = s.Log(context.Background(), next)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) == 0 || !reflect.DeepEqual(got[0], next) || !reflect.DeepEqual(got[1:], want[:len(got)-1]) {
+					t.Errorf("List after logging another event:\ngot:  %v\nwant: %v followed by %v", got, next, want)
+				}
+			})
+		}
+	}
+
+	s, err := fs.NewService(webdav.NewMemFS(), mockUser, &mockUsers{Current: mockUser.UserSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(context.Background(), "nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("Delete of nonexistent event: got error %v, want one satisfying os.IsNotExist", err)
+	}
+}
+
+// cutBeforeLastFile returns archive, a tar archive that's gzipped
+// if gzipped is true, uncompressed and cut right before the header
+// of its last file.
+func cutBeforeLastFile(t *testing.T, archive []byte, gzipped bool) []byte {
+	t.Helper()
+	if gzipped {
+		zr, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err = io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	var (
+		hdrs     []*tar.Header
+		contents [][]byte
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs, contents = append(hdrs, hdr), append(contents, b)
+	}
+	if len(hdrs) < 2 {
+		t.Fatalf("archive has %d files, want at least 2", len(hdrs))
+	}
+
+	// Writing all but the last file without ending the archive
+	// gives where the header of the last file starts.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := range hdrs[:len(hdrs)-1] {
+		err := tw.WriteHeader(hdrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(contents[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(archive, buf.Bytes()) {
+		t.Fatal("rewritten archive isn't a prefix of the original")
+	}
+	return archive[:buf.Len()]
+}
+
+var _ events.Service = (*fs.Service)(nil)
+
+// TestListRange tests that ListRange lists events in a time range,
+// including when the index file is missing or stale.
+func TestListRange(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	at := func(hour int) time.Time { return time.Date(2021, 1, 2, hour, 0, 0, 0, time.UTC) }
+	var all []event.Event
+	for i, hour := range []int{1, 3, 2, 5, 4, 4, 0} { // Not logged in time order.
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      at(hour),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	ids := func(events []event.Event) []string {
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	check := func(name string, s *fs.Service) {
+		t.Helper()
+		for _, tc := range []struct {
+			since, until time.Time
+			want         []string
+		}{
+			{at(0), time.Time{}, []string{"3", "5", "4", "1", "2", "0", "6"}},
+			{at(2), at(5), []string{"5", "4", "1", "2"}},
+			{at(4), at(5), []string{"5", "4"}},
+			{at(5), at(4), nil},
+			{at(6), time.Time{}, nil},
+		} {
+			got, err := s.ListRange(context.Background(), tc.since, tc.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids(got), tc.want) {
+				t.Errorf("%s: ListRange(%v, %v): got %q, want %q", name, tc.since, tc.until, ids(got), tc.want)
+			}
+		}
+	}
+
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("after Log", s)
+
+	s, err = fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after reload", s)
+
+	indexPath := fmt.Sprintf("/%d@%s/index", mockUser.ID, mockUser.Domain)
+	err = mem.RemoveAll(context.Background(), indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after removing index", s)
+
+	f, err := mem.OpenFile(context.Background(), indexPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(`{"Time":"2021-01-02T01:00:00Z","ID":"0"}` + "\n"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after making index stale", s)
+
+	// With a small ring, the oldest events are discarded from the index too.
+	s, err = fs.NewService(webdav.NewMemFS(), mockUser, usersService, fs.WithRingSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.ListRange(context.Background(), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"5", "4", "6"}; !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("ListRange with ring size 3: got %q, want %q", ids(got), want)
+	}
+}
+
+func TestBufferedWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+		keep int // Number of events kept, or 0 if unlimited.
+	}{
+		{"ring", []fs.Option{fs.WithRingSize(5)}, 5},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, 0},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			var all []event.Event
+			log := func(s *fs.Service) {
+				t.Helper()
+				i := len(all)
+				e := event.Event{
+					ID:        fmt.Sprint(i),
+					Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+					Actor:     mockUser,
+					Container: "example.org/starworthy",
+					Payload:   event.Star{},
+				}
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, e)
+			}
+			// latest returns the first n logged events that are kept, latest first.
+			latest := func(n int) []event.Event {
+				var events []event.Event
+				for i := n - 1; i >= 0 && (tc.keep == 0 || len(events) < tc.keep); i-- {
+					events = append(events, all[i])
+				}
+				return events
+			}
+			// stored returns events that are in storage.
+			stored := func() []event.Event {
+				t.Helper()
+				s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				events, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+
+			s, err := fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithBufferedWrites(4, 0))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				log(s)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := latest(3); !reflect.DeepEqual(got, want) {
+				t.Errorf("List of buffered events:\ngot:  %v\nwant: %v", got, want)
+			}
+			if got := stored(); len(got) != 0 {
+				t.Errorf("got %d stored events before buffer is full, want none", len(got))
+			}
+			log(s)
+			if got, want := stored(), latest(4); !reflect.DeepEqual(got, want) {
+				t.Errorf("stored events once buffer is full:\ngot:  %v\nwant: %v", got, want)
+			}
+
+			// More events than the ring size.
+			for i := 0; i < 3; i++ {
+				log(s)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := latest(7); !reflect.DeepEqual(got, want) {
+				t.Errorf("List of buffered and stored events:\ngot:  %v\nwant: %v", got, want)
+			}
+			err = s.Flush(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := stored(), latest(7); !reflect.DeepEqual(got, want) {
+				t.Errorf("stored events after Flush:\ngot:  %v\nwant: %v", got, want)
+			}
+
+			// Close writes buffered events.
+			log(s)
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := stored(), latest(8); !reflect.DeepEqual(got, want) {
+				t.Errorf("stored events after Close:\ngot:  %v\nwant: %v", got, want)
+			}
+
+			// Buffered events are written after the flush interval.
+			s, err = fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithBufferedWrites(0, time.Millisecond))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			log(s)
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				got := stored()
+				if want := latest(9); reflect.DeepEqual(got, want) {
+					break
+				} else if time.Now().After(deadline) {
+					t.Fatalf("stored events after flush interval:\ngot:  %v\nwant: %v", got, want)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+
+	// Negative limits are reported before the tree is read.
+	count := &countFS{FileSystem: webdav.NewMemFS()}
+	for _, opt := range []fs.Option{fs.WithBufferedWrites(-1, 0), fs.WithBufferedWrites(0, -time.Second)} {
+		if _, err := fs.NewService(count, mockUser, &mockUsers{Current: mockUser.UserSpec}, opt); err == nil {
+			t.Error("NewService with negative buffered writes limit: got nil error, want non-nil")
+		}
+	}
+	if n := count.opens.Load(); n != 0 {
+		t.Errorf("NewService with negative buffered writes limit opened %d files, want 0", n)
+	}
+}
+
+// TestIdempotentLog tests that logging an event with the ID of an event
+// that's already stored, or buffered, doesn't store it again.
+func TestIdempotentLog(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", nil},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}},
+		{"buffered", []fs.Option{fs.WithBufferedWrites(10, 0)}},
+		{"locking", []fs.Option{fs.WithLocking()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			e := func(i int) event.Event {
+				return event.Event{
+					ID:        fmt.Sprint(i),
+					Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+					Actor:     mockUser,
+					Container: "example.org/starworthy",
+					Payload:   event.Star{},
+				}
+			}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range []int{0, 1, 0, 1} {
+				err := s.Log(context.Background(), e(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := []event.Event{e(1), e(0)}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List:\ngot:  %v\nwant: %v", got, want)
+			}
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Retry across a reload.
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range []int{1, 2} {
+				err := s.Log(context.Background(), e(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var jsonl bytes.Buffer
+			for _, i := range []int{0, 3, 3} {
+				err := json.NewEncoder(&jsonl).Encode(e(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := s.ImportJSONLines(context.Background(), &jsonl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("ImportJSONLines: got %d events stored, want 1", n)
+			}
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = []event.Event{e(3), e(2), e(1), e(0)}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List after reload:\ngot:  %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxBodyLength(t *testing.T) {
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(webdav.NewMemFS(), mockUser, usersService, fs.WithMaxBodyLength(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	issue := event.Issue{Action: event.IssueOpened, IssueTitle: "Title.", IssueBody: "Short.", IssueHTMLURL: "https://example.org/issues/1"}
+	change := event.Change{Action: event.ChangeOpened, ChangeTitle: "Title.", ChangeBody: "Body wiüth more.", ChangeHTMLURL: "https://example.org/pull/2"}
+	for i, p := range []event.Payload{issue, change} {
+		err := s.Log(context.Background(), event.Event{ID: fmt.Sprint(i), Time: at.Add(time.Duration(i) * time.Second), Actor: mockUser, Container: "example.org/repo", Payload: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	change.ChangeBody = "Body wi" // Cut before "ü", which doesn't fit in 8 bytes.
+	want := []event.Event{
+		{ID: "1", Time: at.Add(time.Second), Actor: mockUser, Container: "example.org/repo", Payload: change},
+		{ID: "0", Time: at, Actor: mockUser, Container: "example.org/repo", Payload: issue},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	if _, err := fs.NewService(webdav.NewMemFS(), mockUser, usersService, fs.WithMaxBodyLength(-1)); err == nil {
+		t.Error("NewService with negative maximum body length: got nil error, want non-nil")
+	}
+}
+
+func TestOtherActors(t *testing.T) {
+	other := users.User{
+		UserSpec: users.UserSpec{ID: 2, Domain: "example.org"},
+		Login:    "gopher2",
+	}
+	e := func(actor users.User, i int) event.Event {
+		return event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     actor,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		}
+	}
+	for _, tc := range []struct {
+		name      string
+		opts      []fs.Option
+		wantErr   bool
+		wantN     int           // Events imported.
+		wantOther []event.Event // Events stored for the other actor.
+	}{
+		{"skip", nil, false, 0, nil},
+		{"reject", []fs.Option{fs.WithOtherActors(fs.RejectOtherActors)}, true, 0, nil},
+		{"store", []fs.Option{fs.WithOtherActors(fs.StoreOtherActors)}, false, 1, []event.Event{e(other, 2), e(other, 1)}},
+		{"store buffered", []fs.Option{fs.WithOtherActors(fs.StoreOtherActors), fs.WithBufferedWrites(0, 0)}, false, 1, []event.Event{e(other, 2), e(other, 1)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Log(context.Background(), e(mockUser, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Log(context.Background(), e(other, 1))
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Log: got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.name == "skip" {
+				// A malformed event of another actor is skipped too, rather than rejected.
+				malformed := e(other, 3)
+				malformed.Payload = event.Push{}
+				if err := s.Log(context.Background(), malformed); err != nil {
+					t.Errorf("Log of skipped malformed event: got error %v, want nil", err)
+				}
+			}
+			var jsonl bytes.Buffer
+			err = json.NewEncoder(&jsonl).Encode(e(other, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := s.ImportJSONLines(context.Background(), &jsonl)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("ImportJSONLines: got error %v, want error: %v", err, tc.wantErr)
+			}
+			if n != tc.wantN {
+				t.Errorf("ImportJSONLines: got %d, want %d", n, tc.wantN)
+			}
+			err = s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = fs.NewService(mem, mockUser, usersService)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []event.Event{e(mockUser, 0)}; !reflect.DeepEqual(got, want) {
+				t.Errorf("List:\ngot:  %v\nwant: %v", got, want)
+			}
+			s, err = fs.NewService(mem, other, &mockUsers{Current: other.UserSpec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.wantOther) {
+				t.Errorf("List of other actor:\ngot:  %v\nwant: %v", got, tc.wantOther)
+			}
+		})
+	}
+}
+
+// TestStats tests that Stats reports events stored per user and the
+// size of their storage.
+func TestStats(t *testing.T) {
+	other := users.UserSpec{ID: 2, Domain: "example.org"}
+	e := func(actor users.UserSpec, i int) event.Event {
+		return event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, i, 3, 4, 5, 0, time.UTC),
+			Actor:     users.User{UserSpec: actor},
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+		want fs.Stats // For mockUser, except for Bytes.
+	}{
+		{"ring", []fs.Option{fs.WithRingSize(3)}, fs.Stats{User: mockUser.UserSpec, Events: 3, Oldest: e(mockUser.UserSpec, 3).Time, Newest: e(mockUser.UserSpec, 5).Time, Capacity: 3}},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}, fs.Stats{User: mockUser.UserSpec, Events: 5, Oldest: e(mockUser.UserSpec, 1).Time, Newest: e(mockUser.UserSpec, 5).Time}},
+		{"buffered", []fs.Option{fs.WithBufferedWrites(10, 0)}, fs.Stats{User: mockUser.UserSpec, Events: 5, Pending: 2, Oldest: e(mockUser.UserSpec, 1).Time, Newest: e(mockUser.UserSpec, 5).Time, Capacity: 100}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(webdav.NewMemFS(), mockUser, usersService, append(tc.opts, fs.WithOtherActors(fs.StoreOtherActors))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			stats, err := s.Stats(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != 1 || stats[0].Events != 0 || !stats[0].Oldest.IsZero() || stats[0].Bytes == 0 {
+				t.Errorf("Stats of new storage: got %+v, want 1 user with no events and a version file", stats)
+			}
+			empty := stats[0].Bytes
+
+			// Flush before logging the last two events, so that with
+			// buffered writes, they're still buffered.
+			for i := 1; i <= 5; i++ {
+				if i == 4 {
+					err := s.Flush(context.Background())
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := s.Log(context.Background(), e(mockUser.UserSpec, i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = s.Log(context.Background(), e(other, 6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err = s.Stats(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != 2 {
+				t.Fatalf("Stats: got %d users, want 2", len(stats))
+			}
+			got := stats[0]
+			if got.Bytes <= empty {
+				t.Errorf("Stats: got %d bytes, want more than %d of new storage", got.Bytes, empty)
+			}
+			got.Bytes = 0
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Stats: got %+v, want %+v", got, tc.want)
+			}
+			if got := stats[1]; got.User != other || got.Events != 1 || !got.Newest.Equal(e(other, 6).Time) {
+				t.Errorf("Stats of other actor: got %+v, want 1 event", got)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range mockEvents {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.NewService(mem, mockUser, usersService, fs.WithLoadContext(ctx))
+	if err != context.Canceled {
+		t.Errorf("NewService with canceled load context: got error %v, want %v", err, context.Canceled)
+	}
+	_, err = s.List(ctx)
+	if err != context.Canceled {
+		t.Errorf("List with canceled context: got error %v, want %v", err, context.Canceled)
+	}
+	_, err = s.ListRange(ctx, time.Time{}, time.Time{})
+	if err != context.Canceled {
+		t.Errorf("ListRange with canceled context: got error %v, want %v", err, context.Canceled)
+	}
+
+	// List doesn't wait for a write in progress.
+	block := &blockFS{FileSystem: mem, unblock: make(chan struct{})}
+	s, err = fs.NewService(block, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.blocking.Store(true)
+	logged := make(chan error)
+	go func() {
+		e := mockEvents[0]
+		e.ID = ""
+		logged <- s.Log(context.Background(), e)
+	}()
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List during Log:\ngot:  %v\nwant: %v", got, want)
+	}
+	close(block.unblock)
+	if err := <-logged; err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want)+1 {
+		t.Errorf("List after Log: got %d events, want %d", len(got), len(want)+1)
+	}
+}
+
+func TestLazyLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []fs.Option
+	}{
+		{"ring", nil},
+		{"append-only", []fs.Option{fs.WithAppendOnly()}},
+		{"JSON Lines", []fs.Option{fs.WithJSONLines()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range mockEvents {
+				err := s.Log(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count := &countFS{FileSystem: mem}
+			s, err = fs.NewService(count, mockUser, usersService, append(tc.opts, fs.WithLazyLoad())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := count.opens.Load(); n != 0 {
+				t.Errorf("NewService opened %d files, want none", n)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("first List:\ngot:  %v\nwant: %v", got, want)
+			}
+			opens := count.opens.Load()
+			got, err = s.ListRange(context.Background(), time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("ListRange: got %d events, want %d", len(got), len(want))
+			}
+			if n := count.opens.Load() - opens; n != 0 {
+				t.Errorf("listing loaded events opened %d files, want none", n)
+			}
+
+			// Logging first loads the existing events.
+			s, err = fs.NewService(mem, mockUser, usersService, append(tc.opts, fs.WithLazyLoad())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := mockEvents[0]
+			e.ID = ""
+			err = s.Log(context.Background(), e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want)+1 || !reflect.DeepEqual(got[1:], want) {
+				t.Errorf("List after Log: got %d events, want %d", len(got), len(want)+1)
+			}
+		})
+	}
+}
+
+// TestUnload tests that an unloaded service writes its buffered events,
+// and loads events again when they're next needed, with changes made
+// to storage meanwhile.
+func TestUnload(t *testing.T) {
+	var all []event.Event
+	for i := 0; i < 6; i++ {
+		all = append(all, event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+	}
+	mem := webdav.NewMemFS()
+	count := &countFS{FileSystem: mem}
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	opts := []fs.Option{fs.WithRingSize(3)}
+	s, err := fs.NewService(count, mockUser, usersService, append(opts, fs.WithBufferedWrites(10, 0))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, e := range all[:5] {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Unload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventFiles(t, mem); len(got) != 3 {
+		t.Errorf("Unload: got %d event files, want 3 with buffered events written", len(got))
+	}
+
+	// Log an event with another service, which the unloaded one picks up.
+	s2, err := fs.NewService(mem, mockUser, usersService, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s2.Log(context.Background(), all[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	opens := count.opens.Load()
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count.opens.Load() - opens; n != 0 {
+		t.Errorf("Refresh of unloaded service opened %d files, want none", n)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []event.Event{all[5], all[4], all[3]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Unload:\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+// TestRingListing tests that ring storage doesn't list event files
+// after writing or removing them, since that reads the whole directory,
+// but still notices event files written by another service.
+func TestRingListing(t *testing.T) {
+	mem := webdav.NewMemFS()
+	count := &countFS{FileSystem: mem}
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(count, mockUser, usersService, fs.WithRingSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := count.dirs.Load()
+	all := append(mockEvents[:len(mockEvents):len(mockEvents)], mockEvents...)
+	for _, e := range all {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count.dirs.Load() - dirs; n != 0 {
+		t.Errorf("Log of %d events opened %d directories, want none", len(all), n)
+	}
+	if got := eventFiles(t, mem); len(got) != 3 {
+		t.Errorf("got %d event files, want 3", len(got))
+	}
+
+	// Refresh after another service logged an event picks it up.
+	s2, err := fs.NewService(mem, mockUser, usersService, fs.WithRingSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s2.Log(context.Background(), mockEvents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := s2.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List after Refresh:\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	dir := fmt.Sprintf("%d@%s", mockUser.ID, mockUser.Domain)
+	for _, tc := range []struct {
+		name    string
+		opts    []fs.Option
+		file    string // File to corrupt, or empty for the event file of the i-th logged event.
+		i       int
+		corrupt func(b []byte) []byte
+		want    []string // Containers of events loaded from corrupted storage, latest first.
+	}{
+		{
+			name:    "ring",
+			opts:    []fs.Option{fs.WithRingSize(5)},
+			i:       2,
+			corrupt: func(b []byte) []byte { return bytes.Replace(b, []byte("repo-2"), []byte("repo-X"), 1) },
+			want:    []string{"repo-4", "repo-3", "repo-1", "repo-0"},
+		},
+		{
+			name:    "ring unknown payload type",
+			opts:    []fs.Option{fs.WithRingSize(5)},
+			i:       2,
+			corrupt: func(b []byte) []byte { return bytes.Replace(b, []byte(`"star"`), []byte(`"noSuchType"`), 1) },
+			want:    []string{"repo-4", "repo-3", "repo-1", "repo-0"},
+		},
+		{
+			name:    "ring truncated",
+			opts:    []fs.Option{fs.WithRingSize(5)},
+			i:       0,
+			corrupt: func(b []byte) []byte { return b[:len(b)/2] },
+			want:    []string{"repo-4", "repo-3", "repo-2", "repo-1"},
+		},
+		{
+			name:    "segment",
+			opts:    []fs.Option{fs.WithAppendOnly()},
+			file:    "segments/2021/01/segment-0",
+			corrupt: func(b []byte) []byte { return bytes.Replace(b, []byte("repo-2"), []byte("repo-X"), 1) },
+			want:    []string{"repo-4", "repo-3", "repo-1", "repo-0"},
+		},
+		{
+			name:    "segment truncated",
+			opts:    []fs.Option{fs.WithAppendOnly()},
+			file:    "segments/2021/01/segment-0",
+			corrupt: func(b []byte) []byte { return b[:len(b)-10] },
+			want:    []string{"repo-3", "repo-2", "repo-1", "repo-0"},
+		},
+		{
+			name:    "log",
+			opts:    []fs.Option{fs.WithJSONLines()},
+			file:    "log-0.jsonl",
+			corrupt: func(b []byte) []byte { return bytes.Replace(b, []byte("repo-2"), []byte("repo-X"), 1) },
+			want:    []string{"repo-4", "repo-3", "repo-1", "repo-0"},
+		},
+		{
+			name:    "gzip segment",
+			opts:    []fs.Option{fs.WithAppendOnly(), fs.WithGzip(true)},
+			file:    "segments/2021/01/segment-0",
+			corrupt: func(b []byte) []byte { b[len(b)-5] ^= 0xff; return b },    // Corrupt the gzip checksum of the last event.
+			want:    []string{"repo-4", "repo-3", "repo-2", "repo-1", "repo-0"}, // The event's own checksum still matches.
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := webdav.NewMemFS()
+			usersService := &mockUsers{Current: mockUser.UserSpec}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			log := func(i int) {
+				t.Helper()
+				err := s.Log(context.Background(), event.Event{
+					ID:        fmt.Sprint(i),
+					Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+					Actor:     mockUser,
+					Container: fmt.Sprintf("example.org/repo-%d", i),
+					Payload:   event.Star{},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			containers := func() []string {
+				t.Helper()
+				events, err := s.List(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				var cs []string
+				for _, e := range events {
+					cs = append(cs, strings.TrimPrefix(e.Container, "example.org/"))
+				}
+				return cs
+			}
+			for i := 0; i < 5; i++ {
+				log(i)
+			}
+
+			file := tc.file
+			if file == "" {
+				file = eventFiles(t, mem)[tc.i]
+			}
+			name := dir + "/" + file
+			f, err := mem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err = mem.OpenFile(context.Background(), name, os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(tc.corrupt(b))
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatalf("loading corrupted storage: %v", err)
+			}
+			if got := containers(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("events loaded from corrupted storage: got %q, want %q", got, tc.want)
+			}
+			corruption := s.Corruption()
+			if len(corruption) != 1 || corruption[0].Path != name {
+				t.Errorf("got corruption %v, want 1 in %s", corruption, name)
+			}
+			if len(corruption) > 0 && corruption[0].Error() == "" {
+				t.Error("got empty corruption error")
+			}
+
+			// Writes after corrupt events are intact.
+			for i := 5; i < 8; i++ {
+				log(i)
+			}
+			err = s.Delete(context.Background(), "6")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := containers()
+			s, err = fs.NewService(mem, mockUser, usersService, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := containers(); !reflect.DeepEqual(got, want) {
+				t.Errorf("events after writing and reloading: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestVerifyRepair tests that Verify reports problems with ring storage,
+// and that Repair fixes them.
+func TestVerifyRepair(t *testing.T) {
+	dir := fmt.Sprintf("%d@%s", mockUser.ID, mockUser.Domain)
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	opts := []fs.Option{fs.WithRingSize(5)}
+	s, err := fs.NewService(mem, mockUser, usersService, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := func(i int) {
+		t.Helper()
+		err := s.Log(context.Background(), event.Event{
+			ID:        fmt.Sprint(i),
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: fmt.Sprintf("example.org/repo-%d", i),
+			Payload:   event.Star{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile := func(name string, b []byte) {
+		t.Helper()
+		f, err := mem.OpenFile(context.Background(), dir+"/"+name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(b)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// verify returns the paths of problems Verify reports, relative to dir.
+	verify := func() []string {
+		t.Helper()
+		problems, err := fs.Verify(context.Background(), mem, mockUser.UserSpec, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, p := range problems {
+			paths = append(paths, strings.TrimPrefix(p.Path, dir+"/"))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	containers := func() []string {
+		t.Helper()
+		s, err := fs.NewService(mem, mockUser, usersService, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cs []string
+		for _, e := range events {
+			cs = append(cs, strings.TrimPrefix(e.Container, "example.org/"))
+		}
+		return cs
+	}
+
+	for i := 0; i < 4; i++ {
+		log(i)
+	}
+	if got := verify(); len(got) != 0 {
+		t.Errorf("Verify of consistent storage: got problems in %q, want none", got)
+	}
+
+	// Corrupt the second event file, and misname the third one.
+	names := eventFiles(t, mem)
+	writeFile(names[1], []byte("{"))
+	misnamed := names[2][:strings.LastIndex(names[2], "-")] + "-0000000000000000"
+	err = mem.Rename(context.Background(), dir+"/"+names[2], dir+"/"+misnamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{names[1], misnamed}
+	sort.Strings(want)
+	if got := verify(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify: got problems in %q, want %q", got, want)
+	}
+
+	n, err := fs.Repair(context.Background(), mem, mockUser.UserSpec, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Repair: got %d events, want 3", n)
+	}
+	if got := verify(); len(got) != 0 {
+		t.Errorf("Verify after Repair: got problems in %q, want none", got)
+	}
+	if got, want := containers(), []string{"repo-3", "repo-2", "repo-0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events after Repair: got %q, want %q", got, want)
+	}
+}
+
+// TestMigrate tests that Migrate converts storage between storage modes
+// and formats, keeping the events and removing the original files.
+func TestMigrate(t *testing.T) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	key := bytes.Repeat([]byte{0x42}, 32)
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range allPayloadsEvents {
+		err := s.Log(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files returns the names in the root and user directories of mem, sorted.
+	files := func() []string {
+		t.Helper()
+		var names []string
+		for _, dir := range []string{"/", fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain)} {
+			f, err := mem.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fis, err := f.Readdir(0)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	from := []fs.Option(nil)
+	for _, tc := range []struct {
+		name  string
+		to    []fs.Option
+		want  []event.Event
+		files []string // Names that must be in the root and user directories, other than event files.
+	}{
+		{"ring to append-only CBOR", []fs.Option{fs.WithAppendOnly(), fs.WithEncoding(fs.CBOR)}, all,
+			[]string{"1@example.org", "generation", "segments", "version"}},
+		{"append-only to encrypted JSON Lines", []fs.Option{fs.WithJSONLines(), fs.WithEncryption(key)}, all,
+			[]string{"1@example.org", "generation", "key", "log-0.jsonl", "version"}},
+		{"JSON Lines to smaller ring", []fs.Option{fs.WithRingSize(3)}, all[:3],
+			[]string{"1@example.org", "generation", "version"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := fs.Migrate(context.Background(), mem, mockUser.UserSpec, from, tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from = tc.to
+			if n != len(tc.want) {
+				t.Errorf("Migrate: got %d events, want %d", n, len(tc.want))
+			}
+			s, err := fs.NewService(mem, mockUser, usersService, tc.to...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List after Migrate: got %d events, want %d", len(got), len(tc.want))
+			}
+			var names []string
+			for _, name := range files() {
+				if !strings.HasPrefix(name, "event-") && name != "index" {
+					names = append(names, name)
+				}
+			}
+			if !reflect.DeepEqual(names, tc.files) {
+				t.Errorf("files after Migrate: got %q, want %q", names, tc.files)
+			}
+			if strings.Contains(tc.name, "to append-only") && len(eventFiles(t, mem)) != 0 {
+				t.Errorf("event files after Migrate: got %d, want none", len(eventFiles(t, mem)))
+			}
+		})
+	}
+
+	// Storage with corrupt files isn't migrated, and is left as it was.
+	names := eventFiles(t, mem)
+	f, err := mem.OpenFile(context.Background(), fmt.Sprintf("/%d@%s/%s", mockUser.ID, mockUser.Domain, names[0]), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("{"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Migrate(context.Background(), mem, mockUser.UserSpec, from, []fs.Option{fs.WithAppendOnly()})
+	if err == nil {
+		t.Error("Migrate of corrupt storage: got nil error, want non-nil")
+	}
+	if got := eventFiles(t, mem); !reflect.DeepEqual(got, names) {
+		t.Errorf("event files after failed Migrate: got %q, want %q", got, names)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	mem := webdav.NewMemFS()
+	usersService := &mockUsers{Current: mockUser.UserSpec}
+	s, err := fs.NewService(mem, mockUser, usersService)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err := s.Log(context.Background(), event.Event{
+			Time:      time.Date(2021, 1, 2, 3, 4, 5, i, time.UTC),
+			Actor:     mockUser,
+			Container: "example.org/starworthy",
+			Payload:   event.Star{},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bc := range []struct {
+		name string
+		fs   webdav.FileSystem
+	}{
+		{"mem", mem},
+		{"latency", latencyFS{FileSystem: mem, latency: time.Millisecond}}, // Like a network-backed filesystem.
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := fs.NewService(bc.fs, mockUser, usersService)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 var mockEvents = []event.Event{
 	{
 		Time:      time.Date(1, 1, 1, 0, 0, 63639271732, 105247415, time.UTC),
@@ -52,6 +3453,7 @@ var mockEvents = []event.Event{
 		Container: "example.org/some-app",
 		Payload: event.Issue{
 			Action:       "opened",
+			IssueNumber:  40,
 			IssueTitle:   "\"Create Issue\" button doesn't show up if user isn't logged in.",
 			IssueHTMLURL: "https://example.org/some-app/issues/40",
 		},
@@ -61,6 +3463,7 @@ var mockEvents = []event.Event{
 		Actor:     mockUser,
 		Container: "example.org/another-app",
 		Payload: event.IssueComment{
+			IssueNumber:    3,
 			IssueTitle:     "feature request: \"recently read\" notifications tab",
 			IssueState:     "open",
 			CommentBody:    "I am going to work on this and implement it soon.\n\nI want to prototype a different visualization/design...",
@@ -122,3 +3525,493 @@ func (m mockUsers) GetAuthenticated(ctx context.Context) (users.User, error) {
 	}
 	return m.Get(ctx, userSpec)
 }
+
+// allPayloadsEvents contains an event of every payload type,
+// with all optional fields populated.
+var allPayloadsEvents = []event.Event{
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Issue{
+			Action:       "opened",
+			IssueNumber:  40,
+			IssueTitle:   "\"Create Issue\" button doesn't show up if user isn't logged in.",
+			IssueBody:    "Steps to reproduce...",
+			IssueHTMLURL: "https://example.org/some-app/issues/40",
+			Milestone:    "v2.0",
+			Labels:       []event.LabelInfo{{Name: "bug", Color: "fc2929"}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Change{
+			Action:        "opened",
+			ChangeNumber:  41,
+			ChangeTitle:   "Show \"Create Issue\" button to logged out users.",
+			ChangeBody:    "Fixes #40.",
+			ChangeHTMLURL: "https://example.org/some-app/pull/41",
+			BaseBranch:    "master",
+			HeadBranch:    "fix-40",
+			Draft:         true,
+			ReviewState:   state.ReviewPlus1,
+			Milestone:     "v2.0",
+			Labels:        []event.LabelInfo{{Name: "bug", Color: "fc2929"}, {Name: "needs review", Color: "ededed"}},
+			References:    []event.Reference{{Container: "example.org/some-app", Number: 40, HTMLURL: "https://example.org/some-app/issues/40"}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.IssueComment{
+			Action:           event.CommentEdited,
+			IssueNumber:      3,
+			IssueTitle:       "feature request: \"recently read\" notifications tab",
+			IssueState:       state.IssueClosed,
+			CommentID:        2,
+			CommentBody:      "I am going to work on this and implement it soon.",
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			CommentHTMLURL:   "https://example.org/another-app/issues/3#comment-2",
+			References:       []event.Reference{{Container: "example.org/another-app", Number: 4, HTMLURL: "https://example.org/another-app/pull/4"}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.ChangeComment{
+			Action:           event.CommentEdited,
+			ChangeTitle:      "Add \"recently read\" notifications tab.",
+			ChangeState:      state.ChangeMerged,
+			CommentID:        5,
+			CommentBody:      "Needs work.",
+			CommentReview:    state.ReviewMinus1,
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			CommentHTMLURL:   "https://example.org/another-app/pull/4#comment-5",
+			References:       []event.Reference{{Container: "example.org/another-app", Number: 3, HTMLURL: "https://example.org/another-app/issues/3"}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.CommitComment{
+			Commit:           mockCommit,
+			CommentID:        6,
+			CommentBody:      "Nice.",
+			CommentCreatedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			Path:             "main.go",
+			Line:             42,
+			References:       []event.Reference{{Container: "example.org/another-app", Number: 4, HTMLURL: "https://example.org/another-app/pull/4"}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/another-app",
+		Payload: event.Push{
+			Branch:        "master",
+			Head:          mockCommit.SHA,
+			Before:        "3ac1e4e1c6a8e3b7be7d1e2a9e0c0f1f4c1f2a3b",
+			Commits:       []event.Commit{mockCommit},
+			TotalCommits:  25,
+			Forced:        true,
+			HeadHTMLURL:   mockCommit.HTMLURL,
+			BeforeHTMLURL: "https://example.org/another-app/commit/3ac1e4e1c6a8e3b7be7d1e2a9e0c0f1f4c1f2a3b",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/starworthy",
+		Payload:   event.Star{},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Create{
+			Type:        "repository",
+			Description: "Some app.",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Create{
+			Type:        "branch",
+			Name:        "fix-40",
+			NameHTMLURL: "https://example.org/some-app/tree/fix-40",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Fork{
+			Container:     "example.org/gopher/some-app",
+			HTMLURL:       "https://example.org/gopher/some-app",
+			Description:   "An app.",
+			DefaultBranch: "main",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Delete{
+			Type:           "branch",
+			Name:           "fix-40",
+			LastSHA:        "4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+			TreeHTMLURL:    "https://example.org/some-app/tree/4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+			CompareHTMLURL: "https://example.org/some-app/compare/4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Wiki{
+			Pages: []event.Page{{
+				Action:         "edited",
+				SHA:            "b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				Title:          "Home",
+				Summary:        "Document installation.",
+				HTMLURL:        "https://example.org/some-app/wiki/Home/b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				CompareHTMLURL: "https://example.org/some-app/wiki/Home/_compare/b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c^...b0c3a3f0a8c6532d4d5ce0ed3e4b5a7f1f6d1e2c",
+				Additions:      5,
+				Deletions:      1,
+			}},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Release{
+			TagName:    "v1.2.0",
+			Name:       "Version 1.2",
+			Body:       "This release fixes #40.",
+			Prerelease: true,
+			HTMLURL:    "https://example.org/some-app/releases/tag/v1.2.0",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload:   event.Publish{},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Member{
+			Action: "added",
+			Member: users.User{
+				UserSpec:  users.UserSpec{ID: 2, Domain: "example.org"},
+				Login:     "collaborator",
+				AvatarURL: "https://example.org/avatars/collaborator",
+			},
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/maintainer",
+		Payload: event.Sponsor{
+			Sponsorable: users.User{
+				UserSpec:  users.UserSpec{ID: 3, Domain: "example.org"},
+				Login:     "maintainer",
+				AvatarURL: "https://example.org/avatars/maintainer",
+			},
+			TierName: "$5 a month",
+			HTMLURL:  "https://example.org/sponsors/maintainer",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Assign{
+			Action: "assigned",
+			Assignee: users.User{
+				UserSpec:  users.UserSpec{ID: 2, Domain: "example.org"},
+				Login:     "collaborator",
+				AvatarURL: "https://example.org/avatars/collaborator",
+			},
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Label{
+			Action:       "labeled",
+			Label:        event.LabelInfo{Name: "bug", Color: "fc2929"},
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Milestone{
+			Action:       "milestoned",
+			Milestone:    "v1.2.0",
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Transfer{
+			IssueNumber:  1,
+			IssueTitle:   "Crash on startup",
+			IssueHTMLURL: "https://example.org/some-app/issues/1",
+		},
+	},
+	{
+		Time:      time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Actor:     mockUser,
+		Container: "example.org/some-app",
+		Payload: event.Rename{
+			From: "example.org/gopher/old-app",
+			To:   "example.org/some-app",
+		},
+	},
+}
+
+var mockCommit = event.Commit{
+	SHA:             "d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3",
+	Message:         "Fix a bug.\n\nThis change fixes a bug.",
+	AuthorAvatarURL: "https://avatars0.githubusercontent.com/u/8566911?v=4&s=32",
+	HTMLURL:         "https://example.org/another-app/commit/d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3",
+	Additions:       10,
+	Deletions:       2,
+	ChangedFiles:    3,
+}
+
+// eventFiles returns the names of event files of mockUser in fs, sorted,
+// which is the order their events were logged in.
+func eventFiles(t *testing.T, fs webdav.FileSystem) []string {
+	t.Helper()
+	f, err := fs.OpenFile(context.Background(), fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), "event-") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// crashFS is a webdav.FileSystem that simulates a crash of the process
+// using it, after writesLeft writes. The crashing write is only partially done,
+// and all modifications after it fail.
+type crashFS struct {
+	webdav.FileSystem
+	writesLeft int
+	crashed    bool
+}
+
+var errCrashed = errors.New("crashed")
+
+func (c *crashFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if c.crashed {
+		return errCrashed
+	}
+	return c.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (c *crashFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if c.crashed && flag != os.O_RDONLY {
+		return nil, errCrashed
+	}
+	f, err := c.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return crashFile{File: f, fs: c}, nil
+}
+
+func (c *crashFS) RemoveAll(ctx context.Context, name string) error {
+	if c.crashed {
+		return errCrashed
+	}
+	return c.FileSystem.RemoveAll(ctx, name)
+}
+
+func (c *crashFS) Rename(ctx context.Context, oldName, newName string) error {
+	if c.crashed {
+		return errCrashed
+	}
+	return c.FileSystem.Rename(ctx, oldName, newName)
+}
+
+type crashFile struct {
+	webdav.File
+	fs *crashFS
+}
+
+func (f crashFile) Write(p []byte) (int, error) {
+	if f.fs.crashed {
+		return 0, errCrashed
+	}
+	if f.fs.writesLeft == 0 {
+		f.fs.crashed = true
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errCrashed
+	}
+	f.fs.writesLeft--
+	return f.File.Write(p)
+}
+
+// noRenameFS is a webdav.FileSystem that doesn't support renaming.
+type noRenameFS struct {
+	webdav.FileSystem
+}
+
+func (noRenameFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrInvalid
+}
+
+// blockFS is a webdav.FileSystem where opening files for writing
+// blocks while blocking is set, until unblock is closed.
+type blockFS struct {
+	webdav.FileSystem
+	blocking atomic.Bool
+	unblock  chan struct{}
+}
+
+func (b *blockFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag != os.O_RDONLY && b.blocking.Load() {
+		<-b.unblock
+	}
+	return b.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+// latencyFS is a webdav.FileSystem that takes latency to open files.
+type latencyFS struct {
+	webdav.FileSystem
+	latency time.Duration
+}
+
+func (l latencyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	time.Sleep(l.latency)
+	return l.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+// failFS is a webdav.FileSystem whose writes fail while fail is set.
+type failFS struct {
+	webdav.FileSystem
+	fail bool
+}
+
+var errFail = errors.New("write failed")
+
+func (f *failFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if f.fail {
+		return errFail
+	}
+	return f.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (f *failFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if f.fail && flag != os.O_RDONLY {
+		return nil, errFail
+	}
+	return f.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (f *failFS) RemoveAll(ctx context.Context, name string) error {
+	if f.fail {
+		return errFail
+	}
+	return f.FileSystem.RemoveAll(ctx, name)
+}
+
+func (f *failFS) Rename(ctx context.Context, oldName, newName string) error {
+	if f.fail {
+		return errFail
+	}
+	return f.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// treeFiles returns the contents of files in the tree of mockUser in fs,
+// by path relative to it.
+func treeFiles(t *testing.T, fs webdav.FileSystem) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	var walk func(dir string)
+	walk = func(dir string) {
+		f, err := fs.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fis, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fis {
+			name := path.Join(dir, fi.Name())
+			if fi.IsDir() {
+				walk(name)
+				continue
+			}
+			f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[strings.TrimPrefix(name, fmt.Sprintf("/%d@%s/", mockUser.ID, mockUser.Domain))] = string(b)
+		}
+	}
+	walk(fmt.Sprintf("/%d@%s", mockUser.ID, mockUser.Domain))
+	return files
+}
+
+// countFS is a webdav.FileSystem that counts opened files,
+// and of those, directories.
+type countFS struct {
+	webdav.FileSystem
+	opens atomic.Int64
+	dirs  atomic.Int64
+}
+
+func (c *countFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	c.opens.Add(1)
+	f, err := c.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err == nil {
+		if fi, err := f.Stat(); err == nil && fi.IsDir() {
+			c.dirs.Add(1)
+		}
+	}
+	return f, err
+}
@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// newID returns a new ULID for an event that happened at time t.
+// See https://github.com/ulid/spec.
+//
+// The timestamp component is derived from t, so IDs of events
+// sort lexicographically in chronological order.
+func newID(t time.Time) (string, error) {
+	var b [16]byte
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(ms))
+	copy(b[:6], ts[2:])        // 48-bit timestamp.
+	_, err := rand.Read(b[6:]) // 80 bits of randomness.
+	if err != nil {
+		return "", err
+	}
+	return encodeULID(b), nil
+}
+
+// crockford is the Crockford's Base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeULID encodes the 128 bits of b into a 26 character string.
+// The encoding treats b as a 130-bit number with 2 leading zero bits.
+func encodeULID(b [16]byte) string {
+	var dst [26]byte
+	for i := range dst {
+		var v byte
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			if pos := i*5 + j - 2; pos >= 0 && b[pos/8]&(0x80>>(pos%8)) != 0 {
+				v |= 1
+			}
+		}
+		dst[i] = crockford[v]
+	}
+	return string(dst[:])
+}
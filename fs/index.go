@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// timeIndex is a list of events sorted by time,
+// so that time range queries only need to look at events in the range.
+// Events with equal times are sorted by sequence number.
+//
+// It's stored in the index file, one JSON value per line.
+type timeIndex []indexEntry
+
+type indexEntry struct {
+	Time time.Time
+	ID   string
+
+	seq int // Sequence number of the event. It's not stored on disk.
+}
+
+// buildIndex builds a time index of events, oldest first,
+// where events[0] has sequence number base.
+func buildIndex(events []event.Event, base int) timeIndex {
+	x := make(timeIndex, len(events))
+	for i, e := range events {
+		x[i] = indexEntry{Time: e.Time, ID: e.ID, seq: base + i}
+	}
+	sort.SliceStable(x, func(i, j int) bool { return x[i].Time.Before(x[j].Time) })
+	return x
+}
+
+// insert inserts entry e, which must have a higher sequence number
+// than all other entries, and reports whether it was inserted at the end.
+func (x *timeIndex) insert(e indexEntry) (atEnd bool) {
+	i := sort.Search(len(*x), func(i int) bool { return (*x)[i].Time.After(e.Time) })
+	*x = append(*x, indexEntry{})
+	copy((*x)[i+1:], (*x)[i:])
+	(*x)[i] = e
+	return i == len(*x)-1
+}
+
+// discard removes entries with sequence numbers lower than seq.
+func (x *timeIndex) discard(seq int) {
+	y := (*x)[:0]
+	for _, e := range *x {
+		if e.seq >= seq {
+			y = append(y, e)
+		}
+	}
+	*x = y
+}
+
+// search returns the range [lo, hi) of entries with Time in [since, until).
+// Zero until means there's no upper bound.
+func (x timeIndex) search(since, until time.Time) (lo, hi int) {
+	lo = sort.Search(len(x), func(i int) bool { return !x[i].Time.Before(since) })
+	hi = len(x)
+	if !until.IsZero() {
+		hi = sort.Search(len(x), func(i int) bool { return !x[i].Time.Before(until) })
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi
+}
+
+// loadIndex loads the time index of events, oldest first,
+// where events[0] has sequence number base.
+// If the index file is missing or doesn't match events,
+// the index is rebuilt from events, and ok is false.
+func loadIndex(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, events []event.Event, base int) (_ timeIndex, ok bool) {
+	x, err := readIndex(ctx, fs, user)
+	if err != nil || len(x) != len(events) {
+		return buildIndex(events, base), false
+	}
+	seqs := make(map[string]int, len(events)) // Event ID -> Sequence number.
+	for i, e := range events {
+		if _, dup := seqs[e.ID]; dup || e.ID == "" {
+			// Events can't be told apart by ID.
+			return buildIndex(events, base), false
+		}
+		seqs[e.ID] = base + i
+	}
+	for i := range x {
+		seq, found := seqs[x[i].ID]
+		if !found || !x[i].Time.Equal(events[seq-base].Time) || (i > 0 && x[i].Time.Before(x[i-1].Time)) {
+			return buildIndex(events, base), false
+		}
+		x[i].seq = seq
+	}
+	return x, true
+}
+
+// readIndex reads the index file of user.
+func readIndex(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) (timeIndex, error) {
+	f, err := vfsutil.Open(ctx, fs, indexPath(user))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var x timeIndex
+	dec := json.NewDecoder(f)
+	for {
+		var e indexEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		x = append(x, e)
+	}
+	return x, nil
+}
+
+// writeIndex writes x to the index file of user, replacing it.
+func writeIndex(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, x timeIndex) error {
+	return writeFile(ctx, fs, indexPath(user), false, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, e := range x {
+			err := enc.Encode(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
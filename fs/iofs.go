@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"context"
+	"io"
+	iofs "io/fs"
+	"os"
+	pathpkg "path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// readOnlyFS is a read-only webdav.FileSystem backed by an io/fs.FS.
+// Any attempt to modify it fails with os.ErrPermission.
+type readOnlyFS struct {
+	fsys iofs.FS
+}
+
+// name converts a webdav.FileSystem name to an io/fs.FS one.
+func (readOnlyFS) name(name string) string {
+	name = strings.TrimPrefix(pathpkg.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (readOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs readOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag != os.O_RDONLY {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	f, err := fs.fsys.Open(fs.name(name))
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{f}, nil
+}
+
+func (readOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	return &os.PathError{Op: "removeall", Path: name, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrPermission}
+}
+
+func (fs readOnlyFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return iofs.Stat(fs.fsys, fs.name(name))
+}
+
+// readOnlyFile is a webdav.File backed by an io/fs.File.
+type readOnlyFile struct {
+	iofs.File
+}
+
+func (f readOnlyFile) Readdir(count int) ([]os.FileInfo, error) {
+	d, ok := f.File.(iofs.ReadDirFile)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Err: iofs.ErrInvalid}
+	}
+	entries, err := d.ReadDir(count)
+	var fis []os.FileInfo
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return fis, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, err
+}
+
+func (f readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, &os.PathError{Op: "seek", Err: iofs.ErrInvalid}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (readOnlyFile) Write([]byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Err: os.ErrPermission}
+}
@@ -2,7 +2,9 @@ package fs
 
 import (
 	"context"
+	"crypto/cipher"
 	"encoding/json"
+	"io"
 	"os"
 	pathpkg "path"
 
@@ -10,34 +12,182 @@ import (
 	"golang.org/x/net/webdav"
 )
 
-// jsonEncodeFile encodes v into file at path, overwriting or creating it.
+// jsonEncodeFile encodes v into file at path, replacing or creating it.
 // The parent directory must exist, otherwise an error will be returned.
 func jsonEncodeFile(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
-	f, err := fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	return writeFile(ctx, fs, path, false, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// jsonEncodeFileWithMkdirAll encodes v into file at path, replacing or creating it.
+// The parent directory is created if it doesn't exist.
+func jsonEncodeFileWithMkdirAll(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
+	return writeFile(ctx, fs, path, true, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// encodeEventsFile encodes events into file at path in the specified format,
+// replacing or creating it.
+// The parent directory is created if it doesn't exist.
+func encodeEventsFile(ctx context.Context, fs webdav.FileSystem, path string, format fileFormat, events ...eventDisk) error {
+	return writeFile(ctx, fs, path, true, func(w io.Writer) error {
+		return writeEvents(w, format, true, events...)
+	})
+}
+
+// writeFile replaces or creates file at path with content written by write.
+// If mkdirAll is true, the parent directory is created if it doesn't exist.
+//
+// The file is replaced atomically, so that a crash while writing it leaves
+// either its old content or its new content, never something in between.
+// Content is written to a temporary file in the same directory, which is then
+// renamed over path. If fs can't rename it, it's copied over path instead.
+// Either way, write is called once, so it may read from a one-shot reader.
+func writeFile(ctx context.Context, fs webdav.FileSystem, path string, mkdirAll bool, write func(w io.Writer) error) error {
+	tmp := tempPath(path)
+	f, err := createFile(ctx, fs, tmp, mkdirAll)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(v)
+	err = closeAfter(f, write(f))
+	if err != nil {
+		fs.RemoveAll(ctx, tmp)
+		return err
+	}
+	err = fs.Rename(ctx, tmp, path)
+	if err == nil {
+		return nil
+	}
+
+	// Fall back to copying the temporary file over path in place,
+	// and only then removing it.
+	err = copyInPlace(ctx, fs, tmp, path)
+	if err != nil {
+		fs.RemoveAll(ctx, tmp)
+		return err
+	}
+	return fs.RemoveAll(ctx, tmp)
 }
 
-// jsonEncodeFileWithMkdirAll encodes v into file at path, overwriting or creating it.
-// The parent directory is created if it doesn't exist.
-func jsonEncodeFileWithMkdirAll(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
-	f, openError := fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if os.IsNotExist(openError) {
+// copyInPlace writes the content of file at src over file at dst,
+// truncating or creating it, without going through a temporary file.
+func copyInPlace(ctx context.Context, fs webdav.FileSystem, src, dst string) error {
+	r, err := vfsutil.Open(ctx, fs, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := createFile(ctx, fs, dst, false)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return closeAfter(f, err)
+}
+
+// tempPath returns the path of the temporary file used for writing file at path.
+// Its name starts with a dot, so it's never mistaken for an event, segment
+// or other file of the tree; one left behind by a crash is ignored,
+// and replaced the next time path is written.
+func tempPath(path string) string {
+	dir, name := pathpkg.Split(path)
+	return dir + "." + name + ".tmp"
+}
+
+// createFile opens file at path for writing, truncating or creating it.
+// If mkdirAll is true, the parent directory is created if it doesn't exist.
+func createFile(ctx context.Context, fs webdav.FileSystem, path string, mkdirAll bool) (webdav.File, error) {
+	f, openError := fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if os.IsNotExist(openError) && mkdirAll {
 		// The parent directory may not exist. Create it, and try again.
-		err := vfsutil.MkdirAll(ctx, fs, pathpkg.Dir(path), 0700)
+		err := vfsutil.MkdirAll(ctx, fs, pathpkg.Dir(path), defaultDirMode)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		f, openError = fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		f, openError = fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFileMode)
 	}
-	if openError != nil {
-		return openError
+	return f, openError
+}
+
+// appendEventsFile encodes events in the specified format and appends them to the end
+// of the file at path. The file must exist, and must already be in that format.
+func appendEventsFile(ctx context.Context, fs webdav.FileSystem, path string, format fileFormat, events ...eventDisk) error {
+	f, err := fs.OpenFile(ctx, path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return closeAfter(f, writeEvents(f, format, false, events...))
+}
+
+// copyFile replaces or creates file at dst with the content of file at src.
+func copyFile(ctx context.Context, fs webdav.FileSystem, src, dst string) error {
+	r, err := vfsutil.Open(ctx, fs, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(ctx, fs, dst, false, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// closeAfter closes f, which was written to, and returns the error
+// from writing to it, or if there was none, from closing it.
+// Closing can fail to flush written data, so its error matters.
+func closeAfter(f webdav.File, err error) error {
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// decodeEventsFile decodes all events in file at path,
+// and reports the format of the file.
+// Encrypted files are decrypted with aead.
+// If the file is corrupt, it returns the events that could be decoded,
+// and reports the corruption, as described by readEvents.
+func decodeEventsFile(ctx context.Context, fs webdav.FileSystem, path string, aead cipher.AEAD) ([]eventDisk, fileFormat, *CorruptionError, error) {
+	// Loading reads many event files, so stop once ctx is done,
+	// even if fs doesn't.
+	if err := ctx.Err(); err != nil {
+		return nil, fileFormat{}, nil, err
+	}
+	f, err := vfsutil.Open(ctx, fs, path)
+	if err != nil {
+		return nil, fileFormat{}, nil, err
 	}
 	defer f.Close()
-	return json.NewEncoder(f).Encode(v)
+	events, format, corrupt, err := readEvents(f, aead)
+	if err != nil {
+		return nil, fileFormat{}, nil, err
+	} else if corrupt != nil {
+		return events, format, &CorruptionError{Path: path, Err: corrupt}, nil
+	}
+	return events, format, nil, nil
+}
+
+// jsonAppendFile encodes v and appends it to the end of the file at path.
+// The file must exist, otherwise an error will be returned.
+func jsonAppendFile(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
+	f, err := fs.OpenFile(ctx, path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return closeAfter(f, json.NewEncoder(f).Encode(v))
 }
 
 // jsonDecodeFile decodes contents of file at path into v.
@@ -49,3 +199,21 @@ func jsonDecodeFile(ctx context.Context, fs webdav.FileSystem, path string, v in
 	defer f.Close()
 	return json.NewDecoder(f).Decode(v)
 }
+
+// fileStamp identifies a version of a file, as far as its metadata tells.
+// The zero value means the file doesn't exist.
+type fileStamp struct {
+	modTime int64 // In Unix nanoseconds.
+	size    int64
+}
+
+// statFile returns the stamp of file at path.
+func statFile(ctx context.Context, fs webdav.FileSystem, path string) (fileStamp, error) {
+	fi, err := fs.Stat(ctx, path)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	} else if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime().UnixNano(), size: fi.Size()}, nil
+}
@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+// ImportJSONLines reads events in their canonical JSON encoding,
+// as produced by event.Event.MarshalJSON, one per line, from r.
+// It stores them after any existing events in chronological order,
+// regardless of the order they're read in, and returns how many were stored.
+// It's meant for seeding storage with events exported from elsewhere.
+//
+// Events are handled as by Log, except they're stored all at once:
+// malformed events are rejected, and nothing is stored if there are any;
+// events of other users are skipped, unless WithOtherActors sets otherwise;
+// event times are converted to UTC, and empty IDs are generated;
+// events with the ID of a stored event are skipped, and of events
+// with the same ID, only one is stored. Events stored for other actors
+// are included in the returned count.
+// If ring storage can't keep all events, only the latest ones are stored.
+// Afterwards, events that aren't kept by the retention policy are discarded.
+//
+// A read-only service doesn't import events, it returns os.ErrPermission.
+func (s *Service) ImportJSONLines(ctx context.Context, r io.Reader) (int, error) {
+	if s.readOnly {
+		return 0, os.ErrPermission
+	}
+	var (
+		events  []event.Event
+		others  []users.UserSpec                         // Other actors, in the order they're first read in.
+		byActor = make(map[users.UserSpec][]event.Event) // Events of other actors.
+	)
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var e event.Event
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("event %d: %v", line, err)
+		}
+		e.Time = e.Time.UTC()
+		other := e.Actor.UserSpec != s.user.UserSpec
+		if other {
+			switch s.otherActors {
+			case SkipOtherActors:
+				continue
+			case RejectOtherActors:
+				return 0, fmt.Errorf("event %d: %v", line, s.otherActorError(e.Actor.UserSpec))
+			}
+		}
+		if err := e.Validate(); err != nil {
+			return 0, fmt.Errorf("event %d: %v", line, err)
+		}
+		e = truncateBody(e, s.maxBody)
+		if e.ID == "" {
+			e.ID, err = newID(e.Time)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if other {
+			if _, ok := byActor[e.Actor.UserSpec]; !ok {
+				others = append(others, e.Actor.UserSpec)
+			}
+			byActor[e.Actor.UserSpec] = append(byActor[e.Actor.UserSpec], e)
+			continue
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 && len(others) == 0 {
+		return 0, nil
+	}
+
+	authenticatedSpec, err := s.users.GetAuthenticatedSpec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if authenticatedSpec != s.user.UserSpec {
+		return 0, os.ErrPermission
+	}
+
+	n, err := s.importEvents(ctx, events)
+	if err != nil {
+		return 0, err
+	}
+	for _, actor := range others {
+		es := byActor[actor]
+		o, err := s.other(es[0].Actor)
+		if err != nil {
+			return n, err
+		}
+		m, err := o.importEvents(ctx, es)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// importEvents stores the valid events, which have IDs, of the user of s,
+// as described by ImportJSONLines, and returns how many were stored.
+func (s *Service) importEvents(ctx context.Context, events []event.Event) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if s.capacity != 0 && len(events) > s.capacity {
+		// Older events would only be discarded.
+		events = events[len(events)-s.capacity:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Buffered events were logged before, so write them first.
+	err := s.flush(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(ctx, events...)
+}
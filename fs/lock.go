@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// staleLockAge is how old a lock file has to be for it to be considered stale,
+	// left behind by a process that exited without releasing it.
+	// It's much longer than lockRefreshInterval, so a held lock
+	// is refreshed well before it's considered stale.
+	staleLockAge = time.Minute
+
+	// lockRetryInterval is how often a lock held by another process is retried.
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// lockRefreshInterval is how often a held lock file is rewritten,
+// so that its modification time is recent, however long it's held.
+// It's a variable so that tests can shorten it.
+var lockRefreshInterval = staleLockAge / 4
+
+// errLocked is returned by tryLock when the lock is held by another process.
+var errLocked = errors.New("storage is locked by another process")
+
+// lock acquires the storage lock of user, waiting until it's released
+// by another process that holds it, or until ctx is done.
+// The returned function releases the lock.
+//
+// If fs supports advisory file locks, they're used. Otherwise a lock file
+// is created and removed, and refreshed every lockRefreshInterval while
+// it's held. A lock file that's not been modified for staleLockAge is
+// considered stale, and is removed, see removeStaleLock. A lock file that
+// fails to be removed is recovered from the same way.
+func lock(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) (unlock func(), err error) {
+	for {
+		unlock, err := tryLock(ctx, fs, user)
+		if err != errLocked {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// flocker is implemented by filesystems that support advisory file locks,
+// which are released when the process holding them exits.
+type flocker interface {
+	// tryFlock acquires an exclusive lock on file at path, creating it
+	// with permissions perm if needed.
+	// If the lock is held by another process, it returns errLocked.
+	tryFlock(ctx context.Context, path string, perm os.FileMode) (unlock func(), err error)
+}
+
+// tryLock acquires the storage lock of user, if it's not held by another process.
+// Otherwise it returns errLocked.
+func tryLock(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) (unlock func(), err error) {
+	if fs, ok := fs.(flocker); ok {
+		return fs.tryFlock(ctx, lockPath(user), defaultFileMode)
+	}
+	name := lockPath(user)
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultFileMode)
+	if os.IsExist(err) {
+		fi, err := fs.Stat(ctx, name)
+		if os.IsNotExist(err) {
+			// Released just now.
+			return nil, errLocked
+		} else if err != nil {
+			return nil, err
+		}
+		if time.Since(fi.ModTime()) < staleLockAge {
+			return nil, errLocked
+		}
+		// Remove the stale lock file, and let the caller retry.
+		err = removeStaleLock(ctx, fs, name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errLocked
+	} else if err != nil {
+		return nil, err
+	}
+	// Record who holds the lock, to help diagnose a lock that isn't released.
+	// It's not needed for locking, so failing to write it isn't an error.
+	host, _ := os.Hostname()
+	info := lockInfo{Host: host, PID: os.Getpid(), Time: time.Now().UTC()}
+	_ = json.NewEncoder(f).Encode(info)
+	err = f.Close()
+	if err != nil {
+		fs.RemoveAll(ctx, name)
+		return nil, err
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(lockRefreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				refreshLock(fs, name, info)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		fs.RemoveAll(context.Background(), name)
+	}, nil
+}
+
+// refreshLock rewrites the lock file at name, if it's still the one
+// with info, so that it's not considered stale. Failing to refresh it
+// isn't an error, since it's tried again.
+func refreshLock(fs webdav.FileSystem, name string, info lockInfo) {
+	ctx := context.Background()
+	var got lockInfo
+	err := jsonDecodeFile(ctx, fs, name, &got)
+	if err != nil || !got.equal(info) {
+		// Unreadable, or removed and maybe acquired by another process.
+		return
+	}
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_TRUNC, defaultFileMode)
+	if err != nil {
+		return
+	}
+	_ = json.NewEncoder(f).Encode(info)
+	f.Close()
+}
+
+// removeStaleLock removes the lock file at name, which was found stale,
+// if it's still the same lock file. Other processes may have found it
+// stale at the same time, and one of them may have already removed it and
+// acquired the lock, creating a new lock file that mustn't be removed.
+//
+// So the lock file is moved to a unique name first, which only one process
+// can do, and it's removed only if it's still stale and has the same
+// content. Otherwise, it's the new lock file of another process, and
+// it's moved back. If fs can't rename files, the lock file is removed
+// only if its content didn't change, which narrows the race but can't
+// close it.
+func removeStaleLock(ctx context.Context, fs webdav.FileSystem, name string) error {
+	var stale lockInfo
+	err := jsonDecodeFile(ctx, fs, name, &stale)
+	if os.IsNotExist(err) {
+		// Removed just now.
+		return nil
+	}
+	// A lock file with no content, or partial content, is left
+	// by a process that exited while acquiring the lock. Its info
+	// is the zero value, and it's compared by that.
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	moved := fmt.Sprintf("%s.stale-%x", name, b)
+	err = fs.Rename(ctx, name, moved)
+	if os.IsNotExist(err) {
+		// Another process moved it.
+		return nil
+	} else if err != nil {
+		// Renaming isn't supported. Check it right before removing it.
+		if still, err := stillStale(ctx, fs, name, stale); !still {
+			return err
+		}
+		err := fs.RemoveAll(ctx, name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	still, err := stillStale(ctx, fs, moved, stale)
+	if err != nil {
+		return err
+	} else if still {
+		return fs.RemoveAll(ctx, moved)
+	}
+	var info lockInfo
+	_ = jsonDecodeFile(ctx, fs, moved, &info)
+
+	// It's the new lock file of another process. Put it back, unless yet
+	// another process acquired the lock since; there's no telling which
+	// one holds it then, so keep the one in place.
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultFileMode)
+	if err == nil {
+		err = closeAfter(f, json.NewEncoder(f).Encode(info))
+	} else if os.IsExist(err) {
+		err = nil
+	}
+	fs.RemoveAll(ctx, moved)
+	return err
+}
+
+// stillStale reports whether the lock file at name is still stale,
+// and is the same one that had info stale.
+func stillStale(ctx context.Context, fs webdav.FileSystem, name string, stale lockInfo) (bool, error) {
+	var info lockInfo
+	_ = jsonDecodeFile(ctx, fs, name, &info)
+	fi, err := fs.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return info.equal(stale) && time.Since(fi.ModTime()) >= staleLockAge, nil
+}
+
+// lockInfo is the content of a lock file.
+type lockInfo struct {
+	Host string
+	PID  int
+	Time time.Time // When the lock was acquired.
+}
+
+// equal reports whether i and j are the info of the same lock file.
+func (i lockInfo) equal(j lockInfo) bool {
+	return i.Host == j.Host && i.PID == j.PID && i.Time.Equal(j.Time)
+}
+
+// readGeneration reads the generation file of user.
+// A tree without one is at generation 0.
+func readGeneration(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) (int, error) {
+	var g int
+	err := jsonDecodeFile(ctx, fs, generationPath(user), &g)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return g, err
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+// TestLockRefresh tests that a lock file that's held for longer than
+// staleLockAge isn't considered stale, since it's refreshed.
+func TestLockRefresh(t *testing.T) {
+	defer func(d time.Duration) { lockRefreshInterval = d }(lockRefreshInterval)
+	lockRefreshInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	root := webdav.Dir(dir)
+	user := users.UserSpec{ID: 1, Domain: "example.org"}
+	unlock, err := lock(context.Background(), root, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the lock file, as if it were held for longer than staleLockAge.
+	name := filepath.Join(dir, filepath.FromSlash(lockPath(user)))
+	old := time.Now().Add(-2 * staleLockAge)
+	err = os.Chtimes(name, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * lockRefreshInterval)
+	if _, err := tryLock(context.Background(), root, user); err != errLocked {
+		t.Fatalf("tryLock while lock is held: got error %v, want %v", err, errLocked)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("lock file was removed as stale while held: %v", err)
+	}
+
+	// Once released, the lock file isn't refreshed anymore.
+	unlock()
+	time.Sleep(3 * lockRefreshInterval)
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("lock file after unlock: got error %v, want it not to exist", err)
+	}
+	unlock, err = tryLock(context.Background(), root, user)
+	if err != nil {
+		t.Fatalf("tryLock after unlock: %v", err)
+	}
+	unlock()
+}
+
+// TestStaleLockRace tests that when two processes find a lock file stale
+// at the same time, only one of them acquires the lock, even if the other
+// gets to removing the lock file after the first one acquired it.
+func TestStaleLockRace(t *testing.T) {
+	dir := t.TempDir()
+	user := users.UserSpec{ID: 1, Domain: "example.org"}
+	name := filepath.Join(dir, filepath.FromSlash(lockPath(user)))
+	b, err := json.Marshal(lockInfo{Host: "other", PID: 1, Time: time.Now().Add(-2 * staleLockAge)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(name, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	err = os.Chtimes(name, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := &slowStatFS{FileSystem: webdav.Dir(dir), name: lockPath(user), statted: make(chan struct{})}
+	var held, most atomic.Int32 // Number of goroutines that hold the lock, and the most of them at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lock(context.Background(), root, user)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n := held.Add(1); n > most.Load() {
+				most.Store(n)
+			}
+			time.Sleep(100 * time.Millisecond)
+			held.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if n := most.Load(); n != 1 {
+		t.Errorf("lock was held by %d goroutines at once, want 1", n)
+	}
+}
+
+// slowStatFS is a webdav.FileSystem where the first two calls to Stat
+// of file name both find it as it was, but the second one returns 50ms
+// after the first one.
+type slowStatFS struct {
+	webdav.FileSystem
+	name    string
+	calls   atomic.Int32
+	statted chan struct{} // Closed once the second call found the file.
+}
+
+func (s *slowStatFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := s.FileSystem.Stat(ctx, name)
+	if name != s.name {
+		return fi, err
+	}
+	switch s.calls.Add(1) {
+	case 1:
+		<-s.statted
+	case 2:
+		close(s.statted)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fi, err
+}
@@ -0,0 +1,279 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// logStore stores all events in log files, which are JSON Lines files
+// that hold events one per line, oldest first. Events are appended to
+// the last log file, so storing them takes a single write, and loading
+// them takes a single read per log file. Once the last log file holds
+// logFileSize events, is in a different format than the one events are
+// stored in, or is corrupt, it's rotated: a new one is started.
+//
+// Log files are numbered consecutively, in the order they're started.
+// Pruning removes log files from the start, so the first log file
+// isn't necessarily log-0.jsonl.
+type logStore struct {
+	fs       webdav.FileSystem
+	user     users.User
+	format   fileFormat // Its encoding is always JSON.
+	readOnly bool       // Whether nothing is to be written to fs.
+
+	files   []logFile // Log files, oldest first.
+	next    int       // Number of the next log file.
+	skip    int       // Number of pruned events still at the start of the first log file.
+	stamp   segmentsStamp
+	corrupt []*CorruptionError
+}
+
+// logFile describes a log file.
+type logFile struct {
+	n      int // Number of the log file.
+	count  int // Number of events in the log file. It's 0 if all of them were removed.
+	format fileFormat
+	// corrupt is whether the log file is corrupt. Only the events
+	// that could be loaded are counted, and nothing is appended to it,
+	// because events after corrupt data can't be loaded.
+	corrupt bool
+}
+
+const logFileSize = 10000 // Maximum number of events in a log file.
+
+func (s *logStore) load(ctx context.Context) ([]event.Event, error) {
+	s.files, s.next, s.skip, s.corrupt = nil, 0, 0, nil
+	ns, err := listLogFiles(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return nil, err
+	}
+	if len(ns) == 0 {
+		// There's no JSON Lines storage yet. Copy events from other storage, if any.
+		return s.copyStorage(ctx)
+	}
+	var events []event.Event
+	for i, n := range ns {
+		if i > 0 && n != ns[i-1]+1 {
+			return nil, fmt.Errorf("log-%d.jsonl is missing", ns[i-1]+1)
+		}
+		es, format, corrupt, err := loadSegment(ctx, s.fs, s.user, logPath(s.user.UserSpec, n), s.format.aead)
+		if err != nil {
+			return nil, err
+		}
+		if corrupt != nil {
+			s.corrupt = append(s.corrupt, corrupt)
+		}
+		events = append(events, es...)
+		s.files = append(s.files, logFile{n: n, count: len(es), format: format, corrupt: corrupt != nil})
+		s.next = n + 1
+	}
+	s.updateStamp(ctx)
+	return events, nil
+}
+
+// copyStorage copies events from append-only storage into s, or if there
+// are none, from ring storage, and returns them.
+// If s is read-only, events are only returned.
+func (s *logStore) copyStorage(ctx context.Context) ([]event.Event, error) {
+	segments := &segmentStore{fs: s.fs, user: s.user, format: s.format, readOnly: true}
+	events, err := segments.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.corrupt = segments.corruption()
+	if s.readOnly {
+		return events, nil
+	}
+	_, err = s.append(ctx, events...)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *logStore) corruption() []*CorruptionError { return s.corrupt }
+
+// append never drops events, so it always reports 0 dropped.
+func (s *logStore) append(ctx context.Context, events ...event.Event) (dropped int, err error) {
+	for len(events) > 0 {
+		if len(s.files) == 0 || s.last().count >= logFileSize || s.last().format != s.format || s.last().corrupt {
+			// Rotate, starting a new log file.
+			k := len(events)
+			if k > logFileSize {
+				k = logFileSize
+			}
+			f := logFile{n: s.next, count: k, format: s.format}
+			err := encodeEventsFile(ctx, s.fs, logPath(s.user.UserSpec, f.n), f.format, fromEvents(events[:k])...)
+			if err != nil {
+				return 0, err
+			}
+			s.files = append(s.files, f)
+			s.next++
+			events = events[k:]
+			continue
+		}
+		k := len(events)
+		if k > logFileSize-s.last().count {
+			k = logFileSize - s.last().count
+		}
+		err := appendEventsFile(ctx, s.fs, logPath(s.user.UserSpec, s.last().n), s.format, fromEvents(events[:k])...)
+		if err != nil {
+			return 0, err
+		}
+		s.last().count += k
+		events = events[k:]
+	}
+	s.updateStamp(ctx)
+	return 0, nil
+}
+
+// last returns the last log file. There must be at least one.
+func (s *logStore) last() *logFile { return &s.files[len(s.files)-1] }
+
+// prune removes log files whose events are all pruned.
+// The first remaining log file is rewritten without its pruned events
+// only once they make up at least half of it, same as for segment files.
+// Until then, they're left in place, and get pruned again after the next load.
+func (s *logStore) prune(ctx context.Context, n int) error {
+	n += s.skip
+	s.skip = 0
+	for len(s.files) > 0 && n >= s.files[0].count {
+		err := s.fs.RemoveAll(ctx, logPath(s.user.UserSpec, s.files[0].n))
+		if err != nil {
+			return err
+		}
+		n -= s.files[0].count
+		s.files = s.files[1:]
+	}
+	s.updateStamp(ctx)
+	if n == 0 {
+		return nil
+	} else if len(s.files) == 0 {
+		return fmt.Errorf("can't prune %d more events than are stored", n)
+	} else if 2*n < s.files[0].count {
+		s.skip = n
+		return nil
+	}
+	return s.rewrite(ctx, 0, func(events []event.Event) []event.Event { return events[n:] })
+}
+
+// remove removes the i-th oldest event. The log file with it is rewritten
+// without it. If that leaves the first log file empty, it's removed.
+// Log files after the first one are left in place even when empty,
+// so that log file numbers stay consecutive.
+func (s *logStore) remove(ctx context.Context, i int) error {
+	// Find the log file with the event, and the event's position in it.
+	// Pruned events still at the start of the first log file come before it.
+	k, pos := 0, s.skip+i
+	for k < len(s.files) && pos >= s.files[k].count {
+		pos -= s.files[k].count
+		k++
+	}
+	if k == len(s.files) {
+		return fmt.Errorf("can't remove event %d, fewer events are stored", i)
+	}
+	if k == 0 && s.files[0].count == 1 {
+		err := s.fs.RemoveAll(ctx, logPath(s.user.UserSpec, s.files[0].n))
+		if err != nil {
+			return err
+		}
+		s.files = s.files[1:]
+		s.updateStamp(ctx)
+		return nil
+	}
+	return s.rewrite(ctx, k, func(events []event.Event) []event.Event {
+		return append(events[:pos:pos], events[pos+1:]...)
+	})
+}
+
+// rewrite rewrites the k-th log file with the events f returns,
+// given the events in it. If the log file is corrupt,
+// it's rewritten without corrupt data.
+func (s *logStore) rewrite(ctx context.Context, k int, f func([]event.Event) []event.Event) error {
+	lf := &s.files[k]
+	name := logPath(s.user.UserSpec, lf.n)
+	events, _, _, err := loadSegment(ctx, s.fs, s.user, name, s.format.aead)
+	if err != nil {
+		return err
+	}
+	events = f(events)
+	err = encodeEventsFile(ctx, s.fs, name, s.format, fromEvents(events)...)
+	if err != nil {
+		return err
+	}
+	lf.count = len(events)
+	lf.format, lf.corrupt = s.format, false
+	s.updateStamp(ctx)
+	return nil
+}
+
+// changed reports whether the log files were changed by something other
+// than s since s last loaded or wrote them.
+func (s *logStore) changed(ctx context.Context) (bool, error) {
+	ns, err := listLogFiles(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return false, err
+	}
+	var stamp segmentsStamp
+	if len(ns) > 0 {
+		stamp.first, stamp.last = ns[0], ns[len(ns)-1]
+		stamp.lastFile, err = statFile(ctx, s.fs, logPath(s.user.UserSpec, stamp.last))
+		if err != nil {
+			return false, err
+		}
+	}
+	return stamp != s.stamp, nil
+}
+
+// updateStamp records the stamp of the log files after s loaded or wrote them.
+// If that fails, changed later reports a change, which only causes a reload.
+func (s *logStore) updateStamp(ctx context.Context) {
+	if len(s.files) == 0 {
+		s.stamp = segmentsStamp{}
+		return
+	}
+	first, last := s.files[0], *s.last()
+	lastFile, err := statFile(ctx, s.fs, logPath(s.user.UserSpec, last.n))
+	if err != nil {
+		lastFile = fileStamp{modTime: -1}
+	}
+	s.stamp = segmentsStamp{first: first.n, last: last.n, lastFile: lastFile}
+}
+
+// listLogFiles returns the numbers of log files of user, sorted.
+func listLogFiles(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) ([]int, error) {
+	d, err := vfsutil.Open(ctx, fs, eventsDir(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fis, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	var ns []int
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, "log-") || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "log-"), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	return ns, nil
+}
@@ -0,0 +1,587 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// schemaVersion is the current version of the tree layout and on-disk schema.
+// It's stored in the version file of each user.
+//
+// Version 0 is trees written before the schema was versioned,
+// which have no version file.
+//
+// Version 1 renames the "CommitMessage" field of commits to "Message".
+//
+// Version 2 moves segment files into year and month directories.
+//
+// Version 3 names event files after their events, and removes the ring file.
+//
+// Version 4 stores events with sums of their payloads as stored,
+// rather than checksums of their payloads as decoded.
+//
+// After changing the schema, run "go test . -run TestGolden -update" to add
+// golden trees of the new version to testdata, and keep those of earlier ones.
+const schemaVersion = 4
+
+// migrations[v] upgrades the tree of user from schema version v to v+1.
+// Encrypted files are decrypted with aead, which is nil if they aren't
+// expected. Trees with schema versions before 2 predate encryption.
+// A migration must be safe to run again if it was interrupted.
+var migrations = []func(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, aead cipher.AEAD) error{
+	0: migrateCommitMessage,
+	1: shardSegments,
+	2: nameEventFiles,
+	3: addSums,
+}
+
+// version is the content of the version file.
+type version struct {
+	Version int
+}
+
+// upgrade upgrades the tree of user to the current schema version, if needed.
+// A tree with a newer schema version than the current one is reported as an error.
+// Encrypted files are decrypted with aead.
+func upgrade(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, aead cipher.AEAD) error {
+	var v version
+	err := jsonDecodeFile(ctx, fs, versionPath(user), &v)
+	if os.IsNotExist(err) {
+		if _, err := fs.Stat(ctx, eventsDir(user)); os.IsNotExist(err) {
+			// A new tree. It starts out at the current schema version.
+			return jsonEncodeFileWithMkdirAll(ctx, fs, versionPath(user), version{Version: schemaVersion})
+		}
+		v.Version = 0
+	} else if err != nil {
+		return err
+	}
+	if v.Version > schemaVersion {
+		return fmt.Errorf("tree has schema version %d, but only versions up to %d are supported", v.Version, schemaVersion)
+	}
+	for ; v.Version < schemaVersion; v.Version++ {
+		err := migrations[v.Version](ctx, fs, user, aead)
+		if err != nil {
+			return fmt.Errorf("migrating schema from version %d to %d: %v", v.Version, v.Version+1, err)
+		}
+		err = jsonEncodeFile(ctx, fs, versionPath(user), version{Version: v.Version + 1})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVersion checks that the tree of user is at the current schema version,
+// without upgrading it. A tree that doesn't exist yet is fine.
+func checkVersion(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) error {
+	var v version
+	err := jsonDecodeFile(ctx, fs, versionPath(user), &v)
+	if os.IsNotExist(err) {
+		if _, err := fs.Stat(ctx, eventsDir(user)); os.IsNotExist(err) {
+			return nil
+		}
+		v.Version = 0
+	} else if err != nil {
+		return err
+	}
+	if v.Version != schemaVersion {
+		return fmt.Errorf("tree has schema version %d, but version %d is required", v.Version, schemaVersion)
+	}
+	return nil
+}
+
+// migrateCommitMessage renames the "CommitMessage" field of commits
+// in all event and segment files of user to "Message".
+func migrateCommitMessage(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, _ cipher.AEAD) error {
+	return rewriteEventFiles(ctx, fs, user, func(e map[string]interface{}) {
+		p, _ := e["Payload"].(map[string]interface{})
+		switch e["Type"] {
+		case "push":
+			cs, _ := p["Commits"].([]interface{})
+			for i, c := range cs {
+				if c, ok := c.(map[string]interface{}); ok {
+					cs[i] = renameField(c, "CommitMessage", "Message")
+				}
+			}
+		case "commitComment":
+			if c, ok := p["Commit"].(map[string]interface{}); ok {
+				p["Commit"] = renameField(c, "CommitMessage", "Message")
+			}
+		}
+	})
+}
+
+// shardSegments moves the segment files of user from the segments directory
+// into year and month directories, splitting segment files with events of
+// more than one month. Segment files are renumbered, keeping their order.
+func shardSegments(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, _ cipher.AEAD) error {
+	dir, old := segmentsDir(user), segmentsDir(user)+"-v1"
+	if _, err := fs.Stat(ctx, old); os.IsNotExist(err) {
+		err := fs.Rename(ctx, dir, old)
+		if os.IsNotExist(err) {
+			// No append-only storage, nothing to do.
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		// An earlier migration was interrupted. Start over.
+		err := fs.RemoveAll(ctx, dir)
+		if err != nil {
+			return err
+		}
+	}
+	files, err := listSegments(ctx, fs, old)
+	if err != nil {
+		return err
+	}
+	s := &segmentStore{fs: fs, user: users.User{UserSpec: user}}
+	for _, f := range files {
+		// Corrupt events can't be told apart from the rest, so they're left out.
+		events, format, _, err := loadSegment(ctx, fs, s.user, f.path, nil)
+		if err != nil {
+			return err
+		}
+		s.format = format
+		_, err = s.append(ctx, events...)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.RemoveAll(ctx, old)
+}
+
+// nameEventFiles renames the event files of ring storage of user from
+// event-{{idx}}, for their index in the ring, to names given by eventName,
+// and then removes the ring file. The time they were written isn't known,
+// so the time of their event is used instead, or if that's not later than
+// the one before, a nanosecond later, to keep their order. Event files
+// that aren't in the ring, or are corrupt, are removed, since they weren't loaded.
+func nameEventFiles(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, aead cipher.AEAD) error {
+	r, err := loadRing(ctx, fs, user)
+	if os.IsNotExist(err) {
+		// No ring storage, nothing to do.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if aead != nil {
+		// Otherwise, every encrypted event file would seem corrupt, and be removed.
+		err := checkKey(ctx, fs, keyPath(user), aead, false)
+		if err != nil {
+			return err
+		}
+	}
+	names, err := listEventFiles(ctx, fs, user)
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	for _, name := range names {
+		// An earlier migration may have been interrupted after renaming some.
+		if t, _, ok := parseEventName(name); ok && t.After(last) {
+			last = t
+		}
+	}
+	for i := 0; i < r.Length; i++ {
+		old := fmt.Sprintf("event-%d", r.At(i))
+		e, corrupt, err := decodeEventFile(ctx, fs, user, old, aead)
+		if os.IsNotExist(err) {
+			// An earlier migration was interrupted after renaming it.
+			continue
+		} else if err != nil {
+			return err
+		} else if corrupt != nil {
+			continue
+		}
+		t := e.Time
+		if !t.After(last) {
+			t = last.Add(time.Nanosecond)
+		}
+		last = t
+		err = renameFile(ctx, fs, eventPath(user, old), eventPath(user, eventName(t, e)))
+		if err != nil {
+			return err
+		}
+	}
+	names, err = listEventFiles(ctx, fs, user)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, "event-")); err != nil {
+			// Already renamed.
+			continue
+		}
+		err := fs.RemoveAll(ctx, eventPath(user, name))
+		if err != nil {
+			return err
+		}
+	}
+	return fs.RemoveAll(ctx, ringPath(user))
+}
+
+// addSums rewrites the event, segment and log files of user, so that
+// their events are stored with sums rather than checksums, see envelope.
+// Corrupt files are left as they are, so that they're still reported,
+// rather than having their intact events stored with new sums.
+func addSums(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, aead cipher.AEAD) error {
+	var paths []string
+	names, err := listEventFiles(ctx, fs, user)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		paths = append(paths, eventPath(user, name))
+	}
+	files, err := listSegments(ctx, fs, segmentsDir(user))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	ns, err := listLogFiles(ctx, fs, user)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		paths = append(paths, logPath(user, n))
+	}
+
+	for _, p := range paths {
+		events, format, corrupt, err := decodeEventsFile(ctx, fs, p, aead)
+		if err != nil {
+			return fmt.Errorf("rewriting %s: %v", p, err)
+		} else if corrupt != nil {
+			continue
+		}
+		err = encodeEventsFile(ctx, fs, p, format, events...)
+		if err != nil {
+			return fmt.Errorf("rewriting %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// renameFile renames file at oldPath to newPath, replacing any file there.
+// If fs can't rename it, it's copied and removed instead.
+func renameFile(ctx context.Context, fs webdav.FileSystem, oldPath, newPath string) error {
+	err := fs.Rename(ctx, oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	err = copyFile(ctx, fs, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	return fs.RemoveAll(ctx, oldPath)
+}
+
+// ringPath is the path of the ring file of user, which trees with schema
+// version before 3 have.
+func ringPath(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "ring")
+}
+
+// loadRing loads the ring file of user.
+func loadRing(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) (ring, error) {
+	var r ring
+	err := jsonDecodeFile(ctx, fs, ringPath(user), &r)
+	if err != nil {
+		return ring{}, err
+	}
+	if r.Size == 0 {
+		// Ring files written before ring size became configurable
+		// don't include it, and always used the default size.
+		r.Size = defaultRingSize
+	}
+	if r.Size < 0 || r.Start < 0 || r.Start >= r.Size || r.Length < 0 || r.Length > r.Size {
+		return ring{}, fmt.Errorf("ring file is invalid: %+v", r)
+	}
+	return r, nil
+}
+
+// renameField returns a copy of m with field from renamed to to, if m has it.
+// (The builtin delete is shadowed by the delete type in this package.)
+func renameField(m map[string]interface{}, from, to string) map[string]interface{} {
+	if _, ok := m[from]; !ok {
+		return m
+	}
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k == from {
+			k = to
+		}
+		r[k] = v
+	}
+	return r
+}
+
+// rewriteEventFiles rewrites all event and segment files of user,
+// passing each event in them to f as a generic JSON object for modification.
+func rewriteEventFiles(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, f func(e map[string]interface{})) error {
+	var paths []string
+	d, err := vfsutil.Open(ctx, fs, eventsDir(user))
+	if err != nil {
+		return err
+	}
+	fis, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), "event-") {
+			continue
+		}
+		paths = append(paths, path.Join(eventsDir(user), fi.Name()))
+	}
+	files, err := listSegments(ctx, fs, segmentsDir(user))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+
+	for _, p := range paths {
+		err := rewriteJSONFile(ctx, fs, p, f)
+		if err != nil {
+			return fmt.Errorf("rewriting %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// rewriteJSONFile rewrites the sequence of JSON objects in file at path,
+// passing each one to f for modification.
+// Numbers are preserved exactly.
+func rewriteJSONFile(ctx context.Context, fs webdav.FileSystem, path string, f func(v map[string]interface{})) error {
+	r, err := vfsutil.Open(ctx, fs, path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	enc := json.NewEncoder(&buf)
+	for {
+		var v map[string]interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			r.Close()
+			return err
+		}
+		f(v)
+		err = enc.Encode(v)
+		if err != nil {
+			r.Close()
+			return err
+		}
+	}
+	r.Close()
+
+	return writeFile(ctx, fs, path, false, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// Migrate converts the storage of user in root from the storage mode
+// and format configured by from to the ones configured by to, such as
+// from ring storage to append-only storage, from JSON to CBOR, or to
+// a different encryption key. It returns how many events are stored
+// afterwards. The tree is upgraded to the current schema version first.
+//
+// The converted tree is written next to the user's tree, and loaded back
+// and checked to hold the same events, before it replaces the user's tree,
+// so that a failed migration leaves storage as it was. The files of the
+// previous storage mode and format are removed along with the old tree.
+// Storage with corrupt files isn't migrated; see Repair.
+//
+// All events in ring storage are migrated, whatever the ring size in from.
+// Migrating to ring storage keeps only the latest events that fit
+// the ring size in to. Other options in from and to don't matter,
+// except WithPermissions in to, for files Migrate creates.
+//
+// Migrate holds the storage lock, but services that don't use locking
+// mustn't use storage while it's being migrated.
+func Migrate(ctx context.Context, root webdav.FileSystem, user users.UserSpec, from, to []Option) (int, error) {
+	fromOpts, err := newOptions(from)
+	if err != nil {
+		return 0, err
+	}
+	toOpts, err := newOptions(to)
+	if err != nil {
+		return 0, err
+	}
+	fromOpts.ringSize = int(^uint(0) >> 1)
+	root = withPermissions(root, toOpts.fileMode, toOpts.dirMode)
+	unlock, err := lock(ctx, root, user)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	err = upgrade(ctx, root, user, fromOpts.format.aead)
+	if err != nil {
+		return 0, err
+	}
+	if fromOpts.format.aead != nil {
+		err := checkKey(ctx, root, keyPath(user), fromOpts.format.aead, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	src, err := newStore(root, users.User{UserSpec: user}, fromOpts, true)
+	if err != nil {
+		return 0, err
+	}
+	events, err := src.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if corrupt := src.corruption(); len(corrupt) > 0 {
+		return 0, fmt.Errorf("storage has %d corrupt files, repair them before migrating: %v", len(corrupt), corrupt[0])
+	}
+
+	dir := eventsDir(user)
+	staging := dir + ".migrate"
+	err = root.RemoveAll(ctx, staging)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	err = vfsutil.MkdirAll(ctx, root, staging, toOpts.dirMode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := writeMigrated(ctx, subFS{root, staging}, user, toOpts, events)
+	if err != nil {
+		root.RemoveAll(ctx, staging)
+		return 0, fmt.Errorf("migrating storage: %v", err)
+	}
+
+	// Count the migration as a write, so that services that use locking reload.
+	g, err := readGeneration(ctx, root, user)
+	if err != nil {
+		root.RemoveAll(ctx, staging)
+		return 0, err
+	}
+	err = jsonEncodeFile(ctx, root, path.Join(staging, generationPath(user)), g+1)
+	if err != nil {
+		root.RemoveAll(ctx, staging)
+		return 0, err
+	}
+
+	err = replaceTree(ctx, root, dir, path.Join(staging, dir))
+	if err != nil {
+		root.RemoveAll(ctx, staging)
+		return 0, err
+	}
+	err = root.RemoveAll(ctx, staging)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeMigrated writes a tree of user with events into fs, stored with
+// options o, and checks that loading it back gives the same events,
+// or the latest ones if only those fit. It returns how many events it holds.
+func writeMigrated(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, o options, events []event.Event) (int, error) {
+	err := jsonEncodeFileWithMkdirAll(ctx, fs, versionPath(user), version{Version: schemaVersion})
+	if err != nil {
+		return 0, err
+	}
+	if o.format.aead != nil {
+		err := checkKey(ctx, fs, keyPath(user), o.format.aead, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	dst, err := newStore(fs, users.User{UserSpec: user}, o, false)
+	if err != nil {
+		return 0, err
+	}
+	_, err = dst.append(ctx, events...)
+	if err != nil {
+		return 0, err
+	}
+
+	check, err := newStore(fs, users.User{UserSpec: user}, o, true)
+	if err != nil {
+		return 0, err
+	}
+	got, err := check.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if corrupt := check.corruption(); len(corrupt) > 0 {
+		return 0, fmt.Errorf("migrated storage has corrupt files: %v", corrupt[0])
+	}
+	want := events
+	if !o.appendOnly && !o.jsonLines && len(want) > o.ringSize {
+		want = want[len(want)-o.ringSize:]
+	}
+	if len(got) != len(want) {
+		return 0, fmt.Errorf("migrated storage has %d events, want %d", len(got), len(want))
+	}
+	for i := range got {
+		g, err := fromEvent(got[i]).envelope()
+		if err != nil {
+			return 0, err
+		}
+		w, err := fromEvent(want[i]).envelope()
+		if err != nil {
+			return 0, err
+		}
+		if g.ID != w.ID || g.checksum() != w.checksum() {
+			return 0, fmt.Errorf("migrated event %d doesn't match the original one", i)
+		}
+	}
+	return len(got), nil
+}
+
+// subFS is a webdav.FileSystem with the names in fs under directory dir.
+type subFS struct {
+	fs  webdav.FileSystem
+	dir string
+}
+
+func (s subFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return s.fs.Mkdir(ctx, path.Join(s.dir, name), perm)
+}
+
+func (s subFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return s.fs.OpenFile(ctx, path.Join(s.dir, name), flag, perm)
+}
+
+func (s subFS) RemoveAll(ctx context.Context, name string) error {
+	return s.fs.RemoveAll(ctx, path.Join(s.dir, name))
+}
+
+func (s subFS) Rename(ctx context.Context, oldName, newName string) error {
+	return s.fs.Rename(ctx, path.Join(s.dir, oldName), path.Join(s.dir, newName))
+}
+
+func (s subFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return s.fs.Stat(ctx, path.Join(s.dir, name))
+}
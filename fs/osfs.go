@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"context"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+)
+
+// osFS is a webdav.FileSystem backed by the native filesystem, rooted at dir.
+// Unlike webdav.Dir, it makes changes durable before reporting success:
+// written files are synced before they're closed, and so are the directories
+// whose entries are created, removed or renamed.
+type osFS struct {
+	dir string
+}
+
+// path converts a webdav.FileSystem name to a native path within fs.dir.
+func (fs osFS) path(name string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(pathpkg.Clean("/"+name)))
+}
+
+func (fs osFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	err := os.Mkdir(fs.path(name), perm)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fs.path(name)))
+}
+
+func (fs osFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := os.OpenFile(fs.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+	return &syncFile{File: f, syncDir: flag&os.O_CREATE != 0}, nil
+}
+
+func (fs osFS) RemoveAll(ctx context.Context, name string) error {
+	path := fs.path(name)
+	if path == filepath.Clean(fs.dir) {
+		// Prohibit removing the root directory, like webdav.Dir does.
+		return os.ErrInvalid
+	}
+	err := os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (fs osFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, newPath := fs.path(oldName), fs.path(newName)
+	if oldPath == filepath.Clean(fs.dir) || newPath == filepath.Clean(fs.dir) {
+		// Prohibit renaming from or to the root directory, like webdav.Dir does.
+		return os.ErrInvalid
+	}
+	err := os.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	err = syncDir(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(oldPath) != filepath.Dir(newPath) {
+		return syncDir(filepath.Dir(oldPath))
+	}
+	return nil
+}
+
+func (fs osFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return os.Stat(fs.path(name))
+}
+
+// syncFile is a file opened for writing. Closing it syncs it first,
+// and if it was opened with os.O_CREATE, its directory too.
+type syncFile struct {
+	*os.File
+	syncDir bool
+}
+
+func (f *syncFile) Close() error {
+	err := f.File.Sync()
+	if err != nil {
+		f.File.Close()
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		return err
+	}
+	if f.syncDir {
+		return syncDir(filepath.Dir(f.File.Name()))
+	}
+	return nil
+}
+
+// syncDir syncs directory dir, so that changes to its entries are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+func (fs osFS) tryFlock(ctx context.Context, path string, perm os.FileMode) (unlock func(), err error) {
+	f, err := os.OpenFile(fs.path(path), os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, errLocked
+	} else if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
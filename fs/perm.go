@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	defaultFileMode os.FileMode = 0600 // Default permissions of created files.
+	defaultDirMode  os.FileMode = 0700 // Default permissions of created directories.
+)
+
+// permFS is a webdav.FileSystem that creates files and directories in fs
+// with the permissions file and dir, rather than the ones asked for.
+type permFS struct {
+	webdav.FileSystem
+	file, dir os.FileMode
+}
+
+// withPermissions returns fs, which creates files and directories
+// with the permissions file and dir. If fs supports advisory file locks,
+// so does the returned filesystem.
+func withPermissions(fs webdav.FileSystem, file, dir os.FileMode) webdav.FileSystem {
+	p := permFS{FileSystem: fs, file: file, dir: dir}
+	if f, ok := fs.(flocker); ok {
+		return flockPermFS{permFS: p, flocker: f}
+	}
+	return p
+}
+
+func (fs permFS) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	return fs.FileSystem.Mkdir(ctx, name, fs.dir)
+}
+
+func (fs permFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_CREATE != 0 {
+		perm = fs.file
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+// flockPermFS is a permFS backed by a filesystem that supports advisory file locks.
+type flockPermFS struct {
+	permFS
+	flocker flocker
+}
+
+func (fs flockPermFS) tryFlock(ctx context.Context, path string, _ os.FileMode) (unlock func(), err error) {
+	return fs.flocker.tryFlock(ctx, path, fs.file)
+}
@@ -0,0 +1,290 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// replicaFS is a webdav.FileSystem that mirrors every write to fs
+// to replica. Reads are only done from fs.
+//
+// Writes are done to fs first, and only the errors from fs are reported.
+// If a write to replica fails, the file it was for is copied from fs
+// to replica once it's written, and if that fails too, replica is left
+// out of date until reconcile brings it up to date.
+type replicaFS struct {
+	webdav.FileSystem
+	replica webdav.FileSystem
+}
+
+// withReplica returns fs, which mirrors every write to replica.
+// If fs supports advisory file locks, so does the returned filesystem.
+// Locks are only held in fs.
+func withReplica(fs, replica webdav.FileSystem) webdav.FileSystem {
+	r := replicaFS{FileSystem: fs, replica: replica}
+	if f, ok := fs.(flocker); ok {
+		return flockReplicaFS{replicaFS: r, flocker: f}
+	}
+	return r
+}
+
+func (fs replicaFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	err := fs.FileSystem.Mkdir(ctx, name, perm)
+	if err != nil {
+		return err
+	}
+	_ = vfsutil.MkdirAll(ctx, fs.replica, name, perm)
+	return nil
+}
+
+func (fs replicaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	rf := &replicaFile{File: f, fs: fs, ctx: ctx, name: name}
+	rf.replica, err = fs.replica.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		rf.replica = nil
+	}
+	return rf, nil
+}
+
+func (fs replicaFS) RemoveAll(ctx context.Context, name string) error {
+	err := fs.FileSystem.RemoveAll(ctx, name)
+	if err != nil {
+		return err
+	}
+	_ = fs.replica.RemoveAll(ctx, name)
+	return nil
+}
+
+func (fs replicaFS) Rename(ctx context.Context, oldName, newName string) error {
+	err := fs.FileSystem.Rename(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+	if err := fs.replica.Rename(ctx, oldName, newName); err != nil {
+		_ = copyFiles(ctx, fs.FileSystem, fs.replica, newName)
+	}
+	return nil
+}
+
+// flockReplicaFS is a replicaFS backed by a filesystem that supports advisory file locks.
+type flockReplicaFS struct {
+	replicaFS
+	flocker flocker
+}
+
+func (fs flockReplicaFS) tryFlock(ctx context.Context, path string, perm os.FileMode) (unlock func(), err error) {
+	return fs.flocker.tryFlock(ctx, path, perm)
+}
+
+// replicaFile is a file of a replicaFS open for writing.
+// Writes to it are mirrored to the same file in replica.
+type replicaFile struct {
+	webdav.File
+	fs      replicaFS
+	ctx     context.Context
+	name    string
+	replica webdav.File // Nil if the file failed to open in replica, or a write to it failed.
+}
+
+func (f *replicaFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if f.replica != nil {
+		if rn, rerr := f.replica.Write(p[:n]); rerr != nil || rn != n {
+			f.dropReplica()
+		}
+	}
+	return n, err
+}
+
+func (f *replicaFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	if err == nil && f.replica != nil {
+		if rn, rerr := f.replica.Seek(offset, whence); rerr != nil || rn != n {
+			f.dropReplica()
+		}
+	}
+	return n, err
+}
+
+func (f *replicaFile) Close() error {
+	err := f.File.Close()
+	if f.replica != nil {
+		if rerr := f.replica.Close(); rerr != nil {
+			f.replica = nil
+		}
+	}
+	if err == nil && f.replica == nil {
+		// Writing the file to replica failed. Copy it over instead.
+		_ = copyFiles(f.ctx, f.fs.FileSystem, f.fs.replica, f.name)
+	}
+	return err
+}
+
+// dropReplica stops mirroring writes to the file in replica,
+// so that it's copied over once closed.
+func (f *replicaFile) dropReplica() {
+	f.replica.Close()
+	f.replica = nil
+}
+
+// reconcileLocked is like reconcile, but holds the storage lock
+// in fs while doing it if locking is true.
+func reconcileLocked(ctx context.Context, fs, replica webdav.FileSystem, user users.UserSpec, locking bool) error {
+	if locking {
+		unlock, err := lock(ctx, fs, user)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return reconcile(ctx, fs, replica, user)
+}
+
+// reconcile brings the tree of user in replica up to date with the one
+// in fs, copying files that are missing or differ, and removing ones
+// that aren't in fs. If fs has no tree of user but replica does,
+// such as after fs was lost, the tree is restored from replica instead.
+//
+// Event files are never overwritten, so ones with the same size are taken
+// to be the same without comparing them. Other files are compared by content.
+func reconcile(ctx context.Context, fs, replica webdav.FileSystem, user users.UserSpec) error {
+	dir := eventsDir(user)
+	if _, err := fs.Stat(ctx, dir); os.IsNotExist(err) {
+		if _, err := replica.Stat(ctx, dir); err == nil {
+			fs, replica = replica, fs
+		}
+	} else if err != nil {
+		return err
+	}
+
+	src, err := listFiles(ctx, fs, dir)
+	if err != nil {
+		return err
+	}
+	dst, err := listFiles(ctx, replica, dir)
+	if err != nil {
+		return err
+	}
+	for name, size := range src {
+		if dstSize, ok := dst[name]; ok && dstSize == size {
+			if strings.HasPrefix(path.Base(name), "event-") {
+				continue
+			}
+			same, err := sameContent(ctx, fs, replica, name)
+			if err != nil {
+				return err
+			} else if same {
+				continue
+			}
+		}
+		err := copyFiles(ctx, fs, replica, name)
+		if err != nil {
+			return err
+		}
+	}
+	for name := range dst {
+		if _, ok := src[name]; ok {
+			continue
+		}
+		err := replica.RemoveAll(ctx, name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listFiles returns the sizes of files in dir and its subdirectories
+// in fs, by path. Temporary files are left out. If dir doesn't exist,
+// there are no files.
+func listFiles(ctx context.Context, fs webdav.FileSystem, dir string) (map[string]int64, error) {
+	var paths []string
+	err := walkFiles(ctx, fs, dir, func(name string) {
+		if !strings.HasPrefix(path.Base(name), ".") {
+			paths = append(paths, name)
+		}
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files := make(map[string]int64, len(paths))
+	for _, name := range paths {
+		fi, err := fs.Stat(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = fi.Size()
+	}
+	return files, nil
+}
+
+// sameContent reports whether file at path has the same content in a and b.
+func sameContent(ctx context.Context, a, b webdav.FileSystem, path string) (bool, error) {
+	ab, err := readFile(ctx, a, path)
+	if err != nil {
+		return false, err
+	}
+	bb, err := readFile(ctx, b, path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+// readFile returns the content of file at path.
+func readFile(ctx context.Context, fs webdav.FileSystem, path string) ([]byte, error) {
+	f, err := vfsutil.Open(ctx, fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// copyFiles replaces or creates the file or directory at name in dst
+// with a copy of the one in src, creating parent directories as needed.
+func copyFiles(ctx context.Context, src, dst webdav.FileSystem, name string) error {
+	fi, err := src.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err := dst.RemoveAll(ctx, name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var copyErr error
+		err = walkFiles(ctx, src, name, func(name string) {
+			if copyErr == nil {
+				copyErr = copyFiles(ctx, src, dst, name)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return copyErr
+	}
+	r, err := vfsutil.Open(ctx, src, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(ctx, dst, name, true, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
@@ -0,0 +1,316 @@
+package fs
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// ringStore stores up to size events, each in its own event file.
+// Event files are named by eventName, so they sort in the order they
+// were written, and they're never overwritten. Once size events are stored,
+// appending an event removes the event file of the oldest one.
+type ringStore struct {
+	fs       webdav.FileSystem
+	user     users.User
+	size     int
+	format   fileFormat
+	readOnly bool // Whether nothing is to be written to fs.
+
+	names   []string  // Names of event files of stored events, oldest first.
+	listing []string  // Names of all event files when s last loaded or wrote them, sorted.
+	last    time.Time // Latest time in the name of an event file.
+
+	// bad holds the names of corrupt event files, sorted. Their events
+	// are skipped, and they're removed once older events are pruned.
+	bad     []string
+	corrupt []*CorruptionError
+}
+
+func (s *ringStore) load(ctx context.Context) ([]event.Event, error) {
+	listing, err := listEventFiles(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return nil, err
+	}
+	events, names, bad, corrupt, err := loadEventFiles(ctx, s.fs, s.user, listing, s.format.aead)
+	if err != nil {
+		return nil, err
+	}
+	s.names, s.listing, s.bad, s.corrupt = names, listing, bad, corrupt
+	s.last = time.Time{}
+	for _, name := range listing {
+		if t, _, ok := parseEventName(name); ok && t.After(s.last) {
+			s.last = t
+		}
+	}
+	if n := len(events) - s.size; n > 0 {
+		// The ring size was reduced, or removing the oldest events
+		// after appending failed. Keep only the latest ones.
+		if s.readOnly {
+			s.names = s.names[n:]
+		} else {
+			err := s.prune(ctx, n)
+			if err != nil {
+				return nil, err
+			}
+		}
+		events = events[n:]
+	}
+	return events, nil
+}
+
+func (s *ringStore) corruption() []*CorruptionError { return s.corrupt }
+
+func (s *ringStore) append(ctx context.Context, events ...event.Event) (dropped int, err error) {
+	if len(events) > s.size {
+		// Older events would only be removed.
+		dropped = len(events) - s.size
+		events = events[dropped:]
+	}
+
+	// Write the new event files, then remove the oldest ones,
+	// so that partial failure leaves extra events rather than fewer.
+	names := make([]string, len(events))
+	for i, e := range events {
+		d := fromEvent(e)
+		names[i] = eventName(s.nextTime(), d)
+		err := encodeEventsFile(ctx, s.fs, eventPath(s.user.UserSpec, names[i]), s.format, d)
+		if err != nil {
+			return 0, err
+		}
+		s.addListed(names[i])
+	}
+	s.names = append(s.names, names...)
+	if n := len(s.names) - s.size; n > 0 {
+		// The new events are stored, so failing to remove the oldest
+		// ones isn't treated as an error. They're removed by a later load.
+		_ = s.prune(ctx, n)
+		if len(s.names) > s.size {
+			s.names = s.names[len(s.names)-s.size:]
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+// nextTime returns the time to name the next event file written after,
+// which is later than that of any event file before it,
+// even if the clock doesn't advance or goes back.
+func (s *ringStore) nextTime() time.Time {
+	t := time.Now().UTC().Round(0)
+	if !t.After(s.last) {
+		t = s.last.Add(time.Nanosecond)
+	}
+	s.last = t
+	return t
+}
+
+func (s *ringStore) prune(ctx context.Context, n int) error {
+	if n > len(s.names) {
+		return fmt.Errorf("can't prune %d events from ring of length %d", n, len(s.names))
+	}
+	if n == 0 {
+		return nil
+	}
+	for _, name := range s.names[:n] {
+		err := s.fs.RemoveAll(ctx, eventPath(s.user.UserSpec, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.removeListed(name)
+	}
+	// Prune corrupt event files that are older than the pruned events too.
+	last := s.names[n-1]
+	bad := s.bad[:0]
+	for _, name := range s.bad {
+		if name > last {
+			bad = append(bad, name)
+			continue
+		}
+		err := s.fs.RemoveAll(ctx, eventPath(s.user.UserSpec, name))
+		if err != nil && !os.IsNotExist(err) {
+			bad = append(bad, name)
+			continue
+		}
+		s.removeListed(name)
+	}
+	s.bad = bad
+	s.names = s.names[n:]
+	return nil
+}
+
+// remove removes the i-th oldest event.
+func (s *ringStore) remove(ctx context.Context, i int) error {
+	if i < 0 || i >= len(s.names) {
+		return fmt.Errorf("can't remove event %d from ring of length %d", i, len(s.names))
+	}
+	err := s.fs.RemoveAll(ctx, eventPath(s.user.UserSpec, s.names[i]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.removeListed(s.names[i])
+	s.names = append(s.names[:i], s.names[i+1:]...)
+	return nil
+}
+
+// changed reports whether event files were added or removed by something
+// other than s since s last loaded or wrote them.
+func (s *ringStore) changed(ctx context.Context) (bool, error) {
+	listing, err := listEventFiles(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return false, err
+	}
+	if len(listing) != len(s.listing) {
+		return true, nil
+	}
+	for i := range listing {
+		if listing[i] != s.listing[i] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addListed records that s wrote the event file name. Listing the event
+// files after each write would take reading the whole directory, so
+// the listing is kept up to date instead, and only made by load.
+func (s *ringStore) addListed(name string) {
+	i := sort.SearchStrings(s.listing, name)
+	if i < len(s.listing) && s.listing[i] == name {
+		return
+	}
+	s.listing = append(s.listing, "")
+	copy(s.listing[i+1:], s.listing[i:])
+	s.listing[i] = name
+}
+
+// removeListed records that s removed the event file name.
+func (s *ringStore) removeListed(name string) {
+	i := sort.SearchStrings(s.listing, name)
+	if i < len(s.listing) && s.listing[i] == name {
+		s.listing = append(s.listing[:i], s.listing[i+1:]...)
+	}
+}
+
+// listEventFiles returns the names of event files of user, sorted.
+func listEventFiles(ctx context.Context, fs webdav.FileSystem, user users.UserSpec) ([]string, error) {
+	d, err := vfsutil.Open(ctx, fs, eventsDir(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fis, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), "event-") {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadConcurrency is the maximum number of event files loaded concurrently.
+// Each load is mostly waiting on the filesystem, which for network-backed
+// filesystems takes long, so loading several at once speeds it up.
+const loadConcurrency = 16
+
+// loadEventFiles loads the events in event files of user with the specified
+// names, in the same order, and returns the names of the ones that loaded.
+// Event files are loaded concurrently.
+// Corrupt event files are skipped. Their names are returned as bad.
+// Encrypted event files are decrypted with aead.
+func loadEventFiles(ctx context.Context, fs webdav.FileSystem, user users.User, names []string, aead cipher.AEAD) (_ []event.Event, good, bad []string, _ []*CorruptionError, _ error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		events  = make([]event.Event, len(names))
+		corrupt = make([]*CorruptionError, len(names))
+		next    = make(chan int)
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		err     error // First error loading an event file.
+	)
+	workers := loadConcurrency
+	if len(names) < workers {
+		workers = len(names)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				e, c, loadErr := loadEventFile(ctx, fs, user, names[i], aead)
+				if loadErr != nil {
+					// Loading fails, so stop loading the others.
+					errOnce.Do(func() { err = loadErr })
+					cancel()
+					continue
+				}
+				events[i], corrupt[i] = e, c
+			}
+		}()
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var cs []*CorruptionError
+	loaded := events[:0]
+	for i, e := range events {
+		if corrupt[i] != nil {
+			bad, cs = append(bad, names[i]), append(cs, corrupt[i])
+			continue
+		}
+		loaded, good = append(loaded, e), append(good, names[i])
+	}
+	return loaded, good, bad, cs, nil
+}
+
+// loadEventFile loads the event in event file name of user.
+// If the event file is corrupt, it's reported as corrupt.
+func loadEventFile(ctx context.Context, fs webdav.FileSystem, user users.User, name string, aead cipher.AEAD) (_ event.Event, corrupt *CorruptionError, _ error) {
+	e, corrupt, err := decodeEventFile(ctx, fs, user.UserSpec, name, aead)
+	if err != nil || corrupt != nil {
+		return event.Event{}, corrupt, err
+	}
+	return e.Event(user), nil, nil
+}
+
+// decodeEventFile decodes the event in event file name of user.
+// Encrypted event files are decrypted with aead.
+// If the event file is corrupt, or doesn't hold exactly one event,
+// it's reported as corrupt.
+func decodeEventFile(ctx context.Context, fs webdav.FileSystem, user users.UserSpec, name string, aead cipher.AEAD) (eventDisk, *CorruptionError, error) {
+	path := eventPath(user, name)
+	es, _, corrupt, err := decodeEventsFile(ctx, fs, path, aead)
+	if err != nil {
+		return eventDisk{}, nil, err
+	} else if corrupt != nil {
+		return eventDisk{}, corrupt, nil
+	}
+	if len(es) != 1 {
+		return eventDisk{}, &CorruptionError{Path: path, Err: fmt.Errorf("has %d events, want 1", len(es))}, nil
+	}
+	return es[0], nil, nil
+}
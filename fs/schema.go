@@ -1,12 +1,17 @@
 package fs
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"path"
+	"strings"
 	"time"
 
 	"dmitri.shuralyov.com/state"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/shurcooL/events/event"
 	"github.com/shurcooL/users"
 )
@@ -14,216 +19,448 @@ import (
 // Tree layout:
 //
 // 	root
+// 	├── userSpec.lock
+// 	├── userSpec.snapshots
+// 	│   ├── 20241201T120000.000000000Z
+// 	│   │   └── ...
+// 	│   └── {{time}}
+// 	│       └── ...
 // 	└── userSpec
-// 	    ├── ring
-// 	    ├── event-0
-// 	    ├── event-1
-// 	    ├── event-2
+// 	    ├── version
+// 	    ├── key
+// 	    ├── generation
+// 	    ├── index
+// 	    ├── event-20241130T090000.000000000Z-3f2a9c0d1e5b7a64
+// 	    ├── event-20241201T120000.000000000Z-b0c4e1f2a3d59687
 // 	    ├── ...
-// 	    └── event-{{ringSize-1}}
+// 	    ├── event-{{time}}-{{key}}
+// 	    ├── log-0.jsonl
+// 	    ├── ...
+// 	    ├── log-{{n-1}}.jsonl
+// 	    └── segments
+// 	        ├── 2024
+// 	        │   ├── 11
+// 	        │   │   ├── segment-0
+// 	        │   │   └── segment-1
+// 	        │   └── 12
+// 	        │       └── segment-2
+// 	        ├── ...
+// 	        └── {{year}}
+// 	            └── {{month}}
+// 	                └── segment-{{n-1}}
+//
+// Ring storage uses the event files, append-only storage uses
+// the segment files, and JSON Lines storage uses the log files.
+// Each event file holds one event, and is named
+// after the time it was written and the ID of its event, as described
+// by eventName, so event files sort in the order events were logged.
+// An event file is never overwritten.
+// Segment files are in directories for the year and month of their events.
+// The index file is used in all storage modes.
+// The version file holds the schema version of the tree.
+// Events in event, segment and log files are stored with checksums.
+// The key file is only used when event, segment and log files are encrypted,
+// to check the encryption key.
+//
+// Snapshots hold copies of the tree, without the generation file,
+// named after the time they were taken.
+//
+// The lock and generation files are only used when storage is shared
+// between processes. The lock file is held while writing, and the generation
+// file counts writes, so that a process can tell when another one wrote.
 
 func eventsDir(user users.UserSpec) string {
 	return marshalUserSpec(user)
 }
 
-func ringPath(user users.UserSpec) string {
-	return path.Join(eventsDir(user), "ring")
+func eventPath(user users.UserSpec, name string) string {
+	return path.Join(eventsDir(user), name)
+}
+
+// eventName returns the name of the event file of e, written at time t.
+// It's made of t, in UTC with fixed width so that names sort by time,
+// and the key of e. Ring storage writes each event file at a later t
+// than the one before it, so names sort in the order events were written.
+func eventName(t time.Time, e eventDisk) string {
+	return "event-" + t.UTC().Format(eventTimeFormat) + "-" + eventKey(e)
+}
+
+// eventKey returns the key of e, which is derived from its ID. Events
+// without an ID, which were logged before IDs were generated, get a key
+// derived from their content instead.
+func eventKey(e eventDisk) string {
+	b := []byte(e.ID)
+	if e.ID == "" {
+		// The content is the envelope with the checksum it had
+		// before sums were added, so that keys don't change.
+		v, _ := e.envelope()
+		v.Checksum = v.checksum()
+		b, _ = json.Marshal(v)
+	}
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// parseEventName parses the time and key from an event file name.
+// It reports whether name is in the format eventName returns.
+func parseEventName(name string) (t time.Time, key string, ok bool) {
+	rest := strings.TrimPrefix(name, "event-")
+	i := strings.LastIndexByte(rest, '-')
+	if rest == name || i == -1 {
+		return time.Time{}, "", false
+	}
+	t, err := time.Parse(eventTimeFormat, rest[:i])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return t, rest[i+1:], true
+}
+
+const eventTimeFormat = "20060102T150405.000000000Z"
+
+func versionPath(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "version")
+}
+
+func keyPath(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "key")
+}
+
+func lockPath(user users.UserSpec) string {
+	return eventsDir(user) + ".lock"
+}
+
+func snapshotsDir(user users.UserSpec) string {
+	return eventsDir(user) + ".snapshots"
 }
 
-func eventPath(user users.UserSpec, idx int) string {
-	return path.Join(eventsDir(user), fmt.Sprintf("event-%d", idx))
+func generationPath(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "generation")
+}
+
+func indexPath(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "index")
+}
+
+func segmentsDir(user users.UserSpec) string {
+	return path.Join(eventsDir(user), "segments")
+}
+
+func segmentPath(user users.UserSpec, month time.Time, n int) string {
+	return path.Join(segmentsDir(user), fmt.Sprintf("%04d", month.Year()), fmt.Sprintf("%02d", month.Month()), fmt.Sprintf("segment-%d", n))
+}
+
+func logPath(user users.UserSpec, n int) string {
+	return path.Join(eventsDir(user), fmt.Sprintf("log-%d.jsonl", n))
 }
 
 func marshalUserSpec(us users.UserSpec) string {
 	return fmt.Sprintf("%d@%s", us.ID, us.Domain)
 }
 
-// ring has capacity of ringSize elements.
-// Zero value is an empty ring.
+// ring is the content of the ring file of trees with schema version
+// before 3, which held the event files event-0 to event-{{Size-1}}.
+// It has capacity of Size elements.
 type ring struct {
-	Start  int // Index of first element in ring, in [0, ringSize-1] range.
-	Length int // Number of elements within ring, in [0, ringSize] range.
+	Start  int // Index of first element in ring, in [0, Size-1] range.
+	Length int // Number of elements within ring, in [0, Size] range.
+
+	// Size is the maximum capacity of the ring. It must be positive.
+	//
+	// It's omitted from older ring files, which always have defaultRingSize capacity.
+	Size int `json:",omitempty"`
 }
 
-const ringSize = 100 // Maximum capacity of the ring.
+const defaultRingSize = 100 // Default maximum number of events in ring storage.
 
 // At returns i-th index from start.
 func (r ring) At(i int) int {
-	return (r.Start + i) % ringSize
-}
-
-// Next returns a copy of ring with the next element added,
-// and the index of that element.
-func (r ring) Next() (ring ring, idx int) {
-	ring = r
-	if ring.Length < ringSize {
-		ring.Length++
-	} else {
-		ring.Start = (ring.Start + 1) % ringSize
-	}
-	idx = (ring.Start + ring.Length - 1) % ringSize
-	return ring, idx
+	return (r.Start + i) % r.Size
 }
 
 // eventDisk is an on-disk representation of event.Event.
 // Actor is omitted from struct because it's encoded as part of event file path.
 type eventDisk struct {
+	ID        string
 	Time      time.Time
 	Container string
-	Payload   interface{} // One of event.{Issue,Change,IssueComment,ChangeComment,CommitComment,Push,Star,Create,Fork,Delete,Wiki}.
+	Payload   event.Payload
 }
 
-func (e eventDisk) MarshalJSON() ([]byte, error) {
-	v := struct {
-		Time      time.Time
-		Container string
-		Type      string
-		Payload   interface{}
-	}{
+// envelope is the on-disk structure of an event,
+// with the payload in its on-disk representation.
+type envelope struct {
+	ID        string `json:",omitempty"`
+	Time      time.Time
+	Container string
+	Type      string
+	Payload   interface{}
+
+	// Checksum is the checksum of the rest of the envelope, as computed
+	// by checksum. Events written before schema version 4 have it instead
+	// of Sum, and ones written before it was added have neither.
+	Checksum uint32 `json:",omitempty"`
+
+	// Sum is the checksum of the envelope as stored, as computed by sum,
+	// for detecting corruption.
+	Sum uint32 `json:",omitempty"`
+}
+
+// checksum returns the checksum of v, which is the CRC-32 of the JSON
+// encoding of v without its checksums. It doesn't depend on the encoding
+// and compression of the file v is in, so it's verified after decoding v.
+// It does depend on the on-disk representation of payloads, though, so
+// it's only verified for events written before schema version 4, whose
+// payloads are decoded into the same representation they were written from.
+func (v envelope) checksum() uint32 {
+	v.Checksum, v.Sum = 0, 0
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Encoding v fails the same way.
+		return 0
+	}
+	return crc32.ChecksumIEEE(b)
+}
+
+// sum returns the checksum of v, whose payload is stored as payload,
+// which is the CRC-32 of the other fields of v, and of payload as it is.
+// Since payload isn't decoded and encoded again, the sum doesn't change
+// when fields are added to payloads, or aren't known to the reader.
+func (v envelope) sum(payload []byte) uint32 {
+	h := crc32.NewIEEE()
+	fmt.Fprintf(h, "%q %s %q %q ", v.ID, v.Time.UTC().Format(time.RFC3339Nano), v.Container, v.Type)
+	h.Write(payload)
+	return h.Sum32()
+}
+
+// errChecksum is returned when decoding an event whose checksum doesn't match.
+var errChecksum = errors.New("event checksum doesn't match")
+
+// errPayloadType is returned when decoding an event whose payload type
+// is unknown, such as one stored by a later version of this package.
+var errPayloadType = errors.New("unknown payload type")
+
+// envelope returns the envelope of e, without checksums. It returns
+// an error if e has a payload type that has no on-disk representation,
+// rather than losing the payload.
+func (e eventDisk) envelope() (envelope, error) {
+	v := envelope{
+		ID:        e.ID,
 		Time:      e.Time,
 		Container: e.Container,
 	}
-	switch p := e.Payload.(type) {
-	case event.Issue:
-		v.Type = "issue"
-		v.Payload = fromIssue(p)
-	case event.Change:
-		v.Type = "change"
-		v.Payload = fromChange(p)
-	case event.IssueComment:
-		v.Type = "issueComment"
-		v.Payload = fromIssueComment(p)
-	case event.ChangeComment:
-		v.Type = "changeComment"
-		v.Payload = fromChangeComment(p)
-	case event.CommitComment:
-		v.Type = "commitComment"
-		v.Payload = fromCommitComment(p)
-	case event.Push:
-		v.Type = "push"
-		v.Payload = fromPush(p)
-	case event.Star:
-		v.Type = "star"
-		v.Payload = fromStar(p)
-	case event.Create:
-		v.Type = "create"
-		v.Payload = fromCreate(p)
-	case event.Fork:
-		v.Type = "fork"
-		v.Payload = fromFork(p)
-	case event.Delete:
-		v.Type = "delete"
-		v.Payload = fromDelete(p)
-	case event.Wiki:
-		v.Type = "wiki"
-		v.Payload = fromWiki(p)
+	dp, ok := diskPayloads[e.Payload.EventType()]
+	if !ok {
+		return envelope{}, fmt.Errorf("unsupported payload type %T", e.Payload)
+	}
+	v.Payload = dp.from(e.Payload)
+	v.Type = diskType(e.Payload.EventType())
+	return v, nil
+}
+
+// stored returns the envelope of e as it's stored, with its payload
+// encoded by marshal and wrapped by raw, so that it's stored as it's
+// encoded, and with the sum of that.
+func (e eventDisk) stored(marshal func(v interface{}) ([]byte, error), raw func(b []byte) interface{}) (envelope, error) {
+	v, err := e.envelope()
+	if err != nil {
+		return envelope{}, err
+	}
+	b, err := marshal(v.Payload)
+	if err != nil {
+		return envelope{}, err
+	}
+	v.Payload, v.Sum = raw(b), v.sum(b)
+	return v, nil
+}
+
+// verify reports errChecksum if e doesn't match the checksums decoded
+// along with it: sum, of payload, which is the payload of e as stored,
+// or, for events written before sums were added, checksum.
+// Zero ones aren't verified.
+func (e eventDisk) verify(payload []byte, checksum, sum uint32) error {
+	if sum == 0 && checksum == 0 {
+		return nil
+	}
+	v, err := e.envelope()
+	if err != nil {
+		return err
+	}
+	if sum != 0 && v.sum(payload) != sum || sum == 0 && v.checksum() != checksum {
+		return errChecksum
+	}
+	return nil
+}
+
+func (e eventDisk) MarshalJSON() ([]byte, error) {
+	v, err := e.stored(json.Marshal, func(b []byte) interface{} { return json.RawMessage(b) })
+	if err != nil {
+		return nil, err
 	}
 	return json.Marshal(v)
 }
 
+func (e eventDisk) MarshalCBOR() ([]byte, error) {
+	v, err := e.stored(cborEncMode.Marshal, func(b []byte) interface{} { return cbor.RawMessage(b) })
+	if err != nil {
+		return nil, err
+	}
+	return cborEncMode.Marshal(v)
+}
+
 func (e *eventDisk) UnmarshalJSON(b []byte) error {
 	// Ignore null, like in the main JSON package.
 	if string(b) == "null" {
 		return nil
 	}
 	var v struct {
+		ID        string
 		Time      time.Time
 		Container string
 		Type      string
 		Payload   json.RawMessage
+		Checksum  uint32
+		Sum       uint32
 	}
 	err := json.Unmarshal(b, &v)
 	if err != nil {
 		return err
 	}
+	p, err := decodePayload(v.Type, func(p interface{}) error { return json.Unmarshal(v.Payload, p) })
+	if err != nil {
+		return err
+	}
 	*e = eventDisk{
+		ID:        v.ID,
 		Time:      v.Time,
 		Container: v.Container,
+		Payload:   p,
 	}
-	switch v.Type {
-	case "issue":
-		var p issue
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Issue()
-	case "change":
-		var p change
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Change()
-	case "issueComment":
-		var p issueComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.IssueComment()
-	case "changeComment":
-		var p changeComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.ChangeComment()
-	case "commitComment":
-		var p commitComment
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.CommitComment()
-	case "push":
-		var p push
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Push()
-	case "star":
-		var p star
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Star()
-	case "create":
-		var p create
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Create()
-	case "fork":
-		var p fork
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Fork()
-	case "delete":
-		var p delete
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Delete()
-	case "wiki":
-		var p wiki
-		err := json.Unmarshal(v.Payload, &p)
-		if err != nil {
-			return err
-		}
-		e.Payload = p.Wiki()
+	return e.verify(v.Payload, v.Checksum, v.Sum)
+}
+
+func (e *eventDisk) UnmarshalCBOR(b []byte) error {
+	// Ignore null, like in the main CBOR package.
+	if len(b) == 1 && b[0] == 0xf6 {
+		return nil
 	}
-	return nil
+	var v struct {
+		ID        string
+		Time      time.Time
+		Container string
+		Type      string
+		Payload   cbor.RawMessage
+		Checksum  uint32
+		Sum       uint32
+	}
+	err := cbor.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	p, err := decodePayload(v.Type, func(p interface{}) error { return cbor.Unmarshal(v.Payload, p) })
+	if err != nil {
+		return err
+	}
+	*e = eventDisk{
+		ID:        v.ID,
+		Time:      v.Time,
+		Container: v.Container,
+		Payload:   p,
+	}
+	return e.verify(v.Payload, v.Checksum, v.Sum)
+}
+
+// decodePayload decodes a payload of on-disk type typ.
+// unmarshal decodes its on-disk representation into the value pointed to by p.
+func decodePayload(typ string, unmarshal func(p interface{}) error) (event.Payload, error) {
+	dp, ok := diskPayloads[eventTypes[typ]]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errPayloadType, typ)
+	}
+	p := dp.new()
+	err := unmarshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return p.payload(), nil
+}
+
+// diskPayload is an on-disk representation of a payload.
+type diskPayload interface {
+	// payload returns the payload it represents.
+	payload() event.Payload
+}
+
+func (p issue) payload() event.Payload         { return p.Issue() }
+func (p change) payload() event.Payload        { return p.Change() }
+func (p issueComment) payload() event.Payload  { return p.IssueComment() }
+func (p changeComment) payload() event.Payload { return p.ChangeComment() }
+func (p commitComment) payload() event.Payload { return p.CommitComment() }
+func (p push) payload() event.Payload          { return p.Push() }
+func (p star) payload() event.Payload          { return p.Star() }
+func (p create) payload() event.Payload        { return p.Create() }
+func (p fork) payload() event.Payload          { return p.Fork() }
+func (p delete) payload() event.Payload        { return p.Delete() }
+func (p wiki) payload() event.Payload          { return p.Wiki() }
+func (p release) payload() event.Payload       { return p.Release() }
+func (p publish) payload() event.Payload       { return p.Publish() }
+func (p member) payload() event.Payload        { return p.Member() }
+func (p sponsor) payload() event.Payload       { return p.Sponsor() }
+func (p assign) payload() event.Payload        { return p.Assign() }
+func (p labelEvent) payload() event.Payload    { return p.Label() }
+func (p milestone) payload() event.Payload     { return p.Milestone() }
+func (p transfer) payload() event.Payload      { return p.Transfer() }
+func (p rename) payload() event.Payload        { return p.Rename() }
+
+// diskPayloads maps event types, as returned by event.Payload.EventType,
+// to the functions that convert payloads of that type to their on-disk
+// representation, and that return a pointer to a new zero on-disk
+// representation to decode into.
+// It must have an entry for each of event.PayloadTypes.
+var diskPayloads = map[string]struct {
+	from func(event.Payload) diskPayload
+	new  func() diskPayload
+}{
+	"Issue":         {func(p event.Payload) diskPayload { return fromIssue(p.(event.Issue)) }, func() diskPayload { return new(issue) }},
+	"Change":        {func(p event.Payload) diskPayload { return fromChange(p.(event.Change)) }, func() diskPayload { return new(change) }},
+	"IssueComment":  {func(p event.Payload) diskPayload { return fromIssueComment(p.(event.IssueComment)) }, func() diskPayload { return new(issueComment) }},
+	"ChangeComment": {func(p event.Payload) diskPayload { return fromChangeComment(p.(event.ChangeComment)) }, func() diskPayload { return new(changeComment) }},
+	"CommitComment": {func(p event.Payload) diskPayload { return fromCommitComment(p.(event.CommitComment)) }, func() diskPayload { return new(commitComment) }},
+	"Push":          {func(p event.Payload) diskPayload { return fromPush(p.(event.Push)) }, func() diskPayload { return new(push) }},
+	"Star":          {func(p event.Payload) diskPayload { return fromStar(p.(event.Star)) }, func() diskPayload { return new(star) }},
+	"Create":        {func(p event.Payload) diskPayload { return fromCreate(p.(event.Create)) }, func() diskPayload { return new(create) }},
+	"Fork":          {func(p event.Payload) diskPayload { return fromFork(p.(event.Fork)) }, func() diskPayload { return new(fork) }},
+	"Delete":        {func(p event.Payload) diskPayload { return fromDelete(p.(event.Delete)) }, func() diskPayload { return new(delete) }},
+	"Wiki":          {func(p event.Payload) diskPayload { return fromWiki(p.(event.Wiki)) }, func() diskPayload { return new(wiki) }},
+	"Release":       {func(p event.Payload) diskPayload { return fromRelease(p.(event.Release)) }, func() diskPayload { return new(release) }},
+	"Publish":       {func(p event.Payload) diskPayload { return fromPublish(p.(event.Publish)) }, func() diskPayload { return new(publish) }},
+	"Member":        {func(p event.Payload) diskPayload { return fromMember(p.(event.Member)) }, func() diskPayload { return new(member) }},
+	"Sponsor":       {func(p event.Payload) diskPayload { return fromSponsor(p.(event.Sponsor)) }, func() diskPayload { return new(sponsor) }},
+	"Assign":        {func(p event.Payload) diskPayload { return fromAssign(p.(event.Assign)) }, func() diskPayload { return new(assign) }},
+	"Label":         {func(p event.Payload) diskPayload { return fromLabel(p.(event.Label)) }, func() diskPayload { return new(labelEvent) }},
+	"Milestone":     {func(p event.Payload) diskPayload { return fromMilestone(p.(event.Milestone)) }, func() diskPayload { return new(milestone) }},
+	"Transfer":      {func(p event.Payload) diskPayload { return fromTransfer(p.(event.Transfer)) }, func() diskPayload { return new(transfer) }},
+	"Rename":        {func(p event.Payload) diskPayload { return fromRename(p.(event.Rename)) }, func() diskPayload { return new(rename) }},
+}
+
+// eventTypes maps on-disk type names of payloads to their event types.
+var eventTypes = func() map[string]string {
+	m := make(map[string]string)
+	for _, p := range event.PayloadTypes() {
+		m[diskType(p.EventType())] = p.EventType()
+	}
+	return m
+}()
+
+// diskType returns the on-disk type name for the event type typ.
+// It's typ with the first letter in lower case, e.g., "issueComment".
+func diskType(typ string) string {
+	return strings.ToLower(typ[:1]) + typ[1:]
 }
 
 func fromEvent(e event.Event) eventDisk {
 	return eventDisk{
+		ID:   e.ID,
 		Time: e.Time,
 		// Omit Actor because it's encoded as part of event file path.
 		Container: e.Container,
@@ -235,6 +472,7 @@ func fromEvent(e event.Event) eventDisk {
 // inferred from event file path.
 func (e eventDisk) Event(actor users.User) event.Event {
 	return event.Event{
+		ID:        e.ID,
 		Time:      e.Time,
 		Actor:     actor,
 		Container: e.Container,
@@ -245,41 +483,99 @@ func (e eventDisk) Event(actor users.User) event.Event {
 // issue is an on-disk representation of event.Issue.
 type issue struct {
 	Action       string
+	IssueNumber  uint64 `json:",omitempty"`
 	IssueTitle   string
 	IssueBody    string `json:",omitempty"`
 	IssueHTMLURL string
+	Milestone    string  `json:",omitempty"`
+	Labels       []label `json:",omitempty"`
 }
 
 func fromIssue(i event.Issue) issue {
-	return issue(i)
+	return issue{
+		Action:       string(i.Action),
+		IssueNumber:  i.IssueNumber,
+		IssueTitle:   i.IssueTitle,
+		IssueBody:    i.IssueBody,
+		IssueHTMLURL: i.IssueHTMLURL,
+		Milestone:    i.Milestone,
+		Labels:       fromLabels(i.Labels),
+	}
 }
 
 func (i issue) Issue() event.Issue {
-	return event.Issue(i)
+	return event.Issue{
+		Action:       event.IssueAction(i.Action),
+		IssueNumber:  i.IssueNumber,
+		IssueTitle:   i.IssueTitle,
+		IssueBody:    i.IssueBody,
+		IssueHTMLURL: i.IssueHTMLURL,
+		Milestone:    i.Milestone,
+		Labels:       labels(i.Labels),
+	}
 }
 
 // change is an on-disk representation of event.Change.
 type change struct {
 	Action        string
+	ChangeNumber  uint64 `json:",omitempty"`
 	ChangeTitle   string
 	ChangeBody    string `json:",omitempty"`
 	ChangeHTMLURL string
+	BaseBranch    string      `json:",omitempty"`
+	HeadBranch    string      `json:",omitempty"`
+	Draft         bool        `json:",omitempty"`
+	ReviewState   int         `json:",omitempty"`
+	Milestone     string      `json:",omitempty"`
+	Labels        []label     `json:",omitempty"`
+	References    []reference `json:",omitempty"`
 }
 
 func fromChange(c event.Change) change {
-	return change(c)
+	return change{
+		Action:        string(c.Action),
+		ChangeNumber:  c.ChangeNumber,
+		ChangeTitle:   c.ChangeTitle,
+		ChangeBody:    c.ChangeBody,
+		ChangeHTMLURL: c.ChangeHTMLURL,
+		BaseBranch:    c.BaseBranch,
+		HeadBranch:    c.HeadBranch,
+		Draft:         c.Draft,
+		ReviewState:   fromReview(c.ReviewState),
+		Milestone:     c.Milestone,
+		Labels:        fromLabels(c.Labels),
+		References:    fromReferences(c.References),
+	}
 }
 
 func (c change) Change() event.Change {
-	return event.Change(c)
+	return event.Change{
+		Action:        event.ChangeAction(c.Action),
+		ChangeNumber:  c.ChangeNumber,
+		ChangeTitle:   c.ChangeTitle,
+		ChangeBody:    c.ChangeBody,
+		ChangeHTMLURL: c.ChangeHTMLURL,
+		BaseBranch:    c.BaseBranch,
+		HeadBranch:    c.HeadBranch,
+		Draft:         c.Draft,
+		ReviewState:   review(c.ReviewState),
+		Milestone:     c.Milestone,
+		Labels:        labels(c.Labels),
+		References:    references(c.References),
+	}
 }
 
 // issueComment is an on-disk representation of event.IssueComment.
 type issueComment struct {
-	IssueTitle     string
-	IssueState     string
-	CommentBody    string
-	CommentHTMLURL string
+	Action           string `json:",omitempty"`
+	IssueNumber      uint64 `json:",omitempty"`
+	IssueTitle       string
+	IssueState       string
+	CommentID        uint64 `json:",omitempty"`
+	CommentBody      string
+	CommentCreatedAt time.Time
+	CommentHTMLURL   string
+	References       []reference `json:",omitempty"`
 }
 
 func fromIssueComment(c event.IssueComment) issueComment {
@@ -291,10 +587,15 @@ func fromIssueComment(c event.IssueComment) issueComment {
 		issueState = "closed"
 	}
 	return issueComment{
-		IssueTitle:     c.IssueTitle,
-		IssueState:     issueState,
-		CommentBody:    c.CommentBody,
-		CommentHTMLURL: c.CommentHTMLURL,
+		Action:           string(c.Action),
+		IssueNumber:      c.IssueNumber,
+		IssueTitle:       c.IssueTitle,
+		IssueState:       issueState,
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentCreatedAt: c.CommentCreatedAt,
+		CommentHTMLURL:   c.CommentHTMLURL,
+		References:       fromReferences(c.References),
 	}
 }
 
@@ -307,20 +608,29 @@ func (c issueComment) IssueComment() event.IssueComment {
 		issueState = state.IssueClosed
 	}
 	return event.IssueComment{
-		IssueTitle:     c.IssueTitle,
-		IssueState:     issueState,
-		CommentBody:    c.CommentBody,
-		CommentHTMLURL: c.CommentHTMLURL,
+		Action:           event.CommentAction(c.Action),
+		IssueNumber:      c.IssueNumber,
+		IssueTitle:       c.IssueTitle,
+		IssueState:       issueState,
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentCreatedAt: c.CommentCreatedAt,
+		CommentHTMLURL:   c.CommentHTMLURL,
+		References:       references(c.References),
 	}
 }
 
 // changeComment is an on-disk representation of event.ChangeComment.
 type changeComment struct {
-	ChangeTitle    string
-	ChangeState    string
-	CommentBody    string
-	CommentReview  int `json:",omitempty"`
-	CommentHTMLURL string
+	Action           string `json:",omitempty"`
+	ChangeTitle      string
+	ChangeState      string
+	CommentID        uint64 `json:",omitempty"`
+	CommentBody      string
+	CommentReview    int `json:",omitempty"`
+	CommentCreatedAt time.Time
+	CommentHTMLURL   string
+	References       []reference `json:",omitempty"`
 }
 
 func fromChangeComment(c event.ChangeComment) changeComment {
@@ -333,25 +643,16 @@ func fromChangeComment(c event.ChangeComment) changeComment {
 	case state.ChangeMerged:
 		changeState = "merged"
 	}
-	var commentReview int
-	switch c.CommentReview {
-	case state.ReviewPlus2:
-		commentReview = +2
-	case state.ReviewPlus1:
-		commentReview = +1
-	case state.ReviewNoScore:
-		commentReview = 0
-	case state.ReviewMinus1:
-		commentReview = -1
-	case state.ReviewMinus2:
-		commentReview = -2
-	}
 	return changeComment{
-		ChangeTitle:    c.ChangeTitle,
-		ChangeState:    changeState,
-		CommentBody:    c.CommentBody,
-		CommentReview:  commentReview,
-		CommentHTMLURL: c.CommentHTMLURL,
+		Action:           string(c.Action),
+		ChangeTitle:      c.ChangeTitle,
+		ChangeState:      changeState,
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentReview:    fromReview(c.CommentReview),
+		CommentCreatedAt: c.CommentCreatedAt,
+		CommentHTMLURL:   c.CommentHTMLURL,
+		References:       fromReferences(c.References),
 	}
 }
 
@@ -365,45 +666,87 @@ func (c changeComment) ChangeComment() event.ChangeComment {
 	case "merged":
 		changeState = state.ChangeMerged
 	}
-	var commentReview state.Review
-	switch c.CommentReview {
+	return event.ChangeComment{
+		Action:           event.CommentAction(c.Action),
+		ChangeTitle:      c.ChangeTitle,
+		ChangeState:      changeState,
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentReview:    review(c.CommentReview),
+		CommentCreatedAt: c.CommentCreatedAt,
+		CommentHTMLURL:   c.CommentHTMLURL,
+		References:       references(c.References),
+	}
+}
+
+// fromReview converts a review state to its on-disk representation.
+func fromReview(r state.Review) int {
+	switch r {
+	case state.ReviewPlus2:
+		return +2
+	case state.ReviewPlus1:
+		return +1
+	case state.ReviewNoScore:
+		return 0
+	case state.ReviewMinus1:
+		return -1
+	case state.ReviewMinus2:
+		return -2
+	default:
+		return 0
+	}
+}
+
+// review converts an on-disk review state to state.Review.
+func review(r int) state.Review {
+	switch r {
 	case +2:
-		commentReview = state.ReviewPlus2
+		return state.ReviewPlus2
 	case +1:
-		commentReview = state.ReviewPlus1
+		return state.ReviewPlus1
 	case 0:
-		commentReview = state.ReviewNoScore
+		return state.ReviewNoScore
 	case -1:
-		commentReview = state.ReviewMinus1
+		return state.ReviewMinus1
 	case -2:
-		commentReview = state.ReviewMinus2
-	}
-	return event.ChangeComment{
-		ChangeTitle:    c.ChangeTitle,
-		ChangeState:    changeState,
-		CommentBody:    c.CommentBody,
-		CommentReview:  commentReview,
-		CommentHTMLURL: c.CommentHTMLURL,
+		return state.ReviewMinus2
+	default:
+		return state.ReviewNoScore
 	}
 }
 
 // commitComment is an on-disk representation of event.CommitComment.
 type commitComment struct {
-	Commit      commit
-	CommentBody string
+	Commit           commit
+	CommentID        uint64 `json:",omitempty"`
+	CommentBody      string
+	CommentCreatedAt time.Time
+	Path             string      `json:",omitempty"`
+	Line             int         `json:",omitempty"`
+	References       []reference `json:",omitempty"`
 }
 
 func fromCommitComment(c event.CommitComment) commitComment {
 	return commitComment{
-		Commit:      fromCommit(c.Commit),
-		CommentBody: c.CommentBody,
+		Commit:           fromCommit(c.Commit),
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentCreatedAt: c.CommentCreatedAt,
+		Path:             c.Path,
+		Line:             c.Line,
+		References:       fromReferences(c.References),
 	}
 }
 
 func (c commitComment) CommitComment() event.CommitComment {
 	return event.CommitComment{
-		Commit:      c.Commit.Commit(),
-		CommentBody: c.CommentBody,
+		Commit:           c.Commit.Commit(),
+		CommentID:        c.CommentID,
+		CommentBody:      c.CommentBody,
+		CommentCreatedAt: c.CommentCreatedAt,
+		Path:             c.Path,
+		Line:             c.Line,
+		References:       references(c.References),
 	}
 }
 
@@ -413,6 +756,8 @@ type push struct {
 	Head          string
 	Before        string
 	Commits       []commit
+	TotalCommits  int    `json:",omitempty"`
+	Forced        bool   `json:",omitempty"`
 	HeadHTMLURL   string `json:",omitempty"`
 	BeforeHTMLURL string `json:",omitempty"`
 }
@@ -427,6 +772,8 @@ func fromPush(p event.Push) push {
 		Head:          p.Head,
 		Before:        p.Before,
 		Commits:       commits,
+		TotalCommits:  p.TotalCommits,
+		Forced:        p.Forced,
 		HeadHTMLURL:   p.HeadHTMLURL,
 		BeforeHTMLURL: p.BeforeHTMLURL,
 	}
@@ -442,6 +789,8 @@ func (p push) Push() event.Push {
 		Head:          p.Head,
 		Before:        p.Before,
 		Commits:       commits,
+		TotalCommits:  p.TotalCommits,
+		Forced:        p.Forced,
 		HeadHTMLURL:   p.HeadHTMLURL,
 		BeforeHTMLURL: p.BeforeHTMLURL,
 	}
@@ -462,20 +811,34 @@ func (s star) Star() event.Star {
 type create struct {
 	Type        string
 	Name        string
+	NameHTMLURL string `json:",omitempty"`
 	Description string
 }
 
 func fromCreate(c event.Create) create {
-	return create(c)
+	return create{
+		Type:        string(c.Type),
+		Name:        c.Name,
+		NameHTMLURL: c.NameHTMLURL,
+		Description: c.Description,
+	}
 }
 
 func (c create) Create() event.Create {
-	return event.Create(c)
+	return event.Create{
+		Type:        event.CreateType(c.Type),
+		Name:        c.Name,
+		NameHTMLURL: c.NameHTMLURL,
+		Description: c.Description,
+	}
 }
 
 // fork is an on-disk representation of event.Fork.
 type fork struct {
-	Container string
+	Container     string
+	HTMLURL       string `json:",omitempty"`
+	Description   string `json:",omitempty"`
+	DefaultBranch string `json:",omitempty"`
 }
 
 func fromFork(f event.Fork) fork {
@@ -488,16 +851,31 @@ func (f fork) Fork() event.Fork {
 
 // delete is an on-disk representation of event.Delete.
 type delete struct {
-	Type string
-	Name string
+	Type           string
+	Name           string
+	LastSHA        string `json:",omitempty"`
+	TreeHTMLURL    string `json:",omitempty"`
+	CompareHTMLURL string `json:",omitempty"`
 }
 
 func fromDelete(d event.Delete) delete {
-	return delete(d)
+	return delete{
+		Type:           string(d.Type),
+		Name:           d.Name,
+		LastSHA:        d.LastSHA,
+		TreeHTMLURL:    d.TreeHTMLURL,
+		CompareHTMLURL: d.CompareHTMLURL,
+	}
 }
 
 func (d delete) Delete() event.Delete {
-	return event.Delete(d)
+	return event.Delete{
+		Type:           event.DeleteType(d.Type),
+		Name:           d.Name,
+		LastSHA:        d.LastSHA,
+		TreeHTMLURL:    d.TreeHTMLURL,
+		CompareHTMLURL: d.CompareHTMLURL,
+	}
 }
 
 // wiki is an on-disk representation of event.Wiki.
@@ -525,12 +903,235 @@ func (w wiki) Wiki() event.Wiki {
 	}
 }
 
+// release is an on-disk representation of event.Release.
+type release struct {
+	TagName    string
+	Name       string `json:",omitempty"`
+	Body       string `json:",omitempty"`
+	Prerelease bool   `json:",omitempty"`
+	HTMLURL    string
+}
+
+func fromRelease(r event.Release) release {
+	return release(r)
+}
+
+func (r release) Release() event.Release {
+	return event.Release(r)
+}
+
+// publish is an on-disk representation of event.Publish.
+type publish struct{}
+
+func fromPublish(p event.Publish) publish {
+	return publish(p)
+}
+
+func (p publish) Publish() event.Publish {
+	return event.Publish(p)
+}
+
+// member is an on-disk representation of event.Member.
+type member struct {
+	Action    string
+	ID        uint64 // UserSpec.ID of the collaborator.
+	Domain    string // UserSpec.Domain of the collaborator.
+	Login     string
+	AvatarURL string `json:",omitempty"`
+}
+
+func fromMember(m event.Member) member {
+	return member{
+		Action:    string(m.Action),
+		ID:        m.Member.ID,
+		Domain:    m.Member.Domain,
+		Login:     m.Member.Login,
+		AvatarURL: m.Member.AvatarURL,
+	}
+}
+
+func (m member) Member() event.Member {
+	return event.Member{
+		Action: event.MemberAction(m.Action),
+		Member: users.User{
+			UserSpec:  users.UserSpec{ID: m.ID, Domain: m.Domain},
+			Login:     m.Login,
+			AvatarURL: m.AvatarURL,
+		},
+	}
+}
+
+// sponsor is an on-disk representation of event.Sponsor.
+type sponsor struct {
+	ID        uint64 // UserSpec.ID of the sponsorable.
+	Domain    string // UserSpec.Domain of the sponsorable.
+	Login     string
+	AvatarURL string `json:",omitempty"`
+	TierName  string `json:",omitempty"`
+	HTMLURL   string
+}
+
+func fromSponsor(s event.Sponsor) sponsor {
+	return sponsor{
+		ID:        s.Sponsorable.ID,
+		Domain:    s.Sponsorable.Domain,
+		Login:     s.Sponsorable.Login,
+		AvatarURL: s.Sponsorable.AvatarURL,
+		TierName:  s.TierName,
+		HTMLURL:   s.HTMLURL,
+	}
+}
+
+func (s sponsor) Sponsor() event.Sponsor {
+	return event.Sponsor{
+		Sponsorable: users.User{
+			UserSpec:  users.UserSpec{ID: s.ID, Domain: s.Domain},
+			Login:     s.Login,
+			AvatarURL: s.AvatarURL,
+		},
+		TierName: s.TierName,
+		HTMLURL:  s.HTMLURL,
+	}
+}
+
+// assign is an on-disk representation of event.Assign.
+type assign struct {
+	Action       string
+	ID           uint64 // UserSpec.ID of the assignee.
+	Domain       string // UserSpec.Domain of the assignee.
+	Login        string
+	AvatarURL    string `json:",omitempty"`
+	IssueNumber  uint64 `json:",omitempty"`
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+func fromAssign(a event.Assign) assign {
+	return assign{
+		Action:       string(a.Action),
+		ID:           a.Assignee.ID,
+		Domain:       a.Assignee.Domain,
+		Login:        a.Assignee.Login,
+		AvatarURL:    a.Assignee.AvatarURL,
+		IssueNumber:  a.IssueNumber,
+		IssueTitle:   a.IssueTitle,
+		IssueHTMLURL: a.IssueHTMLURL,
+	}
+}
+
+func (a assign) Assign() event.Assign {
+	return event.Assign{
+		Action: event.AssignAction(a.Action),
+		Assignee: users.User{
+			UserSpec:  users.UserSpec{ID: a.ID, Domain: a.Domain},
+			Login:     a.Login,
+			AvatarURL: a.AvatarURL,
+		},
+		IssueNumber:  a.IssueNumber,
+		IssueTitle:   a.IssueTitle,
+		IssueHTMLURL: a.IssueHTMLURL,
+	}
+}
+
+// labelEvent is an on-disk representation of event.Label.
+// It's not named label, since that's the one of event.LabelInfo.
+type labelEvent struct {
+	Action       string
+	Name         string // LabelInfo.Name of the label.
+	Color        string // LabelInfo.Color of the label.
+	IssueNumber  uint64 `json:",omitempty"`
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+func fromLabel(l event.Label) labelEvent {
+	return labelEvent{
+		Action:       string(l.Action),
+		Name:         l.Label.Name,
+		Color:        l.Label.Color,
+		IssueNumber:  l.IssueNumber,
+		IssueTitle:   l.IssueTitle,
+		IssueHTMLURL: l.IssueHTMLURL,
+	}
+}
+
+func (l labelEvent) Label() event.Label {
+	return event.Label{
+		Action:       event.LabelAction(l.Action),
+		Label:        event.LabelInfo{Name: l.Name, Color: l.Color},
+		IssueNumber:  l.IssueNumber,
+		IssueTitle:   l.IssueTitle,
+		IssueHTMLURL: l.IssueHTMLURL,
+	}
+}
+
+// milestone is an on-disk representation of event.Milestone.
+type milestone struct {
+	Action       string
+	Title        string `json:",omitempty"` // Milestone.Milestone.
+	IssueNumber  uint64 `json:",omitempty"`
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+func fromMilestone(m event.Milestone) milestone {
+	return milestone{
+		Action:       string(m.Action),
+		Title:        m.Milestone,
+		IssueNumber:  m.IssueNumber,
+		IssueTitle:   m.IssueTitle,
+		IssueHTMLURL: m.IssueHTMLURL,
+	}
+}
+
+func (m milestone) Milestone() event.Milestone {
+	return event.Milestone{
+		Action:       event.MilestoneAction(m.Action),
+		Milestone:    m.Title,
+		IssueNumber:  m.IssueNumber,
+		IssueTitle:   m.IssueTitle,
+		IssueHTMLURL: m.IssueHTMLURL,
+	}
+}
+
+// transfer is an on-disk representation of event.Transfer.
+type transfer struct {
+	IssueNumber  uint64 `json:",omitempty"`
+	IssueTitle   string
+	IssueHTMLURL string
+}
+
+func fromTransfer(t event.Transfer) transfer {
+	return transfer(t)
+}
+
+func (t transfer) Transfer() event.Transfer {
+	return event.Transfer(t)
+}
+
+// rename is an on-disk representation of event.Rename.
+type rename struct {
+	From string
+	To   string
+}
+
+func fromRename(r event.Rename) rename {
+	return rename(r)
+}
+
+func (r rename) Rename() event.Rename {
+	return event.Rename(r)
+}
+
 // commit is an on-disk representation of event.Commit.
 type commit struct {
 	SHA             string
-	Message         string `json:"CommitMessage"`
+	Message         string
 	AuthorAvatarURL string
 	HTMLURL         string `json:",omitempty"`
+	Additions       int    `json:",omitempty"`
+	Deletions       int    `json:",omitempty"`
+	ChangedFiles    int    `json:",omitempty"`
 }
 
 func fromCommit(c event.Commit) commit {
@@ -541,19 +1142,85 @@ func (c commit) Commit() event.Commit {
 	return event.Commit(c)
 }
 
+// reference is an on-disk representation of event.Reference.
+type reference struct {
+	Container string
+	Number    uint64
+	HTMLURL   string
+}
+
+func fromReferences(rs []event.Reference) []reference {
+	var references []reference
+	for _, r := range rs {
+		references = append(references, reference(r))
+	}
+	return references
+}
+
+func references(rs []reference) []event.Reference {
+	var references []event.Reference
+	for _, r := range rs {
+		references = append(references, event.Reference(r))
+	}
+	return references
+}
+
+// label is an on-disk representation of event.LabelInfo.
+type label struct {
+	Name  string
+	Color string
+}
+
+func fromLabels(ls []event.LabelInfo) []label {
+	var labels []label
+	for _, l := range ls {
+		labels = append(labels, label(l))
+	}
+	return labels
+}
+
+func labels(ls []label) []event.LabelInfo {
+	var labels []event.LabelInfo
+	for _, l := range ls {
+		labels = append(labels, event.LabelInfo(l))
+	}
+	return labels
+}
+
 // page is an on-disk representation of event.Page.
 type page struct {
 	Action         string
 	SHA            string
 	Title          string
+	Summary        string `json:",omitempty"`
 	HTMLURL        string
 	CompareHTMLURL string
+	Additions      int `json:",omitempty"`
+	Deletions      int `json:",omitempty"`
 }
 
 func fromPage(p event.Page) page {
-	return page(p)
+	return page{
+		Action:         string(p.Action),
+		SHA:            p.SHA,
+		Title:          p.Title,
+		Summary:        p.Summary,
+		HTMLURL:        p.HTMLURL,
+		CompareHTMLURL: p.CompareHTMLURL,
+		Additions:      p.Additions,
+		Deletions:      p.Deletions,
+	}
 }
 
 func (p page) Page() event.Page {
-	return event.Page(p)
+	return event.Page{
+		Action:         event.PageAction(p.Action),
+		SHA:            p.SHA,
+		Title:          p.Title,
+		Summary:        p.Summary,
+		HTMLURL:        p.HTMLURL,
+		CompareHTMLURL: p.CompareHTMLURL,
+		Additions:      p.Additions,
+		Deletions:      p.Deletions,
+	}
 }
@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/shurcooL/events/event"
+)
+
+// TestDiskPayloads tests that every payload type in the event package
+// has an on-disk representation, which it's encoded to and decoded from,
+// so that adding a payload type to the event package without adding it
+// to the schema fails.
+func TestDiskPayloads(t *testing.T) {
+	types := event.PayloadTypes()
+	for _, p := range types {
+		if _, ok := diskPayloads[p.EventType()]; !ok {
+			t.Errorf("diskPayloads has no %s entry", p.EventType())
+			continue
+		}
+		e := eventDisk{ID: "id", Container: "example.org/repo", Payload: p}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Errorf("%s: json.Marshal: %v", p.EventType(), err)
+			continue
+		}
+		var got eventDisk
+		err = json.Unmarshal(b, &got)
+		if err != nil {
+			t.Errorf("%s: json.Unmarshal: %v", p.EventType(), err)
+		} else if !reflect.DeepEqual(got, e) {
+			t.Errorf("%s: JSON round trip: got %+v, want %+v", p.EventType(), got, e)
+		}
+		b, err = cbor.Marshal(e)
+		if err != nil {
+			t.Errorf("%s: cbor.Marshal: %v", p.EventType(), err)
+			continue
+		}
+		got = eventDisk{}
+		err = cbor.Unmarshal(b, &got)
+		if err != nil {
+			t.Errorf("%s: cbor.Unmarshal: %v", p.EventType(), err)
+		} else if !reflect.DeepEqual(got, e) {
+			t.Errorf("%s: CBOR round trip: got %+v, want %+v", p.EventType(), got, e)
+		}
+	}
+	if len(diskPayloads) != len(types) {
+		t.Errorf("diskPayloads has %d entries, want one for each of the %d payload types", len(diskPayloads), len(types))
+	}
+}
+
+// TestSum tests that events are verified against the sums of their payloads
+// as stored, so that payloads with fields the reader doesn't know about,
+// such as ones written by a later version of this package, still match,
+// but payloads that were changed don't.
+func TestSum(t *testing.T) {
+	e := eventDisk{ID: "id", Container: "example.org/repo", Payload: event.Star{}}
+	v, err := e.envelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{
+		`{}`,
+		`{"Field":"Added by a later version."}`,
+	} {
+		v.Payload, v.Sum = json.RawMessage(payload), v.sum([]byte(payload))
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got eventDisk
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("%s: Unmarshal: %v", payload, err)
+		}
+
+		// Changing the payload as stored makes it not match.
+		b = bytes.Replace(b, []byte(`}`), []byte(` }`), 1)
+		if err := json.Unmarshal(b, &got); err != errChecksum {
+			t.Errorf("%s: Unmarshal of changed payload: got error %v, want %v", payload, err, errChecksum)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package fs
+
+import (
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// segmentStore stores all events in append-only segment files.
+// Each segment file holds up to segmentSize events of a single month,
+// encoded one after another, and is in the directory for that month.
+// Once the last segment file is full, is for a different month than
+// the event being appended, is in a different format than the one
+// events are stored in, or is corrupt, a new one is started.
+//
+// Segment files are numbered consecutively, in the order they're started.
+// Pruning removes segment files from the start, so the first segment file
+// isn't necessarily segment-0.
+type segmentStore struct {
+	fs       webdav.FileSystem
+	user     users.User
+	format   fileFormat
+	readOnly bool // Whether nothing is to be written to fs.
+
+	segments []segment // Segment files, oldest first.
+	next     int       // Number of the next segment file.
+	skip     int       // Number of pruned events still at the start of the first segment file.
+	stamp    segmentsStamp
+	corrupt  []*CorruptionError
+}
+
+// segmentsStamp identifies a version of the segment files, or log files,
+// as far as their numbers and the metadata of the last one tell.
+// Files other than the last one only change by being removed,
+// so that's enough to tell whether they changed.
+type segmentsStamp struct {
+	first, last int // Numbers of the first and last segment files.
+	lastFile    fileStamp
+}
+
+// segment describes a segment file.
+type segment struct {
+	n      int       // Number of the segment file.
+	month  time.Time // Month of events in the segment file.
+	count  int       // Number of events in the segment file. It's 0 if all of them were removed.
+	format fileFormat
+	// corrupt is whether the segment file is corrupt. Only the events
+	// that could be loaded are counted, and nothing is appended to it,
+	// because events after corrupt data can't be loaded.
+	corrupt bool
+}
+
+const segmentSize = 1000 // Maximum number of events in a segment file.
+
+func (s *segmentStore) load(ctx context.Context) ([]event.Event, error) {
+	s.segments, s.next, s.skip, s.corrupt = nil, 0, 0, nil
+	files, err := listSegments(ctx, s.fs, segmentsDir(s.user.UserSpec))
+	if os.IsNotExist(err) {
+		// There's no append-only storage yet. Copy events from ring storage, if any.
+		return s.copyRing(ctx)
+	} else if err != nil {
+		return nil, err
+	}
+	var events []event.Event
+	for i, f := range files {
+		if i > 0 && f.n != files[i-1].n+1 {
+			return nil, fmt.Errorf("segment-%d is missing", files[i-1].n+1)
+		}
+		es, format, corrupt, err := loadSegment(ctx, s.fs, s.user, f.path, s.format.aead)
+		if err != nil {
+			return nil, err
+		}
+		if corrupt != nil {
+			s.corrupt = append(s.corrupt, corrupt)
+		}
+		month, err := segmentMonth(s.user.UserSpec, f.path)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, es...)
+		s.segments = append(s.segments, segment{n: f.n, month: month, count: len(es), format: format, corrupt: corrupt != nil})
+		s.next = f.n + 1
+	}
+	s.updateStamp(ctx)
+	return events, nil
+}
+
+// copyRing copies events from ring storage into s, and returns them.
+// If s is read-only, events are only returned.
+func (s *segmentStore) copyRing(ctx context.Context) ([]event.Event, error) {
+	names, err := listEventFiles(ctx, s.fs, s.user.UserSpec)
+	if err != nil {
+		return nil, err
+	}
+	events, _, _, corrupt, err := loadEventFiles(ctx, s.fs, s.user, names, s.format.aead)
+	if err != nil {
+		return nil, err
+	}
+	s.corrupt = corrupt
+	if s.readOnly {
+		return events, nil
+	}
+	_, err = s.append(ctx, events...)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *segmentStore) corruption() []*CorruptionError { return s.corrupt }
+
+// append never drops events, so it always reports 0 dropped.
+func (s *segmentStore) append(ctx context.Context, events ...event.Event) (dropped int, err error) {
+	for len(events) > 0 {
+		month := monthOf(events[0].Time)
+		if len(s.segments) == 0 || s.last().count == segmentSize || !s.last().month.Equal(month) || s.last().format != s.format || s.last().corrupt {
+			// Start a new segment file.
+			k := sameMonth(events, month, segmentSize)
+			seg := segment{n: s.next, month: month, count: k, format: s.format}
+			err := encodeEventsFile(ctx, s.fs, segmentPath(s.user.UserSpec, seg.month, seg.n), seg.format, fromEvents(events[:k])...)
+			if err != nil {
+				return 0, err
+			}
+			s.segments = append(s.segments, seg)
+			s.next++
+			events = events[k:]
+			continue
+		}
+		k := sameMonth(events, month, segmentSize-s.last().count)
+		err := appendEventsFile(ctx, s.fs, segmentPath(s.user.UserSpec, s.last().month, s.last().n), s.format, fromEvents(events[:k])...)
+		if err != nil {
+			return 0, err
+		}
+		s.last().count += k
+		events = events[k:]
+	}
+	s.updateStamp(ctx)
+	return 0, nil
+}
+
+// sameMonth returns the number of events at the start of events
+// that are in month, up to max.
+func sameMonth(events []event.Event, month time.Time, max int) int {
+	k := 0
+	for k < len(events) && k < max && monthOf(events[k].Time).Equal(month) {
+		k++
+	}
+	return k
+}
+
+// fromEvents converts events to their on-disk representation.
+func fromEvents(events []event.Event) []eventDisk {
+	es := make([]eventDisk, len(events))
+	for i, e := range events {
+		es[i] = fromEvent(e)
+	}
+	return es
+}
+
+// last returns the last segment file. There must be at least one.
+func (s *segmentStore) last() *segment { return &s.segments[len(s.segments)-1] }
+
+// prune removes segment files whose events are all pruned,
+// and month and year directories that become empty.
+// The first remaining segment file is rewritten without its pruned events
+// only once they make up at least half of it, so that pruning a few events
+// at a time doesn't rewrite the same segment file over and over.
+// Until then, they're left in place, and get pruned again after the next load.
+func (s *segmentStore) prune(ctx context.Context, n int) error {
+	n += s.skip
+	s.skip = 0
+	for len(s.segments) > 0 && n >= s.segments[0].count {
+		seg := s.segments[0]
+		name := segmentPath(s.user.UserSpec, seg.month, seg.n)
+		err := s.fs.RemoveAll(ctx, name)
+		if err != nil {
+			return err
+		}
+		err = removeEmptyDirs(ctx, s.fs, path.Dir(name), segmentsDir(s.user.UserSpec))
+		if err != nil {
+			return err
+		}
+		n -= seg.count
+		s.segments = s.segments[1:]
+	}
+	s.updateStamp(ctx)
+	if n == 0 {
+		return nil
+	} else if len(s.segments) == 0 {
+		return fmt.Errorf("can't prune %d more events than are stored", n)
+	} else if 2*n < s.segments[0].count {
+		s.skip = n
+		return nil
+	}
+	seg := &s.segments[0]
+	name := segmentPath(s.user.UserSpec, seg.month, seg.n)
+	// If the segment file is corrupt, it's rewritten without corrupt data.
+	events, _, _, err := loadSegment(ctx, s.fs, s.user, name, s.format.aead)
+	if err != nil {
+		return err
+	}
+	err = encodeEventsFile(ctx, s.fs, name, s.format, fromEvents(events[n:])...)
+	if err != nil {
+		return err
+	}
+	seg.count -= n
+	seg.format, seg.corrupt = s.format, false
+	s.updateStamp(ctx)
+	return nil
+}
+
+// changed reports whether the segment files were changed by something other
+// than s since s last loaded or wrote them.
+func (s *segmentStore) changed(ctx context.Context) (bool, error) {
+	files, err := listSegments(ctx, s.fs, segmentsDir(s.user.UserSpec))
+	if os.IsNotExist(err) {
+		return s.stamp != segmentsStamp{}, nil
+	} else if err != nil {
+		return false, err
+	}
+	var stamp segmentsStamp
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		stamp.first, stamp.last = files[0].n, last.n
+		stamp.lastFile, err = statFile(ctx, s.fs, last.path)
+		if err != nil {
+			return false, err
+		}
+	}
+	return stamp != s.stamp, nil
+}
+
+// updateStamp records the stamp of the segment files after s loaded or wrote them.
+// If that fails, changed later reports a change, which only causes a reload.
+func (s *segmentStore) updateStamp(ctx context.Context) {
+	if len(s.segments) == 0 {
+		s.stamp = segmentsStamp{}
+		return
+	}
+	first, last := s.segments[0], *s.last()
+	lastFile, err := statFile(ctx, s.fs, segmentPath(s.user.UserSpec, last.month, last.n))
+	if err != nil {
+		lastFile = fileStamp{modTime: -1}
+	}
+	s.stamp = segmentsStamp{first: first.n, last: last.n, lastFile: lastFile}
+}
+
+// remove removes the i-th oldest event. The segment file with it is rewritten
+// without it. If that leaves the first segment file empty, it's removed.
+// Segment files after the first one are left in place even when empty,
+// so that segment file numbers stay consecutive.
+func (s *segmentStore) remove(ctx context.Context, i int) error {
+	// Find the segment with the event, and the event's position in it.
+	// Pruned events still at the start of the first segment file come before it.
+	k, pos := 0, s.skip+i
+	for k < len(s.segments) && pos >= s.segments[k].count {
+		pos -= s.segments[k].count
+		k++
+	}
+	if k == len(s.segments) {
+		return fmt.Errorf("can't remove event %d, fewer events are stored", i)
+	}
+	seg := &s.segments[k]
+	name := segmentPath(s.user.UserSpec, seg.month, seg.n)
+	if k == 0 && seg.count == 1 {
+		err := s.fs.RemoveAll(ctx, name)
+		if err != nil {
+			return err
+		}
+		err = removeEmptyDirs(ctx, s.fs, path.Dir(name), segmentsDir(s.user.UserSpec))
+		if err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+		s.updateStamp(ctx)
+		return nil
+	}
+	// If the segment file is corrupt, it's rewritten without corrupt data.
+	events, _, _, err := loadSegment(ctx, s.fs, s.user, name, s.format.aead)
+	if err != nil {
+		return err
+	}
+	var es []eventDisk
+	for j, e := range events {
+		if j != pos {
+			es = append(es, fromEvent(e))
+		}
+	}
+	err = encodeEventsFile(ctx, s.fs, name, s.format, es...)
+	if err != nil {
+		return err
+	}
+	seg.count--
+	seg.format, seg.corrupt = s.format, false
+	s.updateStamp(ctx)
+	return nil
+}
+
+// monthOf returns the start of the month of t, in UTC.
+func monthOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// segmentMonth returns the month of events in segment file at path of user,
+// which is given by the year and month directories the file is in.
+func segmentMonth(user users.UserSpec, p string) (time.Time, error) {
+	month, err := time.Parse("2006/01", strings.TrimPrefix(path.Dir(p), segmentsDir(user)+"/"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s isn't in a year and month directory", p)
+	}
+	return month, nil
+}
+
+// segmentFile is a segment file found by listSegments.
+type segmentFile struct {
+	n    int // Number of the segment file.
+	path string
+}
+
+// listSegments returns the segment files in dir and its subdirectories,
+// sorted by number. If dir doesn't exist, the returned error satisfies os.IsNotExist.
+func listSegments(ctx context.Context, fs webdav.FileSystem, dir string) ([]segmentFile, error) {
+	f, err := vfsutil.Open(ctx, fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var files []segmentFile
+	for _, fi := range fis {
+		if fi.IsDir() {
+			sub, err := listSegments(ctx, fs, path.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		if !strings.HasPrefix(fi.Name(), "segment-") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(fi.Name(), "segment-"))
+		if err != nil {
+			continue
+		}
+		files = append(files, segmentFile{n: n, path: path.Join(dir, fi.Name())})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].n < files[j].n })
+	return files, nil
+}
+
+// removeEmptyDirs removes dir if it's empty, then its parent if that's
+// empty too, and so on, stopping at root, which isn't removed.
+func removeEmptyDirs(ctx context.Context, fs webdav.FileSystem, dir, root string) error {
+	for dir != root && strings.HasPrefix(dir, root+"/") {
+		f, err := vfsutil.Open(ctx, fs, dir)
+		if err != nil {
+			return err
+		}
+		fis, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(fis) > 0 {
+			return nil
+		}
+		err = fs.RemoveAll(ctx, dir)
+		if err != nil {
+			return err
+		}
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+// loadSegment loads the events in segment or log file at path, oldest first,
+// and reports the format of the file. If the file is corrupt, it returns
+// the events that could be loaded, and reports the corruption.
+func loadSegment(ctx context.Context, fs webdav.FileSystem, user users.User, path string, aead cipher.AEAD) ([]event.Event, fileFormat, *CorruptionError, error) {
+	es, format, corrupt, err := decodeEventsFile(ctx, fs, path, aead)
+	if err != nil {
+		return nil, fileFormat{}, nil, err
+	}
+	var events []event.Event
+	for _, e := range es {
+		events = append(events, e.Event(user))
+	}
+	return events, format, corrupt, nil
+}
@@ -0,0 +1,239 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/users"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// Snapshot copies the user's tree as it is now to a new snapshot,
+// and returns its name. Snapshots are in a directory next to the tree,
+// as described in schema.go, and are never written to after they're taken,
+// so they can be backed up with ordinary file copying while the service
+// keeps logging events. Restore replaces the user's events with those
+// in a snapshot.
+//
+// The tree is copied while holding the service lock, and the storage lock
+// if the service uses locking, so a snapshot is consistent: it has either
+// all or none of the changes of each Log call. Buffered events are written
+// first, so they're in the snapshot.
+//
+// Snapshot names are the time they were taken, so they sort in that order.
+//
+// A read-only service doesn't take snapshots, it returns os.ErrPermission.
+func (s *Service) Snapshot(ctx context.Context) (name string, err error) {
+	if s.readOnly {
+		return "", os.ErrPermission
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.flush(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = s.ensureLoaded(ctx)
+	if err != nil {
+		return "", err
+	}
+	if s.locking {
+		// Hold the lock, so that other processes don't write in the middle of it.
+		unlock, err := s.lockStorage(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+	}
+
+	dir := snapshotsDir(s.user.UserSpec)
+	t := time.Now().UTC()
+	for {
+		name = t.Format(eventTimeFormat)
+		_, err := s.fs.Stat(ctx, path.Join(dir, name))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		// A snapshot was already taken at t.
+		t = t.Add(time.Nanosecond)
+	}
+	// Copy into a temporary directory first, so that a partial snapshot
+	// is never mistaken for a complete one.
+	tmp := path.Join(dir, "."+name+".tmp")
+	err = copyTree(ctx, s.fs, eventsDir(s.user.UserSpec), tmp)
+	if err == nil {
+		err = s.fs.Rename(ctx, tmp, path.Join(dir, name))
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, tmp)
+		return "", err
+	}
+	return name, nil
+}
+
+// Snapshots returns the names of snapshots of the user, oldest first.
+func (s *Service) Snapshots(ctx context.Context) ([]string, error) {
+	f, err := vfsutil.Open(ctx, s.fs, snapshotsDir(s.user.UserSpec))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveSnapshot removes the snapshot with the specified name.
+//
+// A read-only service doesn't remove snapshots, it returns os.ErrPermission.
+func (s *Service) RemoveSnapshot(ctx context.Context, name string) error {
+	if s.readOnly {
+		return os.ErrPermission
+	}
+	dir, err := snapshotPath(s.user.UserSpec, name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.fs.Stat(ctx, dir); err != nil {
+		return err
+	}
+	return s.fs.RemoveAll(ctx, dir)
+}
+
+// Restore replaces all events of the user with those in the snapshot
+// with the specified name, taken by Snapshot. If the snapshot was taken
+// with an older schema version, the restored tree is upgraded.
+// Afterwards, List returns the restored events. The snapshot is kept.
+//
+// The snapshot is first copied next to the user's tree, which is then
+// replaced with it, so that a failed restore leaves the events as they were.
+//
+// A read-only service doesn't restore snapshots, it returns os.ErrPermission.
+func (s *Service) Restore(ctx context.Context, name string) error {
+	if s.readOnly {
+		return os.ErrPermission
+	}
+	snapshot, err := snapshotPath(s.user.UserSpec, name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Buffered events are replaced too, but write them first, so that storage
+	// is left with all events logged before Restore if it fails.
+	err = s.flush(ctx)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		unlock, err := lock(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		// Count the restore as a write before doing it, so that other processes
+		// reload even if it partially fails.
+		s.generation, err = readGeneration(ctx, s.fs, s.user.UserSpec)
+		if err != nil {
+			return err
+		}
+		err = s.bumpGeneration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := eventsDir(s.user.UserSpec)
+	staging := dir + ".restore"
+	err = s.fs.RemoveAll(ctx, staging)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = copyTree(ctx, s.fs, snapshot, staging)
+	if err == nil && s.format.aead != nil {
+		err = checkKey(ctx, s.fs, path.Join(staging, path.Base(keyPath(s.user.UserSpec))), s.format.aead, false)
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, staging)
+		return fmt.Errorf("restoring snapshot %s: %v", name, err)
+	}
+	err = replaceTree(ctx, s.fs, dir, staging)
+	if err != nil {
+		return err
+	}
+	if s.locking {
+		// The snapshot has no generation file. Carry it over.
+		err := jsonEncodeFile(ctx, s.fs, generationPath(s.user.UserSpec), s.generation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.loadLocked(ctx)
+}
+
+// snapshotPath returns the path of the snapshot of user with the specified name.
+// It returns an error if name isn't one Snapshot could have returned.
+func snapshotPath(user users.UserSpec, name string) (string, error) {
+	if _, err := time.Parse(eventTimeFormat, name); err != nil {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return path.Join(snapshotsDir(user), name), nil
+}
+
+// copyTree copies the files of a tree in directory src to directory dst,
+// except for the generation file, which is only relevant to processes
+// sharing storage, and temporary files.
+// If src doesn't exist, the returned error satisfies os.IsNotExist.
+func copyTree(ctx context.Context, fs webdav.FileSystem, src, dst string) error {
+	var files []string
+	err := walkFiles(ctx, fs, src, func(name string) {
+		if strings.TrimPrefix(name, src+"/") == "generation" || strings.HasPrefix(path.Base(name), ".") {
+			return
+		}
+		files = append(files, name)
+	})
+	if err != nil {
+		return err
+	}
+	err = vfsutil.MkdirAll(ctx, fs, dst, defaultDirMode)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		r, err := vfsutil.Open(ctx, fs, name)
+		if err != nil {
+			return err
+		}
+		err = writeFile(ctx, fs, path.Join(dst, strings.TrimPrefix(name, src+"/")), true, func(w io.Writer) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+// Stats describes the events stored for a user.
+type Stats struct {
+	User users.UserSpec
+
+	Events  int // Number of events, including buffered ones.
+	Pending int // Number of buffered events not yet written to storage.
+
+	// Oldest and Newest are the earliest and latest Time of events.
+	// They're zero if there are no events.
+	Oldest, Newest time.Time
+
+	// Bytes is the total size of the files in the user's tree.
+	Bytes int64
+
+	// Capacity is the ring size, the maximum number of events kept
+	// in ring storage, so that Events/Capacity is the ring occupancy.
+	// It's 0 for append-only and JSON Lines storage, which are unbounded.
+	Capacity int
+}
+
+// Stats returns statistics of the events stored for the user,
+// followed by those for other actors, sorted by user, if events of other
+// actors are stored with StoreOtherActors. Only other actors whose events
+// were logged since the service was created are included.
+func (s *Service) Stats(ctx context.Context) ([]Stats, error) {
+	st, err := s.stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := []Stats{st}
+	for _, other := range s.otherServices() {
+		st, err := other.stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats[1:], func(i, j int) bool {
+		return marshalUserSpec(stats[1+i].User) < marshalUserSpec(stats[1+j].User)
+	})
+	return stats, nil
+}
+
+// stats returns statistics of the events stored for s.user.
+func (s *Service) stats(ctx context.Context) (Stats, error) {
+	if err := s.ensureListable(ctx); err != nil {
+		return Stats{}, err
+	}
+	st := Stats{User: s.user.UserSpec, Capacity: s.capacity}
+	s.memMu.RLock()
+	st.Pending = len(s.pending)
+	events := append(append(make([]event.Event, 0, len(s.events)+len(s.pending)), s.events...), s.pending...)
+	s.memMu.RUnlock()
+	if st.Capacity != 0 && len(events) > st.Capacity {
+		// Writing buffered events will discard the oldest ones.
+		events = events[len(events)-st.Capacity:]
+	}
+	st.Events = len(events)
+	for _, e := range events {
+		if st.Oldest.IsZero() || e.Time.Before(st.Oldest) {
+			st.Oldest = e.Time
+		}
+		if e.Time.After(st.Newest) {
+			st.Newest = e.Time
+		}
+	}
+
+	var paths []string
+	err := walkFiles(ctx, s.fs, eventsDir(s.user.UserSpec), func(path string) {
+		paths = append(paths, path)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return Stats{}, err
+	}
+	for _, path := range paths {
+		fi, err := s.fs.Stat(ctx, path)
+		if os.IsNotExist(err) {
+			// Removed since it was listed, such as by pruning.
+			continue
+		} else if err != nil {
+			return Stats{}, err
+		}
+		st.Bytes += fi.Size()
+	}
+	return st, nil
+}
@@ -0,0 +1,40 @@
+package fs
+
+import (
+	"context"
+
+	"github.com/shurcooL/events/event"
+)
+
+// store is a storage layout for the events of a single user.
+type store interface {
+	// load loads stored events, oldest first.
+	// It's called before any calls to append. It may be called again
+	// to reload events after another process wrote them, in which case
+	// it replaces any previously loaded state.
+	//
+	// Corrupt events are skipped, and other methods act as if they
+	// weren't stored. They're reported by corruption.
+	load(ctx context.Context) ([]event.Event, error)
+
+	// corruption reports corrupt files found by the last load.
+	corruption() []*CorruptionError
+
+	// append stores events, oldest first, after all previously stored events.
+	// It reports how many of the oldest events, counting both previously
+	// stored and appended ones, it didn't keep, because they didn't fit.
+	append(ctx context.Context, events ...event.Event) (dropped int, err error)
+
+	// prune discards the oldest n stored events.
+	// A store may keep discarded events on disk until a later prune,
+	// so load may return them again.
+	prune(ctx context.Context, n int) error
+
+	// remove removes the i-th oldest stored event that isn't pruned.
+	// Unlike prune, remove doesn't keep the removed event on disk.
+	remove(ctx context.Context, i int) error
+
+	// changed reports whether stored events may have been changed
+	// by something other than the store since it last loaded or wrote them.
+	changed(ctx context.Context) (bool, error)
+}
@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+// Verify checks the storage of user in root for consistency,
+// and reports the problems it finds. It doesn't change storage.
+//
+// It checks that every event file holds one intact event, and has a name
+// with the key of that event, and that segment and log files are numbered
+// consecutively and intact.
+// Problems found in storage are reported as corruption, rather than
+// as errors. A nil result means storage is consistent.
+//
+// opts are the options storage is used with. Only WithEncryption matters,
+// for reading encrypted files.
+//
+// Verify shouldn't be used while storage is being written.
+func Verify(ctx context.Context, root webdav.FileSystem, user users.UserSpec, opts ...Option) ([]*CorruptionError, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = checkVersion(ctx, root, user)
+	if err != nil {
+		return nil, err
+	}
+	if o.format.aead != nil {
+		err := checkKey(ctx, root, keyPath(user), o.format.aead, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var problems []*CorruptionError
+
+	// Ring storage.
+	names, err := listEventFiles(ctx, root, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		e, corrupt, err := decodeEventFile(ctx, root, user, name, o.format.aead)
+		if err != nil {
+			return nil, err
+		} else if corrupt != nil {
+			problems = append(problems, corrupt)
+		} else if _, key, ok := parseEventName(name); !ok || key != eventKey(e) {
+			problems = append(problems, &CorruptionError{Path: eventPath(user, name), Err: fmt.Errorf("name doesn't match its event, whose key is %s", eventKey(e))})
+		}
+	}
+
+	// Append-only storage.
+	files, err := listSegments(ctx, root, segmentsDir(user))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for i, f := range files {
+		if i > 0 && f.n != files[i-1].n+1 {
+			problems = append(problems, &CorruptionError{Path: segmentsDir(user), Err: fmt.Errorf("segment-%d is missing", files[i-1].n+1)})
+		}
+		_, _, corrupt, err := decodeEventsFile(ctx, root, f.path, o.format.aead)
+		if err != nil {
+			return nil, err
+		} else if corrupt != nil {
+			problems = append(problems, corrupt)
+		}
+	}
+
+	// JSON Lines storage.
+	ns, err := listLogFiles(ctx, root, user)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range ns {
+		if i > 0 && n != ns[i-1]+1 {
+			problems = append(problems, &CorruptionError{Path: eventsDir(user), Err: fmt.Errorf("log-%d.jsonl is missing", ns[i-1]+1)})
+		}
+		_, _, corrupt, err := decodeEventsFile(ctx, root, logPath(user, n), o.format.aead)
+		if err != nil {
+			return nil, err
+		} else if corrupt != nil {
+			problems = append(problems, corrupt)
+		}
+	}
+	return problems, nil
+}
+
+// Repair repairs the ring storage of user in root, so that Verify finds
+// no problems with it, and returns how many events it has afterwards.
+// It's meant for recovering storage after a crash or a partial copy,
+// or after event files were changed by hand.
+//
+// Corrupt event files are removed, and event files whose names don't match
+// their events are renamed, keeping the time in their name if it has one,
+// or otherwise using the time of the event. The index file is rebuilt
+// on next load.
+// Append-only and JSON Lines storage aren't repaired.
+//
+// opts are the options storage is used with. Only WithEncryption matters,
+// for reading encrypted files, and WithPermissions, for files Repair creates.
+//
+// Repair holds the storage lock, but services that don't use locking
+// mustn't use storage while it's being repaired.
+func Repair(ctx context.Context, root webdav.FileSystem, user users.UserSpec, opts ...Option) (int, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+	root = withPermissions(root, o.fileMode, o.dirMode)
+	unlock, err := lock(ctx, root, user)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	err = checkVersion(ctx, root, user)
+	if err != nil {
+		return 0, err
+	}
+	if o.format.aead != nil {
+		// Otherwise, every encrypted event file would seem corrupt, and be removed.
+		err := checkKey(ctx, root, keyPath(user), o.format.aead, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	names, err := listEventFiles(ctx, root, user)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, name := range names {
+		e, corrupt, err := decodeEventFile(ctx, root, user, name, o.format.aead)
+		if err != nil {
+			return 0, err
+		} else if corrupt != nil {
+			err := root.RemoveAll(ctx, eventPath(user, name))
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if t, key, ok := parseEventName(name); !ok || key != eventKey(e) {
+			if !ok {
+				t = e.Time
+			}
+			err := renameFile(ctx, root, eventPath(user, name), eventPath(user, eventName(t, e)))
+			if err != nil {
+				return 0, err
+			}
+		}
+		n++
+	}
+	err = root.RemoveAll(ctx, indexPath(user))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// Count the repair as a write, so that services that use locking reload.
+	g, err := readGeneration(ctx, root, user)
+	if err != nil {
+		return 0, err
+	}
+	err = jsonEncodeFile(ctx, root, generationPath(user), g+1)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
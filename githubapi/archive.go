@@ -0,0 +1,78 @@
+package githubapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events"
+)
+
+// ArchiveURL returns the URL of the hourly dump of GH Archive
+// (https://www.gharchive.org) that has the public events during
+// the hour that t is in.
+func ArchiveURL(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("https://data.gharchive.org/%s-%d.json.gz", t.Format("2006-01-02"), t.Hour())
+}
+
+// ImportArchive reads r, an hourly dump of GH Archive, gzip-compressed
+// as given by ArchiveURL, and logs the events in it performed by the user
+// and other users of the service to dst, e.g., a service of the fs package.
+// Events are matched by actor ID rather than login, since logins can be
+// renamed and reused. This recovers activity older than what the Events API
+// lists, back to dumps from 2015, which have the same format.
+//
+// Events keep their IDs, so that importing a dump again to a dst
+// that's idempotent by ID, like the fs package, doesn't duplicate them.
+// The information the events need is fetched like for listed events.
+// If the rate budget is used up first, nothing is logged and an error
+// is returned, so that it can be retried once the rate limit resets.
+func (s *Service) ImportArchive(ctx context.Context, dst events.ExternalService, r io.Reader) error {
+	actors := map[int64]bool{int64(s.user.ID): true}
+	for _, u := range s.others {
+		actors[int64(u.ID)] = true
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("ImportArchive: %v", err)
+	}
+	var es []*githubv3.Event
+	// Dumps have an event per line, and most of them are by others,
+	// so parse only the actor of each line first.
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(nil, 64<<20) // Payloads of big pushes and pull requests can be megabytes.
+	for sc.Scan() {
+		var a struct {
+			Actor struct {
+				ID int64 `json:"id"`
+			} `json:"actor"`
+		}
+		err := json.Unmarshal(sc.Bytes(), &a)
+		if err != nil {
+			return fmt.Errorf("ImportArchive: %v", err)
+		}
+		if !actors[a.Actor.ID] {
+			continue
+		}
+		var e githubv3.Event
+		err = json.Unmarshal(sc.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("ImportArchive: %v", err)
+		}
+		es = append(es, &e)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("ImportArchive: %v", err)
+	}
+	err = s.logEvents(ctx, dst, es, nil, nil)
+	if err != nil {
+		return fmt.Errorf("ImportArchive: %v", err)
+	}
+	return nil
+}
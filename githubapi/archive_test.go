@@ -0,0 +1,88 @@
+package githubapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestArchiveURL(t *testing.T) {
+	for _, tc := range []struct {
+		in   time.Time
+		want string
+	}{
+		{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), "https://data.gharchive.org/2015-01-01-0.json.gz"},
+		{time.Date(2015, 1, 1, 15, 59, 59, 0, time.UTC), "https://data.gharchive.org/2015-01-01-15.json.gz"},
+		{time.Date(2015, 1, 1, 16, 0, 0, 0, time.FixedZone("UTC+1", 60*60)), "https://data.gharchive.org/2015-01-01-15.json.gz"},
+	} {
+		if got := ArchiveURL(tc.in); got != tc.want {
+			t.Errorf("ArchiveURL(%v) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/graphql":
+			w.Write([]byte(`{"data": {"n0": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}}}}`))
+		case "/repos/owner/repo/git/trees/HEAD":
+			w.Write([]byte(`{"sha": "t", "tree": []}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	zw := gzip.NewWriter(&dump)
+	zw.Write([]byte(`{"id": "3", "type": "WatchEvent", "actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"}, "repo": {"id": 1, "name": "owner/repo"}, "payload": {"action": "started"}, "public": true, "created_at": "2015-01-01T15:00:02Z"}
+{"id": "2", "type": "WatchEvent", "actor": {"id": 3, "login": "other", "avatar_url": "https://example.org/other"}, "repo": {"id": 1, "name": "owner/repo"}, "payload": {"action": "started"}, "public": true, "created_at": "2015-01-01T15:00:01Z"}
+{"id": "1", "type": "IssuesEvent", "actor": {"id": 2, "login": "gopher-renamed-since", "avatar_url": "https://example.org/avatar"}, "repo": {"id": 1, "name": "owner/repo"}, "payload": {"action": "opened", "issue": {"number": 1, "title": "Title.", "body": "Body."}}, "public": true, "created_at": "2015-01-01T15:00:00Z"}
+`))
+	zw.Close()
+	var dst logged
+	err = s.ImportArchive(context.Background(), &dst, &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []event.Event{
+		{
+			ID:        "1",
+			Time:      time.Date(2015, 1, 1, 15, 0, 0, 0, time.UTC),
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher-renamed-since", AvatarURL: "https://example.org/avatar"},
+			Container: "example.org/repo",
+			Payload:   event.Issue{Action: event.IssueOpened, IssueNumber: 1, IssueTitle: "Title.", IssueBody: "Body.", IssueHTMLURL: "https://github.com/owner/repo/issues/1"},
+		},
+		{
+			ID:        "3",
+			Time:      time.Date(2015, 1, 1, 15, 0, 2, 0, time.UTC),
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+			Container: "example.org/repo",
+			Payload:   event.Star{},
+		},
+	}
+	if !reflect.DeepEqual([]event.Event(dst), want) {
+		t.Errorf("ImportArchive logged:\ngot  %+v\nwant %+v", dst, want)
+	}
+}
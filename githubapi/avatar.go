@@ -0,0 +1,113 @@
+package githubapi
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/events/event"
+)
+
+// defaultAvatarSize is the size of avatars, in pixels, unless another
+// is set with WithAvatarSize.
+const defaultAvatarSize = 96
+
+// avatars resolves the avatar URLs of listed events, so that they're uniform.
+// Events come with avatar URLs of different sizes, or none, and ones of the same
+// user change over time. Each user's avatar URL is the one of the most recent
+// event that's been listed with it.
+type avatars struct {
+	size int // Size of avatars, in pixels.
+
+	mu     sync.Mutex
+	byUser map[uint64]avatar // User ID -> Most recent avatar.
+}
+
+type avatar struct {
+	url  string    // Normalized avatar URL.
+	time time.Time // Time of the event it was listed with.
+}
+
+// resolve resolves the avatar URLs in es.
+func (a *avatars) resolve(es []event.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.byUser == nil {
+		a.byUser = make(map[uint64]avatar)
+	}
+	note := func(id uint64, avatarURL string, t time.Time) {
+		if avatarURL == "" {
+			return
+		}
+		if av, ok := a.byUser[id]; ok && !t.After(av.time) {
+			return
+		}
+		a.byUser[id] = avatar{url: a.normalize(avatarURL), time: t}
+	}
+	for _, e := range es {
+		note(e.Actor.ID, e.Actor.AvatarURL, e.Time)
+		switch p := e.Payload.(type) {
+		case event.Member:
+			note(p.Member.ID, p.Member.AvatarURL, e.Time)
+		case event.Sponsor:
+			note(p.Sponsorable.ID, p.Sponsorable.AvatarURL, e.Time)
+		case event.Assign:
+			note(p.Assignee.ID, p.Assignee.AvatarURL, e.Time)
+		}
+	}
+	for i, e := range es {
+		es[i].Actor.AvatarURL = a.user(e.Actor.ID)
+		switch p := e.Payload.(type) {
+		case event.Member:
+			p.Member.AvatarURL = a.user(p.Member.ID)
+			es[i].Payload = p
+		case event.Sponsor:
+			p.Sponsorable.AvatarURL = a.user(p.Sponsorable.ID)
+			es[i].Payload = p
+		case event.Assign:
+			p.Assignee.AvatarURL = a.user(p.Assignee.ID)
+			es[i].Payload = p
+		case event.Push:
+			for j := range p.Commits {
+				p.Commits[j].AuthorAvatarURL = a.normalize(p.Commits[j].AuthorAvatarURL)
+			}
+		case event.CommitComment:
+			p.Commit.AuthorAvatarURL = a.normalize(p.Commit.AuthorAvatarURL)
+			es[i].Payload = p
+		}
+	}
+}
+
+// user returns the avatar URL of the user with id, or the placeholder
+// if it's not known. a.mu must be held.
+func (a *avatars) user(id uint64) string {
+	if av, ok := a.byUser[id]; ok {
+		return av.url
+	}
+	return a.normalize("")
+}
+
+// normalize returns avatarURL at the size of avatars. Avatars that GitHub
+// and Gravatar serve are resized by them. The placeholder is returned in place
+// of an empty avatarURL, and other avatar URLs are returned as is.
+func (a *avatars) normalize(avatarURL string) string {
+	if avatarURL == "" {
+		avatarURL = placeholderAvatarURL
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil {
+		return avatarURL
+	}
+	switch {
+	case strings.HasPrefix(u.Host, "avatars") && strings.HasSuffix(u.Host, ".githubusercontent.com"),
+		u.Host == "secure.gravatar.com", u.Host == "www.gravatar.com":
+		q := u.Query()
+		q.Set("s", strconv.Itoa(a.size))
+		u.RawQuery = q.Encode()
+		return u.String()
+	default:
+		return avatarURL
+	}
+}
@@ -0,0 +1,71 @@
+package githubapi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+func TestAvatars(t *testing.T) {
+	user := func(id uint64, avatarURL string) users.User {
+		return users.User{UserSpec: users.UserSpec{ID: id, Domain: "github.com"}, Login: "user", AvatarURL: avatarURL}
+	}
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	a := &avatars{size: 40}
+	es := []event.Event{
+		{
+			Time:    t0.Add(time.Minute),
+			Actor:   user(1, "https://avatars.githubusercontent.com/u/1?v=4"),
+			Payload: event.Member{Member: user(2, "https://secure.gravatar.com/avatar/abc?d=identicon&s=96")},
+		},
+		{
+			Time:  t0,
+			Actor: user(1, "https://avatars.githubusercontent.com/u/1?v=3"), // Changed since.
+			Payload: event.Push{Commits: []event.Commit{
+				{SHA: "aaa", AuthorAvatarURL: "https://avatars.githubusercontent.com/u/1?s=96&v=4"},
+				{SHA: "bbb"},
+				{SHA: "ccc", AuthorAvatarURL: "https://example.org/avatar"},
+			}},
+		},
+		{
+			Time:  t0,
+			Actor: user(3, ""),
+		},
+	}
+	a.resolve(es)
+	const placeholder = "https://secure.gravatar.com/avatar?d=mm&f=y&s=40"
+	want := []event.Event{
+		{
+			Time:    t0.Add(time.Minute),
+			Actor:   user(1, "https://avatars.githubusercontent.com/u/1?s=40&v=4"),
+			Payload: event.Member{Member: user(2, "https://secure.gravatar.com/avatar/abc?d=identicon&s=40")},
+		},
+		{
+			Time:  t0,
+			Actor: user(1, "https://avatars.githubusercontent.com/u/1?s=40&v=4"),
+			Payload: event.Push{Commits: []event.Commit{
+				{SHA: "aaa", AuthorAvatarURL: "https://avatars.githubusercontent.com/u/1?s=40&v=4"},
+				{SHA: "bbb", AuthorAvatarURL: placeholder},
+				{SHA: "ccc", AuthorAvatarURL: "https://example.org/avatar"},
+			}},
+		},
+		{
+			Time:  t0,
+			Actor: user(3, placeholder),
+		},
+	}
+	if !reflect.DeepEqual(es, want) {
+		t.Errorf("resolve:\ngot  %+v\nwant %+v", es, want)
+	}
+
+	// Avatars are cached by user, so older events that are listed later,
+	// e.g., from history, have the most recent avatar URL too.
+	older := []event.Event{{Time: t0.Add(-time.Hour), Actor: user(1, "https://avatars.githubusercontent.com/u/1?v=2")}}
+	a.resolve(older)
+	if got, want := older[0].Actor.AvatarURL, "https://avatars.githubusercontent.com/u/1?s=40&v=4"; got != want {
+		t.Errorf("resolve older: got avatar URL %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,425 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+)
+
+// Backfill synthesizes events performed by the user from their contributions
+// between from and to, like ones older than the Events API lists, and logs them
+// to dst, e.g., a service of the fs package. The contributions are commits to
+// default branches, listed as a push per repository per day, opened issues and
+// pull requests, pull request reviews, and created repositories, as GitHub
+// counts them. Other users and organizations of the service are left out.
+//
+// It's meant to be used once, e.g., when dst is set up. Events are logged
+// with IDs derived from the contributions, so that logging them again
+// to a dst that's idempotent by ID, like the fs package, doesn't duplicate them.
+// Private contributions are left out or redacted, same as by List.
+//
+// If the rate budget is used up before the information the events need
+// is fetched, nothing is logged and an error is returned, so that it can be
+// retried once the rate limit resets.
+func (s *Service) Backfill(ctx context.Context, dst events.ExternalService, from, to time.Time) error {
+	// GitHub lists contributions of at most a year at a time.
+	var es []*githubv3.Event
+	commits := make(map[string]event.Commit) // SHA -> Commit, of synthesized pushes.
+	for start := from; start.Before(to); start = start.AddDate(1, 0, 0) {
+		end := start.AddDate(1, 0, 0)
+		if end.After(to) {
+			end = to
+		}
+		e, err := s.fetchContributions(ctx, start, end, commits)
+		if err != nil {
+			return fmt.Errorf("Backfill: %v", err)
+		}
+		es = append(es, e...)
+	}
+	forced := make(map[string]bool)
+	for _, e := range es {
+		if *e.Type == "PushEvent" {
+			// It's not known, but commits of contributions are on default branches,
+			// which are rarely pushed to with force.
+			forced[*e.ID] = false
+		}
+	}
+	err := s.logEvents(ctx, dst, es, commits, forced)
+	if err != nil {
+		return fmt.Errorf("Backfill: %v", err)
+	}
+	return nil
+}
+
+// logEvents converts events that aren't listed by the Events API,
+// like synthesized or imported ones, and logs them to dst in chronological order.
+// The information they need is fetched like for listed events, except what's
+// already in commits and forced. Events are left out or redacted same as
+// by List. Nothing is logged if the rate budget is used up first.
+func (s *Service) logEvents(ctx context.Context, dst events.ExternalService, es []*githubv3.Event, commits map[string]event.Commit, forced map[string]bool) error {
+	s.mu.Lock()
+	repos, known, prs, deletes, knownForced := s.copyFetched()
+	s.mu.Unlock()
+	for sha, c := range commits {
+		known[sha] = c
+	}
+	for id, f := range forced {
+		knownForced[id] = f
+	}
+	commits, forced = known, knownForced
+	for i := range es {
+		es[i] = s.limitCommits(es[i])
+	}
+
+	err := s.enrich(ctx, es, repos, commits, prs, deletes, forced)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if _, ok := repos[*e.Repo.ID]; !ok {
+			return errors.New("rate budget is used up")
+		}
+	}
+
+	sort.SliceStable(es, func(i, j int) bool { return es[i].CreatedAt.Before(*es[j].CreatedAt) })
+	for _, e := range s.convertListed(ctx, es, repos, commits, prs, deletes, forced) {
+		err := dst.Log(ctx, e)
+		if err != nil {
+			return fmt.Errorf("Log: %v", err)
+		}
+	}
+	return nil
+}
+
+// contributionRepository is a repository that a contribution was made in.
+type contributionRepository struct {
+	DatabaseID    int64
+	NameWithOwner string
+	IsPrivate     bool
+}
+
+// pageInfo is the information about a page of a connection.
+type pageInfo struct {
+	EndCursor   githubv4.String
+	HasNextPage bool
+}
+
+// fetchContributions fetches the contributions of the user from start
+// to end, at most a year apart, and returns them as synthesized GitHub events.
+// The commits of synthesized pushes are added to commits.
+func (s *Service) fetchContributions(ctx context.Context, start, end time.Time, commits map[string]event.Commit) ([]*githubv3.Event, error) {
+	var q struct {
+		User *struct {
+			ID                      githubv4.ID
+			ContributionsCollection struct {
+				CommitContributionsByRepository []struct {
+					Repository contributionRepository
+				} `graphql:"commitContributionsByRepository(maxRepositories:100)"`
+				IssueContributions struct {
+					Nodes []struct {
+						OccurredAt githubv4.DateTime
+						Issue      struct {
+							Number     int
+							Title      string
+							Body       string
+							Repository contributionRepository
+						}
+					}
+					PageInfo pageInfo
+				} `graphql:"issueContributions(first:100,after:$issuesCursor)"`
+				PullRequestContributions struct {
+					Nodes []struct {
+						OccurredAt  githubv4.DateTime
+						PullRequest struct {
+							Number      int
+							Title       string
+							Body        string
+							IsDraft     bool
+							BaseRefName string
+							HeadRefName string
+							Repository  contributionRepository
+						}
+					}
+					PageInfo pageInfo
+				} `graphql:"pullRequestContributions(first:100,after:$pullRequestsCursor)"`
+				PullRequestReviewContributions struct {
+					Nodes []struct {
+						OccurredAt        githubv4.DateTime
+						PullRequestReview struct {
+							DatabaseID int64
+							Body       string
+							State      githubv4.PullRequestReviewState
+						}
+						PullRequest struct {
+							Number   int
+							Title    string
+							ClosedAt *githubv4.DateTime
+							MergedAt *githubv4.DateTime
+						}
+						Repository contributionRepository
+					}
+					PageInfo pageInfo
+				} `graphql:"pullRequestReviewContributions(first:100,after:$reviewsCursor)"`
+				RepositoryContributions struct {
+					Nodes []struct {
+						OccurredAt githubv4.DateTime
+						Repository struct {
+							contributionRepository
+							Description string
+						}
+					}
+					PageInfo pageInfo
+				} `graphql:"repositoryContributions(first:100,after:$repositoriesCursor)"`
+			} `graphql:"contributionsCollection(from:$from,to:$to)"`
+		} `graphql:"user(login:$login)"`
+	}
+	variables := map[string]interface{}{
+		"login":              githubv4.String(s.user.Login),
+		"from":               githubv4.DateTime{Time: start},
+		"to":                 githubv4.DateTime{Time: end},
+		"issuesCursor":       (*githubv4.String)(nil),
+		"pullRequestsCursor": (*githubv4.String)(nil),
+		"reviewsCursor":      (*githubv4.String)(nil),
+		"repositoriesCursor": (*githubv4.String)(nil),
+	}
+	var es []*githubv3.Event
+	var commitRepos []contributionRepository
+	var userID githubv4.ID
+	for first := true; ; first = false {
+		if !s.spendV4() {
+			return nil, errors.New("rate budget is used up")
+		}
+		q.User = nil
+		err := s.clV4.Query(ctx, &q, variables)
+		if err != nil {
+			return nil, err
+		}
+		if q.User == nil {
+			return nil, fmt.Errorf("user %q was not found", s.user.Login)
+		}
+		c := q.User.ContributionsCollection
+		if first {
+			// Commit contributions are listed by repository, all at once.
+			userID = q.User.ID
+			for _, r := range c.CommitContributionsByRepository {
+				commitRepos = append(commitRepos, r.Repository)
+			}
+		}
+		for _, n := range c.IssueContributions.Nodes {
+			r := n.Issue.Repository
+			es = append(es, s.contributionEvent("IssuesEvent", "issue-"+strconv.FormatInt(r.DatabaseID, 10)+"-"+strconv.Itoa(n.Issue.Number), r, n.OccurredAt.Time, &githubv3.IssuesEvent{
+				Action: githubv3.String("opened"),
+				Issue: &githubv3.Issue{
+					Number: githubv3.Int(n.Issue.Number),
+					Title:  githubv3.String(n.Issue.Title),
+					Body:   githubv3.String(n.Issue.Body),
+				},
+			}))
+		}
+		for _, n := range c.PullRequestContributions.Nodes {
+			r, pr := n.PullRequest.Repository, n.PullRequest
+			var p struct {
+				*githubv3.PullRequestEvent
+				PullRequest struct {
+					*githubv3.PullRequest
+					Draft bool `json:"draft"` // Not in githubv3.PullRequest yet.
+				} `json:"pull_request"`
+			}
+			p.PullRequestEvent = &githubv3.PullRequestEvent{Action: githubv3.String("opened"), Number: githubv3.Int(pr.Number)}
+			p.PullRequest.PullRequest = &githubv3.PullRequest{
+				Number: githubv3.Int(pr.Number),
+				Title:  githubv3.String(pr.Title),
+				Body:   githubv3.String(pr.Body),
+				Base:   &githubv3.PullRequestBranch{Ref: githubv3.String(pr.BaseRefName)},
+				Head:   &githubv3.PullRequestBranch{Ref: githubv3.String(pr.HeadRefName)},
+			}
+			p.PullRequest.Draft = pr.IsDraft
+			es = append(es, s.contributionEvent("PullRequestEvent", "pr-"+strconv.FormatInt(r.DatabaseID, 10)+"-"+strconv.Itoa(pr.Number), r, n.OccurredAt.Time, p))
+		}
+		for _, n := range c.PullRequestReviewContributions.Nodes {
+			// Use the state of the pull request as of the review, like the Events API does.
+			pr := &githubv3.PullRequest{Number: githubv3.Int(n.PullRequest.Number), Title: githubv3.String(n.PullRequest.Title), State: githubv3.String("open")}
+			if at := n.PullRequest.ClosedAt; at != nil && !at.After(n.OccurredAt.Time) {
+				pr.State = githubv3.String("closed")
+			}
+			if at := n.PullRequest.MergedAt; at != nil && !at.After(n.OccurredAt.Time) {
+				pr.MergedAt = &at.Time
+			}
+			es = append(es, s.contributionEvent("PullRequestReviewEvent", "review-"+strconv.FormatInt(n.PullRequestReview.DatabaseID, 10), n.Repository, n.OccurredAt.Time, &githubv3.PullRequestReviewEvent{
+				Action: githubv3.String("created"),
+				Review: &githubv3.PullRequestReview{
+					ID:          githubv3.Int64(n.PullRequestReview.DatabaseID),
+					Body:        githubv3.String(n.PullRequestReview.Body),
+					SubmittedAt: &n.OccurredAt.Time,
+					State:       githubv3.String(string(n.PullRequestReview.State)),
+				},
+				PullRequest: pr,
+			}))
+		}
+		for _, n := range c.RepositoryContributions.Nodes {
+			r := n.Repository.contributionRepository
+			es = append(es, s.contributionEvent("CreateEvent", "repo-"+strconv.FormatInt(r.DatabaseID, 10), r, n.OccurredAt.Time, &githubv3.CreateEvent{
+				RefType:     githubv3.String("repository"),
+				Description: githubv3.String(n.Repository.Description),
+			}))
+		}
+
+		// Page through all connections together. Ones that are done
+		// list no more nodes after their end cursor.
+		more := false
+		for cursor, pi := range map[string]pageInfo{
+			"issuesCursor":       c.IssueContributions.PageInfo,
+			"pullRequestsCursor": c.PullRequestContributions.PageInfo,
+			"reviewsCursor":      c.PullRequestReviewContributions.PageInfo,
+			"repositoriesCursor": c.RepositoryContributions.PageInfo,
+		} {
+			if pi.EndCursor != "" {
+				variables[cursor] = githubv4.NewString(pi.EndCursor)
+			}
+			more = more || pi.HasNextPage
+		}
+		if !more {
+			break
+		}
+	}
+
+	for _, r := range commitRepos {
+		e, err := s.fetchCommitContributions(ctx, r, userID, start, end, commits)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e...)
+	}
+	return es, nil
+}
+
+// fetchCommitContributions fetches the commits of the user to the default
+// branch of repository r from start to end, and returns them as synthesized
+// push events, one per day. The commits are added to commits.
+func (s *Service) fetchCommitContributions(ctx context.Context, r contributionRepository, userID githubv4.ID, start, end time.Time, commits map[string]event.Commit) ([]*githubv3.Event, error) {
+	var q struct {
+		Repository *struct {
+			DefaultBranchRef *struct {
+				Name   string
+				Target struct {
+					Commit struct {
+						History struct {
+							Nodes []struct {
+								commitNode
+								CommittedDate githubv4.DateTime
+								Parents       struct {
+									Nodes []struct {
+										OID string
+									}
+								} `graphql:"parents(first:1)"`
+							}
+							PageInfo pageInfo
+						} `graphql:"history(first:100,after:$cursor,author:$author,since:$since,until:$until)"`
+					} `graphql:"...on Commit"`
+				}
+			}
+		} `graphql:"repository(owner:$owner,name:$name)"`
+	}
+	owner, name := splitOwnerRepo(r.NameWithOwner)
+	variables := map[string]interface{}{
+		"owner":  githubv4.String(owner),
+		"name":   githubv4.String(name),
+		"author": githubv4.CommitAuthor{ID: &userID},
+		"since":  githubv4.GitTimestamp{Time: start},
+		"until":  githubv4.GitTimestamp{Time: end},
+		"cursor": (*githubv4.String)(nil),
+	}
+	type dayCommit struct {
+		SHA, Parent string
+	}
+	var (
+		branch string
+		days   []string                       // Days with commits, newest first.
+		byDay  = make(map[string][]dayCommit) // Day -> Commits, newest first.
+		dayAt  = make(map[string]time.Time)   // Day -> When the newest commit was made.
+	)
+	for {
+		if !s.spendV4() {
+			return nil, errors.New("rate budget is used up")
+		}
+		q.Repository = nil
+		err := s.clV4.Query(ctx, &q, variables)
+		if err != nil {
+			return nil, err
+		}
+		if q.Repository == nil || q.Repository.DefaultBranchRef == nil {
+			// E.g., because the repository was deleted since.
+			s.logf("Backfill: default branch of %s was not found", r.NameWithOwner)
+			return nil, nil
+		}
+		branch = q.Repository.DefaultBranchRef.Name
+		h := q.Repository.DefaultBranchRef.Target.Commit.History
+		for _, n := range h.Nodes {
+			commits[n.Commit.OID] = n.commit()
+			parent := zeroSHA
+			if len(n.Parents.Nodes) > 0 {
+				parent = n.Parents.Nodes[0].OID
+			}
+			day := n.CommittedDate.UTC().Format("2006-01-02")
+			if _, ok := byDay[day]; !ok {
+				days = append(days, day)
+				dayAt[day] = n.CommittedDate.UTC()
+			}
+			byDay[day] = append(byDay[day], dayCommit{SHA: n.Commit.OID, Parent: parent})
+		}
+		if !h.PageInfo.HasNextPage {
+			break
+		}
+		variables["cursor"] = githubv4.NewString(h.PageInfo.EndCursor)
+	}
+
+	var es []*githubv3.Event
+	for _, day := range days {
+		cs := byDay[day]
+		var pushed []githubv3.PushEventCommit
+		for i := len(cs) - 1; i >= 0; i-- { // Oldest first, like the Events API lists them.
+			pushed = append(pushed, githubv3.PushEventCommit{SHA: githubv3.String(cs[i].SHA), Message: githubv3.String(commits[cs[i].SHA].Message)})
+		}
+		es = append(es, s.contributionEvent("PushEvent", "push-"+strconv.FormatInt(r.DatabaseID, 10)+"-"+day, r, dayAt[day], &githubv3.PushEvent{
+			Ref:     githubv3.String("refs/heads/" + branch),
+			Head:    githubv3.String(cs[0].SHA),
+			Before:  githubv3.String(cs[len(cs)-1].Parent),
+			Size:    githubv3.Int(len(cs)),
+			Commits: pushed,
+		}))
+	}
+	return es, nil
+}
+
+// contributionEvent returns a GitHub event of the specified type and payload
+// synthesized from a contribution of the user in repository r at time t.
+// Its ID is made unique by id, which identifies the contribution.
+func (s *Service) contributionEvent(typ, id string, r contributionRepository, t time.Time, payload interface{}) *githubv3.Event {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		panic(fmt.Errorf("internal error: contributionEvent given a payload that fails to marshal: %v", err))
+	}
+	t = t.UTC()
+	return &githubv3.Event{
+		Type:       githubv3.String(typ),
+		RawPayload: (*json.RawMessage)(&raw),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(r.DatabaseID), Name: githubv3.String(r.NameWithOwner)},
+		Actor: &githubv3.User{
+			ID:        githubv3.Int64(int64(s.user.ID)),
+			Login:     githubv3.String(s.user.Login),
+			AvatarURL: githubv3.String(s.user.AvatarURL),
+		},
+		Public:    githubv3.Bool(!r.IsPrivate),
+		CreatedAt: &t,
+		ID:        githubv3.String("contribution-" + id),
+	}
+}
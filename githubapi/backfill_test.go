@@ -0,0 +1,194 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/route/github"
+	"dmitri.shuralyov.com/state"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestBackfill(t *testing.T) {
+	field := regexp.MustCompile(`(n\d+):repository\(owner:\$(v\d+)Owner,name:\$v\d+Name\)`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path != "/graphql" {
+			w.Write([]byte(`{"sha": "t", "tree": []}`))
+			return
+		}
+		var in struct {
+			Query     string
+			Variables map[string]interface{}
+		}
+		err := json.NewDecoder(req.Body).Decode(&in)
+		if err != nil {
+			t.Errorf("decoding query: %v", err)
+		}
+		switch {
+		case strings.Contains(in.Query, "contributionsCollection") && in.Variables["issuesCursor"] == nil:
+			w.Write([]byte(`{"data": {"user": {"id": "U", "contributionsCollection": {
+				"commitContributionsByRepository": [{"repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}],
+				"issueContributions": {"nodes": [{"occurredAt": "2019-01-01T00:00:00Z", "issue": {"number": 1, "title": "sub: first", "body": "One.", "repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}}], "pageInfo": {"endCursor": "i1", "hasNextPage": true}},
+				"pullRequestContributions": {"nodes": [{"occurredAt": "2019-04-01T00:00:00Z", "pullRequest": {"number": 3, "title": "Third.", "body": "", "isDraft": true, "baseRefName": "main", "headRefName": "dev", "repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}}], "pageInfo": {"endCursor": "p1", "hasNextPage": false}},
+				"pullRequestReviewContributions": {"nodes": [{"occurredAt": "2019-05-01T00:00:00Z", "pullRequestReview": {"databaseId": 7, "body": "LGTM.", "state": "APPROVED"}, "pullRequest": {"number": 4, "title": "Fourth.", "closedAt": "2019-06-01T00:00:00Z", "mergedAt": "2019-06-01T00:00:00Z"}, "repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}], "pageInfo": {"endCursor": "r1", "hasNextPage": false}},
+				"repositoryContributions": {"nodes": [{"occurredAt": "2019-07-01T00:00:00Z", "repository": {"databaseId": 3, "nameWithOwner": "owner/secret", "isPrivate": true, "description": ""}}], "pageInfo": {"endCursor": "c1", "hasNextPage": false}}
+			}}}}`))
+		case strings.Contains(in.Query, "contributionsCollection"):
+			w.Write([]byte(`{"data": {"user": {"id": "U", "contributionsCollection": {
+				"commitContributionsByRepository": [{"repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}],
+				"issueContributions": {"nodes": [{"occurredAt": "2019-03-01T00:00:00Z", "issue": {"number": 2, "title": "Second.", "body": "", "repository": {"databaseId": 1, "nameWithOwner": "owner/repo", "isPrivate": false}}}], "pageInfo": {"endCursor": "i2", "hasNextPage": false}},
+				"pullRequestContributions": {"nodes": [], "pageInfo": {"endCursor": null, "hasNextPage": false}},
+				"pullRequestReviewContributions": {"nodes": [], "pageInfo": {"endCursor": null, "hasNextPage": false}},
+				"repositoryContributions": {"nodes": [], "pageInfo": {"endCursor": null, "hasNextPage": false}}
+			}}}}`))
+			if got := fmt.Sprintf("%v %v", in.Variables["issuesCursor"], in.Variables["reviewsCursor"]); got != "i1 r1" {
+				t.Errorf("got cursors %v, want i1 r1", got)
+			}
+		case strings.Contains(in.Query, "history("):
+			if in.Variables["owner"] != "owner" || in.Variables["name"] != "repo" {
+				t.Errorf("history of %v/%v was queried, want owner/repo", in.Variables["owner"], in.Variables["name"])
+			}
+			w.Write([]byte(`{"data": {"repository": {"defaultBranchRef": {"name": "main", "target": {"history": {"nodes": [
+				{"oid": "ccc", "message": "C.", "author": {"avatarUrl": "https://example.org/c"}, "url": "https://github.com/owner/repo/commit/ccc", "additions": 1, "deletions": 0, "changedFiles": 1, "committedDate": "2019-02-03T00:00:00Z", "parents": {"nodes": [{"oid": "bbb"}]}},
+				{"oid": "bbb", "message": "B.", "author": {"avatarUrl": "https://example.org/b"}, "url": "https://github.com/owner/repo/commit/bbb", "additions": 1, "deletions": 0, "changedFiles": 1, "committedDate": "2019-02-01T10:00:00Z", "parents": {"nodes": [{"oid": "aaa"}]}},
+				{"oid": "aaa", "message": "A.", "author": {"avatarUrl": "https://example.org/a"}, "url": "https://github.com/owner/repo/commit/aaa", "additions": 1, "deletions": 0, "changedFiles": 1, "committedDate": "2019-02-01T09:00:00Z", "parents": {"nodes": []}}
+			], "pageInfo": {"endCursor": "h1", "hasNextPage": false}}}}}}}`))
+		default:
+			var data []string
+			for _, m := range field.FindAllStringSubmatch(in.Query, -1) {
+				alias, v := m[1], m[2]
+				switch {
+				case in.Variables[v+"Expression"] != nil:
+					data = append(data, `"`+alias+`": {"object": null}`)
+				case in.Variables[v+"Name"] == "repo":
+					data = append(data, `"`+alias+`": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}}`)
+				default:
+					data = append(data, `"`+alias+`": {"databaseId": 3, "object": null}`)
+				}
+			}
+			w.Write([]byte(`{"data": {` + strings.Join(data, ",") + `}}`))
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"}
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dst logged
+	err = s.Backfill(context.Background(), &dst, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(sha, message string) event.Commit {
+		return event.Commit{SHA: sha, Message: message, AuthorAvatarURL: "https://example.org/" + sha[:1], HTMLURL: "https://github.com/owner/repo/commit/" + sha, Additions: 1, ChangedFiles: 1}
+	}
+	want := []event.Event{
+		{
+			ID:        "contribution-issue-1-1",
+			Time:      time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo/sub",
+			Payload:   event.Issue{Action: event.IssueOpened, IssueNumber: 1, IssueTitle: "first", IssueBody: "One.", IssueHTMLURL: "https://github.com/owner/repo/issues/1"},
+		},
+		{
+			ID:        "contribution-push-1-2019-02-01",
+			Time:      time.Date(2019, 2, 1, 10, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo",
+			Payload: event.Push{
+				Branch:        "main",
+				Head:          "bbb",
+				Before:        zeroSHA,
+				Commits:       []event.Commit{commit("aaa", "A."), commit("bbb", "B.")},
+				TotalCommits:  2,
+				HeadHTMLURL:   "https://github.com/owner/repo/commit/bbb",
+				BeforeHTMLURL: "https://github.com/owner/repo/commit/" + zeroSHA,
+			},
+		},
+		{
+			ID:        "contribution-push-1-2019-02-03",
+			Time:      time.Date(2019, 2, 3, 0, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo",
+			Payload: event.Push{
+				Branch:        "main",
+				Head:          "ccc",
+				Before:        "bbb",
+				Commits:       []event.Commit{commit("ccc", "C.")},
+				TotalCommits:  1,
+				HeadHTMLURL:   "https://github.com/owner/repo/commit/ccc",
+				BeforeHTMLURL: "https://github.com/owner/repo/commit/bbb",
+			},
+		},
+		{
+			ID:        "contribution-issue-1-2",
+			Time:      time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo",
+			Payload:   event.Issue{Action: event.IssueOpened, IssueNumber: 2, IssueTitle: "Second.", IssueHTMLURL: "https://github.com/owner/repo/issues/2"},
+		},
+		{
+			ID:        "contribution-pr-1-3",
+			Time:      time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo",
+			Payload:   event.Change{Action: event.ChangeOpened, ChangeNumber: 3, ChangeTitle: "Third.", ChangeHTMLURL: "https://github.com/owner/repo/pull/3", BaseBranch: "main", HeadBranch: "dev", Draft: true},
+		},
+		{
+			ID:        "contribution-review-7",
+			Time:      time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC),
+			Actor:     user,
+			Container: "example.org/repo",
+			Payload: event.ChangeComment{
+				ChangeTitle:      "Fourth.",
+				ChangeState:      state.ChangeOpen, // Merged only after the review.
+				CommentID:        7,
+				CommentBody:      "LGTM.",
+				CommentReview:    state.ReviewPlus2,
+				CommentCreatedAt: time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC),
+				CommentHTMLURL:   github.DotCom{}.PullRequestReviewURL(context.Background(), "owner", "repo", 4, 7),
+			},
+		},
+		// The created repository is private, so it's left out.
+	}
+	if !reflect.DeepEqual([]event.Event(dst), want) {
+		t.Errorf("Backfill logged:\ngot  %+v\nwant %+v", dst, want)
+	}
+}
+
+// logged is an events.Service that records the events logged to it.
+type logged []event.Event
+
+func (l *logged) List(context.Context) ([]event.Event, error) {
+	es := make([]event.Event, len(*l))
+	for i, e := range *l {
+		es[len(es)-1-i] = e // Most recent first.
+	}
+	return es, nil
+}
+
+func (l *logged) Log(_ context.Context, e event.Event) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	*l = append(*l, e)
+	return nil
+}
@@ -0,0 +1,239 @@
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+)
+
+// batchSize is the maximum number of nodes fetched in a single GraphQL query.
+const batchSize = 100
+
+// prefetch fetches the module paths of repositories, the commits and
+// the merge times of pull requests that events need and that aren't already
+// in repos, commits and prs, in as few GraphQL queries as possible,
+// and adds them to repos, commits and prs. It also fetches the module paths
+// at refs that events need and that aren't already in repos, and adds them
+// to refs, for enrich to add to repos once their repositories are known.
+//
+// Repositories are queried by name, like fetchModulePath and fetchCommit do.
+// Nodes that can't be fetched that way, e.g., because the repository was
+// renamed or deleted, are left out, so that fetching them individually
+// falls back to querying them by ID, or reports why they can't be found.
+// So are ones that don't fit in the rate budget.
+func (s *Service) prefetch(
+	ctx context.Context,
+	events []*githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	refs map[repoRef]string, // Ref -> Module path at ref.
+) error {
+	var nodes []batchNode
+	seen := make(map[string]bool) // A set of node keys in nodes.
+	add := func(key string, n func(v string) batchNode) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		nodes = append(nodes, n(fmt.Sprintf("v%d", len(nodes))))
+	}
+	for _, e := range events {
+		owner, name := splitOwnerRepo(*e.Repo.Name)
+		if _, ok := repos[*e.Repo.ID]; !ok && *e.Repo.ID != goRepoID {
+			repoID, repoPath := *e.Repo.ID, "github.com/"+*e.Repo.Name
+			add(fmt.Sprint(repoID), func(v string) batchNode {
+				return batchNode{
+					Field:     repositoryField(v),
+					Variables: repositoryVariables(v, owner, name),
+					Type:      reflect.TypeOf((*repositoryNode)(nil)),
+					Done: func(n interface{}) {
+						if r := n.(*repositoryNode); r.Repository.DatabaseID == repoID {
+							repos[repoID] = repository{ModulePath: r.modulePath(repoPath)}
+						}
+					},
+				}
+			})
+		}
+		payload, err := e.ParsePayload()
+		if err != nil {
+			return fmt.Errorf("prefetch: ParsePayload failed: %v", err)
+		}
+		if ref := eventRef(payload); ref != "" && *e.Repo.ID != goRepoID {
+			if _, ok := repos[*e.Repo.ID].Refs[ref]; !ok {
+				key := repoRef{*e.Repo.ID, ref}
+				add(fmt.Sprint(key), func(v string) batchNode {
+					variables := repositoryVariables(v, owner, name)
+					variables[v+"Expression"] = githubv4.String(ref + ":go.mod")
+					return batchNode{
+						Field:     repositoryField(v),
+						Variables: variables,
+						Type:      fieldType(fmt.Sprintf("object(expression:$%sExpression)", v), reflect.TypeOf((*goModNode)(nil))),
+						Done: func(n interface{}) {
+							var goMod *goModNode // Nil if there's no go.mod file at ref.
+							if f, ok := fieldValue(n); ok {
+								goMod = f.(*goModNode)
+							}
+							refs[key] = goMod.modulePath()
+						},
+					}
+				})
+			}
+		}
+		var shas []string
+		switch p := payload.(type) {
+		case *githubv3.PushEvent:
+			for _, c := range p.Commits {
+				shas = append(shas, *c.SHA)
+			}
+		case *githubv3.CommitCommentEvent:
+			shas = append(shas, *p.Comment.CommitID)
+		case *githubv3.IssueCommentEvent:
+			// Like enrich, only closed pull requests are needed.
+			if p.Issue.PullRequestLinks == nil || *p.Issue.State != "closed" {
+				break
+			}
+			if _, ok := prs[*p.Issue.PullRequestLinks.URL]; ok {
+				break
+			}
+			url, number := *p.Issue.PullRequestLinks.URL, *p.Issue.Number
+			add(url, func(v string) batchNode {
+				variables := repositoryVariables(v, owner, name)
+				variables[v+"Number"] = githubv4.Int(number)
+				return batchNode{
+					Field:     repositoryField(v),
+					Variables: variables,
+					Type:      fieldType(fmt.Sprintf("pullRequest(number:$%sNumber)", v), reflect.TypeOf((*pullRequestNode)(nil))),
+					Done: func(n interface{}) {
+						if pr, ok := fieldValue(n); ok {
+							prs[url] = pr.(*pullRequestNode).mergedAt()
+						}
+					},
+				}
+			})
+		}
+		for _, sha := range shas {
+			if _, ok := commits[sha]; ok {
+				continue
+			}
+			sha := sha
+			add(*e.Repo.Name+"@"+sha, func(v string) batchNode {
+				variables := repositoryVariables(v, owner, name)
+				variables[v+"OID"] = githubv4.GitObjectID(sha)
+				return batchNode{
+					Field:     repositoryField(v),
+					Variables: variables,
+					Type:      fieldType(fmt.Sprintf("object(oid:$%sOID)", v), reflect.TypeOf((*commitNode)(nil))),
+					Done: func(n interface{}) {
+						if c, ok := fieldValue(n); ok {
+							commits[sha] = c.(*commitNode).commit()
+						}
+					},
+				}
+			})
+		}
+	}
+
+	for len(nodes) > 0 && s.spendV4() {
+		n := len(nodes)
+		if n > batchSize {
+			n = batchSize
+		}
+		err := s.queryNodes(ctx, nodes[:n])
+		if err != nil {
+			return err
+		}
+		nodes = nodes[n:]
+	}
+	return nil
+}
+
+// batchNode is a node fetched by queryNodes.
+type batchNode struct {
+	Field     string                 // Field queried for the node, like "repository(owner:$v0Owner,name:$v0Name)".
+	Variables map[string]interface{} // Variables of Field, named uniquely within the query.
+	Type      reflect.Type           // Type of the node's query, a pointer like *repositoryNode.
+	Done      func(n interface{})    // Called with the node's query once it's fetched.
+}
+
+// repositoryField returns the field that queries a repository by name,
+// with variables prefixed by v.
+func repositoryField(v string) string {
+	return fmt.Sprintf("repository(owner:$%[1]sOwner,name:$%[1]sName)", v)
+}
+
+// repositoryVariables returns the variables of repositoryField(v).
+func repositoryVariables(v, owner, name string) map[string]interface{} {
+	return map[string]interface{}{
+		v + "Owner": githubv4.String(owner),
+		v + "Name":  githubv4.String(name),
+	}
+}
+
+// fieldType returns the type of a query of a single field, like
+// "object(oid:$v0OID)", that's queried with the type t, a pointer.
+func fieldType(field string, t reflect.Type) reflect.Type {
+	return reflect.PtrTo(reflect.StructOf([]reflect.StructField{{
+		Name: "Field",
+		Type: t,
+		Tag:  reflect.StructTag(fmt.Sprintf(`graphql:"%s"`, field)),
+	}}))
+}
+
+// fieldValue returns the field queried by n, a query of a type made by fieldType.
+// It returns false if the field wasn't found.
+func fieldValue(n interface{}) (interface{}, bool) {
+	f := reflect.ValueOf(n).Elem().Field(0)
+	if f.IsNil() {
+		return nil, false
+	}
+	return f.Interface(), true
+}
+
+// queryNodes fetches nodes in a single GraphQL query, with aliased fields.
+// Nodes that aren't found are skipped. The rate limit is queried too,
+// for Status.
+func (s *Service) queryNodes(ctx context.Context, nodes []batchNode) error {
+	fields := make([]reflect.StructField, len(nodes), len(nodes)+1)
+	variables := make(map[string]interface{})
+	for i, n := range nodes {
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("N%d", i),
+			Type: n.Type, // A pointer, so that a node that isn't found is nil.
+			Tag:  reflect.StructTag(fmt.Sprintf(`graphql:"n%d:%s"`, i, n.Field)),
+		}
+		for name, v := range n.Variables {
+			variables[name] = v
+		}
+	}
+	fields = append(fields, reflect.StructField{
+		Name: "RateLimit",
+		Type: reflect.TypeOf(rateLimit{}),
+	})
+	q := reflect.New(reflect.StructOf(fields))
+	err := s.clV4.Query(ctx, q.Interface(), variables)
+	if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a ") {
+		// Some nodes weren't found, e.g., because the repo was deleted.
+		// The others were still fetched.
+		s.logf("queryNodes: some nodes were not found: %v", err)
+	} else if err != nil {
+		return err
+	}
+	for i, n := range nodes {
+		if f := q.Elem().Field(i); !f.IsNil() {
+			n.Done(f.Interface())
+		}
+	}
+	if r, ok := rateV4(q.Elem().Field(len(nodes)).Interface().(rateLimit)); ok {
+		s.mu.Lock()
+		s.status.RateV4 = r
+		s.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+)
+
+func TestPrefetch(t *testing.T) {
+	// Nodes the server has, by repository name, and SHA for commits,
+	// number for pull requests or expression for go.mod files at refs.
+	nodes := map[string]string{
+		"owner/repo":                          `{"databaseId": 1, "object": {"text": "module example.org/repo\n"}}`,
+		"owner/repo@aaa":                      `{"object": {"oid": "aaa", "message": "A.", "author": {"avatarUrl": "https://example.org/a"}, "url": "https://github.com/owner/repo/commit/aaa", "additions": 1, "deletions": 2, "changedFiles": 3}}`,
+		"owner/repo@bbb":                      `{"object": {"oid": "bbb", "message": "B.", "author": {"avatarUrl": "https://example.org/b"}, "url": "https://github.com/owner/repo/commit/bbb", "additions": 4, "deletions": 5, "changedFiles": 6}}`,
+		"owner/reused":                        `{"databaseId": 5, "object": null}`, // Another repository took the name of repository 4.
+		"owner/repo:refs/heads/master:go.mod": `{"object": {"text": "module example.org/repo/v2\n"}}`,
+		"owner/repo#1":                        `{"pullRequest": {"mergedAt": "2020-01-02T03:04:05Z"}}`,
+		"owner/repo#2":                        `{"pullRequest": {"mergedAt": null}}`,
+	}
+	field := regexp.MustCompile(`(n\d+):repository\(owner:\$(v\d+)Owner,name:\$v\d+Name\)`)
+	var queries int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries++
+		var in struct {
+			Query     string
+			Variables map[string]interface{}
+		}
+		err := json.NewDecoder(req.Body).Decode(&in)
+		if err != nil {
+			t.Errorf("decoding query: %v", err)
+		}
+		var data, errs []string
+		for _, m := range field.FindAllStringSubmatch(in.Query, -1) {
+			alias, v := m[1], m[2]
+			name := fmt.Sprintf("%v/%v", in.Variables[v+"Owner"], in.Variables[v+"Name"])
+			key, field := name, "object"
+			if oid, ok := in.Variables[v+"OID"]; ok {
+				key += fmt.Sprintf("@%v", oid)
+			} else if expr, ok := in.Variables[v+"Expression"]; ok {
+				key += fmt.Sprintf(":%v", expr)
+			} else if number, ok := in.Variables[v+"Number"]; ok {
+				key, field = key+fmt.Sprintf("#%v", number), "pullRequest"
+			}
+			n, ok := nodes[key]
+			switch {
+			case !ok && nodes[name] != "":
+				n = `{"` + field + `": null}`
+			case !ok:
+				n = "null"
+				errs = append(errs, `{"message": "Could not resolve to a Repository with the name '`+name+`'."}`)
+			}
+			data = append(data, `"`+alias+`": `+n)
+		}
+		if len(data) == 0 {
+			t.Errorf("query %q has no repositories", in.Query)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {` + strings.Join(data, ",") + `}, "errors": [` + strings.Join(errs, ",") + `]}`))
+	}))
+	defer ts.Close()
+	s := &Service{clV4: githubv4.NewEnterpriseClient(ts.URL, nil), logf: t.Logf}
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []*githubv3.Event{
+		{
+			Type:       githubv3.String("PushEvent"),
+			RawPayload: rawMessage(`{"ref": "refs/heads/master", "head": "bbb", "before": "000", "size": 2, "commits": [{"sha": "aaa"}, {"sha": "bbb"}]}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("1"),
+		},
+		{
+			Type:       githubv3.String("CommitCommentEvent"),
+			RawPayload: rawMessage(`{"comment": {"id": 1, "commit_id": "ccc"}}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(2), Name: githubv3.String("owner/deleted")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("2"),
+		},
+		{
+			Type:       githubv3.String("WatchEvent"),
+			RawPayload: rawMessage(`{"action": "started"}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(goRepoID), Name: githubv3.String("golang/go")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("3"),
+		},
+		{
+			Type:       githubv3.String("PushEvent"),
+			RawPayload: rawMessage(`{"ref": "refs/heads/master", "head": "ddd", "before": "000", "size": 1, "commits": [{"sha": "ddd"}]}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(4), Name: githubv3.String("owner/reused")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("4"),
+		},
+	}
+	for i, pr := range []string{`"number": 1, "state": "closed"`, `"number": 2, "state": "closed"`, `"number": 3, "state": "open"`} {
+		events = append(events, &githubv3.Event{
+			Type:       githubv3.String("IssueCommentEvent"),
+			RawPayload: rawMessage(`{"action": "created", "issue": {` + pr + `, "pull_request": {"url": "https://api.github.com/repos/owner/repo/pulls/` + fmt.Sprint(i+1) + `"}}, "comment": {"id": 1}}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(fmt.Sprint(5 + i)),
+		})
+	}
+	repos, commits, prs, refs := map[int64]repository{}, map[string]event.Commit{}, map[string]time.Time{}, map[repoRef]string{}
+	err := s.prefetch(context.Background(), events, repos, commits, prs, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 1 {
+		t.Errorf("got %d queries, want 1", queries)
+	}
+	if want := map[int64]repository{1: {ModulePath: "example.org/repo"}}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("got repos %v, want %v", repos, want)
+	}
+	wantCommits := map[string]event.Commit{
+		"aaa": {SHA: "aaa", Message: "A.", AuthorAvatarURL: "https://example.org/a", HTMLURL: "https://github.com/owner/repo/commit/aaa", Additions: 1, Deletions: 2, ChangedFiles: 3},
+		"bbb": {SHA: "bbb", Message: "B.", AuthorAvatarURL: "https://example.org/b", HTMLURL: "https://github.com/owner/repo/commit/bbb", Additions: 4, Deletions: 5, ChangedFiles: 6},
+	}
+	if !reflect.DeepEqual(commits, wantCommits) {
+		t.Errorf("got commits %v, want %v", commits, wantCommits)
+	}
+	wantPRs := map[string]time.Time{ // The open pull request isn't needed.
+		"https://api.github.com/repos/owner/repo/pulls/1": at,
+		"https://api.github.com/repos/owner/repo/pulls/2": {},
+	}
+	if !reflect.DeepEqual(prs, wantPRs) {
+		t.Errorf("got prs %v, want %v", prs, wantPRs)
+	}
+	wantRefs := map[repoRef]string{
+		{1, "refs/heads/master"}: "example.org/repo/v2",
+		{4, "refs/heads/master"}: "", // No go.mod file there.
+	}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("got refs %v, want %v", refs, wantRefs)
+	}
+
+	// Nothing is fetched when everything is already known.
+	queries = 0
+	repos[1] = repos[1].withRef("refs/heads/master", refs[repoRef{1, "refs/heads/master"}])
+	err = s.prefetch(context.Background(), events[:1], repos, commits, prs, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 0 {
+		t.Errorf("got %d queries, want 0", queries)
+	}
+}
@@ -0,0 +1,79 @@
+package githubapi
+
+import "time"
+
+// budget is the part of a GitHub API's rate limit that the service uses,
+// see WithRateBudget.
+type budget struct {
+	reset time.Time // When the rate limit that used is counted against resets, or zero if it's not known yet.
+	used  int       // Requests, or points for GraphQL API v4, used until reset.
+}
+
+// left returns how many requests or points are left in the budget,
+// given the rate limit r and the fraction of it that may be used.
+// If r isn't known yet, there's no telling, so it returns 1.
+func (b budget) left(r Rate, fraction float64, now time.Time) int {
+	if r.Limit == 0 {
+		return 1
+	}
+	used := b.used
+	if b.resetBy(now) {
+		used = 0
+	}
+	return int(fraction*float64(r.Limit)) - used
+}
+
+// use records that a request or point of the rate limit r was used.
+func (b *budget) use(r Rate, now time.Time) {
+	if b.resetBy(now) {
+		b.reset, b.used = time.Time{}, 0
+	}
+	if b.reset.IsZero() {
+		b.reset = r.Reset
+	}
+	b.used++
+}
+
+// resetBy reports whether the rate limit that b is counted against
+// has reset by now.
+func (b budget) resetBy(now time.Time) bool {
+	return !b.reset.IsZero() && !now.Before(b.reset)
+}
+
+// spendV3 uses a request of the REST API v3 budget and reports true,
+// unless it's used up, see WithRateBudget.
+func (s *Service) spendV3() bool { return s.spend(&s.budgetV3, &s.status.RateV3) }
+
+// spendV4 uses a point of the GraphQL API v4 budget and reports true,
+// unless it's used up, see WithRateBudget.
+func (s *Service) spendV4() bool { return s.spend(&s.budgetV4, &s.status.RateV4) }
+
+// spend uses a request or point of budget b of rate limit *r
+// and reports true, unless b is used up, or GitHub is limiting requests.
+func (s *Service) spend(b *budget, r *Rate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if b.left(*r, s.rateBudget, now) <= 0 || s.rateLimitedNow(now) != nil {
+		return false
+	}
+	b.use(*r, now)
+	return true
+}
+
+// withinBudget reports whether budget b of rate limit *r isn't used up,
+// and GitHub isn't limiting requests.
+func (s *Service) withinBudget(b *budget, r *Rate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	return b.left(*r, s.rateBudget, now) > 0 && s.rateLimitedNow(now) == nil
+}
+
+// charge uses a request or point of budget b of rate limit *r,
+// even if b is used up.
+func (s *Service) charge(b *budget, r *Rate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.use(*r, time.Now())
+}
@@ -0,0 +1,135 @@
+package githubapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	r := Rate{Limit: 100, Remaining: 100, Reset: now.Add(time.Hour)}
+	var b budget
+	if got := b.left(Rate{}, 0.1, now); got != 1 {
+		t.Errorf("left with an unknown rate limit = %d, want 1", got)
+	}
+	b.use(Rate{}, now) // Used before the rate limit is known, it still counts.
+	for i := 0; i < 9; i++ {
+		b.use(r, now)
+	}
+	if got := b.left(r, 0.1, now); got != 0 {
+		t.Errorf("left after using 10 = %d, want 0", got)
+	}
+	if got := b.left(r, 0.5, now); got != 40 {
+		t.Errorf("left of half after using 10 = %d, want 40", got)
+	}
+	later := now.Add(time.Hour)
+	if got := b.left(r, 0.1, later); got != 10 {
+		t.Errorf("left after the rate limit reset = %d, want 10", got)
+	}
+	r.Reset = later.Add(time.Hour)
+	b.use(r, later)
+	if got := b.left(r, 0.1, later); got != 9 {
+		t.Errorf("left after using 1 since the rate limit reset = %d, want 9", got)
+	}
+}
+
+func TestWithRateBudget(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	pushes := []string{`{
+		"type": "PushEvent",
+		"id": "1",
+		"repo": {"id": 1, "name": "owner/repo"},
+		"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+		"created_at": "2020-01-02T03:04:05Z",
+		"payload": {"ref": "refs/heads/master", "head": "aaa", "before": "` + zeroSHA + `", "size": 1, "commits": [{"sha": "aaa", "message": "A."}]}
+	}`}
+	var pages, queries int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/graphql" {
+			queries++
+			w.Write([]byte(`{"data": {
+				"n0": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}},
+				"n1": {"object": null},
+				"n2": {"object": {"oid": "aaa", "message": "A.", "author": {"avatarUrl": "https://example.org/a"}, "url": "https://github.com/owner/repo/commit/aaa", "additions": 1, "deletions": 2, "changedFiles": 3}},
+				"rateLimit": {"limit": 1000, "remaining": 999, "resetAt": "2100-01-01T00:00:00Z"}
+			}}`))
+			return
+		}
+		pages++
+		w.Header().Set("X-RateLimit-Limit", "1000")
+		w.Header().Set("X-RateLimit-Remaining", "999")
+		w.Header().Set("X-RateLimit-Reset", reset)
+		w.Header().Set("Link", `<`+ts.URL+`/users/gopher/events/public?per_page=100&page=2>; rel="next"`)
+		w.Write([]byte(`[` + pushes[len(pushes)-1] + `]`))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+
+	for _, fraction := range []float64{0, -0.5, 1.5} {
+		if _, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithRateBudget(fraction)); err == nil {
+			t.Errorf("NewService with a rate budget of %v: got nil error, want failure", fraction)
+		}
+	}
+
+	// A budget of 0.1% is 1 request of the REST API v3 and 1 point
+	// of the GraphQL API v4.
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithRateBudget(0.001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 1 || queries != 1 {
+		t.Errorf("first Refresh fetched %d pages with %d queries, want 1 with 1", pages, queries)
+	}
+
+	// Once the budget is used up, only the first page of events is fetched,
+	// and placeholders are used for what they need.
+	pushes = append(pushes, `{
+		"type": "PushEvent",
+		"id": "2",
+		"repo": {"id": 3, "name": "owner/other"},
+		"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+		"created_at": "2020-01-02T03:04:06Z",
+		"payload": {"ref": "refs/heads/master", "head": "bbb", "before": "`+zeroSHA+`", "size": 1, "commits": [{"sha": "bbb", "message": "B."}]}
+	}`)
+	pages, queries = 0, 0
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 1 || queries != 0 {
+		t.Errorf("second Refresh fetched %d pages with %d queries, want 1 with none", pages, queries)
+	}
+	events, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if got, want := events[0].Container, "github.com/owner/other"; got != want {
+		t.Errorf("got Container %q, want %q", got, want)
+	}
+	want := event.Commit{SHA: "bbb", Message: "B.", AuthorAvatarURL: placeholderAvatarURL}
+	if got := events[0].Payload.(event.Push).Commits; len(got) != 1 || got[0] != want {
+		t.Errorf("got Commits %v, want [%v]", got, want)
+	}
+}
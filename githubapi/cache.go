@@ -0,0 +1,76 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/webdavfs/vfsutil"
+	"golang.org/x/net/webdav"
+)
+
+// cachePath is the path of the cache file in the filesystem given to WithCache.
+const cachePath = "/cache.json"
+
+// cache is the information fetched for events that's persisted across restarts.
+// Information that can change, like whether a pull request is merged,
+// is included only once it can't change anymore.
+type cache struct {
+	Repos    map[int64]repository    // Repo ID -> Module Path.
+	Commits  map[string]event.Commit // SHA -> Commit.
+	MergedAt map[string]time.Time    // PR API URL -> Merge time of merged pull requests.
+}
+
+// loadCache loads the cache from fs. It returns an empty cache
+// if there's no cache file yet.
+func loadCache(ctx context.Context, fs webdav.FileSystem) (cache, error) {
+	f, err := vfsutil.Open(ctx, fs, cachePath)
+	if os.IsNotExist(err) {
+		return cache{}, nil
+	} else if err != nil {
+		return cache{}, err
+	}
+	defer f.Close()
+	var c cache
+	err = json.NewDecoder(f).Decode(&c)
+	return c, err
+}
+
+// saveCache saves the cache to fs, replacing the cache file or creating it.
+// A crash while it's saved can leave the cache file corrupt. That's fine,
+// since a cache that fails to load is ignored, see WithCache.
+func saveCache(ctx context.Context, fs webdav.FileSystem, c cache) error {
+	f, err := fs.OpenFile(ctx, cachePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(c)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newCache returns the cache of the specified information fetched for events.
+func newCache(
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+) cache {
+	return cache{Repos: repos, Commits: commits, MergedAt: mergedPRs(prs)}
+}
+
+// mergedPRs returns the merged pull requests in prs.
+// A merged pull request stays merged, so it doesn't need to be fetched again.
+func mergedPRs(prs map[string]time.Time) map[string]time.Time {
+	merged := make(map[string]time.Time)
+	for url, mergedAt := range prs {
+		if !mergedAt.IsZero() {
+			merged[url] = mergedAt
+		}
+	}
+	return merged
+}
@@ -0,0 +1,102 @@
+package githubapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+func TestCache(t *testing.T) {
+	var queries int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/graphql":
+			queries++
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data": {
+				"n0": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}},
+				"n1": {"object": null},
+				"n2": {"object": {"oid": "aaa", "message": "A.", "author": {"avatarUrl": "https://example.org/a"}, "url": "https://github.com/owner/repo/commit/aaa", "additions": 1, "deletions": 2, "changedFiles": 3}},
+				"n3": {"pullRequest": {"mergedAt": "2020-01-02T03:04:00Z"}}
+			}}`))
+		case "/users/gopher/events/public":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{
+				"type": "PushEvent",
+				"id": "2",
+				"repo": {"id": 1, "name": "owner/repo"},
+				"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+				"created_at": "2020-01-02T03:04:05Z",
+				"payload": {"ref": "refs/heads/master", "head": "aaa", "before": "` + zeroSHA + `", "size": 1, "commits": [{"sha": "aaa"}]}
+			}, {
+				"type": "IssueCommentEvent",
+				"id": "1",
+				"repo": {"id": 1, "name": "owner/repo"},
+				"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+				"created_at": "2020-01-02T03:04:05Z",
+				"payload": {"action": "created", "issue": {"number": 1, "state": "closed", "pull_request": {"url": "` + ts.URL + `/repos/owner/repo/pulls/1"}}, "comment": {"id": 1}}
+			}]`))
+		case "/repos/owner/repo/git/trees/HEAD":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"sha": "t", "tree": [{"path": "go.mod", "type": "blob"}]}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	cache := webdav.NewMemFS()
+
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 1 {
+		t.Fatalf("first service made %d queries, want 1", queries)
+	}
+
+	// A service created with the same cache, e.g., after a restart,
+	// fetches nothing but the events.
+	queries = 0
+	s2, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s2.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 0 {
+		t.Errorf("second service made %d queries, want none", queries)
+	}
+	if want := map[int64]repository{1: {ModulePath: "example.org/repo", Name: "owner/repo", NameTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Refs: map[string]string{"refs/heads/master": ""}, Modules: map[string]string{}}}; !reflect.DeepEqual(s2.repos, want) {
+		t.Errorf("got repos %v, want %v", s2.repos, want)
+	}
+	wantCommits := map[string]event.Commit{
+		"aaa": {SHA: "aaa", Message: "A.", AuthorAvatarURL: "https://example.org/a", HTMLURL: "https://github.com/owner/repo/commit/aaa", Additions: 1, Deletions: 2, ChangedFiles: 3},
+	}
+	if !reflect.DeepEqual(s2.commits, wantCommits) {
+		t.Errorf("got commits %v, want %v", s2.commits, wantCommits)
+	}
+	if want := map[string]time.Time{ts.URL + "/repos/owner/repo/pulls/1": time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)}; !reflect.DeepEqual(s2.prs, want) {
+		t.Errorf("got prs %v, want %v", s2.prs, want)
+	}
+}
@@ -4,10 +4,11 @@ package githubapi
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
@@ -23,54 +24,440 @@ import (
 	"github.com/shurcooL/githubv4"
 	"github.com/shurcooL/users"
 	"golang.org/x/mod/modfile"
+	"golang.org/x/net/webdav"
 )
 
 // NewService creates a GitHub-backed events.Service using given GitHub client.
-// It fetches events only for the specified user. user.Domain must be "github.com".
+// It fetches events only for the specified user, unless WithOrganization,
+// WithReceivedEvents or WithUsers is used.
+// user.Domain must be "github.com".
 //
 // If router is nil, github.DotCom router is used, which links to subjects on github.com.
-func NewService(clientV3 *githubv3.Client, clientV4 *githubv4.Client, user users.User, router github.Router) (events.Service, error) {
+func NewService(clientV3 *githubv3.Client, clientV4 *githubv4.Client, user users.User, router github.Router, opts ...Option) (*Service, error) {
 	if user.Domain != "github.com" {
 		return nil, fmt.Errorf(`user.Domain is %q, it must be "github.com"`, user.Domain)
 	}
 	if router == nil {
 		router = github.DotCom{}
 	}
-	s := &service{
+	o := options{pages: maxPages, rateBudget: 1, avatarSize: defaultAvatarSize, polling: true, minPoll: defaultMinPoll, ctx: context.Background(), logf: log.Printf}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.pages < 1 || o.pages > maxPages {
+		return nil, fmt.Errorf("pages is %d, it must be from 1 to %d", o.pages, maxPages)
+	}
+	for _, u := range o.others {
+		if u.Domain != "github.com" {
+			return nil, fmt.Errorf(`domain of user %q is %q, it must be "github.com"`, u.Login, u.Domain)
+		}
+	}
+	if o.rateBudget <= 0 || o.rateBudget > 1 {
+		return nil, fmt.Errorf("rate budget is %v, it must be more than 0 and at most 1", o.rateBudget)
+	}
+	if o.avatarSize < 1 {
+		return nil, fmt.Errorf("avatar size is %d, it must be positive", o.avatarSize)
+	}
+	if o.pushCommits < 0 {
+		return nil, fmt.Errorf("push commits is %d, it must not be negative", o.pushCommits)
+	}
+	if o.minPoll <= 0 || o.maxPoll < 0 || (o.maxPoll != 0 && o.maxPoll < o.minPoll) {
+		return nil, fmt.Errorf("poll interval bounds [%v, %v] are invalid", o.minPoll, o.maxPoll)
+	}
+	ctx, cancel := context.WithCancel(o.ctx)
+	s := &Service{
 		clV3: clientV3,
 		clV4: clientV4,
 		user: user,
+		org:  o.org,
 		rtr:  router,
+
+		received: o.received,
+		others:   o.others,
+
+		pages: o.pages,
+
+		privateEvents: o.privateEvents,
+		redactPrivate: o.redactPrivate,
+
+		noMembers:      o.noMembers,
+		issueActions:   o.issueActions,
+		commentActions: o.commentActions,
+
+		webhookSecret: o.webhookSecret,
+
+		cache: o.cache,
+
+		history: o.history,
+
+		rateBudget: o.rateBudget,
+
+		pushCommits: o.pushCommits,
+
+		avatars: &avatars{size: o.avatarSize},
+
+		logf: o.logf,
+
+		minPoll: o.minPoll,
+		maxPoll: o.maxPoll,
+
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if o.cache != nil {
+		c, err := loadCache(o.ctx, o.cache)
+		if err != nil {
+			s.logf("loadCache: %v", err)
+		} else {
+			s.repos, s.commits, s.prs = c.Repos, c.Commits, c.MergedAt
+		}
+	}
+	if o.polling {
+		go s.poll(ctx)
+	} else {
+		close(s.done)
 	}
-	go s.poll()
 	return s, nil
 }
 
-type service struct {
+// Option configures a service created by NewService.
+// If multiple options select which events are fetched, the last one applies.
+type Option func(*options)
+
+type options struct {
+	org            string
+	received       bool
+	others         []users.User
+	privateEvents  bool
+	redactPrivate  bool
+	pages          int
+	noMembers      bool
+	issueActions   bool
+	commentActions bool
+	webhookSecret  []byte
+	rateBudget     float64
+	cache          webdav.FileSystem
+	history        events.Service
+	avatarSize     int
+	pushCommits    int
+	polling        bool
+	minPoll        time.Duration
+	maxPoll        time.Duration
+	ctx            context.Context
+	logf           func(format string, v ...interface{})
+}
+
+// defaultMinPoll is the default minimum poll interval.
+const defaultMinPoll = time.Minute
+
+// WithOrganization makes the service fetch events in repositories
+// of the GitHub organization org, performed by anyone, instead of
+// events performed by the user.
+func WithOrganization(org string) Option {
+	return func(o *options) { o.org, o.received, o.others = org, false, nil }
+}
+
+// WithReceivedEvents makes the service fetch events that the user received,
+// i.e., ones performed by users they follow and in repositories they watch,
+// instead of events performed by the user. It's what their news feed shows.
+// Webhook deliveries are ignored, since they can't be told apart.
+func WithReceivedEvents() Option {
+	return func(o *options) { o.org, o.received, o.others = "", true, nil }
+}
+
+// WithUsers makes the service fetch events performed by the specified
+// users too, not only by the user, and list them all together.
+// The information fetched for events, like module paths of repositories,
+// is shared between them, so it's fetched only once for repositories
+// they're all active in. Their Domain must be "github.com".
+func WithUsers(others ...users.User) Option {
+	return func(o *options) { o.org, o.received, o.others = "", false, others }
+}
+
+// WithPrivateEvents makes the service fetch and list private events too,
+// not only public ones, i.e., ones that happened in private repositories.
+// GitHub lists them only to the user, so the clients must be authenticated
+// as the user.
+//
+// If redact is true, private events are listed with the details of their
+// repositories stripped, so that they tell only who did what kind of thing,
+// and when. Their container and all text, like titles, bodies, commit messages
+// and names of branches, are left out. Required names are replaced with
+// "redacted", and required links with a link to the actor.
+//
+// Without it, only public events are listed, including ones delivered by webhooks.
+func WithPrivateEvents(redact bool) Option {
+	return func(o *options) { o.privateEvents, o.redactPrivate = true, redact }
+}
+
+// WithPages sets the maximum number of pages of events fetched at once,
+// from 1 to 3. The Events API lists up to 300 events, and they're fetched
+// 100 per page, so in up to 3 pages. The default is 3, so all of them are fetched.
+func WithPages(n int) Option {
+	return func(o *options) { o.pages = n }
+}
+
+// maxPages is the maximum number of pages the Events API lists,
+// with 100 events per page.
+const maxPages = 3
+
+// WithoutMemberEvents makes the service not list member events,
+// i.e., collaborators being added to repositories or removed from them,
+// for users who consider them noise.
+func WithoutMemberEvents() Option {
+	return func(o *options) { o.noMembers = true }
+}
+
+// WithIssueActions makes the service list issue events of more actions
+// than opening, closing and reopening issues: assigning users to them,
+// labeling them, adding them to milestones, transferring them to other
+// repositories, and pinning them, for users who want a richer feed.
+// They're listed as Assign, Label, Milestone and Transfer events,
+// and Issue events for pinning.
+func WithIssueActions() Option {
+	return func(o *options) { o.issueActions = true }
+}
+
+// WithCommentActions makes the service list comment events of more actions
+// than creating comments on issues and pull requests: editing and deleting
+// them, for users who want edit and moderation activity in their feed.
+// They're listed as IssueComment and ChangeComment events with the Action
+// of the comment event. Deleted comments are listed without their body.
+func WithCommentActions() Option {
+	return func(o *options) { o.commentActions = true }
+}
+
+// WithWebhookSecret makes the service accept GitHub webhook deliveries
+// signed with secret, see ServeHTTP. Without it, all deliveries are rejected.
+func WithWebhookSecret(secret []byte) Option {
+	return func(o *options) { o.webhookSecret = secret }
+}
+
+// WithCache makes the service persist the information it fetches
+// for events, like module paths of repositories and commits, in fs,
+// and reload it when it's created. Events fetched after a restart then
+// need only the information that's missing, rather than all of it.
+// A cache that fails to load is ignored. fs must not be shared with
+// other services.
+func WithCache(fs webdav.FileSystem) Option {
+	return func(o *options) { o.cache = fs }
+}
+
+// WithHistory makes the service keep the events it lists in history,
+// e.g., a service of the fs package, so that they're still listed once they
+// age out of the Events API, which lists only the most recent 300 of them.
+// Events are logged to history once the information they need is fetched,
+// and List lists the events in history along with the fetched ones.
+// Events delivered by webhooks are logged once the Events API lists them,
+// since they have other IDs until then. history must not be shared with
+// other services.
+func WithHistory(history events.Service) Option {
+	return func(o *options) { o.history = history }
+}
+
+// WithAvatarSize sets the size, in pixels, of the avatars of listed events,
+// which are resized to it when GitHub or Gravatar serves them.
+// Each user's avatar is the most recent one listed. The default is 96.
+func WithAvatarSize(size int) Option {
+	return func(o *options) { o.avatarSize = size }
+}
+
+// WithPushCommits limits the commits of each listed push to its n most
+// recent ones, so that pushes of many commits, like rebases, don't need
+// as many of them fetched. TotalCommits of pushes is still the total number
+// of commits in them. Zero means no limit, the default.
+func WithPushCommits(n int) Option {
+	return func(o *options) { o.pushCommits = n }
+}
+
+// WithRateBudget limits the service to using the specified fraction,
+// more than 0 and at most 1, of the hourly rate limits of the REST API v3
+// and GraphQL API v4, e.g., 0.1 for 10%, so that it doesn't starve others
+// that use the same token. The default is 1.
+//
+// Once the budget is used up, until the rate limit resets, only the first
+// page of events is fetched, and the information events need, like module
+// paths of repositories and commits, isn't. Meanwhile, events are listed
+// with placeholders for it, e.g., the repository path instead of its
+// module path. It's fetched once the budget allows.
+func WithRateBudget(fraction float64) Option {
+	return func(o *options) { o.rateBudget = fraction }
+}
+
+// WithPollInterval sets the bounds of the interval between polls.
+// GitHub asks for an interval with every response, which is used
+// if it's within them. The minimum must be positive, and a maximum of 0
+// means there's none. The defaults are one minute, and no maximum.
+//
+// A minimum shorter than what GitHub asks for uses up the rate limit faster.
+// While polls find no new events, the interval backs off up to the maximum,
+// or 15 minutes if it's none or longer, and is back to what GitHub asks for
+// once they do. It's lengthened by up to a tenth at random, so that services
+// sharing a host don't poll at once. After failed polls, the interval backs off
+// past the maximum, up to 30 minutes, until a poll succeeds.
+func WithPollInterval(minInterval, maxInterval time.Duration) Option {
+	return func(o *options) { o.minPoll, o.maxPoll = minInterval, maxInterval }
+}
+
+// WithoutPolling makes the service not poll GitHub for events,
+// so that they're only fetched by Refresh, or come from webhook deliveries
+// when used together with WithWebhookSecret.
+func WithoutPolling() Option {
+	return func(o *options) { o.polling = false }
+}
+
+// WithLogf makes the service report diagnostics, like errors fetching events
+// and events it doesn't support, by calling logf with a format and arguments
+// as for fmt.Printf, without a trailing newline. This lets the application
+// route, rate-limit or level them. The default is log.Printf.
+// logf is called from multiple goroutines, so it must be safe for concurrent use.
+func WithLogf(logf func(format string, v ...interface{})) Option {
+	return func(o *options) { o.logf = logf }
+}
+
+// WithContext sets the parent context of polling. Once ctx is done,
+// polling stops, same as after Close. The default is context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(o *options) { o.ctx = ctx }
+}
+
+// Service is a GitHub-backed events.Service. It's also an http.Handler
+// of GitHub webhook deliveries, see ServeHTTP.
+type Service struct {
 	clV3 *githubv3.Client // GitHub REST API v3 client.
 	clV4 *githubv4.Client // GitHub GraphQL API v4 client.
 	user users.User
+	org  string // Organization whose events are fetched, or empty if it's the user's.
 	rtr  github.Router
 
+	// received is whether the events fetched are the ones the user received,
+	// rather than the ones performed by the user.
+	received bool
+
+	others []users.User // Users whose events are fetched too, performed by them.
+
+	privateEvents bool // Whether private events are fetched and listed too.
+	redactPrivate bool // Whether private events are listed redacted, see redact.
+
+	pages int // Maximum number of pages of events fetched.
+
+	noMembers      bool // Whether member events are left out of listed events.
+	issueActions   bool // Whether issue events of actions besides opening, closing and reopening are listed.
+	commentActions bool // Whether comment events of actions besides creating comments are listed.
+
+	webhookSecret []byte // Secret that webhook deliveries are signed with, or nil if they're rejected.
+
+	cache webdav.FileSystem // Filesystem the fetched information is persisted in, or nil if it isn't.
+
+	history    events.Service  // Service listed events are kept in, or nil if they aren't.
+	historyIDs map[string]bool // A set of IDs of events in history, or nil if not listed yet. Guarded by update.
+
+	rateBudget float64 // Fraction of rate limits that may be used.
+
+	pushCommits int // Maximum number of commits listed per push, or 0 if there's no limit.
+
+	avatars *avatars // Resolves avatar URLs of listed events.
+
+	logf func(format string, v ...interface{}) // Reports diagnostics, see WithLogf.
+
+	minPoll, maxPoll time.Duration // Bounds of the interval between polls. maxPoll is 0 if there's no maximum.
+
+	// update serializes updates of events, so that those made by polling
+	// and by ingesting webhook deliveries don't overwrite each other.
+	update sync.Mutex
+	feeds  map[string]feed // Path -> Last fetched feed of events. Guarded by update.
+
 	mu         sync.Mutex
 	events     []*githubv3.Event
+	hooked     []*githubv3.Event       // Events delivered by webhooks that polling hasn't listed yet, and synthesized renames, see followRenames.
 	repos      map[int64]repository    // Repo ID -> Module Path.
 	commits    map[string]event.Commit // SHA -> Commit.
-	prs        map[string]bool         // PR API URL -> Pull Request merged.
+	prs        map[string]time.Time    // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes    map[string]string       // Delete event ID -> Last SHA.
+	forced     map[string]bool         // Push event ID -> Forced.
 	fetchError error
+	status     Status          // Status of fetching events, except for LastError, which is fetchError.
+	budgetV3   budget          // Used REST API v3 rate limit.
+	budgetV4   budget          // Used GraphQL API v4 rate limit.
+	rateLimit  *RateLimitError // Error GitHub last limited requests with, or nil if it hasn't.
+
+	cancel context.CancelFunc // Stops polling.
+	done   chan struct{}      // Closed once polling has stopped.
 }
 
+var _ events.Service = (*Service)(nil)
+
 // List lists events.
-func (s *service) List(ctx context.Context) ([]event.Event, error) {
+//
+// If fetching events failed the last time, the events fetched before are listed
+// along with a *StaleError, since they're still usable. So are the events fetched
+// the last time, when only some of the information they need failed to be fetched.
+// Only if no events were ever fetched, no events are listed, and the error
+// fetching them is returned as is.
+func (s *Service) List(ctx context.Context) ([]event.Event, error) {
 	s.mu.Lock()
-	events, repos, commits, prs, fetchError := s.events, s.repos, s.commits, s.prs, s.fetchError
+	events, repos, commits, prs, deletes, forced, fetchError := s.events, s.repos, s.commits, s.prs, s.deletes, s.forced, s.fetchError
+	lastFetch := s.status.LastFetch
 	s.mu.Unlock()
-	return convert(ctx, events, repos, commits, prs, s.rtr), fetchError
+	if fetchError != nil {
+		if lastFetch.IsZero() && len(events) == 0 {
+			return nil, fetchError
+		}
+		fetchError = &StaleError{Err: fetchError, LastFetch: lastFetch}
+	}
+	es := s.convertListed(ctx, events, repos, commits, prs, deletes, forced)
+	if s.history != nil {
+		es = s.withHistory(ctx, es)
+	}
+	return es, fetchError
+}
+
+// convertListed converts events to the ones that List lists,
+// leaving out or redacting ones as configured, with resolved avatar URLs.
+func (s *Service) convertListed(
+	ctx context.Context,
+	events []*githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
+) []event.Event {
+	if s.noMembers {
+		events = withoutType(events, "MemberEvent")
+	}
+	if !s.issueActions {
+		events = withoutIssueActions(events)
+	}
+	if !s.commentActions {
+		events = withoutCommentActions(events)
+	}
+	switch {
+	case !s.privateEvents:
+		// Private events aren't fetched, but webhooks may deliver them.
+		events = withoutPrivate(events)
+	case s.redactPrivate:
+		var es []event.Event
+		for _, e := range events {
+			ee := convert(ctx, []*githubv3.Event{e}, repos, commits, prs, deletes, forced, s.rtr, s.logf)
+			if private(e) {
+				for i := range ee {
+					ee[i] = redact(ee[i])
+				}
+			}
+			es = append(es, ee...)
+		}
+		s.avatars.resolve(es)
+		return es
+	}
+	es := convert(ctx, events, repos, commits, prs, deletes, forced, s.rtr, s.logf)
+	s.avatars.resolve(es)
+	return es
 }
 
 // Log logs the event.
 // event.Time time zone must be UTC.
-func (s *service) Log(_ context.Context, event event.Event) error {
+func (s *Service) Log(_ context.Context, event event.Event) error {
 	if event.Time.Location() != time.UTC {
 		return errors.New("event.Time time zone must be UTC")
 	}
@@ -78,148 +465,771 @@ func (s *service) Log(_ context.Context, event event.Event) error {
 	return nil
 }
 
-func (s *service) poll() {
-	for {
+// Close stops polling, canceling requests it has in flight,
+// and waits for it to stop. Events fetched until then are still listed.
+// It can be called more than once.
+func (s *Service) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Refresh fetches events now, rather than when they're next polled,
+// and returns the error fetching them, if any. Until it returns,
+// List lists the events fetched before. It works without polling too.
+func (s *Service) Refresh(ctx context.Context) error {
+	_, _, err := s.refresh(ctx)
+	return err
+}
+
+// poll polls for events until ctx is done.
+// After polls without new events, it polls less often, see quietInterval.
+// After failed polls, it backs off, see backoff.
+func (s *Service) poll(ctx context.Context) {
+	defer func() {
 		s.mu.Lock()
-		repos := make(map[int64]repository, len(s.repos))
-		for id, r := range s.repos {
-			repos[id] = r
+		s.status.PollInterval, s.status.NextPoll = 0, time.Time{}
+		s.mu.Unlock()
+		close(s.done)
+	}()
+	failures := 0 // Number of consecutive failed polls.
+	quiet := 0    // Number of consecutive successful polls without new events.
+	for {
+		pollInterval, active, err := s.refresh(ctx)
+		if ctx.Err() != nil {
+			// Polling is stopped, and the fetch may have been canceled.
+			return
+		} else if err != nil {
+			s.logf("fetchEvents: %v", err)
+			failures++
+		} else {
+			failures = 0
 		}
-		commits := make(map[string]event.Commit, len(s.commits))
-		for sha, c := range s.commits {
-			commits[sha] = c
+		switch {
+		case active:
+			quiet = 0
+		case err == nil:
+			quiet++
 		}
-		s.mu.Unlock()
-		events, repos, commits, prs, pollInterval, fetchError := s.fetchEvents(context.Background(), repos, commits)
-		if fetchError != nil {
-			log.Println("fetchEvents:", fetchError)
+
+		interval := s.pollInterval(pollInterval)
+		if failures > 0 {
+			interval = backoff(interval, failures)
+		} else {
+			interval = jitter(s.quietInterval(interval, quiet))
 		}
 		s.mu.Lock()
-		if fetchError == nil {
-			s.events, s.repos, s.commits, s.prs = events, repos, commits, prs
+		if l := s.rateLimitedNow(time.Now()); l != nil && time.Until(l.RetryAfter) > interval {
+			// Polling sooner would only be limited again.
+			interval = time.Until(l.RetryAfter)
 		}
-		s.fetchError = fetchError
+		s.status.PollInterval, s.status.NextPoll = interval, time.Now().Add(interval)
 		s.mu.Unlock()
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// refresh fetches events and updates them, along with the fetch error.
+// If ctx is done, nothing is updated, and ctx.Err() is returned.
+// If only some of the information events need failed to be fetched,
+// they're updated anyway, and enrichError is returned.
+// It returns the poll interval GitHub asked for, or 0 if it didn't,
+// and whether there are new events since they were last fetched.
+func (s *Service) refresh(ctx context.Context) (pollInterval time.Duration, active bool, _ error) {
+	s.update.Lock()
+	defer s.update.Unlock()
+	s.mu.Lock()
+	repos, commits, prs, deletes, forced := s.copyFetched()
+	hooked := s.hooked
+	s.mu.Unlock()
+	events, renames, repos, commits, prs, deletes, forced, pollInterval, fetchError := s.fetchEvents(ctx, hooked, repos, commits, mergedPRs(prs), deletes, forced)
+	if ctx.Err() != nil {
+		return 0, false, ctx.Err()
+	}
+	notModified := fetchError == errNotModified
+	if notModified {
+		fetchError = nil
+	}
+	_, incomplete := fetchError.(enrichError)
+	fetched := fetchError == nil || incomplete
+	s.mu.Lock()
+	if fetched && !notModified {
+		active = newEvents(s.events, events)
+		s.events, s.repos, s.commits, s.prs, s.deletes, s.forced = events, repos, commits, prs, deletes, forced
+		s.hooked = retained(append(hooked[:len(hooked):len(hooked)], renames...), events)
+	}
+	s.fetchError = fetchError
+	if fetched {
+		s.status.LastFetch = time.Now()
+	}
+	s.mu.Unlock()
+	if fetched && !notModified {
+		s.saveCache(ctx, repos, commits, prs)
+		s.logHistory(ctx, events, repos, commits, prs, deletes, forced)
+	}
+	return pollInterval, active, fetchError
+}
 
-		if pollInterval < time.Minute {
-			pollInterval = time.Minute
+// newEvents reports whether events has ones that old doesn't.
+func newEvents(old, events []*githubv3.Event) bool {
+	seen := make(map[string]bool, len(old)) // A set of old event IDs.
+	for _, e := range old {
+		seen[*e.ID] = true
+	}
+	for _, e := range events {
+		if !seen[*e.ID] {
+			return true
 		}
-		time.Sleep(pollInterval)
 	}
+	return false
+}
+
+// saveCache saves the specified information fetched for events
+// to the cache, if there's one. s.update must be held.
+func (s *Service) saveCache(
+	ctx context.Context,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+) {
+	if s.cache == nil {
+		return
+	}
+	err := saveCache(ctx, s.cache, newCache(repos, commits, prs))
+	if err != nil {
+		s.logf("saveCache: %v", err)
+	}
+}
+
+// pollInterval returns the interval to wait before polling again,
+// given the one GitHub asked for, or 0 if it didn't.
+func (s *Service) pollInterval(asked time.Duration) time.Duration {
+	switch {
+	case asked < s.minPoll:
+		return s.minPoll
+	case s.maxPoll != 0 && asked > s.maxPoll:
+		return s.maxPoll
+	default:
+		return asked
+	}
+}
+
+// quietPolls is the number of consecutive polls without new events
+// after which quietInterval doubles the poll interval.
+const quietPolls = 3
+
+// maxQuietPoll is the maximum interval that quietInterval backs off to,
+// unless the poll interval is longer.
+const maxQuietPoll = 15 * time.Minute
+
+// quietInterval returns the interval to wait before polling again
+// after the specified number of consecutive polls without new events,
+// given the poll interval. It doubles every quietPolls of them,
+// up to maxQuietPoll, or the maximum set by WithPollInterval if it's shorter,
+// so that quiet feeds are polled less often than GitHub allows,
+// and active ones as often as it does. It's never shorter than the poll interval.
+func (s *Service) quietInterval(interval time.Duration, quiet int) time.Duration {
+	max := maxQuietPoll
+	if s.maxPoll != 0 && s.maxPoll < max {
+		max = s.maxPoll
+	}
+	d := interval
+	for i := 0; i < quiet/quietPolls && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d < interval {
+		return interval
+	}
+	return d
+}
+
+// jitter returns interval lengthened by up to a tenth of it at random,
+// so that services polling at the same interval, e.g., since they started
+// together, don't poll in lockstep. It's never shorter, since GitHub asks
+// not to poll more often than the poll interval.
+func jitter(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Int63n(int64(interval/10)+1))
+}
+
+// maxBackoff is the maximum interval that backoff backs off to,
+// unless the poll interval is longer.
+const maxBackoff = 30 * time.Minute
+
+// backoff returns the interval to wait before polling again
+// after the specified number of consecutive failed polls,
+// given the poll interval. It doubles with each failure, up to maxBackoff,
+// and is jittered to between half and all of that,
+// so that services failing at the same time don't retry in lockstep.
+// It's never shorter than the poll interval.
+func backoff(interval time.Duration, failures int) time.Duration {
+	d := interval
+	for i := 0; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d-d/2)+1))
+	if d < interval {
+		return interval
+	}
+	return d
+}
+
+// copyFetched returns copies of the information fetched for events,
+// which can be updated without holding s.mu. s.mu must be held.
+func (s *Service) copyFetched() (
+	repos map[int64]repository,
+	commits map[string]event.Commit,
+	prs map[string]time.Time,
+	deletes map[string]string,
+	forced map[string]bool,
+) {
+	repos = make(map[int64]repository, len(s.repos))
+	for id, r := range s.repos {
+		repos[id] = r
+	}
+	commits = make(map[string]event.Commit, len(s.commits))
+	for sha, c := range s.commits {
+		commits[sha] = c
+	}
+	prs = make(map[string]time.Time, len(s.prs))
+	for url, mergedAt := range s.prs {
+		prs[url] = mergedAt
+	}
+	deletes = make(map[string]string, len(s.deletes))
+	for id, sha := range s.deletes {
+		deletes[id] = sha
+	}
+	forced = make(map[string]bool, len(s.forced))
+	for id, f := range s.forced {
+		forced[id] = f
+	}
+	return repos, commits, prs, deletes, forced
 }
 
-// fetchEvents fetches events, repository module paths, mentioned commits and PRs from GitHub.
-// Provided repos and commits must be non-nil, and they're used as a starting point.
-// Only missing repos and commits are fetched, and unused ones are removed at the end.
-func (s *service) fetchEvents(
+// fetchEvents fetches events, repository module paths, mentioned commits and PRs from GitHub,
+// resolves the last SHA of deleted refs, and determines which pushes were force-pushes.
+// Events in hooked, delivered by webhooks, are included among the fetched ones
+// until they're listed, see unlisted.
+// Provided repos, commits, prs, deletes and forced must be non-nil, and they're used as a starting point.
+// Only missing entries are fetched, and unused ones are removed at the end.
+// If no feed of events has changed since it was last fetched, errNotModified
+// is returned along with pollInterval, the longest one any feed asked for.
+// If only some of the information events need failed to be fetched,
+// enrichError is returned along with the events and what was fetched.
+// s.update must be held.
+func (s *Service) fetchEvents(
 	ctx context.Context,
+	hooked []*githubv3.Event,
 	repos map[int64]repository, // Repo ID -> Module Path.
 	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
 ) (
 	events []*githubv3.Event,
+	renames []*githubv3.Event, // Renames synthesized by followRenames, which events include.
 	_ map[int64]repository, // repos.
 	_ map[string]event.Commit, // commits.
-	prs map[string]bool, // PR API URL -> Pull Request merged.
+	_ map[string]time.Time, // prs.
+	_ map[string]string, // deletes.
+	_ map[string]bool, // forced.
 	pollInterval time.Duration,
 	err error,
 ) {
-	// TODO: Investigate this:
-	//       Events support pagination, however the per_page option is unsupported. The fixed page size is 30 items. Fetching up to ten pages is supported, for a total of 300 events.
-	events, resp, err := s.clV3.Activity.ListEventsPerformedByUser(ctx, s.user.Login, true, &githubv3.ListOptions{PerPage: 100})
-	if err != nil {
-		return nil, nil, nil, nil, 0, err
+	// Each feed of events is fetched separately. Ones that haven't changed
+	// since they were last fetched are used as they were.
+	feeds := make(map[string]feed) // Path -> Feed.
+	modified := false
+	seen := make(map[string]bool) // A set of fetched event IDs.
+	for _, path := range s.eventsPaths() {
+		f, pi, err := s.fetchFeed(ctx, path, s.feeds[path].etag)
+		if pi > pollInterval {
+			pollInterval = pi
+		}
+		if err == errNotModified {
+			f = s.feeds[path]
+		} else if err != nil {
+			return nil, nil, nil, nil, nil, nil, nil, 0, err
+		} else {
+			modified = true
+		}
+		feeds[path] = f
+		var es []*githubv3.Event
+		for _, e := range f.events {
+			// Feeds of different users may list the same event,
+			// e.g., one performed in an organization they're both in.
+			if seen[*e.ID] {
+				continue
+			}
+			seen[*e.ID] = true
+			es = append(es, e)
+		}
+		events = mergeEvents(events, es)
+	}
+	if !modified {
+		return nil, nil, nil, nil, nil, nil, nil, pollInterval, errNotModified
+	}
+	events = mergeEvents(unlisted(hooked, events), events)
+	renames = followRenames(events, repos, commits)
+	events = mergeEvents(renames, events)
+
+	err = s.enrich(ctx, events, repos, commits, prs, deletes, forced)
+	if _, ok := err.(enrichError); ok && ctx.Err() == nil {
+		// Use the events anyway, with placeholders for what failed to be fetched.
+		// Fetch the feeds in full next time, so that it's fetched again
+		// even if they haven't changed.
+		for path, f := range feeds {
+			f.etag = ""
+			feeds[path] = f
+		}
+	} else if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, 0, err
+	}
+	s.feeds = feeds
+	return events, renames, repos, commits, prs, deletes, forced, pollInterval, err
+}
+
+// fetchFeed fetches the feed of events at the Events API endpoint path.
+// etag is the ETag of the feed when it was last fetched, or empty if it wasn't.
+// If the feed hasn't changed since, errNotModified is returned along with
+// pollInterval. s.update must be held.
+func (s *Service) fetchFeed(ctx context.Context, path, etag string) (f feed, pollInterval time.Duration, _ error) {
+	// The Events API lists events in pages, up to maxPages of them.
+	// Only the first page is fetched with a conditional request,
+	// since the others can only change if it does.
+	seen := make(map[string]bool) // A set of fetched event IDs.
+	for page := 1; page <= s.pages; page++ {
+		if page > 1 && !s.withinBudget(&s.budgetV3, &s.status.RateV3) {
+			// The first page is always fetched, otherwise no events are.
+			// The others can wait until the rate budget allows.
+			break
+		}
+		if page == 1 {
+			s.mu.Lock()
+			l := s.rateLimitedNow(time.Now())
+			s.mu.Unlock()
+			if l != nil {
+				return feed{}, 0, l
+			}
+		}
+		req, err := s.clV3.NewRequest("GET", fmt.Sprintf("%s?per_page=100&page=%d", path, page), nil)
+		if err != nil {
+			return feed{}, 0, err
+		}
+		if page == 1 && etag != "" {
+			// Make a conditional request. If events haven't changed since
+			// they were last fetched, it doesn't count against the rate limit.
+			req.Header.Set("If-None-Match", etag)
+		}
+		var es []*githubv3.Event
+		resp, err := s.clV3.Do(ctx, req, &es)
+		if resp != nil {
+			if r, ok := rateV3(resp.Rate); ok {
+				s.mu.Lock()
+				s.status.RateV3 = r
+				s.mu.Unlock()
+			}
+			if resp.StatusCode != http.StatusNotModified {
+				s.charge(&s.budgetV3, &s.status.RateV3)
+			}
+		}
+		if page == 1 && resp != nil {
+			if pi, err := strconv.Atoi(resp.Header.Get("X-Poll-Interval")); err == nil {
+				pollInterval = time.Duration(pi) * time.Second
+			}
+			if resp.StatusCode == http.StatusNotModified {
+				return feed{}, pollInterval, errNotModified
+			}
+			f.etag = resp.Header.Get("ETag")
+		}
+		if err != nil {
+			return feed{}, 0, s.limited(err)
+		}
+		for _, e := range es {
+			// Events that happen while pages are fetched shift the
+			// following pages, so some events may be listed twice.
+			if seen[*e.ID] {
+				continue
+			}
+			seen[*e.ID] = true
+			f.events = append(f.events, s.limitCommits(e))
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+	}
+	return f, pollInterval, nil
+}
+
+// feed is a feed of events listed by an Events API endpoint.
+type feed struct {
+	etag   string            // ETag of the feed.
+	events []*githubv3.Event // Events in the feed, from most recent to oldest.
+}
+
+// eventsPaths returns the paths of the Events API endpoints that list events.
+// The ones that list private events too are used only if they're included.
+func (s *Service) eventsPaths() []string {
+	public := "/public"
+	if s.privateEvents {
+		public = ""
 	}
-	if pi, err := strconv.Atoi(resp.Header.Get("X-Poll-Interval")); err == nil {
-		pollInterval = time.Duration(pi) * time.Second
+	switch {
+	case s.org != "" && s.privateEvents:
+		return []string{fmt.Sprintf("users/%v/events/orgs/%v", s.user.Login, s.org)}
+	case s.org != "":
+		return []string{fmt.Sprintf("orgs/%v/events", s.org)}
+	case s.received:
+		return []string{fmt.Sprintf("users/%v/received_events%s", s.user.Login, public)}
+	default:
+		paths := []string{fmt.Sprintf("users/%v/events%s", s.user.Login, public)}
+		for _, u := range s.others {
+			paths = append(paths, fmt.Sprintf("users/%v/events%s", u.Login, public))
+		}
+		return paths
+	}
+}
+
+// lists reports whether event e is one that the Events API endpoint lists.
+// Received events depend on who the user follows, so it reports false for them.
+func (s *Service) lists(e *githubv3.Event) bool {
+	switch {
+	case s.org != "":
+		owner, _ := splitOwnerRepo(*e.Repo.Name)
+		return strings.EqualFold(owner, s.org)
+	case s.received:
+		return false
+	default:
+		if uint64(*e.Actor.ID) == s.user.ID {
+			return true
+		}
+		for _, u := range s.others {
+			if uint64(*e.Actor.ID) == u.ID {
+				return true
+			}
+		}
+		return false
 	}
+}
+
+// errNotModified is returned by fetchEvents when events haven't changed
+// since they were last fetched, so there's nothing to update.
+var errNotModified = errors.New("events not modified")
 
+// enrich fetches repository module paths, mentioned commits and PRs that events need,
+// resolves the last SHA of deleted refs, and determines which pushes were force-pushes.
+// events must be ordered from most recent to oldest.
+// Provided repos, commits, prs, deletes and forced must be non-nil, and they're updated in place.
+// Only missing entries are fetched, and unused ones are removed at the end.
+// Ones that prefetch leaves out are fetched in parallel, see fetchAll.
+// If some fail to be fetched, the others still are, and enrichError is returned.
+func (s *Service) enrich(
+	ctx context.Context,
+	events []*githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
+) error {
 	// Iterate over all events and fetch additional information
 	// needed based on their contents.
-	prs = make(map[string]bool)
 	usedRepos := make(map[int64]bool)    // A set of used repo IDs.
 	usedCommits := make(map[string]bool) // A set of used commit SHAs.
-	for _, e := range events {
-		payload, err := e.ParsePayload()
+	usedDeletes := make(map[string]bool) // A set of used delete event IDs.
+	usedPushes := make(map[string]bool)  // A set of used push event IDs.
+	usedPRs := make(map[string]bool)     // A set of used PR API URLs.
+	usedRefs := make(map[repoRef]bool)   // A set of used refs.
+	refs := make(map[repoRef]string)     // Ref -> Module path at ref, prefetched.
+	// Fetches that fail don't stop the others. What they were for
+	// is fetched individually instead, or left out, see enrichError.
+	failure := s.prefetch(ctx, events, repos, commits, prs, refs)
+	var err error
+	payloads := make([]interface{}, len(events))
+	for i, e := range events {
+		payloads[i], err = e.ParsePayload()
 		if err != nil {
-			return nil, nil, nil, nil, 0, fmt.Errorf("fetchEvents: ParsePayload failed: %v", err)
+			return fmt.Errorf("enrich: ParsePayload failed: %v", err)
+		}
+	}
+
+	// Fetch the module paths of repositories that aren't already known first,
+	// since what else is fetched depends on them. Once the rate budget is used up,
+	// nothing else is fetched, and convert uses placeholders until it's fetched later.
+	// Fetches are budgeted in order of events, and then done in parallel.
+	var fetches []fetch
+	pendingRepos := make(map[int64]bool)
+	for _, e := range events {
+		repoID, repoName, at := *e.Repo.ID, *e.Repo.Name, *e.CreatedAt
+		usedRepos[repoID] = true
+		if _, ok := repos[repoID]; ok || pendingRepos[repoID] || (repoID != goRepoID && !s.spendV4()) {
+			continue
 		}
+		pendingRepos[repoID] = true
+		var modulePath string
+		fetches = append(fetches, fetch{
+			do: func(ctx context.Context) error {
+				var err error
+				modulePath, err = s.fetchModulePath(ctx, repoID, repoName)
+				if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
+					s.logf("fetchModulePath: repository id=%d name=%q was not found: %v", repoID, repoName, err)
+					modulePath = "github.com/" + repoName
+				} else if err != nil {
+					return fmt.Errorf("fetchModulePath: %v", err)
+				}
+				return nil
+			},
+			apply: func() { repos[repoID] = repository{ModulePath: modulePath, Name: repoName, NameTime: at} },
+		})
+	}
+	if err := fetchAll(ctx, fetches); err != nil && failure == nil {
+		failure = err
+	}
+
+	fetches = nil
+	pendingModules := make(map[int64]bool)
+	pendingRefs := make(map[repoRef]bool)
+	pendingCommits := make(map[string]bool)
+	pendingPRs := make(map[string]bool)
+	for i, e := range events {
+		e, repoID, repoName := e, *e.Repo.ID, *e.Repo.Name
 
-		// Fetch the module path for this repository if not already known.
-		usedRepos[*e.Repo.ID] = true
-		if _, ok := repos[*e.Repo.ID]; !ok {
-			modulePath, err := s.fetchModulePath(ctx, *e.Repo.ID, "github.com/"+*e.Repo.Name)
-			if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
-				log.Printf("fetchModulePath: repository id=%d name=%q was not found: %v\n", *e.Repo.ID, *e.Repo.Name, err)
-				modulePath = "github.com/" + *e.Repo.Name
-			} else if err != nil {
-				return nil, nil, nil, nil, 0, fmt.Errorf("fetchModulePath: %v", err)
+		// Fetch the module path at the pushed or created ref, since go.mod
+		// may differ there from the one on the default branch.
+		if ref := eventRef(payloads[i]); ref != "" && repoID != goRepoID {
+			rr := repoRef{repoID, ref}
+			usedRefs[rr] = true
+			r, ok := repos[repoID]
+			if _, fetched := r.Refs[ref]; ok && !fetched && !pendingRefs[rr] {
+				if modulePath, prefetched := refs[rr]; prefetched {
+					repos[repoID] = r.withRef(ref, modulePath)
+				} else if s.spendV4() {
+					pendingRefs[rr] = true
+					fetches = append(fetches, fetch{
+						do: func(ctx context.Context) error {
+							var err error
+							modulePath, err = s.fetchModulePathAt(ctx, repoName, ref)
+							if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a Repository ") { // E.g., because the repo was deleted.
+								s.logf("fetchModulePathAt: repository %q was not found: %v", repoName, err)
+							} else if err != nil {
+								return fmt.Errorf("fetchModulePathAt: %v", err)
+							}
+							return nil
+						},
+						apply: func() { repos[repoID] = repos[repoID].withRef(ref, modulePath) },
+					})
+				}
 			}
-			repos[*e.Repo.ID] = repository{ModulePath: modulePath}
 		}
 
 		// Fetch the mentioned commits and PRs that aren't already known.
-		switch p := payload.(type) {
+		switch p := payloads[i].(type) {
 		case *githubv3.PushEvent:
 			for _, c := range p.Commits {
+				c := c
 				usedCommits[*c.SHA] = true
-				if _, ok := commits[*c.SHA]; ok {
+				if _, ok := commits[*c.SHA]; ok || pendingCommits[*c.SHA] || !s.spendV4() {
 					continue
 				}
-				commit, err := s.fetchCommit(ctx, *e.Repo.ID, *c.SHA)
-				if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
-					log.Printf("fetchEvents: commit %s@%s was not found: %v\n", *e.Repo.Name, *c.SHA, err)
+				pendingCommits[*c.SHA] = true
+				var commit event.Commit
+				fetches = append(fetches, fetch{
+					do: func(ctx context.Context) error {
+						var err error
+						commit, err = s.fetchCommit(ctx, repoID, repoName, *c.SHA)
+						if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
+							s.logf("enrich: commit %s@%s was not found: %v", repoName, *c.SHA, err)
 
-					avatarURL := "https://secure.gravatar.com/avatar?d=mm&f=y&s=96"
-					if *c.Author.Email == s.user.Email {
-						avatarURL = s.user.AvatarURL
-					}
-					commit = event.Commit{
-						SHA:             *c.SHA,
-						Message:         *c.Message,
-						AuthorAvatarURL: avatarURL,
-					}
-				} else if err != nil {
-					return nil, nil, nil, nil, 0, fmt.Errorf("fetchCommit: %v", err)
-				}
-				commits[*c.SHA] = commit
+							avatarURL := placeholderAvatarURL
+							for _, u := range append([]users.User{s.user}, s.others...) {
+								if *c.Author.Email == u.Email {
+									avatarURL = u.AvatarURL
+									break
+								}
+							}
+							commit = event.Commit{
+								SHA:             *c.SHA,
+								Message:         *c.Message,
+								AuthorAvatarURL: avatarURL,
+							}
+						} else if err != nil {
+							return fmt.Errorf("fetchCommit: %v", err)
+						}
+						return nil
+					},
+					apply: func() { commits[*c.SHA] = commit },
+				})
+			}
+
+			usedPushes[*e.ID] = true
+			if _, ok := forced[*e.ID]; ok {
+				continue
+			}
+			if p.Forced != nil {
+				// Only webhook payloads include this, but use it when available.
+				forced[*e.ID] = *p.Forced
+				continue
+			}
+			if !s.spendV3() {
+				continue
 			}
+			var f bool
+			fetches = append(fetches, fetch{
+				do: func(ctx context.Context) error {
+					owner, repo := splitOwnerRepo(repoName)
+					var err error
+					f, err = s.fetchForced(ctx, owner, repo, *p.Before, *p.Head)
+					if err != nil {
+						return fmt.Errorf("fetchForced: %v", err)
+					}
+					return nil
+				},
+				apply: func() { forced[*e.ID] = f },
+			})
 		case *githubv3.CommitCommentEvent:
-			usedCommits[*p.Comment.CommitID] = true
-			if _, ok := commits[*p.Comment.CommitID]; ok {
+			sha := *p.Comment.CommitID
+			usedCommits[sha] = true
+			if _, ok := commits[sha]; ok || pendingCommits[sha] || !s.spendV4() {
 				continue
 			}
-			commit, err := s.fetchCommit(ctx, *e.Repo.ID, *p.Comment.CommitID)
-			if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
-				log.Printf("fetchEvents: commit %s@%s was not found: %v\n", *e.Repo.Name, *p.Comment.CommitID, err)
+			pendingCommits[sha] = true
+			var commit event.Commit
+			fetches = append(fetches, fetch{
+				do: func(ctx context.Context) error {
+					var err error
+					commit, err = s.fetchCommit(ctx, repoID, repoName, sha)
+					if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a node ") { // E.g., because the repo was deleted.
+						s.logf("enrich: commit %s@%s was not found: %v", repoName, sha, err)
 
-				commit = event.Commit{
-					SHA:             *p.Comment.CommitID,
-					AuthorAvatarURL: "https://secure.gravatar.com/avatar?d=mm&f=y&s=96",
-				}
-			} else if err != nil {
-				return nil, nil, nil, nil, 0, fmt.Errorf("fetchCommit: %v", err)
-			}
-			commits[*p.Comment.CommitID] = commit
+						commit = event.Commit{
+							SHA:             sha,
+							AuthorAvatarURL: placeholderAvatarURL,
+						}
+					} else if err != nil {
+						return fmt.Errorf("fetchCommit: %v", err)
+					}
+					return nil
+				},
+				apply: func() { commits[sha] = commit },
+			})
 
 		case *githubv3.IssueCommentEvent:
-			if p.Issue.PullRequestLinks == nil {
+			if p.Issue.PullRequestLinks == nil || *p.Issue.State != "closed" {
+				// Only whether a closed PR was merged by the time of the event is needed.
+				continue
+			}
+			url, number := *p.Issue.PullRequestLinks.URL, *p.Issue.Number
+			usedPRs[url] = true
+			if _, ok := prs[url]; ok || pendingPRs[url] || !s.spendV4() {
 				continue
 			}
-			if _, ok := prs[*p.Issue.PullRequestLinks.URL]; ok {
+			pendingPRs[url] = true
+			var mergedAt time.Time
+			fetches = append(fetches, fetch{
+				do: func(ctx context.Context) error {
+					owner, repo := splitOwnerRepo(repoName)
+					var err error
+					mergedAt, err = s.fetchPullRequestMergedAt(ctx, owner, repo, number)
+					if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a ") { // E.g., because the repo was deleted.
+						s.logf("fetchPullRequestMergedAt: pull request %s#%d was not found: %v", repoName, number, err)
+					} else if err != nil {
+						return fmt.Errorf("fetchPullRequestMergedAt: %v", err)
+					}
+					return nil
+				},
+				apply: func() { prs[url] = mergedAt },
+			})
+
+		case *githubv3.DeleteEvent:
+			usedDeletes[*e.ID] = true
+			if _, ok := deletes[*e.ID]; ok {
 				continue
 			}
-			merged, err := s.fetchPullRequestMerged(ctx, *p.Issue.PullRequestLinks.URL)
-			if err != nil {
-				return nil, nil, nil, nil, 0, fmt.Errorf("fetchPullRequestMerged: %v", err)
+			// Look for the most recent push to the deleted ref first.
+			// If there isn't one and a branch was deleted, it's likely to be the
+			// head branch of a pull request, so use the head SHA of that.
+			sha := lastPushedSHA(events[i+1:], repoID, fullRef(*p.RefType, *p.Ref))
+			if sha != "" || *p.RefType != "branch" {
+				deletes[*e.ID] = sha // The empty string means the last SHA is unknown.
+				continue
 			}
-			prs[*p.Issue.PullRequestLinks.URL] = merged
+			if !s.spendV4() {
+				continue
+			}
+			fetches = append(fetches, fetch{
+				do: func(ctx context.Context) error {
+					owner, repo := splitOwnerRepo(repoName)
+					var err error
+					sha, err = s.fetchPullRequestHeadSHA(ctx, owner, repo, *p.Ref)
+					if err != nil && strings.HasPrefix(err.Error(), "Could not resolve to a Repository ") { // E.g., because the repo was deleted.
+						s.logf("fetchPullRequestHeadSHA: repository %q was not found: %v", repoName, err)
+					} else if err != nil {
+						return fmt.Errorf("fetchPullRequestHeadSHA: %v", err)
+					}
+					return nil
+				},
+				apply: func() { deletes[*e.ID] = sha },
+			})
+		}
+	}
+
+	// Fetch the nested modules of repositories that aren't already known last,
+	// so that events can be attributed to the most specific module. How much
+	// of the rate budget fetching them takes depends on what they are.
+	for _, e := range events {
+		repoID, repoName := *e.Repo.ID, *e.Repo.Name
+		if r, ok := repos[repoID]; !ok || r.Modules != nil || repoID == goRepoID || pendingModules[repoID] {
+			continue
 		}
+		pendingModules[repoID] = true
+		var (
+			modules map[string]string
+			fetched bool
+		)
+		fetches = append(fetches, fetch{
+			do: func(ctx context.Context) error {
+				var err error
+				modules, fetched, err = s.fetchModules(ctx, repoName)
+				if err != nil {
+					return fmt.Errorf("fetchModules: %v", err)
+				}
+				return nil
+			},
+			apply: func() {
+				if fetched {
+					r := repos[repoID]
+					r.Modules = modules
+					repos[repoID] = r
+				}
+			},
+		})
+	}
+	if err := fetchAll(ctx, fetches); err != nil && failure == nil {
+		failure = err
 	}
 
-	// Remove unused repos and commits.
-	for id := range repos {
+	// Remove unused entries.
+	for id, r := range repos {
 		if !usedRepos[id] {
 			delete(repos, id)
+			continue
+		}
+		for ref := range r.Refs {
+			if !usedRefs[repoRef{id, ref}] {
+				repos[id] = r.withoutUnusedRefs(id, usedRefs)
+				break
+			}
 		}
 	}
 	for sha := range commits {
@@ -227,115 +1237,333 @@ func (s *service) fetchEvents(
 			delete(commits, sha)
 		}
 	}
+	for url := range prs {
+		if !usedPRs[url] {
+			delete(prs, url)
+		}
+	}
+	for id := range deletes {
+		if !usedDeletes[id] {
+			delete(deletes, id)
+		}
+	}
+	for id := range forced {
+		if !usedPushes[id] {
+			delete(forced, id)
+		}
+	}
+
+	if failure != nil {
+		return enrichError{s.limited(failure)}
+	}
+	return nil
+}
+
+// enrichError is returned by enrich when some of the information that events
+// need failed to be fetched. The rest is still updated, and events can be
+// converted with placeholders for what's missing, until it's fetched later.
+type enrichError struct{ err error }
+
+func (e enrichError) Error() string { return e.err.Error() }
+
+// placeholderAvatarURL is the avatar URL of commit authors that aren't known.
+const placeholderAvatarURL = "https://secure.gravatar.com/avatar?d=mm&f=y&s=96"
+
+// goRepoID is the repository ID of the github.com/golang/go repository.
+const goRepoID = 23096959
+
+// fetchModulePath fetches the module path for the specified repository,
+// whose name is like "owner/repo".
+// Its repo path (e.g., "github.com/owner/repo") is returned as the module path
+// if the repository has no go.mod file, or if the go.mod file fails to parse.
+//
+// For the main Go repository (i.e., https://github.com/golang/go),
+// the empty string is returned as the module path without using network.
+//
+// The repository is queried by its name. If it's not found by name,
+// or the name is now taken by another repository, e.g., because it was renamed
+// since the event, it's queried by its ID with repositoryID instead.
+//
+// enrich fetches module paths in batches with prefetch first,
+// so this is used only for ones that prefetch left out.
+func (s *Service) fetchModulePath(ctx context.Context, repoID int64, repoName string) (modulePath string, _ error) {
+	if repoID == goRepoID {
+		// Use empty string as the module path for the main Go repository.
+		return "", nil
+	}
+	repoPath := "github.com/" + repoName
+
+	var q struct {
+		Repository *repositoryNode `graphql:"repository(owner:$owner,name:$name)"`
+	}
+	owner, name := splitOwnerRepo(repoName)
+	variables := map[string]interface{}{
+		"owner": githubv4.String(owner),
+		"name":  githubv4.String(name),
+	}
+	err := s.clV4.Query(ctx, &q, variables)
+	if err == nil && q.Repository != nil && q.Repository.Repository.DatabaseID == repoID {
+		return q.Repository.modulePath(repoPath), nil
+	} else if err != nil && !strings.HasPrefix(err.Error(), "Could not resolve to a Repository ") {
+		return "", err
+	}
+
+	var qn struct {
+		Node repositoryNode `graphql:"node(id:$repoID)"`
+	}
+	variables = map[string]interface{}{
+		"repoID": repositoryID(repoID),
+	}
+	err = s.clV4.Query(ctx, &qn, variables)
+	if err != nil {
+		return "", err
+	}
+	return qn.Node.modulePath(repoPath), nil
+}
+
+// repositoryNode is a repository node, queried for its go.mod file.
+type repositoryNode struct {
+	Repository struct {
+		DatabaseID int64
+		Object     *struct {
+			Blob struct {
+				Text string
+			} `graphql:"...on Blob"`
+		} `graphql:"object(expression:\"HEAD:go.mod\")"`
+	} `graphql:"...on Repository"`
+}
+
+// modulePath returns the module path of the module at the root
+// of the repository with the "github.com/owner/repo" repoPath.
+// repoPath is returned if the repository has no go.mod file,
+// or if the go.mod file fails to parse.
+func (n repositoryNode) modulePath(repoPath string) string {
+	if n.Repository.Object == nil {
+		// No go.mod file, so the module path must be equal to the repo path.
+		return repoPath
+	}
+	modulePath := modfile.ModulePath([]byte(n.Repository.Object.Blob.Text))
+	if modulePath == "" {
+		// No module path found in go.mod file, so fall back to using the repo path.
+		return repoPath
+	}
+	return modulePath
+}
+
+// fetchModulePathAt fetches the module path in the go.mod file at ref,
+// like "refs/heads/master", in the specified repository, whose name is like "owner/repo".
+// The empty string is returned if there's no go.mod file there,
+// or if it fails to parse. Then the module path at HEAD applies, see repository.modulePathAt.
+//
+// enrich fetches module paths at refs in batches with prefetch first,
+// so this is used only for ones that prefetch left out.
+func (s *Service) fetchModulePathAt(ctx context.Context, repoName, ref string) (string, error) {
+	var q struct {
+		Repository struct {
+			Object *goModNode `graphql:"object(expression:$expression)"`
+		} `graphql:"repository(owner:$owner,name:$name)"`
+	}
+	owner, name := splitOwnerRepo(repoName)
+	variables := map[string]interface{}{
+		"owner":      githubv4.String(owner),
+		"name":       githubv4.String(name),
+		"expression": githubv4.String(ref + ":go.mod"),
+	}
+	err := s.clV4.Query(ctx, &q, variables)
+	if err != nil {
+		return "", err
+	}
+	return q.Repository.Object.modulePath(), nil
+}
+
+// goModNode is a go.mod file blob node.
+type goModNode struct {
+	Blob struct {
+		Text string
+	} `graphql:"...on Blob"`
+}
+
+// modulePath returns the module path in the go.mod file n,
+// or the empty string if n is nil or fails to parse.
+func (n *goModNode) modulePath() string {
+	if n == nil {
+		return ""
+	}
+	return modfile.ModulePath([]byte(n.Blob.Text))
+}
+
+// repositoryID returns the GraphQL node ID of the repository with repoID.
+// The format of node IDs is undocumented, and GitHub has changed it before,
+// so it's only a fallback for when a repository can't be queried by name.
+func repositoryID(repoID int64) githubv4.ID {
+	return githubv4.ID(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("010:Repository%d", repoID)))) // HACK, TODO: Confirm StdEncoding vs URLEncoding.
+}
+
+// fetchCommit fetches the specified commit in the specified repository,
+// whose name is like "owner/repo".
+//
+// The commit is queried in the repository by its name. If it's not found
+// that way, e.g., because the repository was renamed since the event,
+// it's queried by its ID with commitID instead.
+//
+// enrich fetches commits in batches with prefetch first,
+// so this is used only for ones that prefetch left out.
+func (s *Service) fetchCommit(ctx context.Context, repoID int64, repoName, sha string) (event.Commit, error) {
+	var q struct {
+		Repository *struct {
+			Object *commitNode `graphql:"object(oid:$oid)"`
+		} `graphql:"repository(owner:$owner,name:$name)"`
+	}
+	owner, name := splitOwnerRepo(repoName)
+	variables := map[string]interface{}{
+		"owner": githubv4.String(owner),
+		"name":  githubv4.String(name),
+		"oid":   githubv4.GitObjectID(sha),
+	}
+	err := s.clV4.Query(ctx, &q, variables)
+	if err == nil && q.Repository != nil && q.Repository.Object != nil {
+		return q.Repository.Object.commit(), nil
+	} else if err != nil && !strings.HasPrefix(err.Error(), "Could not resolve to a Repository ") {
+		return event.Commit{}, err
+	}
 
-	return events, repos, commits, prs, pollInterval, nil
+	var qn struct {
+		Node commitNode `graphql:"node(id:$commitID)"`
+	}
+	variables = map[string]interface{}{
+		"commitID": commitID(repoID, sha),
+	}
+	err = s.clV4.Query(ctx, &qn, variables)
+	if err != nil {
+		return event.Commit{}, err
+	}
+	return qn.Node.commit(), nil
 }
 
-// goRepoID is the repository ID of the github.com/golang/go repository.
-const goRepoID = 23096959
+// commitNode is a commit node.
+type commitNode struct {
+	Commit struct {
+		OID     string
+		Message string
+		Author  struct {
+			AvatarURL string `graphql:"avatarUrl"` // Resized by avatars.
+		}
+		URL          string
+		Additions    int
+		Deletions    int
+		ChangedFiles int
+	} `graphql:"...on Commit"`
+}
 
-// fetchModulePath fetches the module path for the specified repository.
-// repoPath is returned as the module path if the repository has no go.mod file,
-// or if the go.mod file fails to parse.
-//
-// For the main Go repository (i.e., https://github.com/golang/go),
-// the empty string is returned as the module path without using network.
-func (s *service) fetchModulePath(ctx context.Context, repoID int64, repoPath string) (modulePath string, _ error) {
-	if repoID == goRepoID {
-		// Use empty string as the module path for the main Go repository.
-		return "", nil
+// commit returns the commit that n is.
+func (n commitNode) commit() event.Commit {
+	return event.Commit{
+		SHA:             n.Commit.OID,
+		Message:         n.Commit.Message,
+		AuthorAvatarURL: n.Commit.Author.AvatarURL,
+		HTMLURL:         n.Commit.URL,
+		Additions:       n.Commit.Additions,
+		Deletions:       n.Commit.Deletions,
+		ChangedFiles:    n.Commit.ChangedFiles,
 	}
+}
 
-	// TODO: It'd be better to batch and fetch all module paths at once (in fetchEvents loop),
-	//       rather than making an individual query for each.
-	//       See https://github.com/shurcooL/githubv4/issues/17.
+// commitID returns the GraphQL node ID of the commit with sha
+// in the repository with repoID. Like repositoryID, it's only a fallback.
+func commitID(repoID int64, sha string) githubv4.ID {
+	return githubv4.ID(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("06:Commit%d:%s", repoID, sha)))) // HACK, TODO: Confirm StdEncoding vs URLEncoding.
+}
 
+// fetchPullRequestMergedAt fetches when the specified pull request was merged.
+// The zero time is returned if it isn't merged.
+//
+// enrich fetches pull requests in batches with prefetch first,
+// so this is used only for ones that prefetch left out.
+func (s *Service) fetchPullRequestMergedAt(ctx context.Context, owner, repo string, number int) (time.Time, error) {
 	var q struct {
-		Node struct {
-			Repository struct {
-				Object *struct {
-					Blob struct {
-						Text string
-					} `graphql:"...on Blob"`
-				} `graphql:"object(expression:\"HEAD:go.mod\")"`
-			} `graphql:"...on Repository"`
-		} `graphql:"node(id:$repoID)"`
+		Repository struct {
+			PullRequest pullRequestNode `graphql:"pullRequest(number:$number)"`
+		} `graphql:"repository(owner:$owner,name:$name)"`
 	}
 	variables := map[string]interface{}{
-		"repoID": githubv4.ID(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("010:Repository%d", repoID)))), // HACK, TODO: Confirm StdEncoding vs URLEncoding.
+		"owner":  githubv4.String(owner),
+		"name":   githubv4.String(repo),
+		"number": githubv4.Int(number),
 	}
 	err := s.clV4.Query(ctx, &q, variables)
 	if err != nil {
-		return "", err
-	}
-	if q.Node.Repository.Object == nil {
-		// No go.mod file, so the module path must be equal to the repo path.
-		return repoPath, nil
+		return time.Time{}, err
 	}
-	modulePath = modfile.ModulePath([]byte(q.Node.Repository.Object.Blob.Text))
-	if modulePath == "" {
-		// No module path found in go.mod file, so fall back to using the repo path.
-		return repoPath, nil
+	return q.Repository.PullRequest.mergedAt(), nil
+}
+
+// pullRequestNode is a pull request node, queried for when it was merged.
+type pullRequestNode struct {
+	MergedAt *githubv4.DateTime
+}
+
+// mergedAt returns when the pull request was merged, or the zero time
+// if it isn't merged.
+func (n pullRequestNode) mergedAt() time.Time {
+	if n.MergedAt == nil {
+		return time.Time{}
 	}
-	return modulePath, nil
+	return n.MergedAt.Time
 }
 
-// fetchCommit fetches the specified commit.
-func (s *service) fetchCommit(ctx context.Context, repoID int64, sha string) (event.Commit, error) {
-	// TODO: It'd be better to batch and fetch all commits at once (in fetchEvents loop),
-	//       rather than making an individual query for each.
-	//       See https://github.com/shurcooL/githubv4/issues/17.
+// zeroSHA is the SHA that GitHub uses for the "before" commit
+// of a push that created a branch.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// fetchForced fetches whether a push that moved a ref from before to head
+// was a force-push, i.e., whether before is not an ancestor of head.
+func (s *Service) fetchForced(ctx context.Context, owner, repo, before, head string) (bool, error) {
+	if before == zeroSHA {
+		// The push created the ref.
+		return false, nil
+	}
+	cmp, _, err := s.clV3.Repositories.CompareCommits(ctx, owner, repo, before, head)
+	if e, ok := err.(*githubv3.ErrorResponse); ok && e.Response.StatusCode == http.StatusNotFound {
+		// E.g., because the repo was deleted, or the before commit is gone.
+		s.logf("fetchForced: comparison %s/%s@%s...%s was not found: %v", owner, repo, before, head, err)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	switch *cmp.Status {
+	case "diverged", "behind":
+		return true, nil
+	default: // "ahead", "identical".
+		return false, nil
+	}
+}
 
-	commitID := fmt.Sprintf("06:Commit%d:%s", repoID, sha)
+// fetchPullRequestHeadSHA fetches the head SHA of the most recent pull request
+// in the specified repository whose head branch is named branch.
+// The empty string is returned if there's no such pull request.
+func (s *Service) fetchPullRequestHeadSHA(ctx context.Context, owner, repo, branch string) (string, error) {
 	var q struct {
-		Node struct {
-			Commit struct {
-				OID     string
-				Message string
-				Author  struct {
-					AvatarURL string `graphql:"avatarUrl(size:96)"`
+		Repository struct {
+			PullRequests struct {
+				Nodes []struct {
+					HeadRefOID string
 				}
-				URL string
-			} `graphql:"...on Commit"`
-		} `graphql:"node(id:$commitID)"`
+			} `graphql:"pullRequests(headRefName:$headRefName,last:1)"`
+		} `graphql:"repository(owner:$owner,name:$name)"`
 	}
 	variables := map[string]interface{}{
-		"commitID": githubv4.ID(base64.StdEncoding.EncodeToString([]byte(commitID))), // HACK, TODO: Confirm StdEncoding vs URLEncoding.
+		"owner":       githubv4.String(owner),
+		"name":        githubv4.String(repo),
+		"headRefName": githubv4.String(branch),
 	}
 	err := s.clV4.Query(ctx, &q, variables)
 	if err != nil {
-		return event.Commit{}, err
-	}
-	return event.Commit{
-		SHA:             q.Node.Commit.OID,
-		Message:         q.Node.Commit.Message,
-		AuthorAvatarURL: q.Node.Commit.Author.AvatarURL,
-		HTMLURL:         q.Node.Commit.URL,
-	}, nil
-}
-
-// fetchPullRequestMerged fetches whether the Pull Request at the API URL is merged
-// at current time.
-func (s *service) fetchPullRequestMerged(ctx context.Context, prURL string) (bool, error) {
-	// https://developer.github.com/v3/pulls/#get-if-a-pull-request-has-been-merged.
-	req, err := s.clV3.NewRequest("GET", prURL+"/merge", nil)
-	if err != nil {
-		return false, err
+		return "", err
 	}
-	resp, err := s.clV3.Do(ctx, req, nil)
-	switch e, ok := err.(*githubv3.ErrorResponse); {
-	case err == nil && resp.StatusCode == http.StatusNoContent:
-		// PR merged.
-		return true, nil
-	case ok && e.Response.StatusCode == http.StatusNotFound:
-		// PR not merged.
-		return false, nil
-	case err != nil:
-		return false, err
-	default:
-		body, _ := ioutil.ReadAll(resp.Body)
-		return false, fmt.Errorf("unexpected status code: %v body: %q", resp.Status, body)
+	if len(q.Repository.PullRequests.Nodes) == 0 {
+		return "", nil
 	}
+	return q.Repository.PullRequests.Nodes[0].HeadRefOID, nil
 }
 
 // convert converts GitHub events. Events must contain valid payloads,
@@ -345,12 +1573,16 @@ func convert(
 	events []*githubv3.Event,
 	repos map[int64]repository, // Repo ID -> Module Path.
 	commits map[string]event.Commit, // SHA -> Commit.
-	prs map[string]bool, // PR API URL -> Pull Request merged.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
 	router github.Router,
+	logf func(format string, v ...interface{}), // Reports unsupported events.
 ) []event.Event {
 	var es []event.Event
 	for _, e := range events {
 		ee := event.Event{
+			ID:   *e.ID,
 			Time: *e.CreatedAt,
 			Actor: users.User{
 				UserSpec:  users.UserSpec{ID: uint64(*e.Actor.ID), Domain: "github.com"},
@@ -359,118 +1591,221 @@ func convert(
 			},
 		}
 
-		modulePath := repos[*e.Repo.ID].ModulePath
+		r, ok := repos[*e.Repo.ID]
+		if !ok {
+			// The module path isn't fetched yet, e.g., because the rate budget
+			// was used up. Use the repository path meanwhile.
+			r.ModulePath = "github.com/" + *e.Repo.Name
+		}
+		modulePath := r.ModulePath
 		owner, repo := splitOwnerRepo(*e.Repo.Name)
-		payload, err := e.ParsePayload()
+		payload, err := parsePayload(e)
 		if err != nil {
 			panic(fmt.Errorf("internal error: convert given a githubv3.Event with an invalid payload: %v", err))
 		}
 		switch p := payload.(type) {
 		case *githubv3.IssuesEvent:
-			var body string
-			switch *p.Action {
-			case "opened":
-				body = *p.Issue.Body
-			case "closed", "reopened":
-
-				//default:
-				//log.Println("convert: unsupported *githubv3.IssuesEvent action:", *p.Action)
-			}
 			paths, title := prefixtitle.ParseIssue(modulePath, *p.Issue.Title)
-			ee.Container = paths[0]
-			ee.Payload = event.Issue{
-				Action:       *p.Action,
-				IssueTitle:   title,
-				IssueBody:    body,
-				IssueHTMLURL: router.IssueURL(ctx, owner, repo, uint64(*p.Issue.Number)),
+			number := uint64(*p.Issue.Number)
+			htmlURL := router.IssueURL(ctx, owner, repo, number)
+			switch *p.Action {
+			case "opened", "closed", "reopened", "pinned", "unpinned":
+				var body string
+				if *p.Action == "opened" {
+					body = *p.Issue.Body
+				}
+				ee.Payload = event.Issue{
+					Action:       event.IssueAction(*p.Action),
+					IssueNumber:  number,
+					IssueTitle:   title,
+					IssueBody:    body,
+					IssueHTMLURL: htmlURL,
+					Milestone:    milestoneTitle(p.Issue.Milestone),
+					Labels:       convertLabels(p.Issue.Labels),
+				}
+			case "assigned", "unassigned":
+				ee.Payload = event.Assign{
+					Action: event.AssignAction(*p.Action),
+					Assignee: users.User{
+						UserSpec:  users.UserSpec{ID: uint64(*p.Assignee.ID), Domain: "github.com"},
+						Login:     *p.Assignee.Login,
+						AvatarURL: *p.Assignee.AvatarURL,
+					},
+					IssueNumber:  number,
+					IssueTitle:   title,
+					IssueHTMLURL: htmlURL,
+				}
+			case "labeled", "unlabeled":
+				ee.Payload = event.Label{
+					Action:       event.LabelAction(*p.Action),
+					Label:        event.LabelInfo{Name: *p.Label.Name, Color: *p.Label.Color},
+					IssueNumber:  number,
+					IssueTitle:   title,
+					IssueHTMLURL: htmlURL,
+				}
+			case "milestoned", "demilestoned":
+				ee.Payload = event.Milestone{
+					Action:       event.MilestoneAction(*p.Action),
+					Milestone:    issuesEventMilestone(e, p),
+					IssueNumber:  number,
+					IssueTitle:   title,
+					IssueHTMLURL: htmlURL,
+				}
+			case "transferred":
+				ee.Payload = event.Transfer{
+					IssueNumber:  number,
+					IssueTitle:   title,
+					IssueHTMLURL: htmlURL,
+				}
+			default:
+				logf("convert: unsupported *githubv3.IssuesEvent action: %v", *p.Action)
+				continue
 			}
+			ee.Container = r.packagePath(paths[0])
 		case *githubv3.PullRequestEvent:
-			var action, body string
+			var action event.ChangeAction
+			var body string
 			switch {
 			case *p.Action == "opened":
-				action = "opened"
+				action = event.ChangeOpened
 				body = *p.PullRequest.Body
 			case *p.Action == "closed" && !*p.PullRequest.Merged:
-				action = "closed"
+				action = event.ChangeClosed
 			case *p.Action == "closed" && *p.PullRequest.Merged:
-				action = "merged"
+				action = event.ChangeMerged
 			case *p.Action == "reopened":
-				action = "reopened"
-
-				//default:
-				//log.Println("convert: unsupported *githubv3.PullRequestEvent PullRequest.State:", *p.PullRequest.State, "PullRequest.Merged:", *p.PullRequest.Merged)
+				action = event.ChangeReopened
+			default:
+				logf("convert: unsupported *githubv3.PullRequestEvent: Action=%v", *p.Action)
+				continue
 			}
 			paths, title := prefixtitle.ParseChange(modulePath, *p.PullRequest.Title)
-			ee.Container = paths[0]
+			ee.Container = r.packagePath(paths[0])
 			ee.Payload = event.Change{
 				Action:        action,
+				ChangeNumber:  uint64(*p.PullRequest.Number),
 				ChangeTitle:   title,
 				ChangeBody:    body,
 				ChangeHTMLURL: router.PullRequestURL(ctx, owner, repo, uint64(*p.PullRequest.Number)),
+				BaseBranch:    *p.PullRequest.Base.Ref,
+				HeadBranch:    *p.PullRequest.Head.Ref,
+				Draft:         pullRequestDraft(e),
+				Milestone:     milestoneTitle(p.PullRequest.Milestone),
+				Labels:        convertLabelPointers(p.PullRequest.Labels),
+				References:    extractReferences(ctx, router, owner, repo, body),
 			}
 
 		case *githubv3.IssueCommentEvent:
+			action, ok := commentAction(*p.Action)
+			if !ok {
+				logf("convert: unsupported *githubv3.IssueCommentEvent: Action=%v", *p.Action)
+				continue
+			}
+			body := commentBody(action, *p.Comment.Body)
 			switch p.Issue.PullRequestLinks {
 			case nil: // Issue.
-				switch *p.Action {
-				case "created":
-					var issueState state.Issue
-					switch *p.Issue.State {
-					case "open":
-						issueState = state.IssueOpen
-					case "closed":
-						issueState = state.IssueClosed
-					default:
-						log.Printf("convert: unsupported *githubv3.IssueCommentEvent (issue): Issue.State=%v\n", *p.Issue.State)
-						continue
-					}
-					paths, title := prefixtitle.ParseIssue(modulePath, *p.Issue.Title)
-					ee.Container = paths[0]
-					ee.Payload = event.IssueComment{
-						IssueTitle:     title,
-						IssueState:     issueState,
-						CommentBody:    *p.Comment.Body,
-						CommentHTMLURL: router.IssueCommentURL(ctx, owner, repo, uint64(*p.Issue.Number), uint64(*p.Comment.ID)),
-					}
-
-					//default:
-					//e.WIP = true
-					//e.Action = component.Text(fmt.Sprintf("%v on an issue in", *p.Action))
+				var issueState state.Issue
+				switch *p.Issue.State {
+				case "open":
+					issueState = state.IssueOpen
+				case "closed":
+					issueState = state.IssueClosed
+				default:
+					logf("convert: unsupported *githubv3.IssueCommentEvent (issue): Issue.State=%v", *p.Issue.State)
+					continue
+				}
+				paths, title := prefixtitle.ParseIssue(modulePath, *p.Issue.Title)
+				ee.Container = r.packagePath(paths[0])
+				ee.Payload = event.IssueComment{
+					Action:           action,
+					IssueNumber:      uint64(*p.Issue.Number),
+					IssueTitle:       title,
+					IssueState:       issueState,
+					CommentID:        uint64(*p.Comment.ID),
+					CommentBody:      body,
+					CommentCreatedAt: *p.Comment.CreatedAt,
+					CommentHTMLURL:   router.IssueCommentURL(ctx, owner, repo, uint64(*p.Issue.Number), uint64(*p.Comment.ID)),
+					References:       extractReferences(ctx, router, owner, repo, body),
 				}
 			default: // Pull Request.
-				switch *p.Action {
-				case "created":
-					var changeState state.Change
-					// Note, State is PR state at the time of event, but merged is PR merged at current time.
-					// So, only check merged when State is closed. It's an approximation, but good enough in majority of cases.
-					switch merged := prs[*p.Issue.PullRequestLinks.URL]; {
-					case *p.Issue.State == "open":
-						changeState = state.ChangeOpen
-					case *p.Issue.State == "closed" && !merged:
-						changeState = state.ChangeClosed
-					case *p.Issue.State == "closed" && merged:
-						changeState = state.ChangeMerged
-					default:
-						log.Printf("convert: unsupported *githubv3.IssueCommentEvent (pr): merged=%v Issue.State=%v\n", prs[*p.Issue.PullRequestLinks.URL], *p.Issue.State)
-						continue
-					}
-					paths, title := prefixtitle.ParseChange(modulePath, *p.Issue.Title)
-					ee.Container = paths[0]
-					ee.Payload = event.ChangeComment{
-						ChangeTitle:    title,
-						ChangeState:    changeState,
-						CommentBody:    *p.Comment.Body,
-						CommentHTMLURL: router.PullRequestCommentURL(ctx, owner, repo, uint64(*p.Issue.Number), uint64(*p.Comment.ID)),
-					}
-
-					//default:
-					//e.WIP = true
-					//e.Action = component.Text(fmt.Sprintf("%v on a pull request in", *p.Action))
+				var changeState state.Change
+				// Note, State is PR state at the time of event, which doesn't tell closed and merged apart.
+				// A closed PR was merged by then if it was merged before the event, not just later,
+				// e.g., after it was reopened. If it's not known when it was merged yet, it's considered closed.
+				switch mergedAt := prs[*p.Issue.PullRequestLinks.URL]; {
+				case *p.Issue.State == "open":
+					changeState = state.ChangeOpen
+				case *p.Issue.State == "closed" && (mergedAt.IsZero() || mergedAt.After(*e.CreatedAt)):
+					changeState = state.ChangeClosed
+				case *p.Issue.State == "closed":
+					changeState = state.ChangeMerged
+				default:
+					logf("convert: unsupported *githubv3.IssueCommentEvent (pr): mergedAt=%v Issue.State=%v", mergedAt, *p.Issue.State)
+					continue
+				}
+				paths, title := prefixtitle.ParseChange(modulePath, *p.Issue.Title)
+				ee.Container = r.packagePath(paths[0])
+				ee.Payload = event.ChangeComment{
+					Action:           action,
+					ChangeTitle:      title,
+					ChangeState:      changeState,
+					CommentID:        uint64(*p.Comment.ID),
+					CommentBody:      body,
+					CommentCreatedAt: *p.Comment.CreatedAt,
+					CommentHTMLURL:   router.PullRequestCommentURL(ctx, owner, repo, uint64(*p.Issue.Number), uint64(*p.Comment.ID)),
+					References:       extractReferences(ctx, router, owner, repo, body),
 				}
 			}
 		case *githubv3.PullRequestReviewCommentEvent:
+			action, ok := commentAction(*p.Action)
+			if !ok {
+				logf("convert: unsupported *githubv3.PullRequestReviewCommentEvent: Action=%v", *p.Action)
+				continue
+			}
+			var changeState state.Change
+			switch {
+			case p.PullRequest.MergedAt == nil && *p.PullRequest.State == "open":
+				changeState = state.ChangeOpen
+			case p.PullRequest.MergedAt == nil && *p.PullRequest.State == "closed":
+				changeState = state.ChangeClosed
+			case p.PullRequest.MergedAt != nil:
+				changeState = state.ChangeMerged
+			default:
+				logf("convert: unsupported *githubv3.PullRequestReviewCommentEvent: PullRequest.MergedAt=%v PullRequest.State=%v", p.PullRequest.MergedAt, *p.PullRequest.State)
+				continue
+			}
+			body := commentBody(action, *p.Comment.Body)
+			paths, title := prefixtitle.ParseChange(modulePath, *p.PullRequest.Title)
+			ee.Container = r.packagePath(paths[0])
+			ee.Payload = event.ChangeComment{
+				Action:           action,
+				ChangeTitle:      title,
+				ChangeState:      changeState,
+				CommentID:        uint64(*p.Comment.ID),
+				CommentBody:      body,
+				CommentCreatedAt: *p.Comment.CreatedAt,
+				CommentHTMLURL:   router.PullRequestReviewCommentURL(ctx, owner, repo, uint64(*p.PullRequest.Number), uint64(*p.Comment.ID)),
+				References:       extractReferences(ctx, router, owner, repo, body),
+			}
+		case *githubv3.PullRequestReviewEvent:
 			switch *p.Action {
-			case "created":
+			case "created", "submitted": // The Events API lists it as created, webhooks deliver it as submitted.
+				var review state.Review
+				switch strings.ToLower(*p.Review.State) {
+				case "approved":
+					review = state.ReviewPlus2
+				case "changes_requested":
+					review = state.ReviewMinus2
+				case "commented":
+					if p.Review.Body == nil || *p.Review.Body == "" {
+						// The review only has review comments, which are listed on their own.
+						continue
+					}
+					review = state.ReviewNoScore
+				default:
+					logf("convert: unsupported *githubv3.PullRequestReviewEvent: Review.State=%v", *p.Review.State)
+					continue
+				}
 				var changeState state.Change
 				switch {
 				case p.PullRequest.MergedAt == nil && *p.PullRequest.State == "open":
@@ -480,46 +1815,68 @@ func convert(
 				case p.PullRequest.MergedAt != nil:
 					changeState = state.ChangeMerged
 				default:
-					log.Printf("convert: unsupported *githubv3.PullRequestReviewCommentEvent: PullRequest.MergedAt=%v PullRequest.State=%v\n", p.PullRequest.MergedAt, *p.PullRequest.State)
+					logf("convert: unsupported *githubv3.PullRequestReviewEvent: PullRequest.MergedAt=%v PullRequest.State=%v", p.PullRequest.MergedAt, *p.PullRequest.State)
 					continue
 				}
+				var body string
+				if p.Review.Body != nil {
+					body = *p.Review.Body
+				}
+				var submittedAt time.Time
+				if p.Review.SubmittedAt != nil {
+					submittedAt = *p.Review.SubmittedAt
+				}
 				paths, title := prefixtitle.ParseChange(modulePath, *p.PullRequest.Title)
-				ee.Container = paths[0]
+				ee.Container = r.packagePath(paths[0])
 				ee.Payload = event.ChangeComment{
-					ChangeTitle:    title,
-					ChangeState:    changeState,
-					CommentBody:    *p.Comment.Body,
-					CommentHTMLURL: router.PullRequestReviewCommentURL(ctx, owner, repo, uint64(*p.PullRequest.Number), uint64(*p.Comment.ID)),
+					ChangeTitle:      title,
+					ChangeState:      changeState,
+					CommentID:        uint64(*p.Review.ID),
+					CommentBody:      body,
+					CommentReview:    review,
+					CommentCreatedAt: submittedAt,
+					CommentHTMLURL:   router.PullRequestReviewURL(ctx, owner, repo, uint64(*p.PullRequest.Number), uint64(*p.Review.ID)),
+					References:       extractReferences(ctx, router, owner, repo, body),
 				}
-
-				//default:
-				//basicEvent.WIP = true
-				//e.Action = component.Text(fmt.Sprintf("%v on a pull request in", *p.Action))
 			}
-		// TODO: Add support for *githubv3.PullRequestReviewEvent whenever GitHub API v3 starts
-		//       including it... Map it to an event.ChangeComment with the CommentReview field set.
 		case *githubv3.CommitCommentEvent:
-			c := commits[*p.Comment.CommitID]
+			c, ok := commits[*p.Comment.CommitID]
+			if !ok {
+				// Not fetched yet, e.g., because the rate budget was used up.
+				c = event.Commit{SHA: *p.Comment.CommitID, AuthorAvatarURL: placeholderAvatarURL}
+			}
 			subject, body := splitCommitMessage(c.Message)
 			paths, title := prefixtitle.ParseChange(modulePath, subject)
-			ee.Container = paths[0]
+			ee.Container = r.packagePath(paths[0])
 			c.Message = joinCommitMessage(title, body)
 			ee.Payload = event.CommitComment{
-				Commit:      c,
-				CommentBody: *p.Comment.Body,
+				Commit:           c,
+				CommentID:        uint64(*p.Comment.ID),
+				CommentBody:      *p.Comment.Body,
+				CommentCreatedAt: *p.Comment.CreatedAt,
+				Path:             stringValue(p.Comment.Path),
+				Line:             commitCommentLine(e),
+				References:       extractReferences(ctx, router, owner, repo, *p.Comment.Body),
 			}
 
 		case *githubv3.PushEvent:
 			var cs []event.Commit
 			for _, c := range p.Commits {
-				cs = append(cs, commits[*c.SHA])
+				commit, ok := commits[*c.SHA]
+				if !ok {
+					// Not fetched yet, e.g., because the rate budget was used up.
+					commit = event.Commit{SHA: *c.SHA, Message: stringValue(c.Message), AuthorAvatarURL: placeholderAvatarURL}
+				}
+				cs = append(cs, commit)
 			}
-			ee.Container = modulePath
+			ee.Container = r.pushModulePath(*p.Ref, p.Commits)
 			ee.Payload = event.Push{
 				Branch:        strings.TrimPrefix(*p.Ref, "refs/heads/"),
 				Head:          *p.Head,
 				Before:        *p.Before,
 				Commits:       cs,
+				TotalCommits:  *p.Size,
+				Forced:        forced[*e.ID],
 				HeadHTMLURL:   "https://github.com/" + *e.Repo.Name + "/commit/" + *p.Head,
 				BeforeHTMLURL: "https://github.com/" + *e.Repo.Name + "/commit/" + *p.Before,
 			}
@@ -533,14 +1890,15 @@ func convert(
 			case "repository":
 				ee.Container = modulePath
 				ee.Payload = event.Create{
-					Type:        "repository",
+					Type:        event.CreateRepository,
 					Description: *p.Description,
 				}
 			case "branch", "tag":
-				ee.Container = modulePath
+				ee.Container = r.modulePathAt(fullRef(*p.RefType, *p.Ref))
 				ee.Payload = event.Create{
-					Type: *p.RefType,
-					Name: *p.Ref,
+					Type:        event.CreateType(*p.RefType),
+					Name:        *p.Ref,
+					NameHTMLURL: refHTMLURL(*e.Repo.Name, *p.RefType, *p.Ref),
 				}
 
 				//default:
@@ -550,40 +1908,125 @@ func convert(
 				//	Text: *p.Ref,
 				//}
 			}
+		case *githubv3.RepositoryEvent:
+			// The Events API doesn't list RepositoryEvents.
+			// The only ones are renames synthesized by followRenames.
+			from, ok := renamedFrom(e)
+			if *p.Action != "renamed" || !ok {
+				logf("convert: unsupported *githubv3.RepositoryEvent: Action=%v", *p.Action)
+				continue
+			}
+			ee.Container = modulePath
+			ee.Payload = event.Rename{
+				From: "github.com/" + from,
+				To:   "github.com/" + *e.Repo.Name,
+			}
 		case *githubv3.ForkEvent:
 			ee.Container = modulePath
 			ee.Payload = event.Fork{
-				Container: "github.com/" + *p.Forkee.FullName,
+				Container:     "github.com/" + *p.Forkee.FullName,
+				HTMLURL:       stringValue(p.Forkee.HTMLURL),
+				Description:   stringValue(p.Forkee.Description),
+				DefaultBranch: stringValue(p.Forkee.DefaultBranch),
 			}
 		case *githubv3.DeleteEvent:
+			var typ event.DeleteType
+			switch *p.RefType {
+			case "branch":
+				typ = event.DeleteBranch
+			case "tag":
+				typ = event.DeleteTag
+			default:
+				logf("convert: unsupported *githubv3.DeleteEvent: RefType=%v", *p.RefType)
+				continue
+			}
+			var treeURL, compareURL string
+			lastSHA := deletes[*e.ID]
+			if lastSHA != "" {
+				// The ref is gone, but what it pointed to can still be explored by SHA.
+				treeURL = "https://github.com/" + *e.Repo.Name + "/tree/" + lastSHA
+				compareURL = "https://github.com/" + *e.Repo.Name + "/compare/" + lastSHA
+			}
 			ee.Container = modulePath
 			ee.Payload = event.Delete{
-				Type: *p.RefType, // TODO: Verify *p.RefType?
-				Name: *p.Ref,
+				Type:           typ,
+				Name:           *p.Ref,
+				LastSHA:        lastSHA,
+				TreeHTMLURL:    treeURL,
+				CompareHTMLURL: compareURL,
 			}
 
 		case *githubv3.GollumEvent:
 			var pages []event.Page
 			for _, p := range p.Pages {
-				pages = append(pages, event.Page{
-					Action:         *p.Action,
-					SHA:            *p.SHA,
-					Title:          *p.Title,
-					HTMLURL:        *p.HTMLURL + "/" + *p.SHA,
-					CompareHTMLURL: *p.HTMLURL + "/_compare/" + *p.SHA + "^..." + *p.SHA,
-				})
+				pages = append(pages, convertPage(p))
 			}
 			ee.Container = modulePath
 			ee.Payload = event.Wiki{
 				Pages: pages,
 			}
 
+		case *githubv3.ReleaseEvent:
+			if *p.Action != "published" {
+				continue
+			}
+			var name, body string
+			if p.Release.Name != nil {
+				name = *p.Release.Name
+			}
+			if p.Release.Body != nil {
+				body = excerpt(*p.Release.Body, releaseExcerptLength)
+			}
+			ee.Container = modulePath
+			ee.Payload = event.Release{
+				TagName:    *p.Release.TagName,
+				Name:       name,
+				Body:       body,
+				Prerelease: p.Release.Prerelease != nil && *p.Release.Prerelease,
+				HTMLURL:    *p.Release.HTMLURL,
+			}
+
+		case *githubv3.PublicEvent:
+			ee.Container = modulePath
+			ee.Payload = event.Publish{}
+
 		case *githubv3.MemberEvent:
-			// Unsupported event type, skip it.
-			continue
+			switch *p.Action {
+			case "added", "removed":
+			default:
+				logf("convert: unsupported *githubv3.MemberEvent action: %v", *p.Action)
+				continue
+			}
+			ee.Container = modulePath
+			ee.Payload = event.Member{
+				Action: event.MemberAction(*p.Action),
+				Member: users.User{
+					UserSpec:  users.UserSpec{ID: uint64(*p.Member.ID), Domain: "github.com"},
+					Login:     *p.Member.Login,
+					AvatarURL: *p.Member.AvatarURL,
+				},
+			}
+
+		case *sponsorshipEvent:
+			if p.Action != "created" || p.Sponsorship.PrivacyLevel == "private" {
+				continue
+			}
+			sponsorable := p.Sponsorship.Sponsorable
+			// A sponsorship is of a user or an organization, not of the repository
+			// the event is in, so its container is the sponsorable's profile.
+			ee.Container = "github.com/" + sponsorable.Login
+			ee.Payload = event.Sponsor{
+				Sponsorable: users.User{
+					UserSpec:  users.UserSpec{ID: uint64(sponsorable.ID), Domain: "github.com"},
+					Login:     sponsorable.Login,
+					AvatarURL: sponsorable.AvatarURL,
+				},
+				TierName: p.Sponsorship.Tier.Name,
+				HTMLURL:  "https://github.com/sponsors/" + sponsorable.Login,
+			}
 
 		default:
-			log.Printf("convert: unexpected event type: %T\n", p)
+			logf("convert: unexpected event type: %T", p)
 			continue
 		}
 
@@ -592,6 +2035,304 @@ func convert(
 	return es
 }
 
+// parsePayload is like e.ParsePayload, except that it also parses
+// payloads of SponsorshipEvent, which githubv3 doesn't have a type for,
+// to a *sponsorshipEvent.
+func parsePayload(e *githubv3.Event) (interface{}, error) {
+	if *e.Type != "SponsorshipEvent" {
+		return e.ParsePayload()
+	}
+	var p sponsorshipEvent
+	err := json.Unmarshal(*e.RawPayload, &p)
+	return &p, err
+}
+
+// sponsorshipEvent is the payload of a SponsorshipEvent.
+type sponsorshipEvent struct {
+	Action      string `json:"action"`
+	Sponsorship struct {
+		Sponsorable struct {
+			ID        int64  `json:"id"`
+			Login     string `json:"login"`
+			AvatarURL string `json:"avatar_url"`
+		} `json:"sponsorable"`
+		Tier struct {
+			Name string `json:"name"`
+		} `json:"tier"`
+		PrivacyLevel string `json:"privacy_level"`
+	} `json:"sponsorship"`
+}
+
+// pullRequestDraft reports whether the pull request in a PullRequestEvent is a draft.
+// The githubv3.PullRequest type doesn't have the draft field,
+// so it's decoded from the raw event payload.
+func pullRequestDraft(e *githubv3.Event) bool {
+	var p struct {
+		PullRequest struct {
+			Draft bool `json:"draft"`
+		} `json:"pull_request"`
+	}
+	err := json.Unmarshal(*e.RawPayload, &p)
+	if err != nil {
+		// The payload was already parsed successfully by ParsePayload,
+		// so this can't happen.
+		panic(fmt.Errorf("internal error: pullRequestDraft given a githubv3.Event with an invalid payload: %v", err))
+	}
+	return p.PullRequest.Draft
+}
+
+// issuesEventMilestone returns the title of the milestone that the issue
+// in IssuesEvent p was added to or removed from. The githubv3.IssuesEvent type
+// doesn't have the milestone field, so it's decoded from the raw event payload.
+// If the payload doesn't have it, the milestone of the issue is used,
+// which is empty once it's removed from it.
+func issuesEventMilestone(e *githubv3.Event, p *githubv3.IssuesEvent) string {
+	var v struct {
+		Milestone *githubv3.Milestone `json:"milestone"`
+	}
+	err := json.Unmarshal(*e.RawPayload, &v)
+	if err != nil {
+		// The payload was already parsed successfully by ParsePayload,
+		// so this can't happen.
+		panic(fmt.Errorf("internal error: issuesEventMilestone given a githubv3.Event with an invalid payload: %v", err))
+	}
+	if v.Milestone != nil && v.Milestone.Title != nil {
+		return *v.Milestone.Title
+	}
+	return milestoneTitle(p.Issue.Milestone)
+}
+
+// commitCommentLine returns the line in the file that the comment
+// in a CommitCommentEvent is on, or 0 if it's not an inline comment.
+// The githubv3.RepositoryComment type doesn't have the line field,
+// only the position in the diff, so it's decoded from the raw event payload.
+func commitCommentLine(e *githubv3.Event) int {
+	var p struct {
+		Comment struct {
+			Line *int `json:"line"`
+		} `json:"comment"`
+	}
+	err := json.Unmarshal(*e.RawPayload, &p)
+	if err != nil {
+		// The payload was already parsed successfully by ParsePayload,
+		// so this can't happen.
+		panic(fmt.Errorf("internal error: commitCommentLine given a githubv3.Event with an invalid payload: %v", err))
+	}
+	if p.Comment.Line == nil {
+		return 0
+	}
+	return *p.Comment.Line
+}
+
+// releaseExcerptLength is the maximum length of release notes,
+// in runes, included in a release event. Release notes are often long,
+// and the release page has all of them.
+const releaseExcerptLength = 500
+
+// excerpt returns s if it's at most n runes long. Otherwise it returns
+// its first n runes, followed by an ellipsis.
+func excerpt(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i] + "…"
+		}
+		n--
+	}
+	return s
+}
+
+// milestoneTitle returns the title of milestone m,
+// or the empty string if m is nil.
+func milestoneTitle(m *githubv3.Milestone) string {
+	if m == nil {
+		return ""
+	}
+	return *m.Title
+}
+
+// limitCommits returns push event e with its commits limited to
+// the s.pushCommits most recent ones, see WithPushCommits. The size
+// of the push, the total number of commits in it, is kept. Other events,
+// and pushes without more commits, are returned as is.
+func (s *Service) limitCommits(e *githubv3.Event) *githubv3.Event {
+	if s.pushCommits == 0 || *e.Type != "PushEvent" {
+		return e
+	}
+	var p githubv3.PushEvent
+	if err := json.Unmarshal(*e.RawPayload, &p); err != nil || len(p.Commits) <= s.pushCommits {
+		return e
+	}
+	if p.Size == nil {
+		p.Size = githubv3.Int(len(p.Commits))
+	}
+	p.Commits = p.Commits[len(p.Commits)-s.pushCommits:] // Ordered from earliest to most recent.
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return e
+	}
+	limited := *e
+	limited.RawPayload = (*json.RawMessage)(&raw)
+	return &limited
+}
+
+// commentAction converts the action of a comment event,
+// reporting whether it's supported.
+func commentAction(action string) (event.CommentAction, bool) {
+	switch action {
+	case "created":
+		return event.CommentCreated, true
+	case "edited":
+		return event.CommentEdited, true
+	case "deleted":
+		return event.CommentDeleted, true
+	default:
+		return "", false
+	}
+}
+
+// commentBody returns body, the body of a comment as of a comment event
+// with action, or the empty string if the comment was deleted.
+// Deleted comments are listed without their body, like on GitHub.
+func commentBody(action event.CommentAction, body string) string {
+	if action == event.CommentDeleted {
+		return ""
+	}
+	return body
+}
+
+// withoutCommentActions returns the events that aren't comment events
+// of actions besides creating comments, see WithCommentActions.
+func withoutCommentActions(events []*githubv3.Event) []*githubv3.Event {
+	var es []*githubv3.Event
+	for _, e := range events {
+		if *e.Type == "IssueCommentEvent" || *e.Type == "PullRequestReviewCommentEvent" {
+			var p struct {
+				Action string `json:"action"`
+			}
+			if err := json.Unmarshal(*e.RawPayload, &p); err == nil && p.Action != "created" {
+				continue
+			}
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// withoutIssueActions returns the events that aren't issue events
+// of actions besides opening, closing and reopening, see WithIssueActions.
+func withoutIssueActions(events []*githubv3.Event) []*githubv3.Event {
+	var es []*githubv3.Event
+	for _, e := range events {
+		if *e.Type == "IssuesEvent" {
+			var p struct {
+				Action string `json:"action"`
+			}
+			if err := json.Unmarshal(*e.RawPayload, &p); err == nil &&
+				p.Action != "opened" && p.Action != "closed" && p.Action != "reopened" {
+				continue
+			}
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// withoutType returns the events that aren't of type typ.
+func withoutType(events []*githubv3.Event, typ string) []*githubv3.Event {
+	var es []*githubv3.Event
+	for _, e := range events {
+		if *e.Type == typ {
+			continue
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// convertPage converts a GitHub wiki page of a GollumEvent.
+// Its diff statistics aren't known, since GitHub APIs don't serve
+// wiki repositories, but its summary is, if one was given.
+func convertPage(p *githubv3.Page) event.Page {
+	page := event.Page{
+		Action:  event.PageAction(*p.Action),
+		SHA:     *p.SHA,
+		Title:   *p.Title,
+		Summary: stringValue(p.Summary),
+		HTMLURL: *p.HTMLURL + "/" + *p.SHA, // The page as of the revision.
+	}
+	if page.Action == event.PageEdited {
+		// Created pages have no earlier revision to compare with.
+		page.CompareHTMLURL = *p.HTMLURL + "/_compare/" + *p.SHA + "^..." + *p.SHA
+	}
+	return page
+}
+
+// convertLabels converts GitHub labels.
+func convertLabels(ls []githubv3.Label) []event.LabelInfo {
+	var labels []event.LabelInfo
+	for _, l := range ls {
+		labels = append(labels, event.LabelInfo{
+			Name:  *l.Name,
+			Color: *l.Color,
+		})
+	}
+	return labels
+}
+
+// convertLabelPointers is like convertLabels, but for a slice of pointers.
+func convertLabelPointers(ls []*githubv3.Label) []event.LabelInfo {
+	var labels []event.LabelInfo
+	for _, l := range ls {
+		labels = append(labels, event.LabelInfo{
+			Name:  *l.Name,
+			Color: *l.Color,
+		})
+	}
+	return labels
+}
+
+// refHTMLURL returns the URL of a branch or tag named name
+// in the GitHub repository with the "owner/repo" name.
+func refHTMLURL(ownerRepo, refType, name string) string {
+	switch refType {
+	case "tag":
+		return "https://github.com/" + ownerRepo + "/releases/tag/" + name
+	default:
+		return "https://github.com/" + ownerRepo + "/tree/" + name
+	}
+}
+
+// fullRef returns the fully qualified name of a branch or tag,
+// e.g., "refs/heads/master" or "refs/tags/v1.0.0".
+func fullRef(refType, name string) string {
+	switch refType {
+	case "tag":
+		return "refs/tags/" + name
+	default:
+		return "refs/heads/" + name
+	}
+}
+
+// lastPushedSHA returns the head SHA of the most recent push to ref
+// in the repository with repoID, or the empty string if there's none.
+// events must be ordered from most recent to oldest,
+// and contain valid payloads, otherwise lastPushedSHA panics.
+func lastPushedSHA(events []*githubv3.Event, repoID int64, ref string) string {
+	for _, e := range events {
+		if *e.Type != "PushEvent" || *e.Repo.ID != repoID {
+			continue
+		}
+		payload, err := e.ParsePayload()
+		if err != nil {
+			panic(fmt.Errorf("internal error: lastPushedSHA given a githubv3.Event with an invalid payload: %v", err))
+		}
+		if p := payload.(*githubv3.PushEvent); *p.Ref == ref {
+			return *p.Head
+		}
+	}
+	return ""
+}
+
 // splitOwnerRepo splits "owner/repo" into "owner" and "repo".
 func splitOwnerRepo(ownerRepo string) (owner, repo string) {
 	i := strings.IndexByte(ownerRepo, '/')
@@ -602,6 +2343,77 @@ func splitOwnerRepo(ownerRepo string) (owner, repo string) {
 type repository struct {
 	// ModulePath is the module path of the module at the root of the repository.
 	ModulePath string
+
+	// Name is the name of the repository, like "owner/repo", as of NameTime,
+	// the time of the most recent event listed with it. It's empty if it's
+	// not known yet. Renames are noticed by it, see followRenames.
+	Name     string `json:",omitempty"`
+	NameTime time.Time
+
+	// Refs maps refs that events were pushed to or created, like
+	// "refs/heads/dev", to the module path in go.mod there, or the empty
+	// string if there's none. It's replaced rather than modified, since
+	// it's shared between copies of repositories, see copyFetched.
+	Refs map[string]string `json:",omitempty"`
+
+	// Modules maps directories of nested modules in the repository at HEAD,
+	// like "foo/bar", to their module paths, or is nil if they aren't fetched yet.
+	// Like Refs, it's replaced rather than modified.
+	Modules map[string]string
+}
+
+// modulePathAt returns the module path of the module at the root
+// of the repository at ref. It's the one at HEAD, unless go.mod
+// at ref has another one.
+func (r repository) modulePathAt(ref string) string {
+	if modulePath := r.Refs[ref]; modulePath != "" {
+		return modulePath
+	}
+	return r.ModulePath
+}
+
+// withRef returns r with the module path at ref set to modulePath.
+func (r repository) withRef(ref, modulePath string) repository {
+	refs := make(map[string]string, len(r.Refs)+1)
+	for ref, modulePath := range r.Refs {
+		refs[ref] = modulePath
+	}
+	refs[ref] = modulePath
+	r.Refs = refs
+	return r
+}
+
+// withoutUnusedRefs returns r, the repository with repoID,
+// without refs that aren't in used.
+func (r repository) withoutUnusedRefs(repoID int64, used map[repoRef]bool) repository {
+	refs := make(map[string]string)
+	for ref, modulePath := range r.Refs {
+		if used[repoRef{repoID, ref}] {
+			refs[ref] = modulePath
+		}
+	}
+	r.Refs = refs
+	return r
+}
+
+// repoRef is a ref, like "refs/heads/master", in the repository with RepoID.
+type repoRef struct {
+	RepoID int64
+	Ref    string
+}
+
+// eventRef returns the ref that the event with payload was pushed to or created,
+// or the empty string if there's none.
+func eventRef(payload interface{}) string {
+	switch p := payload.(type) {
+	case *githubv3.PushEvent:
+		return *p.Ref
+	case *githubv3.CreateEvent:
+		if *p.RefType == "branch" || *p.RefType == "tag" {
+			return fullRef(*p.RefType, *p.Ref)
+		}
+	}
+	return ""
 }
 
 // splitCommitMessage splits commit message s into subject and body, if any.
@@ -0,0 +1,1522 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/route/github"
+	"dmitri.shuralyov.com/state"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestFetchEventsNotModified(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.URL.Path != "/users/gopher/events/public" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("X-Poll-Interval", "60")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, nil, user, nil, WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func() error {
+		_, _, _, _, _, _, _, pollInterval, err := s.fetchEvents(context.Background(), nil,
+			map[int64]repository{}, map[string]event.Commit{}, map[string]time.Time{}, map[string]string{}, map[string]bool{})
+		if err == nil || err == errNotModified {
+			if got, want := pollInterval.Seconds(), 60.0; got != want {
+				t.Errorf("pollInterval = %vs, want %vs", got, want)
+			}
+		}
+		return err
+	}
+	if err := fetch(); err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	if got, want := s.feeds["users/gopher/events/public"].etag, `"v1"`; got != want {
+		t.Errorf("etag = %q, want %q", got, want)
+	}
+	if err := fetch(); err != errNotModified {
+		t.Errorf("second fetch: got error %v, want errNotModified", err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestClose(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Block until the request is canceled.
+		close(started)
+		<-req.Context().Done()
+		close(canceled)
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, nil, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request in flight wasn't canceled")
+	}
+	if _, err := s.List(context.Background()); err != nil {
+		t.Errorf("List after Close: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	polled := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewService(clV3, nil, user, nil, WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-polled
+
+	// Canceling the parent context stops polling while it waits
+	// for the next poll, a minute away, rather than after it.
+	cancel()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("polling didn't stop once its parent context was canceled")
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	tests := []struct {
+		opts  []Option
+		asked time.Duration
+		want  time.Duration
+	}{
+		{opts: nil, asked: 0, want: time.Minute},
+		{opts: nil, asked: 30 * time.Second, want: time.Minute},
+		{opts: nil, asked: time.Hour, want: time.Hour},
+		{opts: []Option{WithPollInterval(time.Second, 0)}, asked: 0, want: time.Second},
+		{opts: []Option{WithPollInterval(time.Second, 0)}, asked: 30 * time.Second, want: 30 * time.Second},
+		{opts: []Option{WithPollInterval(time.Second, 10*time.Second)}, asked: 30 * time.Second, want: 10 * time.Second},
+	}
+	for _, tc := range tests {
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.pollInterval(tc.asked); got != tc.want {
+			t.Errorf("pollInterval(%v) = %v, want %v", tc.asked, got, tc.want)
+		}
+	}
+
+	for _, bounds := range [][2]time.Duration{{0, 0}, {-time.Second, 0}, {time.Minute, time.Second}, {time.Second, -time.Second}} {
+		_, err := NewService(nil, nil, user, nil, WithPollInterval(bounds[0], bounds[1]))
+		if err == nil {
+			t.Errorf("NewService with poll interval bounds %v: got nil error", bounds)
+		}
+	}
+}
+
+func TestQuietInterval(t *testing.T) {
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	tests := []struct {
+		opts     []Option
+		interval time.Duration
+		quiet    int
+		want     time.Duration
+	}{
+		{interval: time.Minute, quiet: 0, want: time.Minute},
+		{interval: time.Minute, quiet: quietPolls - 1, want: time.Minute},
+		{interval: time.Minute, quiet: quietPolls, want: 2 * time.Minute},
+		{interval: time.Minute, quiet: 2 * quietPolls, want: 4 * time.Minute},
+		{interval: time.Minute, quiet: 100 * quietPolls, want: maxQuietPoll},
+		{interval: time.Hour, quiet: 100 * quietPolls, want: time.Hour},
+		{opts: []Option{WithPollInterval(time.Minute, 3*time.Minute)}, interval: time.Minute, quiet: 2 * quietPolls, want: 3 * time.Minute},
+	}
+	for _, tc := range tests {
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.quietInterval(tc.interval, tc.quiet); got != tc.want {
+			t.Errorf("quietInterval(%v, %d) = %v, want %v", tc.interval, tc.quiet, got, tc.want)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := jitter(time.Minute); got < time.Minute || got > time.Minute+6*time.Second {
+			t.Fatalf("jitter(1m) = %v, want from 1m to 1m6s", got)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fail {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{
+			"type": "WatchEvent",
+			"id": "1",
+			"repo": {"id": 23096959, "name": "golang/go"},
+			"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+			"created_at": "2020-01-02T03:04:05Z",
+			"payload": {"action": "started"}
+		}]`))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, nil, user, nil, WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events, err := s.List(context.Background()); err != nil || len(events) != 0 {
+		t.Fatalf("List before Refresh = %v, %v; want no events", events, err)
+	}
+
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != "1" || events[0].Payload != (event.Star{}) {
+		t.Errorf("List after Refresh = %v, want the star", events)
+	}
+
+	// Fetching the same events again finds no new ones.
+	if _, active, err := s.refresh(context.Background()); err != nil || active {
+		t.Errorf("refresh = %v, %v; want no new events", active, err)
+	}
+
+	// A failed refresh keeps the events, and List reports the error.
+	fail = true
+	if err := s.Refresh(context.Background()); err == nil {
+		t.Error("Refresh: got nil error, want failure")
+	}
+	events, err = s.List(context.Background())
+	if se, ok := err.(*StaleError); !ok || se.LastFetch.IsZero() {
+		t.Errorf("List: got error %v, want a *StaleError with the last fetch", err)
+	}
+	if len(events) != 1 {
+		t.Errorf("List after failed Refresh = %v, want the star", events)
+	}
+
+	// If events were never fetched, there's nothing usable to list.
+	s, err = NewService(clV3, nil, user, nil, WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Refresh(context.Background())
+	events, err = s.List(context.Background())
+	if _, ok := err.(*StaleError); ok || err == nil || len(events) != 0 {
+		t.Errorf("List after only failed Refresh = %v, %v; want no events and the fetch error", events, err)
+	}
+}
+
+func TestRefreshIncomplete(t *testing.T) {
+	var fail bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/graphql":
+			if fail {
+				http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"data": {"n0": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}}}}`))
+		case "/users/gopher/events/public":
+			w.Header().Set("ETag", `"1"`)
+			if req.Header.Get("If-None-Match") == `"1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte(`[{
+				"type": "WatchEvent",
+				"id": "1",
+				"repo": {"id": 1, "name": "owner/repo"},
+				"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+				"created_at": "2020-01-02T03:04:05Z",
+				"payload": {"action": "started"}
+			}]`))
+		case "/repos/owner/repo/git/trees/HEAD":
+			w.Write([]byte(`{"sha": "t", "tree": []}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// If the module path fails to be fetched, the event is listed
+	// with a placeholder, along with the error.
+	fail = true
+	if err := s.Refresh(context.Background()); err == nil {
+		t.Error("Refresh: got nil error, want failure")
+	}
+	events, err := s.List(context.Background())
+	if _, ok := err.(*StaleError); !ok {
+		t.Errorf("List: got error %v, want a *StaleError", err)
+	}
+	if len(events) != 1 || events[0].Container != "github.com/owner/repo" {
+		t.Errorf("List after incomplete Refresh = %v, want the star with a placeholder", events)
+	}
+
+	// It's fetched again, even though the feed hasn't changed.
+	fail = false
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events, err = s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Container != "example.org/repo" {
+		t.Errorf("List after Refresh = %v, want the star in example.org/repo", events)
+	}
+}
+
+func TestOrganization(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/orgs/golang/events" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{
+			"type": "WatchEvent",
+			"id": "1",
+			"repo": {"id": 23096959, "name": "golang/go"},
+			"actor": {"id": 3, "login": "other", "avatar_url": "https://example.org/other"},
+			"created_at": "2020-01-02T03:04:05Z",
+			"payload": {"action": "started"}
+		}]`))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, nil, user, nil, WithOrganization("golang"), WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Actor.Login != "other" {
+		t.Errorf("List = %v, want the star by other", events)
+	}
+
+	for _, tc := range []struct {
+		repo string
+		want bool
+	}{
+		{repo: "golang/go", want: true},
+		{repo: "GoLang/tools", want: true},
+		{repo: "gopher/go", want: false},
+	} {
+		e := &githubv3.Event{
+			Repo:  &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String(tc.repo)},
+			Actor: &githubv3.User{ID: githubv3.Int64(2)},
+		}
+		if got := s.lists(e); got != tc.want {
+			t.Errorf("lists(event in %s) = %v, want %v", tc.repo, got, tc.want)
+		}
+	}
+}
+
+func TestEventsPaths(t *testing.T) {
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	other := users.User{UserSpec: users.UserSpec{ID: 3, Domain: "github.com"}, Login: "other"}
+	tests := []struct {
+		opts []Option
+		want []string
+	}{
+		{opts: nil, want: []string{"users/gopher/events/public"}},
+		{opts: []Option{WithOrganization("golang")}, want: []string{"orgs/golang/events"}},
+		{opts: []Option{WithReceivedEvents()}, want: []string{"users/gopher/received_events/public"}},
+		{opts: []Option{WithReceivedEvents(), WithOrganization("golang")}, want: []string{"orgs/golang/events"}},
+		{opts: []Option{WithOrganization("golang"), WithReceivedEvents()}, want: []string{"users/gopher/received_events/public"}},
+		{opts: []Option{WithUsers(other)}, want: []string{"users/gopher/events/public", "users/other/events/public"}},
+		{opts: []Option{WithUsers(other), WithOrganization("golang")}, want: []string{"orgs/golang/events"}},
+		{opts: []Option{WithOrganization("golang"), WithUsers(other)}, want: []string{"users/gopher/events/public", "users/other/events/public"}},
+		{opts: []Option{WithPrivateEvents(false)}, want: []string{"users/gopher/events"}},
+		{opts: []Option{WithPrivateEvents(false), WithOrganization("golang")}, want: []string{"users/gopher/events/orgs/golang"}},
+		{opts: []Option{WithPrivateEvents(false), WithReceivedEvents()}, want: []string{"users/gopher/received_events"}},
+		{opts: []Option{WithPrivateEvents(true), WithUsers(other)}, want: []string{"users/gopher/events", "users/other/events"}},
+	}
+	for _, tc := range tests {
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.eventsPaths(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("eventsPaths = %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestWithUsers(t *testing.T) {
+	// Feeds of users by login. Event 2 is in both.
+	feeds := map[string]string{
+		"gopher": `[` + watchEvent("3", 2, "2020-01-02T03:04:07Z") + `, ` + watchEvent("2", 2, "2020-01-02T03:04:06Z") + `]`,
+		"other":  `[` + watchEvent("2", 2, "2020-01-02T03:04:06Z") + `, ` + watchEvent("1", 3, "2020-01-02T03:04:05Z") + `]`,
+	}
+	requests := make(map[string]int) // Login -> Requests, other than conditional ones that aren't modified.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		login := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/users/"), "/events/public")
+		etag := fmt.Sprintf(`"%d"`, len(feeds[login]))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		requests[login]++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(feeds[login]))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	other := users.User{UserSpec: users.UserSpec{ID: 3, Domain: "github.com"}, Login: "other"}
+	if _, err := NewService(clV3, nil, user, nil, WithoutPolling(), WithUsers(users.User{Login: "elsewhere"})); err == nil {
+		t.Error("NewService with a user not on github.com: got nil error, want failure")
+	}
+	s, err := NewService(clV3, nil, user, nil, WithoutPolling(), WithUsers(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func() []string {
+		events, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(), []string{"3", "2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+
+	// Only the feed that changed is fetched again.
+	feeds["other"] = `[` + watchEvent("4", 3, "2020-01-02T03:04:08Z") + `, ` + feeds["other"][1:]
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(), []string{"4", "3", "2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after other user's event = %v, want %v", got, want)
+	}
+	if want := map[string]int{"gopher": 1, "other": 2}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+
+	// Webhook deliveries of events performed by any of the users are listed.
+	if e := (&githubv3.Event{Actor: &githubv3.User{ID: githubv3.Int64(3)}}); !s.lists(e) {
+		t.Error("lists = false for other user's event, want true")
+	}
+}
+
+// watchEvent returns a JSON-encoded WatchEvent in the golang/go repository,
+// with the specified ID, performed by the user with actorID at the time createdAt.
+func watchEvent(id string, actorID int64, createdAt string) string {
+	return fmt.Sprintf(`{
+		"type": "WatchEvent",
+		"id": %q,
+		"repo": {"id": 23096959, "name": "golang/go"},
+		"actor": {"id": %d, "login": "user%d", "avatar_url": "https://example.org/avatar"},
+		"created_at": %q,
+		"payload": {"action": "started"}
+	}`, id, actorID, actorID, createdAt)
+}
+
+func TestPages(t *testing.T) {
+	// Page 2 repeats the last event of page 1,
+	// as if an event happened while pages were fetched.
+	pages := map[string][]string{"1": {"5", "4"}, "2": {"4", "3", "2"}, "3": {"1"}}
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		page := req.URL.Query().Get("page")
+		ids, ok := pages[page]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if page != "3" {
+			next := *req.URL
+			next.RawQuery = "per_page=100&page=" + string(page[0]+1)
+			w.Header().Set("Link", `<http://`+req.Host+next.String()+`>; rel="next"`)
+		}
+		var events []string
+		for _, id := range ids {
+			events = append(events, `{
+				"type": "WatchEvent",
+				"id": "`+id+`",
+				"repo": {"id": 23096959, "name": "golang/go"},
+				"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+				"created_at": "2020-01-02T03:04:0`+id+`Z",
+				"payload": {"action": "started"}
+			}`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[" + strings.Join(events, ",") + "]"))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+
+	tests := []struct {
+		opts         []Option
+		want         []string // Event IDs.
+		wantRequests int
+	}{
+		{opts: nil, want: []string{"5", "4", "3", "2", "1"}, wantRequests: 3},
+		{opts: []Option{WithPages(2)}, want: []string{"5", "4", "3", "2"}, wantRequests: 2},
+		{opts: []Option{WithPages(1)}, want: []string{"5", "4"}, wantRequests: 1},
+	}
+	for _, tc := range tests {
+		requests = 0
+		s, err := NewService(clV3, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Refresh(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got events %v, want %v", got, tc.want)
+		}
+		if requests != tc.wantRequests {
+			t.Errorf("got %d requests, want %d", requests, tc.wantRequests)
+		}
+	}
+
+	for _, n := range []int{0, 4} {
+		_, err := NewService(clV3, nil, user, nil, WithPages(n))
+		if err == nil {
+			t.Errorf("NewService with %d pages: got nil error", n)
+		}
+	}
+}
+
+func TestFetchByName(t *testing.T) {
+	// Repository 1 was renamed from owner/old to owner/new,
+	// and repository 2 took its old name. Only querying by ID finds it.
+	var byID int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var in struct {
+			Query     string
+			Variables map[string]string
+		}
+		err := json.NewDecoder(req.Body).Decode(&in)
+		if err != nil {
+			t.Errorf("decoding query: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(in.Query, "node(id:$repoID)"):
+			byID++
+			w.Write([]byte(`{"data": {"node": {"databaseId": 1, "object": {"text": "module example.org/old\n"}}}}`))
+		case strings.Contains(in.Query, "node(id:$commitID)"):
+			byID++
+			w.Write([]byte(`{"data": {"node": {"oid": "aaa", "message": "A."}}}`))
+		case in.Variables["name"] == "old" && strings.Contains(in.Query, "object(oid:$oid)"):
+			w.Write([]byte(`{"data": {"repository": {"object": null}}}`))
+		case in.Variables["name"] == "old":
+			w.Write([]byte(`{"data": {"repository": {"databaseId": 2, "object": {"text": "module example.org/reused\n"}}}}`))
+		case in.Variables["name"] == "new" && strings.Contains(in.Query, "object(oid:$oid)"):
+			w.Write([]byte(`{"data": {"repository": {"object": {"oid": "aaa", "message": "A."}}}}`))
+		case in.Variables["name"] == "new":
+			w.Write([]byte(`{"data": {"repository": {"databaseId": 1, "object": {"text": "module example.org/new\n"}}}}`))
+		default:
+			w.Write([]byte(`{"data": {"repository": null}, "errors": [{"message": "Could not resolve to a Repository with the name 'owner/` + in.Variables["name"] + `'."}]}`))
+		}
+	}))
+	defer ts.Close()
+	s := &Service{clV4: githubv4.NewEnterpriseClient(ts.URL, nil), logf: t.Logf}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		repoName string
+		want     string
+		wantByID int
+	}{
+		{"owner/new", "example.org/new", 0},
+		{"owner/old", "example.org/old", 1},
+		{"owner/deleted", "example.org/old", 1},
+	} {
+		byID = 0
+		got, err := s.fetchModulePath(ctx, 1, tc.repoName)
+		if err != nil {
+			t.Fatalf("fetchModulePath(%q): %v", tc.repoName, err)
+		}
+		if got != tc.want || byID != tc.wantByID {
+			t.Errorf("fetchModulePath(%q) = %q with %d queries by ID, want %q with %d", tc.repoName, got, byID, tc.want, tc.wantByID)
+		}
+	}
+	for _, tc := range []struct {
+		repoName string
+		wantByID int
+	}{
+		{"owner/new", 0},
+		{"owner/old", 1},
+		{"owner/deleted", 1},
+	} {
+		byID = 0
+		got, err := s.fetchCommit(ctx, 1, tc.repoName, "aaa")
+		if err != nil {
+			t.Fatalf("fetchCommit(%q): %v", tc.repoName, err)
+		}
+		if want := (event.Commit{SHA: "aaa", Message: "A."}); got != want || byID != tc.wantByID {
+			t.Errorf("fetchCommit(%q) = %+v with %d queries by ID, want %+v with %d", tc.repoName, got, byID, want, tc.wantByID)
+		}
+	}
+}
+
+func TestConvertPullRequestReview(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	review := func(state, body string) *githubv3.Event {
+		return &githubv3.Event{
+			Type: githubv3.String("PullRequestReviewEvent"),
+			RawPayload: rawMessage(`{
+				"action": "created",
+				"review": {"id": 7, "state": "` + state + `", "body": ` + body + `, "submitted_at": "2020-01-02T03:04:05Z"},
+				"pull_request": {"number": 3, "state": "open", "title": "Add feature."}
+			}`),
+			Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt: &at,
+			ID:        githubv3.String("1"),
+		}
+	}
+	tests := []struct {
+		e    *githubv3.Event
+		want []event.Event
+	}{
+		{e: review("approved", "null"), want: []event.Event{wantReview(state.ReviewPlus2, "")}},
+		{e: review("changes_requested", `"See #1."`), want: []event.Event{wantReview(state.ReviewMinus2, "See #1.", event.Reference{Container: "github.com/owner/repo", Number: 1, HTMLURL: "https://github.com/owner/repo/issues/1"})}},
+		{e: review("commented", `"Looks good so far."`), want: []event.Event{wantReview(state.ReviewNoScore, "Looks good so far.")}},
+		{e: review("commented", `""`), want: nil}, // Only review comments.
+		{e: review("dismissed", `""`), want: nil},
+	}
+	for _, tc := range tests {
+		got := convert(context.Background(), []*githubv3.Event{tc.e},
+			map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("convert:\ngot  %+v\nwant %+v", got, tc.want)
+		}
+	}
+}
+
+// wantReview returns the event that TestConvertPullRequestReview
+// wants for a review with the specified score, body and references.
+func wantReview(review state.Review, body string, refs ...event.Reference) event.Event {
+	return event.Event{
+		ID:        "1",
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.ChangeComment{
+			ChangeTitle:      "Add feature.",
+			ChangeState:      state.ChangeOpen,
+			CommentID:        7,
+			CommentBody:      body,
+			CommentReview:    review,
+			CommentCreatedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			CommentHTMLURL:   "https://github.com/owner/repo/pull/3#pullrequestreview-7",
+			References:       refs,
+		},
+	}
+}
+
+func TestConvertRelease(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &githubv3.Event{
+		Type: githubv3.String("ReleaseEvent"),
+		RawPayload: rawMessage(`{
+			"action": "published",
+			"release": {"id": 7, "tag_name": "v1.0.0", "name": "Version 1", "body": "` + strings.Repeat("é", releaseExcerptLength+1) + `", "prerelease": false, "html_url": "https://github.com/owner/repo/releases/tag/v1.0.0"}
+		}`),
+		Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt: &at,
+		ID:        githubv3.String("1"),
+	}
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "1",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Release{
+			TagName: "v1.0.0",
+			Name:    "Version 1",
+			Body:    strings.Repeat("é", releaseExcerptLength) + "…",
+			HTMLURL: "https://github.com/owner/repo/releases/tag/v1.0.0",
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestConvertFork(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &githubv3.Event{
+		Type:       githubv3.String("ForkEvent"),
+		RawPayload: rawMessage(`{"forkee": {"full_name": "gopher/repo", "html_url": "https://github.com/gopher/repo", "description": "A repository.", "default_branch": "main"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("1"),
+	}
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "1",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Fork{
+			Container:     "github.com/gopher/repo",
+			HTMLURL:       "https://github.com/gopher/repo",
+			Description:   "A repository.",
+			DefaultBranch: "main",
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestConvertDelete(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	deleteEvent := func(id, refType, ref string) *githubv3.Event {
+		return &githubv3.Event{
+			Type:       githubv3.String("DeleteEvent"),
+			RawPayload: rawMessage(`{"ref": "` + ref + `", "ref_type": "` + refType + `"}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(id),
+		}
+	}
+	pushEvent := &githubv3.Event{
+		Type:       githubv3.String("PushEvent"),
+		RawPayload: rawMessage(`{"ref": "refs/heads/fix", "head": "bbb", "before": "aaa", "size": 0, "commits": []}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		ID:         githubv3.String("0"),
+	}
+	if got, want := lastPushedSHA([]*githubv3.Event{pushEvent}, 1, fullRef("branch", "fix")), "bbb"; got != want {
+		t.Errorf("lastPushedSHA = %q, want %q", got, want)
+	}
+
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	deletes := map[string]string{"branch": "bbb", "tag": ""}
+	for _, tc := range []struct {
+		in   *githubv3.Event
+		want event.Payload // Nil if the event isn't converted.
+	}{
+		{
+			in: deleteEvent("branch", "branch", "fix"),
+			want: event.Delete{
+				Type:           event.DeleteBranch,
+				Name:           "fix",
+				LastSHA:        "bbb",
+				TreeHTMLURL:    "https://github.com/owner/repo/tree/bbb",
+				CompareHTMLURL: "https://github.com/owner/repo/compare/bbb",
+			},
+		},
+		{
+			in:   deleteEvent("tag", "tag", "v1.0.0"),
+			want: event.Delete{Type: event.DeleteTag, Name: "v1.0.0"},
+		},
+		{
+			in:   deleteEvent("repository", "repository", ""),
+			want: nil,
+		},
+	} {
+		got := convert(context.Background(), []*githubv3.Event{tc.in}, repos, nil, nil, deletes, nil, github.DotCom{}, t.Logf)
+		var want []event.Event
+		if tc.want != nil {
+			want = []event.Event{{
+				ID:        *tc.in.ID,
+				Time:      at,
+				Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+				Container: "example.org/repo",
+				Payload:   tc.want,
+			}}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", *tc.in.ID, got, want)
+		}
+		for _, e := range got {
+			if err := e.Validate(); err != nil {
+				t.Errorf("%s: Validate: %v", *tc.in.ID, err)
+			}
+		}
+	}
+}
+
+func TestConvertWiki(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &githubv3.Event{
+		Type: githubv3.String("GollumEvent"),
+		RawPayload: rawMessage(`{"pages": [
+			{"page_name": "Home", "title": "Home", "summary": "Document installation.", "action": "edited", "sha": "bbb", "html_url": "https://github.com/owner/repo/wiki/Home"},
+			{"page_name": "FAQ", "title": "FAQ", "summary": null, "action": "created", "sha": "ccc", "html_url": "https://github.com/owner/repo/wiki/FAQ"}
+		]}`),
+		Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt: &at,
+		ID:        githubv3.String("1"),
+	}
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "1",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Wiki{Pages: []event.Page{
+			{
+				Action:         event.PageEdited,
+				SHA:            "bbb",
+				Title:          "Home",
+				Summary:        "Document installation.",
+				HTMLURL:        "https://github.com/owner/repo/wiki/Home/bbb",
+				CompareHTMLURL: "https://github.com/owner/repo/wiki/Home/_compare/bbb^...bbb",
+			},
+			{
+				Action:  event.PageCreated,
+				SHA:     "ccc",
+				Title:   "FAQ",
+				HTMLURL: "https://github.com/owner/repo/wiki/FAQ/ccc",
+			},
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+	for _, e := range got {
+		if err := e.Validate(); err != nil {
+			t.Errorf("Validate: %v", err)
+		}
+	}
+}
+
+func TestConvertCommitComment(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	commit := event.Commit{SHA: "aaa", Message: "Add feature.", AuthorAvatarURL: "https://example.org/avatar"}
+	for _, tc := range []struct {
+		name     string
+		comment  string
+		wantPath string
+		wantLine int
+	}{
+		{"inline", `"path": "foo.go", "position": 3, "line": 42`, "foo.go", 42},
+		{"on commit", `"path": null, "position": null, "line": null`, "", 0},
+	} {
+		e := &githubv3.Event{
+			Type:       githubv3.String("CommitCommentEvent"),
+			RawPayload: rawMessage(`{"comment": {"id": 1, "commit_id": "aaa", "body": "Nice.", "created_at": "2020-01-02T03:04:05Z", ` + tc.comment + `}}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("1"),
+		}
+		got := convert(context.Background(), []*githubv3.Event{e},
+			map[int64]repository{1: {ModulePath: "example.org/repo"}}, map[string]event.Commit{"aaa": commit}, nil, nil, nil, github.DotCom{}, t.Logf)
+		want := []event.Event{{
+			ID:        "1",
+			Time:      at,
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+			Container: "example.org/repo",
+			Payload: event.CommitComment{
+				Commit:           commit,
+				CommentID:        1,
+				CommentBody:      "Nice.",
+				CommentCreatedAt: at,
+				Path:             tc.wantPath,
+				Line:             tc.wantLine,
+			},
+		}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", tc.name, got, want)
+		}
+	}
+}
+
+func TestConvertPullRequestDraft(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, draft := range []bool{false, true} {
+		e := &githubv3.Event{
+			Type: githubv3.String("PullRequestEvent"),
+			RawPayload: rawMessage(`{
+				"action": "opened",
+				"pull_request": {"number": 1, "title": "Add feature.", "body": "", "merged": false, "draft": ` + fmt.Sprint(draft) + `, "base": {"ref": "master"}, "head": {"ref": "feature"}}
+			}`),
+			Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt: &at,
+			ID:        githubv3.String("1"),
+		}
+		got := convert(context.Background(), []*githubv3.Event{e},
+			map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if len(got) != 1 {
+			t.Fatalf("draft=%v: got %d events, want 1", draft, len(got))
+		}
+		if got := got[0].Payload.(event.Change); got.Action != event.ChangeOpened || got.Draft != draft {
+			t.Errorf("draft=%v: got Action %q and Draft %v, want %q and %v", draft, got.Action, got.Draft, event.ChangeOpened, draft)
+		}
+	}
+}
+
+// TestConvertPullRequestUnsupported tests that pull request events
+// with actions that have no change action, like "synchronize", are skipped.
+func TestConvertPullRequestUnsupported(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var events []*githubv3.Event
+	for i, action := range []string{"edited", "synchronize", "opened"} {
+		events = append(events, &githubv3.Event{
+			Type: githubv3.String("PullRequestEvent"),
+			RawPayload: rawMessage(`{
+				"action": "` + action + `",
+				"pull_request": {"number": 1, "title": "Add feature.", "body": "", "merged": false, "base": {"ref": "master"}, "head": {"ref": "feature"}}
+			}`),
+			Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt: &at,
+			ID:        githubv3.String(fmt.Sprint(i)),
+		})
+	}
+	got := convert(context.Background(), events,
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	if len(got) != 1 || got[0].ID != "2" {
+		t.Fatalf("got %d events, want only the opened one: %+v", len(got), got)
+	}
+	if err := got[0].Validate(); err != nil {
+		t.Errorf("converted event is invalid: %v", err)
+	}
+}
+
+func TestConvertPullRequestComment(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	const prURL = "https://api.github.com/repos/owner/repo/pulls/1"
+	for _, tc := range []struct {
+		name     string
+		state    string    // Issue state at the time of comment.
+		mergedAt time.Time // Zero if not merged, or not fetched.
+		want     state.Change
+	}{
+		{"open", "open", at.Add(time.Hour), state.ChangeOpen},
+		{"closed", "closed", time.Time{}, state.ChangeClosed},
+		{"merged", "closed", at.Add(-time.Hour), state.ChangeMerged},
+		{"closed, then reopened and merged", "closed", at.Add(time.Hour), state.ChangeClosed},
+	} {
+		e := &githubv3.Event{
+			Type: githubv3.String("IssueCommentEvent"),
+			RawPayload: rawMessage(`{
+				"action": "created",
+				"issue": {"number": 1, "title": "Add feature.", "state": "` + tc.state + `", "pull_request": {"url": "` + prURL + `"}},
+				"comment": {"id": 2, "body": "Nice.", "created_at": "2020-01-02T03:04:05Z"}
+			}`),
+			Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt: &at,
+			ID:        githubv3.String("1"),
+		}
+		prs := map[string]time.Time{}
+		if !tc.mergedAt.IsZero() {
+			prs[prURL] = tc.mergedAt
+		}
+		got := convert(context.Background(), []*githubv3.Event{e},
+			map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, prs, nil, nil, github.DotCom{}, t.Logf)
+		if len(got) != 1 {
+			t.Fatalf("%s: got %d events, want 1", tc.name, len(got))
+		}
+		if got := got[0].Payload.(event.ChangeComment).ChangeState; got != tc.want {
+			t.Errorf("%s: got ChangeState %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConvertModulePathAtRef(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	repos := map[int64]repository{1: {
+		ModulePath: "example.org/repo",
+		Refs: map[string]string{
+			"refs/heads/v2":    "example.org/repo/v2",
+			"refs/tags/v0.1.0": "", // No go.mod file there.
+		},
+	}}
+	for _, tc := range []struct {
+		typ     string
+		payload string
+		want    string // Container.
+	}{
+		{"PushEvent", `{"ref": "refs/heads/v2", "head": "bbb", "before": "aaa", "size": 0, "commits": []}`, "example.org/repo/v2"},
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 0, "commits": []}`, "example.org/repo"},
+		{"CreateEvent", `{"ref": "v2", "ref_type": "branch"}`, "example.org/repo/v2"},
+		{"CreateEvent", `{"ref": "v0.1.0", "ref_type": "tag"}`, "example.org/repo"},
+	} {
+		e := &githubv3.Event{
+			Type:       githubv3.String(tc.typ),
+			RawPayload: rawMessage(tc.payload),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("1"),
+		}
+		got := convert(context.Background(), []*githubv3.Event{e}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if len(got) != 1 || got[0].Container != tc.want {
+			t.Errorf("%s %s: got %+v, want Container %q", tc.typ, tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestConvertPublic(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &githubv3.Event{
+		Type:       githubv3.String("PublicEvent"),
+		RawPayload: rawMessage(`{}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("1"),
+	}
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "1",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload:   event.Publish{},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestConvertMember(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	memberEvent := func(action string) *githubv3.Event {
+		return &githubv3.Event{
+			Type:       githubv3.String("MemberEvent"),
+			RawPayload: rawMessage(`{"action": "` + action + `", "member": {"id": 3, "login": "collaborator", "avatar_url": "https://example.org/collaborator"}}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(action),
+		}
+	}
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	member := users.User{UserSpec: users.UserSpec{ID: 3, Domain: "github.com"}, Login: "collaborator", AvatarURL: "https://example.org/collaborator"}
+	for _, tc := range []struct {
+		action string
+		want   []event.Event
+	}{
+		{"added", []event.Event{{
+			ID:        "added",
+			Time:      at,
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+			Container: "example.org/repo",
+			Payload:   event.Member{Action: event.MemberAdded, Member: member},
+		}}},
+		{"removed", []event.Event{{
+			ID:        "removed",
+			Time:      at,
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+			Container: "example.org/repo",
+			Payload:   event.Member{Action: event.MemberRemoved, Member: member},
+		}}},
+		{"edited", nil},
+	} {
+		got := convert(context.Background(), []*githubv3.Event{memberEvent(tc.action)}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestWithoutMemberEvents(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []*githubv3.Event{{
+		Type:       githubv3.String("MemberEvent"),
+		RawPayload: rawMessage(`{"action": "added", "member": {"id": 3, "login": "collaborator", "avatar_url": "https://example.org/collaborator"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(goRepoID), Name: githubv3.String("golang/go")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("2"),
+	}, {
+		Type:       githubv3.String("WatchEvent"),
+		RawPayload: rawMessage(`{"action": "started"}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(goRepoID), Name: githubv3.String("golang/go")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("1"),
+	}}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string // Event IDs.
+	}{
+		{"default", nil, []string{"2", "1"}},
+		{"without member events", []Option{WithoutMemberEvents()}, []string{"1"}},
+	} {
+		user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.events = events
+		listed, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range listed {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: List = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConvertIssueActions(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	issuesEvent := func(action, fields string) *githubv3.Event {
+		return &githubv3.Event{
+			Type:       githubv3.String("IssuesEvent"),
+			RawPayload: rawMessage(`{"action": "` + action + `", "issue": {"number": 1, "title": "Title.", "body": "Body."}` + fields + `}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(action),
+		}
+	}
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	const issueURL = "https://github.com/owner/repo/issues/1"
+	for _, tc := range []struct {
+		in   *githubv3.Event
+		want event.Payload // Nil if the event isn't converted.
+	}{
+		{
+			in:   issuesEvent("assigned", `, "assignee": {"id": 3, "login": "collaborator", "avatar_url": "https://example.org/collaborator"}`),
+			want: event.Assign{Action: event.AssignAssigned, Assignee: users.User{UserSpec: users.UserSpec{ID: 3, Domain: "github.com"}, Login: "collaborator", AvatarURL: "https://example.org/collaborator"}, IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("unlabeled", `, "label": {"name": "bug", "color": "fc2929"}`),
+			want: event.Label{Action: event.LabelUnlabeled, Label: event.LabelInfo{Name: "bug", Color: "fc2929"}, IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("milestoned", `, "milestone": {"title": "v1.0.0"}`),
+			want: event.Milestone{Action: event.MilestoneMilestoned, Milestone: "v1.0.0", IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("demilestoned", ``),
+			want: event.Milestone{Action: event.MilestoneDemilestoned, IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("transferred", ``),
+			want: event.Transfer{IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("pinned", ``),
+			want: event.Issue{Action: event.IssuePinned, IssueNumber: 1, IssueTitle: "Title.", IssueHTMLURL: issueURL},
+		},
+		{
+			in:   issuesEvent("locked", ``),
+			want: nil,
+		},
+	} {
+		got := convert(context.Background(), []*githubv3.Event{tc.in}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		var want []event.Event
+		if tc.want != nil {
+			want = []event.Event{{
+				ID:        *tc.in.ID,
+				Time:      at,
+				Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+				Container: "example.org/repo",
+				Payload:   tc.want,
+			}}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", *tc.in.ID, got, want)
+		}
+		for _, e := range got {
+			if err := e.Validate(); err != nil {
+				t.Errorf("%s: Validate: %v", *tc.in.ID, err)
+			}
+		}
+	}
+
+	// Unless WithIssueActions is used, only opening, closing and reopening are listed.
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string // Event IDs.
+	}{
+		{"default", nil, []string{"opened"}},
+		{"with issue actions", []Option{WithIssueActions()}, []string{"opened", "labeled"}},
+	} {
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.events = []*githubv3.Event{issuesEvent("opened", ``), issuesEvent("labeled", `, "label": {"name": "bug", "color": "fc2929"}`)}
+		listed, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range listed {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: List = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConvertCommentActions(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	commentEvent := func(typ, id, payload string) *githubv3.Event {
+		return &githubv3.Event{
+			Type:       githubv3.String(typ),
+			RawPayload: rawMessage(payload),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(id),
+		}
+	}
+	const comment = `"comment": {"id": 5, "body": "Body.", "created_at": "2020-01-01T00:00:00Z"}`
+	issueComment := func(action string) *githubv3.Event {
+		return commentEvent("IssueCommentEvent", "issue-"+action, `{"action": "`+action+`", "issue": {"number": 1, "title": "Title.", "state": "open"}, `+comment+`}`)
+	}
+	prComment := func(action string) *githubv3.Event {
+		return commentEvent("IssueCommentEvent", "pr-"+action, `{"action": "`+action+`", "issue": {"number": 1, "title": "Title.", "state": "open", "pull_request": {"url": "https://api.github.com/repos/owner/repo/pulls/1"}}, `+comment+`}`)
+	}
+	reviewComment := func(action string) *githubv3.Event {
+		return commentEvent("PullRequestReviewCommentEvent", "review-"+action, `{"action": "`+action+`", "pull_request": {"number": 1, "title": "Title.", "state": "closed"}, `+comment+`}`)
+	}
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	for _, tc := range []struct {
+		in   *githubv3.Event
+		want event.Payload // Nil if the event isn't converted.
+	}{
+		{
+			in:   issueComment("created"),
+			want: event.IssueComment{Action: event.CommentCreated, IssueNumber: 1, IssueTitle: "Title.", IssueState: state.IssueOpen, CommentID: 5, CommentBody: "Body.", CommentCreatedAt: createdAt, CommentHTMLURL: "https://github.com/owner/repo/issues/1#issuecomment-5"},
+		},
+		{
+			in:   issueComment("edited"),
+			want: event.IssueComment{Action: event.CommentEdited, IssueNumber: 1, IssueTitle: "Title.", IssueState: state.IssueOpen, CommentID: 5, CommentBody: "Body.", CommentCreatedAt: createdAt, CommentHTMLURL: "https://github.com/owner/repo/issues/1#issuecomment-5"},
+		},
+		{
+			in:   prComment("deleted"),
+			want: event.ChangeComment{Action: event.CommentDeleted, ChangeTitle: "Title.", ChangeState: state.ChangeOpen, CommentID: 5, CommentCreatedAt: createdAt, CommentHTMLURL: "https://github.com/owner/repo/pull/1#issuecomment-5"},
+		},
+		{
+			in:   reviewComment("edited"),
+			want: event.ChangeComment{Action: event.CommentEdited, ChangeTitle: "Title.", ChangeState: state.ChangeClosed, CommentID: 5, CommentBody: "Body.", CommentCreatedAt: createdAt, CommentHTMLURL: "https://github.com/owner/repo/pull/1#discussion_r5"},
+		},
+		{
+			in:   reviewComment("deleted"),
+			want: event.ChangeComment{Action: event.CommentDeleted, ChangeTitle: "Title.", ChangeState: state.ChangeClosed, CommentID: 5, CommentCreatedAt: createdAt, CommentHTMLURL: "https://github.com/owner/repo/pull/1#discussion_r5"},
+		},
+		{
+			in:   issueComment("pinned"),
+			want: nil,
+		},
+	} {
+		got := convert(context.Background(), []*githubv3.Event{tc.in}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		var want []event.Event
+		if tc.want != nil {
+			want = []event.Event{{
+				ID:        *tc.in.ID,
+				Time:      at,
+				Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+				Container: "example.org/repo",
+				Payload:   tc.want,
+			}}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", *tc.in.ID, got, want)
+		}
+		for _, e := range got {
+			if err := e.Validate(); err != nil {
+				t.Errorf("%s: Validate: %v", *tc.in.ID, err)
+			}
+		}
+	}
+
+	// Unless WithCommentActions is used, only creating comments is listed.
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string // Event IDs.
+	}{
+		{"default", nil, []string{"issue-created"}},
+		{"with comment actions", []Option{WithCommentActions()}, []string{"issue-created", "issue-edited", "review-deleted"}},
+	} {
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.events = []*githubv3.Event{issueComment("created"), issueComment("edited"), reviewComment("deleted")}
+		listed, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range listed {
+			got = append(got, e.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: List = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWithPushCommits(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pushEvent := func(id string, shas ...string) *githubv3.Event {
+		var commits []string
+		for _, sha := range shas {
+			commits = append(commits, `{"sha": "`+sha+`", "message": "Commit `+sha+`."}`)
+		}
+		return &githubv3.Event{
+			Type:       githubv3.String("PushEvent"),
+			RawPayload: rawMessage(`{"ref": "refs/heads/master", "head": "ccc", "before": "000", "size": 30, "commits": [` + strings.Join(commits, ", ") + `]}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(id),
+		}
+	}
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	if _, err := NewService(nil, nil, user, nil, WithPushCommits(-1), WithoutPolling()); err == nil {
+		t.Error("NewService: got nil error for negative push commits, want non-nil")
+	}
+	s, err := NewService(nil, nil, user, nil, WithPushCommits(2), WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pushes of few enough commits are kept as is.
+	if e := pushEvent("1", "bbb", "ccc"); s.limitCommits(e) != e {
+		t.Error("limitCommits: got a different push of 2 commits, want the same one")
+	}
+
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	got := convert(context.Background(), []*githubv3.Event{s.limitCommits(pushEvent("2", "aaa", "bbb", "ccc"))}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	if len(got) != 1 {
+		t.Fatalf("convert: got %d events, want 1", len(got))
+	}
+	p, ok := got[0].Payload.(event.Push)
+	if !ok {
+		t.Fatalf("convert: got payload %T, want event.Push", got[0].Payload)
+	}
+	var shas []string
+	for _, c := range p.Commits {
+		shas = append(shas, c.SHA)
+	}
+	if want := []string{"bbb", "ccc"}; !reflect.DeepEqual(shas, want) {
+		t.Errorf("got commits %v, want the most recent %v", shas, want)
+	}
+	if p.TotalCommits != 30 || !p.Truncated() {
+		t.Errorf("got TotalCommits %d, want the total of 30", p.TotalCommits)
+	}
+}
+
+func TestWithLogf(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var logged []string
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(nil, nil, user, nil, WithoutPolling(), WithLogf(func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events = []*githubv3.Event{{
+		Type:       githubv3.String("MemberEvent"),
+		RawPayload: rawMessage(`{"action": "edited", "member": {"id": 3, "login": "collaborator", "avatar_url": "https://example.org/collaborator"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(goRepoID), Name: githubv3.String("golang/go")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("1"),
+	}}
+	listed, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 0 {
+		t.Errorf("List = %v, want none", listed)
+	}
+	if want := []string{"convert: unsupported *githubv3.MemberEvent action: edited"}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestConvertSponsorship(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	sponsorshipEvent := func(action, privacyLevel string) *githubv3.Event {
+		return &githubv3.Event{
+			Type: githubv3.String("SponsorshipEvent"),
+			RawPayload: rawMessage(`{"action": "` + action + `", "sponsorship": {` +
+				`"sponsorable": {"id": 3, "login": "maintainer", "avatar_url": "https://example.org/maintainer"}, ` +
+				`"tier": {"name": "$5 a month"}, "privacy_level": "` + privacyLevel + `"}}`),
+			Repo:      &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("maintainer/maintainer")},
+			Actor:     &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt: &at,
+			ID:        githubv3.String("1"),
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		in   *githubv3.Event
+		want []event.Event
+	}{
+		{"created", sponsorshipEvent("created", "public"), []event.Event{{
+			ID:        "1",
+			Time:      at,
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+			Container: "github.com/maintainer",
+			Payload: event.Sponsor{
+				Sponsorable: users.User{UserSpec: users.UserSpec{ID: 3, Domain: "github.com"}, Login: "maintainer", AvatarURL: "https://example.org/maintainer"},
+				TierName:    "$5 a month",
+				HTMLURL:     "https://github.com/sponsors/maintainer",
+			},
+		}}},
+		{"private", sponsorshipEvent("created", "private"), nil},
+		{"cancelled", sponsorshipEvent("cancelled", "public"), nil},
+	} {
+		got := convert(context.Background(), []*githubv3.Event{tc.in},
+			map[int64]repository{1: {ModulePath: "github.com/maintainer/maintainer"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: convert:\ngot  %+v\nwant %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		min, max time.Duration
+	}{
+		{time.Minute, 1, time.Minute, 2 * time.Minute},
+		{time.Minute, 2, 2 * time.Minute, 4 * time.Minute},
+		{time.Minute, 3, 4 * time.Minute, 8 * time.Minute},
+		{time.Minute, 10, maxBackoff / 2, maxBackoff},
+		{time.Minute, 1000, maxBackoff / 2, maxBackoff},
+		{time.Hour, 3, time.Hour, time.Hour}, // Never shorter than the poll interval.
+	}
+	for _, tc := range tests {
+		for i := 0; i < 100; i++ {
+			if got := backoff(tc.interval, tc.failures); got < tc.min || got > tc.max {
+				t.Errorf("backoff(%v, %d) = %v, want from %v to %v", tc.interval, tc.failures, got, tc.min, tc.max)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+)
+
+// logHistory logs the fetched events that aren't in history yet to it,
+// once the information they need is fetched, see WithHistory.
+// Failures are reported with logf, and retried the next time.
+// s.update must be held.
+func (s *Service) logHistory(
+	ctx context.Context,
+	events []*githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
+) {
+	if s.history == nil {
+		return
+	}
+	if s.historyIDs == nil {
+		es, err := s.history.List(ctx)
+		if err != nil {
+			s.logf("logHistory: List: %v", err)
+			return
+		}
+		s.historyIDs = make(map[string]bool, len(es))
+		for _, e := range es {
+			s.historyIDs[e.ID] = true
+		}
+	}
+	var es []*githubv3.Event
+	for i := len(events) - 1; i >= 0; i-- { // Oldest first.
+		e := events[i]
+		if s.historyIDs[*e.ID] || strings.HasPrefix(*e.ID, "webhook-") || !enriched(e, repos, commits, prs, deletes, forced) {
+			continue
+		}
+		es = append(es, e)
+	}
+	for _, e := range s.convertListed(ctx, es, repos, commits, prs, deletes, forced) {
+		err := s.history.Log(ctx, e)
+		if err != nil {
+			s.logf("logHistory: Log: %v", err)
+			return
+		}
+		s.historyIDs[e.ID] = true
+	}
+}
+
+// enriched reports whether the information that event e needs is fetched,
+// so that it's converted without placeholders. e must contain a valid payload,
+// otherwise enriched panics.
+func enriched(
+	e *githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+	prs map[string]time.Time, // PR API URL -> Pull Request merge time, zero if not merged.
+	deletes map[string]string, // Delete event ID -> Last SHA.
+	forced map[string]bool, // Push event ID -> Forced.
+) bool {
+	if r, ok := repos[*e.Repo.ID]; !ok || r.Modules == nil {
+		return false
+	}
+	payload, err := parsePayload(e)
+	if err != nil {
+		panic(fmt.Errorf("internal error: enriched given a githubv3.Event with an invalid payload: %v", err))
+	}
+	switch p := payload.(type) {
+	case *githubv3.PushEvent:
+		if _, ok := forced[*e.ID]; !ok {
+			return false
+		}
+		for _, c := range p.Commits {
+			if _, ok := commits[*c.SHA]; !ok {
+				return false
+			}
+		}
+	case *githubv3.CommitCommentEvent:
+		if _, ok := commits[*p.Comment.CommitID]; !ok {
+			return false
+		}
+	case *githubv3.DeleteEvent:
+		if _, ok := deletes[*e.ID]; !ok {
+			return false
+		}
+	case *githubv3.IssueCommentEvent:
+		if p.Issue.PullRequestLinks != nil && *p.Issue.State == "closed" {
+			if _, ok := prs[*p.Issue.PullRequestLinks.URL]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// withHistory returns the listed events es, from most recent to oldest,
+// along with the ones in history that they don't include, e.g., because
+// they've aged out of the Events API. If history fails to be listed,
+// it's reported with logf, and es are returned as is.
+func (s *Service) withHistory(ctx context.Context, es []event.Event) []event.Event {
+	history, err := s.history.List(ctx)
+	if err != nil {
+		s.logf("withHistory: List: %v", err)
+		return es
+	}
+	listed := make(map[string]bool, len(es)) // A set of listed event IDs.
+	for _, e := range es {
+		listed[e.ID] = true
+	}
+	all := append([]event.Event(nil), es...)
+	for _, e := range history {
+		if listed[e.ID] {
+			continue
+		}
+		all = append(all, e)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.After(all[j].Time) })
+	s.avatars.resolve(all) // Events in history have the avatar URLs they were logged with.
+	return all
+}
@@ -0,0 +1,94 @@
+package githubapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestWithHistory(t *testing.T) {
+	feed := `[{
+		"type": "WatchEvent",
+		"id": "2",
+		"repo": {"id": 1, "name": "owner/repo"},
+		"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+		"created_at": "2020-01-02T03:04:06Z",
+		"payload": {"action": "started"}
+	}, {
+		"type": "WatchEvent",
+		"id": "1",
+		"repo": {"id": 1, "name": "owner/repo"},
+		"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+		"created_at": "2020-01-02T03:04:05Z",
+		"payload": {"action": "started"}
+	}]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/graphql":
+			w.Write([]byte(`{"data": {"n0": {"databaseId": 1, "object": {"text": "module example.org/repo\n"}}}}`))
+		case "/users/gopher/events/public":
+			w.Write([]byte(feed))
+		case "/repos/owner/repo/git/trees/HEAD":
+			w.Write([]byte(`{"sha": "t", "tree": []}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	var history logged
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithLogf(t.Logf), WithHistory(&history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The older events age out of the feed, but are still listed.
+	feed = `[{
+		"type": "WatchEvent",
+		"id": "3",
+		"repo": {"id": 1, "name": "owner/repo"},
+		"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+		"created_at": "2020-01-02T03:04:07Z",
+		"payload": {"action": "started"}
+	}]`
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.ID)
+		if e.Container != "example.org/repo" {
+			t.Errorf("event %s is in %q, want example.org/repo", e.ID, e.Container)
+		}
+	}
+	if want := []string{"3", "2", "1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List listed events %v, want %v", ids, want)
+	}
+
+	// Each event is logged to history once, oldest first.
+	ids = nil
+	for _, e := range history {
+		ids = append(ids, e.ID)
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("history has events %v, want %v", ids, want)
+	}
+}
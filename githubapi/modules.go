@@ -0,0 +1,163 @@
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"dmitri.shuralyov.com/go/prefixtitle"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+)
+
+// fetchModules fetches the nested modules of the specified repository,
+// whose name is like "owner/repo", i.e., the modules with go.mod files
+// in subdirectories at HEAD. It returns a map of their directories,
+// like "foo/bar", to their module paths.
+//
+// Fetching them takes a request of the REST API v3, and a GraphQL API v4 query
+// per batchSize modules. It returns false if they don't fit in the rate budget.
+func (s *Service) fetchModules(ctx context.Context, repoName string) (map[string]string, bool, error) {
+	if !s.spendV3() {
+		return nil, false, nil
+	}
+	owner, name := splitOwnerRepo(repoName)
+	tree, _, err := s.clV3.Git.GetTree(ctx, owner, name, "HEAD", true)
+	if e, ok := err.(*githubv3.ErrorResponse); ok && (e.Response.StatusCode == http.StatusNotFound || e.Response.StatusCode == http.StatusConflict) {
+		// E.g., because the repo was deleted, or it's empty.
+		s.logf("fetchModules: tree of %s was not found: %v", repoName, err)
+		return map[string]string{}, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	// If the tree is truncated because the repository is huge,
+	// only the modules in the listed part of it are known.
+	var dirs []string
+	for _, e := range tree.Entries {
+		if e.Type == nil || *e.Type != "blob" || e.Path == nil || path.Base(*e.Path) != "go.mod" {
+			continue
+		}
+		if dir := path.Dir(*e.Path); dir != "." && !ignoredDir(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	modules := make(map[string]string)
+	var nodes []batchNode
+	for i, dir := range dirs {
+		dir, v := dir, fmt.Sprintf("v%d", i)
+		variables := repositoryVariables(v, owner, name)
+		variables[v+"Expression"] = githubv4.String("HEAD:" + dir + "/go.mod")
+		nodes = append(nodes, batchNode{
+			Field:     repositoryField(v),
+			Variables: variables,
+			Type:      fieldType(fmt.Sprintf("object(expression:$%sExpression)", v), reflect.TypeOf((*goModNode)(nil))),
+			Done: func(n interface{}) {
+				f, ok := fieldValue(n)
+				if !ok {
+					return
+				}
+				if modulePath := f.(*goModNode).modulePath(); modulePath != "" {
+					modules[dir] = modulePath
+				}
+			},
+		})
+	}
+	for len(nodes) > 0 {
+		if !s.spendV4() {
+			return nil, false, nil
+		}
+		n := len(nodes)
+		if n > batchSize {
+			n = batchSize
+		}
+		err := s.queryNodes(ctx, nodes[:n])
+		if err != nil {
+			return nil, false, err
+		}
+		nodes = nodes[n:]
+	}
+	return modules, true, nil
+}
+
+// ignoredDir reports whether the go tool ignores the directory dir,
+// so that a go.mod file in it doesn't make a module.
+func ignoredDir(dir string) bool {
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "testdata" || elem == "vendor" || strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleDir returns the directory of the most specific module of
+// the repository whose directory contains dir, a directory relative
+// to the root, or the empty string if it's the module at the root.
+func (r repository) moduleDir(dir string) string {
+	for ; dir != "." && dir != ""; dir = path.Dir(dir) {
+		if _, ok := r.Modules[dir]; ok {
+			return dir
+		}
+	}
+	return ""
+}
+
+// packagePath returns the import path of the package at p, an import path
+// under the module path of the module at the root of the repository,
+// like one parsed from a title prefix, in the most specific module that
+// contains it.
+func (r repository) packagePath(p string) string {
+	if r.ModulePath == "" || !strings.HasPrefix(p, r.ModulePath+"/") {
+		return p
+	}
+	rel := p[len(r.ModulePath)+1:]
+	dir := r.moduleDir(rel)
+	if dir == "" {
+		return p
+	}
+	return r.Modules[dir] + rel[len(dir):]
+}
+
+// pushModulePath returns the module path of the most specific module
+// of the repository that contains all paths that a push to ref affected.
+// Paths are the files that commits added, removed or modified, if they're known,
+// like they are in webhook deliveries. Otherwise, they're the title prefixes
+// of commit messages.
+func (r repository) pushModulePath(ref string, commits []githubv3.PushEventCommit) string {
+	var dirs []string // Affected directories, relative to the root.
+	for _, c := range commits {
+		if files := append(append(append([]string(nil), c.Added...), c.Removed...), c.Modified...); len(files) > 0 {
+			for _, f := range files {
+				dirs = append(dirs, path.Dir(f))
+			}
+			continue
+		}
+		subject, _ := splitCommitMessage(stringValue(c.Message))
+		paths, _ := prefixtitle.ParseChange(r.ModulePath, subject)
+		for _, p := range paths {
+			if r.ModulePath != "" && strings.HasPrefix(p, r.ModulePath+"/") {
+				dirs = append(dirs, p[len(r.ModulePath)+1:])
+			} else {
+				dirs = append(dirs, ".")
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return r.modulePathAt(ref)
+	}
+	dir := r.moduleDir(dirs[0])
+	for _, d := range dirs[1:] {
+		if r.moduleDir(d) != dir {
+			// Paths in different modules were affected.
+			return r.modulePathAt(ref)
+		}
+	}
+	if dir == "" {
+		return r.modulePathAt(ref)
+	}
+	return r.Modules[dir]
+}
@@ -0,0 +1,119 @@
+package githubapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/route/github"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+)
+
+func TestFetchModules(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/repos/owner/repo/git/trees/HEAD":
+			w.Write([]byte(`{"sha": "t", "tree": [
+				{"path": "go.mod", "type": "blob"},
+				{"path": "sub", "type": "tree"},
+				{"path": "sub/go.mod", "type": "blob"},
+				{"path": "sub/nested/go.mod", "type": "blob"},
+				{"path": "tools/go.mod", "type": "blob"},
+				{"path": "testdata/go.mod", "type": "blob"},
+				{"path": "internal/vendor/x/go.mod", "type": "blob"},
+				{"path": "_example/go.mod", "type": "blob"}
+			]}`))
+		case "/graphql":
+			w.Write([]byte(`{"data": {
+				"n0": {"object": {"text": "module example.org/repo/sub\n"}},
+				"n1": {"object": {"text": "module example.org/nested\n"}},
+				"n2": {"object": {"text": "not a go.mod file"}}
+			}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	s := &Service{
+		clV3:       clV3,
+		clV4:       githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil),
+		rateBudget: 1,
+		logf:       t.Logf,
+	}
+	modules, fetched, err := s.fetchModules(context.Background(), "owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"sub":        "example.org/repo/sub",
+		"sub/nested": "example.org/nested",
+	}
+	if !fetched || !reflect.DeepEqual(modules, want) {
+		t.Errorf("got modules %v, fetched %v; want %v, true", modules, fetched, want)
+	}
+}
+
+func TestConvertNestedModules(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	repos := map[int64]repository{1: {
+		ModulePath: "example.org/repo",
+		Modules: map[string]string{
+			"sub":        "example.org/repo/sub",
+			"sub/nested": "example.org/nested",
+		},
+	}}
+	for _, tc := range []struct {
+		typ     string
+		payload string
+		want    string // Container.
+	}{
+		{"IssuesEvent", `{"action": "opened", "issue": {"number": 1, "title": "sub/pkg: fix", "body": ""}}`, "example.org/repo/sub/pkg"},
+		{"IssuesEvent", `{"action": "opened", "issue": {"number": 1, "title": "sub/nested: fix", "body": ""}}`, "example.org/nested"},
+		{"IssuesEvent", `{"action": "opened", "issue": {"number": 1, "title": "subway: fix", "body": ""}}`, "example.org/repo/subway"},
+		{"IssuesEvent", `{"action": "opened", "issue": {"number": 1, "title": "Fix", "body": ""}}`, "example.org/repo"},
+
+		// Commits listed by the events API have messages, but no files.
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 2, "commits": [
+			{"sha": "a", "message": "sub/pkg: fix"},
+			{"sha": "b", "message": "sub: fix"}
+		]}`, "example.org/repo/sub"},
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 2, "commits": [
+			{"sha": "a", "message": "sub/pkg: fix"},
+			{"sha": "b", "message": "sub/nested/pkg: fix"}
+		]}`, "example.org/repo"},
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 1, "commits": [
+			{"sha": "a", "message": "Fix"}
+		]}`, "example.org/repo"},
+
+		// Commits in webhook deliveries list the files they affected.
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 2, "commits": [
+			{"sha": "a", "message": "Fix", "added": ["sub/nested/a.go"]},
+			{"sha": "b", "message": "Fix", "modified": ["sub/nested/pkg/b.go"], "removed": ["sub/nested/c.go"]}
+		]}`, "example.org/nested"},
+		{"PushEvent", `{"ref": "refs/heads/master", "head": "bbb", "before": "aaa", "size": 1, "commits": [
+			{"sha": "a", "message": "sub: fix", "modified": ["sub/a.go", "README.md"]}
+		]}`, "example.org/repo"},
+	} {
+		e := &githubv3.Event{
+			Type:       githubv3.String(tc.typ),
+			RawPayload: rawMessage(tc.payload),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String("1"),
+		}
+		got := convert(context.Background(), []*githubv3.Event{e}, repos, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+		if len(got) != 1 || got[0].Container != tc.want {
+			t.Errorf("%s %s: got %+v, want Container %q", tc.typ, strings.Join(strings.Fields(tc.payload), " "), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package githubapi
+
+import (
+	"context"
+	"sync"
+)
+
+// maxParallelFetches is the maximum number of fetches that enrich makes at once.
+// It's small, since GitHub asks clients not to make many requests concurrently.
+const maxParallelFetches = 4
+
+// fetch is a fetch of information that events need.
+type fetch struct {
+	// do fetches the information. It's called concurrently with other fetches,
+	// so it must not modify shared state, but only keep what it fetched for apply.
+	do func(ctx context.Context) error
+
+	// apply stores what do fetched. It's called after all fetches are done,
+	// in order of fetches.
+	apply func()
+}
+
+// fetchAll does fetches, at most maxParallelFetches at once, then applies the ones
+// that succeeded in order, so that the outcome is the same as if they were done
+// sequentially. A fetch that fails doesn't stop the others, so that what
+// can be fetched is. The error of the first one in order that failed is returned.
+func fetchAll(ctx context.Context, fetches []fetch) error {
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, maxParallelFetches)
+		errs = make([]error, len(fetches))
+	)
+	for i, f := range fetches {
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			// The rest would fail the same way.
+			<-sem
+			for i := i; i < len(errs); i++ {
+				errs[i] = err
+			}
+			break
+		}
+		wg.Add(1)
+		go func(i int, f fetch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = f.do(ctx)
+		}(i, f)
+	}
+	wg.Wait()
+	var first error
+	for i, f := range fetches {
+		if errs[i] != nil {
+			if first == nil {
+				first = errs[i]
+			}
+			continue
+		}
+		f.apply()
+	}
+	return first
+}
@@ -0,0 +1,61 @@
+package githubapi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchAll(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, most int
+		applied       []int
+		fetches       []fetch
+	)
+	for i := 0; i < 10; i++ {
+		i := i
+		fetches = append(fetches, fetch{
+			do: func(ctx context.Context) error {
+				mu.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Duration(10-i) * time.Millisecond) // Later fetches finish first.
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			},
+			apply: func() { applied = append(applied, i) },
+		})
+	}
+	err := fetchAll(context.Background(), fetches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most < 2 || most > maxParallelFetches {
+		t.Errorf("got %d fetches at once, want from 2 to %d", most, maxParallelFetches)
+	}
+	if want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("fetches were applied in order %v, want %v", applied, want)
+	}
+
+	// If a fetch fails, the others are still applied.
+	applied = nil
+	fail := errors.New("fail")
+	fetches[3].do = func(context.Context) error { return fail }
+	fetches[5].do = func(context.Context) error { return errors.New("later failure") }
+	err = fetchAll(context.Background(), fetches)
+	if err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+	if want := []int{0, 1, 2, 4, 6, 7, 8, 9}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("fetches were applied in order %v, want %v", applied, want)
+	}
+}
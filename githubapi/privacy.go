@@ -0,0 +1,100 @@
+package githubapi
+
+import (
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+)
+
+// private reports whether e happened in a private repository.
+func private(e *githubv3.Event) bool {
+	return e.Public != nil && !*e.Public
+}
+
+// withoutPrivate returns the events that aren't private.
+func withoutPrivate(events []*githubv3.Event) []*githubv3.Event {
+	var es []*githubv3.Event
+	for _, e := range events {
+		if private(e) {
+			continue
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// redacted is what required names of things in private repositories
+// are replaced with by redact.
+const redacted = "redacted"
+
+// redact returns e, an event that happened in a private repository,
+// with the details of the repository stripped, so that it tells only
+// who did what kind of thing, and when. Its container and all text,
+// like titles, bodies, commit messages and names of branches, are left out.
+// Required names are replaced with "redacted",
+// and required links with a link to the actor.
+func redact(e event.Event) event.Event {
+	actorURL := "https://github.com/" + e.Actor.Login
+	e.Container = ""
+	switch p := e.Payload.(type) {
+	case event.Issue:
+		e.Payload = event.Issue{Action: p.Action, IssueHTMLURL: actorURL}
+	case event.Change:
+		e.Payload = event.Change{Action: p.Action, Draft: p.Draft, ChangeHTMLURL: actorURL}
+	case event.IssueComment:
+		e.Payload = event.IssueComment{Action: p.Action, IssueState: p.IssueState, CommentHTMLURL: actorURL}
+	case event.ChangeComment:
+		e.Payload = event.ChangeComment{Action: p.Action, ChangeState: p.ChangeState, CommentReview: p.CommentReview, CommentHTMLURL: actorURL}
+	case event.CommitComment:
+		e.Payload = event.CommitComment{Commit: redactCommit(p.Commit)}
+	case event.Push:
+		var commits []event.Commit
+		for _, c := range p.Commits {
+			commits = append(commits, redactCommit(c))
+		}
+		e.Payload = event.Push{
+			Head:         p.Head,
+			Before:       p.Before,
+			Commits:      commits,
+			TotalCommits: p.TotalCommits,
+			Forced:       p.Forced,
+		}
+	case event.Create:
+		switch p.Type {
+		case event.CreateBranch, event.CreateTag:
+			e.Payload = event.Create{Type: p.Type, Name: redacted}
+		default:
+			e.Payload = event.Create{Type: p.Type}
+		}
+	case event.Fork:
+		e.Payload = event.Fork{Container: redacted}
+	case event.Delete:
+		e.Payload = event.Delete{Type: p.Type, Name: redacted}
+	case event.Wiki:
+		var pages []event.Page
+		for _, page := range p.Pages {
+			pages = append(pages, event.Page{Action: page.Action, SHA: page.SHA, HTMLURL: actorURL})
+		}
+		e.Payload = event.Wiki{Pages: pages}
+	case event.Release:
+		e.Payload = event.Release{TagName: redacted, Prerelease: p.Prerelease, HTMLURL: actorURL}
+	case event.Assign:
+		e.Payload = event.Assign{Action: p.Action, Assignee: p.Assignee, IssueHTMLURL: actorURL}
+	case event.Label:
+		e.Payload = event.Label{Action: p.Action, Label: event.LabelInfo{Name: redacted}, IssueHTMLURL: actorURL}
+	case event.Milestone:
+		e.Payload = event.Milestone{Action: p.Action, IssueHTMLURL: actorURL}
+	case event.Transfer:
+		e.Payload = event.Transfer{IssueHTMLURL: actorURL}
+	case event.Rename:
+		e.Payload = event.Rename{From: redacted, To: redacted}
+	case event.Star, event.Publish, event.Member, event.Sponsor:
+		// Nothing to strip besides the container. Collaborators and
+		// sponsorables are users, not details of the repository.
+	}
+	return e
+}
+
+// redactCommit returns c with everything but its SHA stripped.
+func redactCommit(c event.Commit) event.Commit {
+	return event.Commit{SHA: c.SHA, AuthorAvatarURL: placeholderAvatarURL}
+}
@@ -0,0 +1,105 @@
+package githubapi
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+func TestRedact(t *testing.T) {
+	// Every detail of the private repository mentions "secret",
+	// so none of them must be left after redacting.
+	commit := event.Commit{SHA: "deadbeef", Message: "secret message", AuthorAvatarURL: "https://example.org/secret", HTMLURL: "https://github.com/secret/repo/commit/deadbeef"}
+	for _, p := range []event.Payload{
+		event.Issue{Action: event.IssueOpened, IssueNumber: 1, IssueTitle: "secret title", IssueBody: "secret body", IssueHTMLURL: "https://github.com/secret/repo/issues/1", Milestone: "secret", Labels: []event.LabelInfo{{Name: "secret"}}},
+		event.Change{Action: event.ChangeOpened, ChangeNumber: 1, ChangeTitle: "secret title", ChangeBody: "secret body", ChangeHTMLURL: "https://github.com/secret/repo/pull/1", BaseBranch: "secret", HeadBranch: "secret"},
+		event.IssueComment{IssueTitle: "secret title", IssueState: "open", CommentBody: "secret body", CommentHTMLURL: "https://github.com/secret/repo/issues/1#issuecomment-1"},
+		event.ChangeComment{ChangeTitle: "secret title", ChangeState: "merged", CommentBody: "secret body", CommentHTMLURL: "https://github.com/secret/repo/pull/1#issuecomment-1"},
+		event.CommitComment{Commit: commit, CommentBody: "secret body"},
+		event.Push{Branch: "secret", Head: "deadbeef", Before: "cafebabe", Commits: []event.Commit{commit}, TotalCommits: 1, HeadHTMLURL: "https://github.com/secret/repo/commit/deadbeef"},
+		event.Create{Type: event.CreateBranch, Name: "secret", NameHTMLURL: "https://github.com/secret/repo/tree/secret"},
+		event.Create{Type: event.CreateRepository, Description: "secret description"},
+		event.Fork{Container: "github.com/gopher/secret", HTMLURL: "https://github.com/gopher/secret", Description: "secret description", DefaultBranch: "secret"},
+		event.Delete{Type: event.DeleteBranch, Name: "secret", LastSHA: "deadbeef", TreeHTMLURL: "https://github.com/secret/repo/tree/secret", CompareHTMLURL: "https://github.com/secret/repo/compare/secret"},
+		event.Wiki{Pages: []event.Page{{Action: event.PageCreated, SHA: "deadbeef", Title: "secret", Summary: "secret summary", HTMLURL: "https://github.com/secret/repo/wiki/secret"}}},
+		event.Rename{From: "github.com/gopher/secret", To: "github.com/secret/repo"},
+		event.Release{TagName: "secret", Name: "secret name", Body: "secret body", HTMLURL: "https://github.com/secret/repo/releases/tag/secret"},
+		event.Star{},
+	} {
+		e := event.Event{
+			Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"},
+			Container: "github.com/secret/repo",
+			Payload:   p,
+		}
+		if err := e.Validate(); err != nil {
+			t.Fatalf("%T: invalid test event: %v", p, err)
+		}
+		got := redact(e)
+		if err := got.Validate(); err != nil {
+			t.Errorf("%T: redacted event is invalid: %v", p, err)
+		}
+		if s := fmt.Sprintf("%+v", got); strings.Contains(s, "secret") {
+			t.Errorf("%T: redacted event has details left: %s", p, s)
+		}
+		if !got.Time.Equal(e.Time) || !reflect.DeepEqual(got.Actor, e.Actor) {
+			t.Errorf("%T: redacted event has time %v and actor %v, want %v and %v", p, got.Time, got.Actor, e.Time, e.Actor)
+		}
+	}
+}
+
+func TestWithPrivateEvents(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []*githubv3.Event{{
+		Type:       githubv3.String("ForkEvent"),
+		Public:     githubv3.Bool(false),
+		RawPayload: rawMessage(`{"forkee": {"full_name": "gopher/secret"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("org/secret")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("2"),
+	}, {
+		Type:       githubv3.String("ForkEvent"),
+		Public:     githubv3.Bool(true),
+		RawPayload: rawMessage(`{"forkee": {"full_name": "gopher/go"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(goRepoID), Name: githubv3.String("golang/go")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("1"),
+	}}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string // Containers of events.
+	}{
+		{"public only", nil, []string{"go.googlesource.com/go"}},
+		{"private", []Option{WithPrivateEvents(false)}, []string{"github.com/org/secret", "go.googlesource.com/go"}},
+		{"private redacted", []Option{WithPrivateEvents(true)}, []string{"", "go.googlesource.com/go"}},
+	} {
+		user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+		s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.events = events
+		s.repos = map[int64]repository{goRepoID: {ModulePath: "go.googlesource.com/go"}}
+		listed, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range listed {
+			got = append(got, e.Container)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: List containers = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package githubapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+)
+
+// RateLimitError is the error fetching events when GitHub limits requests,
+// either because a rate limit is used up, or because a secondary rate limit
+// is hit, e.g., for making too many requests at once. No requests are made
+// until RetryAfter, see Status.RateLimited.
+type RateLimitError struct {
+	Err        error     // Error of the request that was limited.
+	RetryAfter time.Time // When requests can be made again.
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited until %v: %v", e.RetryAfter.Format(time.RFC3339), e.Err)
+}
+
+func (e *RateLimitError) Unwrap() error { return e.Err }
+
+// defaultRetryAfter is how long to wait after GitHub limits requests
+// without saying for how long. GitHub asks to wait at least a minute.
+const defaultRetryAfter = time.Minute
+
+// limited returns err as a *RateLimitError if it's due to GitHub limiting
+// requests, and records it, so that no requests are made until GitHub
+// allows them again. Otherwise it returns err as is.
+func (s *Service) limited(err error) error {
+	if err == nil {
+		return nil
+	}
+	retryAfter, ok := rateLimited(err, time.Now())
+	if !ok {
+		return err
+	}
+	l := &RateLimitError{Err: err, RetryAfter: retryAfter}
+	s.mu.Lock()
+	if s.rateLimit == nil || l.RetryAfter.After(s.rateLimit.RetryAfter) {
+		s.rateLimit = l
+	}
+	s.mu.Unlock()
+	return l
+}
+
+// rateLimitedNow returns the error that GitHub last limited requests with,
+// if they're still limited, or nil if they're not. s.mu must be held.
+func (s *Service) rateLimitedNow(now time.Time) *RateLimitError {
+	if s.rateLimit == nil || !now.Before(s.rateLimit.RetryAfter) {
+		return nil
+	}
+	return s.rateLimit
+}
+
+// rateLimited reports whether err is due to GitHub limiting requests,
+// and if so, when requests can be made again.
+func rateLimited(err error, now time.Time) (retryAfter time.Time, ok bool) {
+	switch err := err.(type) {
+	case *RateLimitError:
+		return err.RetryAfter, true
+	case *githubv3.RateLimitError:
+		if err.Rate.Reset.Time.After(now) {
+			return err.Rate.Reset.Time, true
+		}
+		return now.Add(defaultRetryAfter), true
+	case *githubv3.AbuseRateLimitError:
+		if err.RetryAfter != nil {
+			return now.Add(*err.RetryAfter), true
+		}
+		return now.Add(defaultRetryAfter), true
+	case *githubv3.ErrorResponse:
+		// Secondary rate limits are documented at a URL
+		// that *githubv3.AbuseRateLimitError doesn't recognize.
+		if t, ok := retryAfterHeader(err.Response, now); ok {
+			return t, true
+		}
+	}
+	// Errors of the GraphQL API v4, and ones of fetches that enrich makes,
+	// which are wrapped, tell only in their message.
+	msg := err.Error()
+	if strings.Contains(msg, "secondary rate limit") ||
+		strings.Contains(msg, "abuse detection") ||
+		strings.Contains(msg, "API rate limit exceeded") {
+		return now.Add(defaultRetryAfter), true
+	}
+	return time.Time{}, false
+}
+
+// retryAfterHeader returns when requests can be made again, as told
+// by the headers of resp, if it's a response for a limited request.
+func retryAfterHeader(resp *http.Response, now time.Time) (time.Time, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests) {
+		return time.Time{}, false
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return now.Add(time.Duration(s) * time.Second), true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil && time.Unix(reset, 0).After(now) {
+			return time.Unix(reset, 0), true
+		}
+		return now.Add(defaultRetryAfter), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,135 @@
+package githubapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestRateLimited(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	response := func(code int, header ...string) *http.Response {
+		req, _ := http.NewRequest("GET", "https://api.github.com/users/gopher/events", nil)
+		resp := &http.Response{Request: req, StatusCode: code, Header: make(http.Header)}
+		for i := 0; i < len(header); i += 2 {
+			resp.Header.Set(header[i], header[i+1])
+		}
+		return resp
+	}
+	thirty := 30 * time.Second
+	for _, tc := range []struct {
+		in     error
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			in:     &githubv3.RateLimitError{Rate: githubv3.Rate{Reset: githubv3.Timestamp{Time: now.Add(time.Hour)}}},
+			want:   now.Add(time.Hour),
+			wantOK: true,
+		},
+		{
+			in:     &githubv3.AbuseRateLimitError{RetryAfter: &thirty},
+			want:   now.Add(thirty),
+			wantOK: true,
+		},
+		{
+			in:     &githubv3.AbuseRateLimitError{},
+			want:   now.Add(defaultRetryAfter),
+			wantOK: true,
+		},
+		{
+			in:     &githubv3.ErrorResponse{Response: response(http.StatusForbidden, "Retry-After", "120")},
+			want:   now.Add(2 * time.Minute),
+			wantOK: true,
+		},
+		{
+			in:     &githubv3.ErrorResponse{Response: response(http.StatusTooManyRequests, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", fmt.Sprint(now.Add(time.Hour).Unix()))},
+			want:   now.Add(time.Hour),
+			wantOK: true,
+		},
+		{
+			in:     &githubv3.ErrorResponse{Response: response(http.StatusForbidden, "X-RateLimit-Remaining", "10")},
+			wantOK: false,
+		},
+		{
+			in:     errors.New(`fetchCommit: non-200 OK status code: 403 Forbidden body: "{\"message\":\"You have exceeded a secondary rate limit.\"}"`),
+			want:   now.Add(defaultRetryAfter),
+			wantOK: true,
+		},
+		{
+			in:     errors.New("fetchCommit: non-200 OK status code: 502 Bad Gateway"),
+			wantOK: false,
+		},
+	} {
+		got, ok := rateLimited(tc.in, now)
+		if !got.Equal(tc.want) || ok != tc.wantOK {
+			t.Errorf("rateLimited(%v) = %v, %v, want %v, %v", tc.in, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestSecondaryRateLimit(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again.", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#secondary-rate-limits"}`))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling(), WithLogf(t.Logf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	err = s.Refresh(context.Background())
+	l, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Refresh: got error %v, want a *RateLimitError", err)
+	}
+	if l.RetryAfter.Before(before.Add(time.Minute)) || l.RetryAfter.After(time.Now().Add(time.Minute)) {
+		t.Errorf("got RetryAfter %v, want a minute from now", l.RetryAfter)
+	}
+	if st := s.Status(); !st.RateLimited.Equal(l.RetryAfter) || st.LastError != err {
+		t.Errorf("Status = %+v, want RateLimited %v and LastError %v", st, l.RetryAfter, err)
+	}
+
+	// Until GitHub allows requests again, none are made.
+	err = s.Refresh(context.Background())
+	if _, ok := err.(*RateLimitError); !ok {
+		t.Errorf("Refresh: got error %v, want a *RateLimitError", err)
+	}
+	if s.spendV3() || s.spendV4() {
+		t.Error("spend: got true while rate limited, want false")
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	// Once it does, they're made again.
+	s.mu.Lock()
+	s.rateLimit.RetryAfter = time.Now()
+	s.mu.Unlock()
+	s.Refresh(context.Background())
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+	if st := s.Status(); st.RateLimited.IsZero() {
+		t.Error("Status: got zero RateLimited after being limited again, want non-zero")
+	}
+}
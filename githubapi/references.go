@@ -0,0 +1,48 @@
+package githubapi
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+
+	"dmitri.shuralyov.com/route/github"
+	"github.com/shurcooL/events/event"
+)
+
+// referencePattern matches references to issues and changes,
+// like "#123" or "owner/repo#123".
+//
+// A reference must not be preceded by a word character or one of "/#.-",
+// so that URL fragments and similar text don't count as references.
+var referencePattern = regexp.MustCompile(`(?:^|[^\w/#.-])(?:([\w.-]+)/([\w.-]+))?#(\d+)\b`)
+
+// extractReferences extracts references to issues and changes
+// mentioned in body. References without an explicit repository
+// are taken to be in the repository specified by owner and repo.
+// Each reference is included once, in order of first mention.
+func extractReferences(ctx context.Context, router github.Router, owner, repo, body string) []event.Reference {
+	var refs []event.Reference
+	seen := make(map[event.Reference]bool)
+	for _, m := range referencePattern.FindAllStringSubmatch(body, -1) {
+		o, r := owner, repo
+		if m[1] != "" {
+			o, r = m[1], m[2]
+		}
+		number, err := strconv.ParseUint(m[3], 10, 64)
+		if err != nil || number == 0 {
+			// Number is too large or zero, so it can't be a reference.
+			continue
+		}
+		ref := event.Reference{
+			Container: "github.com/" + o + "/" + r,
+			Number:    number,
+			HTMLURL:   router.IssueURL(ctx, o, r, number),
+		}
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	return refs
+}
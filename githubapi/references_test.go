@@ -0,0 +1,45 @@
+package githubapi
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"dmitri.shuralyov.com/route/github"
+	"github.com/shurcooL/events/event"
+)
+
+func TestExtractReferences(t *testing.T) {
+	tests := []struct {
+		body string
+		want []event.Reference
+	}{
+		{body: "", want: nil},
+		{body: "No references here.", want: nil},
+		{
+			body: "Fixes #12.",
+			want: []event.Reference{{Container: "github.com/owner/repo", Number: 12, HTMLURL: "https://github.com/owner/repo/issues/12"}},
+		},
+		{
+			body: "See #1, other/project#2 and #1 again.",
+			want: []event.Reference{
+				{Container: "github.com/owner/repo", Number: 1, HTMLURL: "https://github.com/owner/repo/issues/1"},
+				{Container: "github.com/other/project", Number: 2, HTMLURL: "https://github.com/other/project/issues/2"},
+			},
+		},
+		{
+			body: "#3 is at the start.\n#4 is at the start of a line.",
+			want: []event.Reference{
+				{Container: "github.com/owner/repo", Number: 3, HTMLURL: "https://github.com/owner/repo/issues/3"},
+				{Container: "github.com/owner/repo", Number: 4, HTMLURL: "https://github.com/owner/repo/issues/4"},
+			},
+		},
+		{body: "https://example.org/page#1 and a#2 and ##3 and #0.", want: nil},
+	}
+	for _, tc := range tests {
+		got := extractReferences(context.Background(), github.DotCom{}, "owner", "repo", tc.body)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("extractReferences(%q):\ngot:  %+v\nwant: %+v", tc.body, got, tc.want)
+		}
+	}
+}
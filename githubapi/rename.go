@@ -0,0 +1,130 @@
+package githubapi
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+)
+
+// followRenames follows renames of repositories that events happened in,
+// including transfers to other owners. The Events API doesn't list them,
+// but events after a rename are listed with the new name of the repository.
+//
+// It records the names of repositories in repos as of the most recent
+// events in events. Repositories that were renamed since their names were
+// recorded are removed from repos, so that their module paths, which may
+// have changed along with their names, are fetched again, and the URLs
+// of their commits in commits are updated to the new names.
+// It returns the rename events it synthesized, see renameEvent.
+func followRenames(
+	events []*githubv3.Event,
+	repos map[int64]repository, // Repo ID -> Module Path.
+	commits map[string]event.Commit, // SHA -> Commit.
+) []*githubv3.Event {
+	latest := make(map[int64]*githubv3.Event) // Repo ID -> Most recent event.
+	for _, e := range events {
+		if l, ok := latest[*e.Repo.ID]; !ok || e.CreatedAt.After(*l.CreatedAt) {
+			latest[*e.Repo.ID] = e
+		}
+	}
+	// The earliest event with the new name of a renamed repository
+	// is the one that reveals the rename.
+	revealing := make(map[int64]*githubv3.Event) // Repo ID -> Earliest event with the new name.
+	for _, e := range events {
+		r, ok := repos[*e.Repo.ID]
+		if !ok || r.Name == "" || *e.Repo.Name == r.Name || *e.Repo.Name != *latest[*e.Repo.ID].Repo.Name || !e.CreatedAt.After(r.NameTime) {
+			continue
+		}
+		if f, ok := revealing[*e.Repo.ID]; !ok || !e.CreatedAt.After(*f.CreatedAt) {
+			revealing[*e.Repo.ID] = e
+		}
+	}
+
+	var renames []*githubv3.Event
+	done := make(map[int64]bool) // A set of repo IDs.
+	for _, e := range events {
+		repoID := *e.Repo.ID
+		if done[repoID] {
+			continue
+		}
+		done[repoID] = true
+		r, ok := repos[repoID]
+		if !ok {
+			// Not fetched yet. Its name is recorded when it is.
+			continue
+		}
+		l := latest[repoID]
+		if f, ok := revealing[repoID]; ok {
+			from, to := r.Name, *l.Repo.Name
+			renames = append(renames, renameEvent(f, from))
+			renameCommits(commits, from, to)
+			delete(repos, repoID)
+		} else if r.Name == "" || (*l.Repo.Name == r.Name && l.CreatedAt.After(r.NameTime)) {
+			r.Name, r.NameTime = *l.Repo.Name, *l.CreatedAt
+			repos[repoID] = r
+		}
+	}
+	return renames
+}
+
+// renameEvent returns a RepositoryEvent for the rename of the repository
+// from the name from, synthesized from e, the earliest event listed with
+// its new name. GitHub doesn't tell who renamed it, or when, so it's
+// attributed to the actor of e, and happened a second before e.
+func renameEvent(e *githubv3.Event, from string) *githubv3.Event {
+	var p renamePayload
+	p.Action = "renamed"
+	p.Repo.ID, p.Repo.FullName = *e.Repo.ID, *e.Repo.Name
+	p.From = from
+	raw, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	t := e.CreatedAt.Add(-time.Second)
+	return &githubv3.Event{
+		Type:       githubv3.String("RepositoryEvent"),
+		Public:     e.Public,
+		RawPayload: (*json.RawMessage)(&raw),
+		Repo:       e.Repo,
+		Actor:      e.Actor,
+		Org:        e.Org,
+		CreatedAt:  &t,
+		ID:         githubv3.String("rename-" + *e.ID),
+	}
+}
+
+// renamePayload is the payload of a RepositoryEvent synthesized by renameEvent.
+type renamePayload struct {
+	Action string `json:"action"`
+	Repo   struct {
+		ID       int64  `json:"id"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	From string `json:"from"` // Name of the repository before, like "owner/repo".
+}
+
+// renamedFrom returns the name that the repository of e, a RepositoryEvent
+// synthesized by renameEvent, was renamed from.
+func renamedFrom(e *githubv3.Event) (string, bool) {
+	var p renamePayload
+	if err := json.Unmarshal(*e.RawPayload, &p); err != nil || p.From == "" {
+		return "", false
+	}
+	return p.From, true
+}
+
+// renameCommits updates the URLs of commits of the repository
+// that was renamed from the name from to the name to.
+func renameCommits(commits map[string]event.Commit, from, to string) {
+	prefix := "https://github.com/" + from + "/"
+	for sha, c := range commits {
+		if !strings.HasPrefix(c.HTMLURL, prefix) {
+			continue
+		}
+		c.HTMLURL = "https://github.com/" + to + "/" + strings.TrimPrefix(c.HTMLURL, prefix)
+		commits[sha] = c
+	}
+}
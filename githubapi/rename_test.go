@@ -0,0 +1,89 @@
+package githubapi
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/route/github"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+func TestFollowRenames(t *testing.T) {
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	watchEvent := func(id, repoName string, at time.Time) *githubv3.Event {
+		return &githubv3.Event{
+			Type:       githubv3.String("WatchEvent"),
+			Public:     githubv3.Bool(true),
+			RawPayload: rawMessage(`{"action": "started"}`),
+			Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String(repoName)},
+			Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+			CreatedAt:  &at,
+			ID:         githubv3.String(id),
+		}
+	}
+
+	// The name of a repository is recorded once it's known.
+	repos := map[int64]repository{1: {ModulePath: "example.org/repo"}}
+	events := []*githubv3.Event{watchEvent("2", "owner/repo", t0.Add(time.Minute)), watchEvent("1", "owner/repo", t0)}
+	if renames := followRenames(events, repos, nil); len(renames) != 0 {
+		t.Errorf("followRenames: got %d renames of a repository with an unknown name, want none", len(renames))
+	}
+	if got, want := repos[1], (repository{ModulePath: "example.org/repo", Name: "owner/repo", NameTime: t0.Add(time.Minute)}); !reflect.DeepEqual(got, want) {
+		t.Errorf("followRenames: got repository %+v, want %+v", got, want)
+	}
+
+	// Older events, e.g., ones listed before the repository was renamed,
+	// don't count as renames.
+	events = append(events, watchEvent("0", "owner/old-repo", t0.Add(-time.Hour)))
+	if renames := followRenames(events, repos, nil); len(renames) != 0 {
+		t.Errorf("followRenames: got %d renames for an older event, want none", len(renames))
+	}
+
+	// Once events are listed with a new name, the repository is renamed.
+	// It's forgotten, so that its module path is fetched again,
+	// and the URLs of its commits are updated.
+	commits := map[string]event.Commit{
+		"aaa": {SHA: "aaa", HTMLURL: "https://github.com/owner/repo/commit/aaa"},
+		"bbb": {SHA: "bbb", HTMLURL: "https://github.com/owner/repository/commit/bbb"},
+	}
+	events = append([]*githubv3.Event{
+		watchEvent("4", "anotheruser/repo", t0.Add(3*time.Minute)),
+		watchEvent("3", "anotheruser/repo", t0.Add(2*time.Minute)),
+	}, events...)
+	renames := followRenames(events, repos, commits)
+	if len(renames) != 1 {
+		t.Fatalf("followRenames: got %d renames, want 1", len(renames))
+	}
+	if _, ok := repos[1]; ok {
+		t.Error("followRenames: renamed repository is still known, want it forgotten")
+	}
+	wantCommits := map[string]event.Commit{
+		"aaa": {SHA: "aaa", HTMLURL: "https://github.com/anotheruser/repo/commit/aaa"},
+		"bbb": {SHA: "bbb", HTMLURL: "https://github.com/owner/repository/commit/bbb"},
+	}
+	if !reflect.DeepEqual(commits, wantCommits) {
+		t.Errorf("followRenames: got commits %+v, want %+v", commits, wantCommits)
+	}
+
+	// The rename is attributed to the actor of the earliest event
+	// with the new name, and happened just before it.
+	got := convert(context.Background(), renames,
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "rename-3",
+		Time:      t0.Add(2*time.Minute - time.Second),
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Rename{
+			From: "github.com/owner/repo",
+			To:   "github.com/anotheruser/repo",
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+}
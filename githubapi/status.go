@@ -0,0 +1,101 @@
+package githubapi
+
+import (
+	"fmt"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+)
+
+// Status is the status of fetching events, see Service.Status.
+type Status struct {
+	// LastFetch is when events were last fetched successfully,
+	// including when they hadn't changed, or zero if they haven't been.
+	// Events whose information was fetched only partly count, too.
+	LastFetch time.Time
+
+	// LastError is the error fetching events the last time,
+	// or nil if it succeeded. It's a *RateLimitError if GitHub limited requests.
+	LastError error
+
+	// PollInterval is the interval between polls currently in effect,
+	// i.e., the one GitHub asked for within the bounds set by WithPollInterval,
+	// backed off while polls find no new events or fail, and jittered.
+	// NextPoll is when events are polled next. They're zero if not polling.
+	PollInterval time.Duration
+	NextPoll     time.Time
+
+	// RateV3 and RateV4 are the rate limits of the REST API v3 and GraphQL API v4,
+	// as of the last time they were used, or zero if they haven't been.
+	RateV3 Rate
+	RateV4 Rate
+
+	// RateLimited is when GitHub allows requests again, if it's limiting them
+	// because a rate limit was used up or a secondary rate limit was hit,
+	// or zero if it isn't. Until then, no requests are made, see RateLimitError.
+	RateLimited time.Time
+}
+
+// StaleError is the error that List returns along with events that are
+// usable, but stale, since fetching them failed the last time. The events
+// may be missing ones that happened since, or lack some of the information
+// they need, like module paths of repositories, which have placeholders instead.
+type StaleError struct {
+	Err       error     // Error fetching events the last time.
+	LastFetch time.Time // When events were last fetched, or zero if only webhooks delivered them.
+}
+
+func (e *StaleError) Error() string {
+	if e.LastFetch.IsZero() {
+		return fmt.Sprintf("events are stale: %v", e.Err)
+	}
+	return fmt.Sprintf("events are stale, last fetched at %v: %v", e.LastFetch.Format(time.RFC3339), e.Err)
+}
+
+func (e *StaleError) Unwrap() error { return e.Err }
+
+// Rate is the rate limit of a GitHub API.
+type Rate struct {
+	Limit     int       // Maximum number of requests, or points for GraphQL API v4, per hour.
+	Remaining int       // Number remaining until Reset.
+	Reset     time.Time // When the rate limit resets.
+}
+
+// Status returns the status of fetching events, e.g., to tell
+// how long ago they were fetched, or to notice when they go stale.
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.LastError = s.fetchError
+	if l := s.rateLimitedNow(time.Now()); l != nil {
+		st.RateLimited = l.RetryAfter
+	}
+	return st
+}
+
+// rateV3 returns the rate limit in r, reported by a REST API v3 response.
+// It returns false if the response didn't report one.
+func rateV3(r githubv3.Rate) (Rate, bool) {
+	if r.Limit == 0 {
+		return Rate{}, false
+	}
+	return Rate{Limit: r.Limit, Remaining: r.Remaining, Reset: r.Reset.Time}, true
+}
+
+// rateLimit is the rate limit of the GraphQL API v4, queried along with
+// other fields.
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	ResetAt   githubv4.DateTime
+}
+
+// rateV4 returns the rate limit in r. It returns false if it wasn't queried.
+func rateV4(r rateLimit) (Rate, bool) {
+	if r.Limit == 0 {
+		return Rate{}, false
+	}
+	return Rate{Limit: r.Limit, Remaining: r.Remaining, Reset: r.ResetAt.Time}, true
+}
@@ -0,0 +1,107 @@
+package githubapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/githubv4"
+	"github.com/shurcooL/users"
+)
+
+func TestStatus(t *testing.T) {
+	reset := time.Date(2020, 1, 2, 4, 0, 0, 0, time.UTC)
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/graphql" {
+			w.Write([]byte(`{"data": {
+				"n0": {"databaseId": 1, "object": null},
+				"rateLimit": {"limit": 5000, "remaining": 4990, "resetAt": "2020-01-02T04:00:00Z"}
+			}}`))
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Reset", "1577937600") // 2020-01-02T04:00:00Z.
+		if req.URL.Path == "/repos/owner/repo/git/trees/HEAD" {
+			w.Write([]byte(`{"sha": "t", "tree": []}`))
+			return
+		}
+		w.Header().Set("X-Poll-Interval", "60")
+		if fail {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{
+			"type": "WatchEvent",
+			"id": "1",
+			"repo": {"id": 1, "name": "owner/repo"},
+			"actor": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"},
+			"created_at": "2020-01-02T03:04:05Z",
+			"payload": {"action": "started"}
+		}]`))
+	}))
+	defer ts.Close()
+	clV3 := githubv3.NewClient(nil)
+	clV3.BaseURL, _ = url.Parse(ts.URL + "/")
+	clV4 := githubv4.NewEnterpriseClient(ts.URL+"/graphql", nil)
+	user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+	s, err := NewService(clV3, clV4, user, nil, WithoutPolling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Status(); got != (Status{}) {
+		t.Errorf("Status before Refresh = %+v, want zero", got)
+	}
+
+	err = s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if st.LastFetch.IsZero() || st.LastError != nil {
+		t.Errorf("Status after Refresh: LastFetch = %v, LastError = %v; want a fetch and no error", st.LastFetch, st.LastError)
+	}
+	if want := (Rate{Limit: 5000, Remaining: 4999, Reset: reset}); !st.RateV3.Reset.Equal(want.Reset) || st.RateV3.Limit != want.Limit || st.RateV3.Remaining != want.Remaining {
+		t.Errorf("Status.RateV3 = %+v, want %+v", st.RateV3, want)
+	}
+	if want := (Rate{Limit: 5000, Remaining: 4990, Reset: reset}); !st.RateV4.Reset.Equal(want.Reset) || st.RateV4.Limit != want.Limit || st.RateV4.Remaining != want.Remaining {
+		t.Errorf("Status.RateV4 = %+v, want %+v", st.RateV4, want)
+	}
+	if st.PollInterval != 0 || !st.NextPoll.IsZero() {
+		t.Errorf("Status without polling: PollInterval = %v, NextPoll = %v; want zero", st.PollInterval, st.NextPoll)
+	}
+
+	// A failed fetch is reported, and the last successful one is kept.
+	fail = true
+	if err := s.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh: got nil error, want failure")
+	}
+	if got := s.Status(); got.LastError == nil || !got.LastFetch.Equal(st.LastFetch) {
+		t.Errorf("Status after failed Refresh: LastFetch = %v, LastError = %v; want %v and an error", got.LastFetch, got.LastError, st.LastFetch)
+	}
+	fail = false
+
+	// Polling reports the poll interval in effect and the next poll,
+	// until it's stopped.
+	s, err = NewService(clV3, clV4, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().NextPoll.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := s.Status(); got.PollInterval < time.Minute || got.PollInterval > time.Minute+time.Minute/10 || got.NextPoll.IsZero() {
+		t.Errorf("Status while polling: PollInterval = %v, NextPoll = %v; want 1m jittered and the next poll", got.PollInterval, got.NextPoll)
+	}
+	s.Close()
+	if got := s.Status(); got.PollInterval != 0 || !got.NextPoll.IsZero() {
+		t.Errorf("Status after Close: PollInterval = %v, NextPoll = %v; want zero", got.PollInterval, got.NextPoll)
+	}
+}
@@ -0,0 +1,357 @@
+package githubapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/github"
+)
+
+// ServeHTTP handles GitHub webhook deliveries. It's meant to be set as
+// the payload URL of webhooks of repositories or organizations the user
+// is active in, with the secret given to WithWebhookSecret, and either
+// content type.
+//
+// Delivered events that polling would list, i.e., ones performed by the user
+// or by users given to WithUsers, or in repositories of the organization given
+// to WithOrganization, are converted and listed right away, without waiting
+// for the next poll.
+// Once polling lists them too, they're listed only once.
+// Other deliveries, including pings, are accepted and ignored.
+// Deliveries larger than GitHub sends are rejected.
+func (s *Service) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.webhookSecret == nil {
+		http.Error(w, "403 Forbidden\n\nwebhook deliveries aren't accepted", http.StatusForbidden)
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, maxDeliverySize)
+	payload, err := githubv3.ValidatePayload(req, s.webhookSecret)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "400 Bad Request\n\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	e, err := webhookEvent(githubv3.WebHookType(req), githubv3.DeliveryID(req), payload, time.Now().UTC(), s.issueActions)
+	if err != nil {
+		http.Error(w, "400 Bad Request\n\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e == nil || !s.lists(e) {
+		// Not an event that polling would list, so there's nothing to do.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	err = s.ingest(req.Context(), e)
+	if err != nil {
+		s.logf("ingest: %v", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxDeliverySize is the maximum size of a webhook delivery, in bytes.
+// GitHub caps payloads of deliveries at 25 MB.
+const maxDeliverySize = 25 << 20
+
+// maxEvents is the maximum number of events that ingesting webhook
+// deliveries keeps, same as the most that the Events API lists.
+const maxEvents = 300
+
+// ingest adds event e, delivered by a webhook, to the listed events,
+// fetching the information it needs from GitHub. If e is already listed,
+// it's not added again, since GitHub may deliver an event more than once.
+func (s *Service) ingest(ctx context.Context, e *githubv3.Event) error {
+	e = s.limitCommits(e)
+	s.update.Lock()
+	defer s.update.Unlock()
+	s.mu.Lock()
+	repos, commits, prs, deletes, forced := s.copyFetched()
+	events, hooked := s.events, s.hooked
+	s.mu.Unlock()
+	key := eventKey(e)
+	for _, l := range events {
+		if eventKey(l) == key {
+			return nil
+		}
+	}
+	events = mergeEvents([]*githubv3.Event{e}, events)
+	renames := followRenames(events, repos, commits)
+	events = mergeEvents(renames, events)
+	if len(events) > maxEvents {
+		events = events[:maxEvents]
+	}
+	err := s.enrich(ctx, events, repos, commits, prs, deletes, forced)
+	if _, ok := err.(enrichError); ok {
+		// Ingest the event anyway, with placeholders for what failed to be fetched.
+		// Fetch the feeds in full next time, so that it's fetched again then.
+		s.logf("ingest: %v", err)
+		for path, f := range s.feeds {
+			f.etag = ""
+			s.feeds[path] = f
+		}
+	} else if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.events, s.repos, s.commits, s.prs, s.deletes, s.forced = events, repos, commits, prs, deletes, forced
+	s.hooked = retained(append(append(hooked[:len(hooked):len(hooked)], e), renames...), events)
+	s.mu.Unlock()
+	s.saveCache(ctx, repos, commits, prs)
+	return nil
+}
+
+// webhookTypes maps names of webhook events to types of events that the
+// Events API lists for them, along with the actions it lists them for.
+// No actions means all of them, for events that don't have an action.
+var webhookTypes = map[string]struct {
+	Type    string
+	Actions []string
+}{
+	"commit_comment":              {Type: "CommitCommentEvent", Actions: []string{"created"}},
+	"create":                      {Type: "CreateEvent"},
+	"delete":                      {Type: "DeleteEvent"},
+	"fork":                        {Type: "ForkEvent"},
+	"gollum":                      {Type: "GollumEvent"},
+	"issue_comment":               {Type: "IssueCommentEvent", Actions: []string{"created", "edited", "deleted"}},
+	"issues":                      {Type: "IssuesEvent", Actions: []string{"opened", "closed", "reopened"}},
+	"member":                      {Type: "MemberEvent", Actions: []string{"added", "removed"}},
+	"pull_request":                {Type: "PullRequestEvent", Actions: []string{"opened", "closed", "reopened"}},
+	"pull_request_review":         {Type: "PullRequestReviewEvent", Actions: []string{"submitted"}},
+	"pull_request_review_comment": {Type: "PullRequestReviewCommentEvent", Actions: []string{"created", "edited", "deleted"}},
+	"public":                      {Type: "PublicEvent"},
+	"push":                        {Type: "PushEvent"},
+	"release":                     {Type: "ReleaseEvent", Actions: []string{"published"}},
+	"watch":                       {Type: "WatchEvent", Actions: []string{"started"}},
+}
+
+// moreIssueActions are the actions of issue events, besides opening, closing
+// and reopening, that the Events API lists too. Deliveries of them are
+// converted only for services that list them, see WithIssueActions.
+var moreIssueActions = []string{
+	"assigned", "unassigned",
+	"labeled", "unlabeled",
+	"milestoned", "demilestoned",
+	"transferred",
+	"pinned", "unpinned",
+}
+
+// webhookEvent converts the payload of a webhook delivery of the named event
+// with the specified delivery ID, which was received at time t, to the event
+// that the Events API lists for it. It returns nil if the Events API
+// doesn't list such events. Issue events of actions in moreIssueActions
+// are converted only if issueActions is true.
+//
+// Webhook payloads have the same structure as payloads of listed events,
+// except that push payloads lack some fields, and create payloads may have
+// a null description. They're rewritten to have the fields listed events have.
+func webhookEvent(name, deliveryID string, payload []byte, t time.Time, issueActions bool) (*githubv3.Event, error) {
+	wt, ok := webhookTypes[name]
+	if !ok {
+		return nil, nil
+	}
+	var p struct {
+		Action *string `json:"action"`
+		Repo   *struct {
+			ID       *int64  `json:"id"`
+			FullName *string `json:"full_name"`
+			Private  bool    `json:"private"`
+		} `json:"repository"`
+		Sender *struct {
+			ID        *int64  `json:"id"`
+			Login     *string `json:"login"`
+			AvatarURL *string `json:"avatar_url"`
+		} `json:"sender"`
+	}
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return nil, fmt.Errorf("webhookEvent: %s payload: %v", name, err)
+	}
+	if p.Repo == nil || p.Repo.ID == nil || p.Repo.FullName == nil ||
+		p.Sender == nil || p.Sender.ID == nil || p.Sender.Login == nil || p.Sender.AvatarURL == nil {
+		return nil, fmt.Errorf("webhookEvent: %s payload is missing repository or sender", name)
+	}
+	actions := wt.Actions
+	if name == "issues" && issueActions {
+		actions = append(actions[:len(actions):len(actions)], moreIssueActions...)
+	}
+	if len(actions) > 0 && (p.Action == nil || !contains(actions, *p.Action)) {
+		return nil, nil
+	}
+	raw := json.RawMessage(payload)
+	e := &githubv3.Event{
+		Type:       githubv3.String(wt.Type),
+		RawPayload: &raw,
+		Repo: &githubv3.Repository{
+			ID:   p.Repo.ID,
+			Name: p.Repo.FullName,
+		},
+		Actor: &githubv3.User{
+			ID:        p.Sender.ID,
+			Login:     p.Sender.Login,
+			AvatarURL: p.Sender.AvatarURL,
+		},
+		Public:    githubv3.Bool(!p.Repo.Private),
+		CreatedAt: &t,
+		ID:        githubv3.String("webhook-" + deliveryID),
+	}
+	pl, err := e.ParsePayload()
+	if err != nil {
+		return nil, fmt.Errorf("webhookEvent: %s payload: %v", name, err)
+	}
+	switch pl := pl.(type) {
+	case *githubv3.PushEvent:
+		if pl.Deleted != nil && *pl.Deleted {
+			// The Events API lists only a DeleteEvent for deleting a ref.
+			return nil, nil
+		}
+		pl.Head, pl.Size = pl.After, githubv3.Int(len(pl.Commits))
+		for i := range pl.Commits {
+			pl.Commits[i].SHA = pl.Commits[i].ID
+		}
+		*e.RawPayload, err = json.Marshal(pl)
+		if err != nil {
+			return nil, err
+		}
+	case *githubv3.CreateEvent:
+		if pl.Description == nil {
+			pl.Description = githubv3.String("")
+			*e.RawPayload, err = json.Marshal(pl)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// eventKey returns a key that's the same for an event delivered by a webhook
+// and the event that the Events API lists for it. e must contain a valid payload,
+// otherwise eventKey panics.
+func eventKey(e *githubv3.Event) string {
+	payload, err := e.ParsePayload()
+	if err != nil {
+		panic(fmt.Errorf("internal error: eventKey given a githubv3.Event with an invalid payload: %v", err))
+	}
+	key := *e.Type + " " + strconv.FormatInt(*e.Repo.ID, 10)
+	switch p := payload.(type) {
+	case *githubv3.PushEvent:
+		return key + " " + *p.Ref + " " + *p.Head
+	case *githubv3.IssuesEvent:
+		return key + " " + strconv.Itoa(*p.Issue.Number) + " " + *p.Action
+	case *githubv3.PullRequestEvent:
+		return key + " " + strconv.Itoa(*p.PullRequest.Number) + " " + *p.Action
+	case *githubv3.IssueCommentEvent:
+		return key + " " + strconv.FormatInt(*p.Comment.ID, 10)
+	case *githubv3.PullRequestReviewCommentEvent:
+		return key + " " + strconv.FormatInt(*p.Comment.ID, 10)
+	case *githubv3.PullRequestReviewEvent:
+		return key + " " + strconv.FormatInt(*p.Review.ID, 10)
+	case *githubv3.CommitCommentEvent:
+		return key + " " + strconv.FormatInt(*p.Comment.ID, 10)
+	case *githubv3.CreateEvent:
+		return key + " " + *p.RefType + " " + stringValue(p.Ref)
+	case *githubv3.DeleteEvent:
+		return key + " " + *p.RefType + " " + *p.Ref
+	case *githubv3.ReleaseEvent:
+		return key + " " + strconv.FormatInt(*p.Release.ID, 10)
+	case *githubv3.PublicEvent:
+		// A repository is made public only once.
+		return key
+	case *githubv3.MemberEvent:
+		return key + " " + strconv.FormatInt(*p.Member.ID, 10) + " " + *p.Action
+	case *githubv3.ForkEvent:
+		return key + " " + *p.Forkee.FullName
+	case *githubv3.GollumEvent:
+		var shas []string
+		for _, p := range p.Pages {
+			shas = append(shas, *p.SHA)
+		}
+		return key + " " + strings.Join(shas, " ")
+	default:
+		// Other events are never delivered by webhooks, so they have
+		// no match and their ID works as the key.
+		return key + " " + *e.ID
+	}
+}
+
+// mergeEvents merges events a and b, ordering them from most recent to oldest.
+// Events that happened at the same time keep their order, with ones in a first.
+func mergeEvents(a, b []*githubv3.Event) []*githubv3.Event {
+	events := make([]*githubv3.Event, 0, len(a)+len(b))
+	events = append(events, a...)
+	events = append(events, b...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.After(*events[j].CreatedAt) })
+	return events
+}
+
+// unlisted returns the events in hooked, delivered by webhooks,
+// that aren't in listed, the events the Events API listed.
+//
+// The Events API lists events from most recent to oldest, so an event
+// delivered before the oldest listed one was either listed by an earlier poll,
+// or isn't going to be. Such events are left out too.
+func unlisted(hooked, listed []*githubv3.Event) []*githubv3.Event {
+	keys := make(map[string]bool, len(listed))
+	for _, e := range listed {
+		keys[eventKey(e)] = true
+	}
+	var events []*githubv3.Event
+	for _, e := range hooked {
+		if keys[eventKey(e)] {
+			continue
+		}
+		if len(listed) > 0 && e.CreatedAt.Before(*listed[len(listed)-1].CreatedAt) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// retained returns the events in hooked that are still in events.
+func retained(hooked, events []*githubv3.Event) []*githubv3.Event {
+	in := make(map[*githubv3.Event]bool, len(events))
+	for _, e := range events {
+		in[e] = true
+	}
+	var rs []*githubv3.Event
+	for _, e := range hooked {
+		if in[e] {
+			rs = append(rs, e)
+		}
+	}
+	return rs
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stringValue returns the value of s, or the empty string if s is nil.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
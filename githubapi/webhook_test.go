@@ -0,0 +1,206 @@
+package githubapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dmitri.shuralyov.com/route/github"
+	githubv3 "github.com/google/go-github/github"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/users"
+)
+
+const pushPayload = `{
+	"ref": "refs/heads/master",
+	"before": "1111111111111111111111111111111111111111",
+	"after": "2222222222222222222222222222222222222222",
+	"forced": false,
+	"deleted": false,
+	"commits": [{"id": "2222222222222222222222222222222222222222", "message": "Add feature.", "author": {"email": "gopher@example.org"}}],
+	"repository": {"id": 1, "full_name": "owner/repo"},
+	"sender": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"}
+}`
+
+func TestWebhookEvent(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e, err := webhookEvent("push", "delivery", []byte(pushPayload), at, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil {
+		t.Fatal("webhookEvent returned nil for a push")
+	}
+
+	// The event must match the one the Events API lists for the same push.
+	listed := &githubv3.Event{
+		Type:       githubv3.String("PushEvent"),
+		RawPayload: rawMessage(`{"ref": "refs/heads/master", "head": "2222222222222222222222222222222222222222", "before": "1111111111111111111111111111111111111111", "size": 1, "commits": [{"sha": "2222222222222222222222222222222222222222"}]}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		Actor:      &githubv3.User{ID: githubv3.Int64(2), Login: githubv3.String("gopher"), AvatarURL: githubv3.String("https://example.org/avatar")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("123"),
+	}
+	if got, want := eventKey(e), eventKey(listed); got != want {
+		t.Errorf("eventKey = %q, want %q", got, want)
+	}
+	if got := unlisted([]*githubv3.Event{e}, []*githubv3.Event{listed}); len(got) != 0 {
+		t.Errorf("unlisted = %v, want none", got)
+	}
+	if private(e) {
+		t.Error("webhookEvent of a push to a public repository is private")
+	}
+	pe, err := webhookEvent("push", "delivery", []byte(strings.Replace(pushPayload, `"full_name": "owner/repo"`, `"full_name": "owner/repo", "private": true`, 1)), at, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !private(pe) {
+		t.Error("webhookEvent of a push to a private repository isn't private")
+	}
+
+	commit := event.Commit{SHA: "2222222222222222222222222222222222222222", Message: "Add feature."}
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}},
+		map[string]event.Commit{commit.SHA: commit}, nil, nil,
+		map[string]bool{"webhook-delivery": false}, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "webhook-delivery",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Push{
+			Branch:        "master",
+			Head:          "2222222222222222222222222222222222222222",
+			Before:        "1111111111111111111111111111111111111111",
+			Commits:       []event.Commit{commit},
+			TotalCommits:  1,
+			HeadHTMLURL:   "https://github.com/owner/repo/commit/2222222222222222222222222222222222222222",
+			BeforeHTMLURL: "https://github.com/owner/repo/commit/1111111111111111111111111111111111111111",
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// Deliveries of events that the Events API doesn't list are ignored.
+	for _, tc := range []struct{ name, payload string }{
+		{"ping", `{"zen": "Keep it logically awesome.", "sender": {"id": 2}}`},
+		{"issues", `{"action": "labeled", "issue": {"number": 1}, "repository": {"id": 1, "full_name": "owner/repo"}, "sender": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"}}`},
+		{"push", strings.Replace(pushPayload, `"deleted": false`, `"deleted": true`, 1)},
+	} {
+		e, err := webhookEvent(tc.name, "delivery", []byte(tc.payload), at, false)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if e != nil {
+			t.Errorf("%s: webhookEvent = %v, want nil", tc.name, e)
+		}
+	}
+}
+
+func TestWebhookIssueActions(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	const payload = `{"action": "labeled", "issue": {"number": 1, "title": "Title.", "html_url": "https://github.com/owner/repo/issues/1"}, "label": {"name": "bug", "color": "fc2929"}, "repository": {"id": 1, "full_name": "owner/repo"}, "sender": {"id": 2, "login": "gopher", "avatar_url": "https://example.org/avatar"}}`
+
+	// Deliveries of issue events of more actions are converted
+	// only for services that list them.
+	if e, err := webhookEvent("issues", "delivery", []byte(payload), at, false); err != nil || e != nil {
+		t.Fatalf("webhookEvent without issue actions = %v, %v, want nil, nil", e, err)
+	}
+	e, err := webhookEvent("issues", "delivery", []byte(payload), at, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil {
+		t.Fatal("webhookEvent with issue actions returned nil for a labeled issue")
+	}
+
+	listed := &githubv3.Event{
+		Type:       githubv3.String("IssuesEvent"),
+		RawPayload: rawMessage(`{"action": "labeled", "issue": {"number": 1}, "label": {"name": "bug", "color": "fc2929"}}`),
+		Repo:       &githubv3.Repository{ID: githubv3.Int64(1), Name: githubv3.String("owner/repo")},
+		CreatedAt:  &at,
+		ID:         githubv3.String("123"),
+	}
+	if got, want := eventKey(e), eventKey(listed); got != want {
+		t.Errorf("eventKey = %q, want %q", got, want)
+	}
+
+	got := convert(context.Background(), []*githubv3.Event{e},
+		map[int64]repository{1: {ModulePath: "example.org/repo"}}, nil, nil, nil, nil, github.DotCom{}, t.Logf)
+	want := []event.Event{{
+		ID:        "webhook-delivery",
+		Time:      at,
+		Actor:     users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher", AvatarURL: "https://example.org/avatar"},
+		Container: "example.org/repo",
+		Payload: event.Label{
+			Action:       event.LabelLabeled,
+			Label:        event.LabelInfo{Name: "bug", Color: "fc2929"},
+			IssueNumber:  1,
+			IssueTitle:   "Title.",
+			IssueHTMLURL: "https://github.com/owner/repo/issues/1",
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convert:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		name    string
+		opts    []Option
+		event   string
+		payload string
+		sign    []byte // Secret the delivery is signed with.
+		want    int
+	}{
+		{name: "no secret", event: "push", payload: pushPayload, sign: secret, want: http.StatusForbidden},
+		{name: "bad signature", opts: []Option{WithWebhookSecret(secret)}, event: "push", payload: pushPayload, sign: []byte("other"), want: http.StatusBadRequest},
+		{name: "ping", opts: []Option{WithWebhookSecret(secret)}, event: "ping", payload: `{"zen": "Design for failure."}`, sign: secret, want: http.StatusNoContent},
+		{name: "other user", opts: []Option{WithWebhookSecret(secret)}, event: "push", payload: strings.Replace(pushPayload, `"id": 2`, `"id": 3`, 1), sign: secret, want: http.StatusNoContent},
+		{name: "bad payload", opts: []Option{WithWebhookSecret(secret)}, event: "push", payload: `{"ref": 1}`, sign: secret, want: http.StatusBadRequest},
+		{name: "too large", opts: []Option{WithWebhookSecret(secret)}, event: "push", payload: pushPayload + strings.Repeat(" ", maxDeliverySize), sign: secret, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			user := users.User{UserSpec: users.UserSpec{ID: 2, Domain: "github.com"}, Login: "gopher"}
+			s, err := NewService(nil, nil, user, nil, append(tc.opts, WithoutPolling())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", tc.event)
+			req.Header.Set("X-GitHub-Delivery", "delivery")
+			mac := hmac.New(sha256.New, tc.sign)
+			mac.Write([]byte(tc.payload))
+			req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+			if got := rr.Code; got != tc.want {
+				t.Errorf("status = %d, want %d; body: %q", got, tc.want, rr.Body.String())
+			}
+			events, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 0 {
+				t.Errorf("List = %v, want none", events)
+			}
+		})
+	}
+}
+
+func rawMessage(s string) *json.RawMessage {
+	m := json.RawMessage(s)
+	return &m
+}
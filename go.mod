@@ -1,3 +1,13 @@
 module github.com/shurcooL/events
 
 go 1.19
+
+require (
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/shurcooL/githubv4 v0.0.0-20260209031235-2402fdf4a9ed
+)
+
+require (
+	github.com/shurcooL/graphql v0.0.0-20240915155400-7ee5256398cf // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)